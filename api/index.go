@@ -6,5 +6,5 @@ import (
 )
 
 func IndexHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Println(w, "Hello from the main handler!")
+	fmt.Fprint(w, "Welcome to the main handler!")
 }
@@ -2,66 +2,345 @@
 package api
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
-	"profolio-vercel/handlers"   // Importing the handlers package
+	"net/url"
+	"os"
+	"profolio-vercel/config"
+	"profolio-vercel/handlers" // Importing the handlers package
+	"profolio-vercel/logging"
+	"profolio-vercel/metrics"
 	"profolio-vercel/middleware" // Importing the middleware package
+	"profolio-vercel/models"
+	"profolio-vercel/problem"
+	"profolio-vercel/shared"
+	"profolio-vercel/store"
+	"profolio-vercel/tracing"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
 
 	"github.com/gorilla/mux" // Importing the mux package from Gorilla for HTTP routing
 )
 
-// Handler is the main entry point for Vercel
-// func Handler(w http.ResponseWriter, r *http.Request) {
-// 	router := mux.NewRouter()
-// 	RegisterUserRoutes(router)
-// 	router.ServeHTTP(w, r)
-// }
+// NewRouter hands the configuration to every package, connects the database
+// and returns the router with every route mounted, behind tracing, request
+// IDs, access logging and metrics. Both the main binary and the Vercel function
+// serve it. It fails when the database cannot be reached or a route is broken.
+func NewRouter(cfg *config.Config) (http.Handler, error) {
+	slog.SetDefault(logging.New(os.Stdout, cfg.Log))
+	if err := tracing.Setup(context.Background(), cfg.Tracing); err != nil {
+		slog.Error("tracing is off", "error", err)
+	}
+	shared.Configure(cfg)
+	if err := middleware.Configure(cfg); err != nil {
+		return nil, fmt.Errorf("loading JWT signing keys: %w", err)
+	}
+	handlers.Configure(cfg)
+	mongoClient, err := shared.Connect()
+	if err != nil {
+		return nil, fmt.Errorf("connecting to MongoDB: %w", err)
+	}
+	handlers.SetClient(mongoClient)
+	mongoStores := store.NewMongo(mongoClient)
+	middleware.SetStores(middleware.Stores{Users: mongoStores, Auth: mongoStores, APIKeys: mongoStores, Revocations: mongoStores})
 
-// RegisterUserRoutes registers all the routes related to user operations
+	router := mux.NewRouter()
+	router.NotFoundHandler = problem.NotFoundHandler
+	router.MethodNotAllowedHandler = problem.MethodNotAllowedHandler
+	router.HandleFunc("/", IndexHandler).Methods("GET")                   // Route for checking the service is up
+	router.HandleFunc("/healthz", handlers.HealthzHandler).Methods("GET") // Route for the liveness probe
+	router.HandleFunc("/readyz", handlers.ReadyzHandler).Methods("GET")   // Route for the readiness probe
+	registerMetricsRoute(router)
+	RegisterUserRoutes(router, cfg, handlers.MongoStores(mongoStores))
 
-func RegisterUserRoutes(router *mux.Router) {
-	router.HandleFunc("/api/signup", handlers.SignUpHandler).Methods("POST") // Route for user signup
-	router.HandleFunc("/api/signin", handlers.SignInHandler).Methods("POST") // Route for user signin
-	router.HandleFunc("/api/skills", handlers.GetSkillsHandler).Methods("GET")
+	if err := ValidateRoutes(router); err != nil {
+		return nil, fmt.Errorf("invalid routes: %w", err)
+	}
+	// Tracing runs outermost so the request ID and access log share its span
+	handler := middleware.RequestID(middleware.AccessLog(middleware.Metrics(router)(router)))
+	return middleware.Tracing(router)(handler), nil
+}
+
+// registerMetricsRoute serves the Prometheus metrics to admins. Scrapers send
+// an admin's API key with the metrics:read scope in the X-API-Key header.
+func registerMetricsRoute(router *mux.Router) {
+	monitoring := router.NewRoute().Subrouter()
+	monitoring.Use(middleware.Authenticate)
+	monitoring.Handle("/metrics", middleware.WithScope(models.ScopeMetrics, middleware.RequirePermission(middleware.PermReadMetrics)(metrics.Handler()))).Methods("GET") // Route for Prometheus scrapes
+}
+
+// RegisterUserRoutes registers all the routes related to user operations,
+// served from the given stores
+func RegisterUserRoutes(router *mux.Router, cfg *config.Config, stores handlers.Stores) {
+	auth := &handlers.AuthHandlers{Stores: stores}
+	twoFactor := &handlers.TwoFactorHandlers{Stores: stores}
+	accounts := &handlers.AccountHandlers{Stores: stores}
+	oauth := &handlers.OAuthHandlers{Stores: stores}
+	apiKeys := &handlers.APIKeyHandlers{Stores: stores}
+	audit := &handlers.AuditHandlers{Stores: stores}
+	admins := &handlers.AdminHandlers{Stores: stores}
+	users := &handlers.UserHandlers{Stores: stores}
+	skills := &handlers.SkillHandlers{Stores: stores}
+	resumes := &handlers.ResumeHandlers{Stores: stores}
+
+	router.Handle("/api/signup", problem.HandlerFunc(auth.SignUp)).Methods("POST")          // Route for user signup
+	router.Handle("/api/signin", problem.HandlerFunc(auth.SignIn)).Methods("POST")          // Route for user signin
+	router.Handle("/api/signin/2fa", problem.HandlerFunc(twoFactor.SignIn)).Methods("POST") // Route for the second step of a two-factor signin
+	router.Handle("/api/skills", problem.HandlerFunc(skills.GetSkills)).Methods("GET")
+	router.HandleFunc("/.well-known/jwks.json", middleware.JWKSHandler).Methods("GET")                                        // Route for the public token verification keys
+	router.Handle("/api/token/refresh", problem.HandlerFunc(auth.RefreshToken)).Methods("POST")                               // Route for rotating a refresh token
+	router.Handle("/api/password/reset", problem.HandlerFunc(accounts.RequestPasswordReset)).Methods("POST")                  // Route for mailing a password reset link
+	router.Handle("/api/password/reset/confirm", problem.HandlerFunc(accounts.ConfirmPasswordReset)).Methods("POST")          // Route for choosing a new password
+	router.Handle("/api/verify-email", problem.HandlerFunc(accounts.VerifyEmail)).Methods("GET")                              // Route for following an email verification link
+	router.Handle("/api/oauth/{provider}/login", problem.HandlerFunc(oauth.Login)).Methods("GET").Name("oauthLogin")          // Route for starting a social login
+	router.Handle("/api/oauth/{provider}/callback", problem.HandlerFunc(oauth.Callback)).Methods("GET").Name("oauthCallback") // Route the login provider redirects back to
 
 	// Routes that require authentication
 	authenticated := router.PathPrefix("/api").Subrouter()
-	authenticated.Use(middleware.JwtVerify)
+	authenticated.Use(middleware.Authenticate) // Bearer token, or an API key on routes registered WithScope
+	authenticated.Use(middleware.RequireOwner) // Users may only act on their own id, email or username unless their role allows more
+
+	// Sign out
+	authenticated.Handle("/signout", problem.HandlerFunc(auth.SignOut)).Methods("POST")               // Route for revoking the current session
+	authenticated.Handle("/signout/all", problem.HandlerFunc(auth.SignOutEverywhere)).Methods("POST") // Route for revoking every session of the user
+
+	// Account settings an impersonating admin must not change
+	account := authenticated.NewRoute().Subrouter()
+	account.Use(middleware.DenyImpersonation)
+
+	// Two-factor authentication
+	account.Handle("/2fa/enroll", problem.HandlerFunc(twoFactor.Enroll)).Methods("POST")   // Route for starting TOTP enrollment
+	account.Handle("/2fa/confirm", problem.HandlerFunc(twoFactor.Confirm)).Methods("POST") // Route for confirming TOTP enrollment with a code
+	account.Handle("/2fa/disable", problem.HandlerFunc(twoFactor.Disable)).Methods("POST") // Route for turning TOTP off
+
+	// Email and username, which auth_users and users have to agree on
+	account.Handle("/account/email", problem.HandlerFunc(accounts.ChangeEmail)).Methods("POST")       // Route for moving the account to a new email address
+	account.Handle("/account/username", problem.HandlerFunc(accounts.ChangeUsername)).Methods("POST") // Route for choosing a new username
+
+	// Social login
+	account.Handle("/oauth/{provider}/link", problem.HandlerFunc(oauth.Link)).Methods("POST").Name("oauthLink") // Route for linking a login provider to the user
+
+	// API keys
+	account.Handle("/keys", problem.HandlerFunc(apiKeys.Create)).Methods("POST")                                // Route for creating an API key
+	account.Handle("/keys", problem.HandlerFunc(apiKeys.List)).Methods("GET")                                   // Route for listing the user's API keys
+	account.Handle("/keys/{keyID}", problem.HandlerFunc(apiKeys.Revoke)).Methods("DELETE").Name("revokeAPIKey") // Route for revoking an API key
+
+	// Audit log
+	authenticated.Handle("/audit", problem.HandlerFunc(audit.ListMine)).Methods("GET") // Route for the user's own audit history
+
+	// Email verification
+	authenticated.Handle("/verify-email/resend", problem.HandlerFunc(accounts.ResendVerification)).Methods("POST") // Route for mailing a new verification link
 
 	// Add User
-	authenticated.HandleFunc("/user", handlers.AddUserHandler).Methods("POST")
+	authenticated.Handle("/user", middleware.WithScope(models.ScopeUserWrite, problem.HandlerFunc(users.AddUser))).Methods("POST")
 
 	// Get User
-	authenticated.HandleFunc("/user", handlers.UserHandler).Methods("GET")                     // Route for getting a user
-	authenticated.HandleFunc("/user/{id}", handlers.UserHandler).Methods("GET")                // Route for getting a user by ID
-	authenticated.HandleFunc("/user/email/{email}", handlers.UserHandler).Methods("GET")       // Route for getting a user by email
-	authenticated.HandleFunc("/user/username/{username}", handlers.UserHandler).Methods("GET") // Route for getting a user by username
+	authenticated.Handle("/user", middleware.WithScope(models.ScopeUserRead, problem.HandlerFunc(users.GetAllUsers))).Methods("GET")                                                     // Route for getting a user
+	authenticated.Handle("/user/{id}", middleware.WithScope(models.ScopeUserRead, problem.HandlerFunc(users.GetUserByID))).Methods("GET").Name("getUser")                                // Route for getting a user by ID
+	authenticated.Handle("/user/email/{email}", middleware.WithScope(models.ScopeUserRead, problem.HandlerFunc(users.GetUserByEmail))).Methods("GET").Name("getUserByEmail")             // Route for getting a user by email
+	authenticated.Handle("/user/username/{username}", middleware.WithScope(models.ScopeUserRead, problem.HandlerFunc(users.GetUserByUsername))).Methods("GET").Name("getUserByUsername") // Route for getting a user by username
 
 	// Update User
-	authenticated.HandleFunc("/user/{id}", handlers.UpdateUserHandler).Methods("PATCH")                          // Route for updating a user by ID
-	authenticated.HandleFunc("/user/email/{email}", handlers.UpdateUserByEmailHandler).Methods("PATCH")          // Route for updating a user by email
-	authenticated.HandleFunc("/user/username/{username}", handlers.UpdateUserByUsernameHandler).Methods("PATCH") // Route for updating a user by username
-	authenticated.HandleFunc("/user", handlers.AddUserHandler).Methods("POST")                                   // Route for adding a new user
+	authenticated.Handle("/user/{id}", middleware.WithScope(models.ScopeUserWrite, problem.HandlerFunc(users.UpdateUser))).Methods("PATCH").Name("updateUser")                                    // Route for updating a user by ID
+	authenticated.Handle("/user/email/{email}", middleware.WithScope(models.ScopeUserWrite, problem.HandlerFunc(users.UpdateUserByEmail))).Methods("PATCH").Name("updateUserByEmail")             // Route for updating a user by email
+	authenticated.Handle("/user/username/{username}", middleware.WithScope(models.ScopeUserWrite, problem.HandlerFunc(users.UpdateUserByUsername))).Methods("PATCH").Name("updateUserByUsername") // Route for updating a user by username
 
 	// Get User Skills
-	authenticated.HandleFunc("/user/id/{id}/skills", handlers.GetSkillsByUserIDHandler).Methods("GET")               // Route for getting skills by id
-	authenticated.HandleFunc("/user/username/{username}/skills", handlers.GetSkillsByUsernameHandler).Methods("GET") // Route for getting skills by username
-	authenticated.HandleFunc("/user/email/{email}/skills", handlers.GetSkillsByEmailHandler).Methods("GET")          // Route for getting skills by email
+	authenticated.Handle("/user/id/{id}/skills", middleware.WithScope(models.ScopeUserRead, problem.HandlerFunc(skills.GetSkillsByUserID))).Methods("GET").Name("getSkillsByUserID")                 // Route for getting skills by id
+	authenticated.Handle("/user/username/{username}/skills", middleware.WithScope(models.ScopeUserRead, problem.HandlerFunc(skills.GetSkillsByUsername))).Methods("GET").Name("getSkillsByUsername") // Route for getting skills by username
+	authenticated.Handle("/user/email/{email}/skills", middleware.WithScope(models.ScopeUserRead, problem.HandlerFunc(skills.GetSkillsByEmail))).Methods("GET").Name("getSkillsByEmail")             // Route for getting skills by email
+
+	// Admin routes, each guarded by the permission it needs
+	admin := authenticated.PathPrefix("/admin").Subrouter()
+	admin.Handle("/users", middleware.RequirePermission(middleware.PermListUsers)(problem.HandlerFunc(users.GetAllUsers))).Methods("GET")                                                        // Route for listing users a page at a time
+	admin.Handle("/users/{targetID}/disable", middleware.RequirePermission(middleware.PermDisableUsers)(problem.HandlerFunc(admins.DisableUser))).Methods("POST").Name("disableUser")            // Route for disabling an account
+	admin.Handle("/users/{targetID}/enable", middleware.RequirePermission(middleware.PermDisableUsers)(problem.HandlerFunc(admins.EnableUser))).Methods("POST").Name("enableUser")               // Route for re-enabling an account
+	admin.Handle("/users/{targetID}/role", middleware.RequirePermission(middleware.PermManageRoles)(problem.HandlerFunc(admins.SetUserRole))).Methods("PUT").Name("setUserRole")                 // Route for changing a user's role
+	admin.Handle("/audit", middleware.RequirePermission(middleware.PermReadAudit)(problem.HandlerFunc(audit.List))).Methods("GET")                                                               // Route for searching every audit event
+	admin.Handle("/users/{targetID}/impersonate", middleware.RequirePermission(middleware.PermImpersonate)(problem.HandlerFunc(admins.ImpersonateUser))).Methods("POST").Name("impersonateUser") // Route for acting as a user
+
+	// Routes that also require a verified email address
+	verified := authenticated.NewRoute().Subrouter()
+	verified.Use(middleware.RequireVerifiedEmail)
 
 	// AI Routes
-	authenticated.HandleFunc("/cover-letter", handlers.GeminiCoverLetterHandler).Methods("POST")  // Route for generating a cover letter using Gemini
-	authenticated.HandleFunc("/calc-chance", handlers.CalculateReplacementChance).Methods("POST") // Route for calculating replacement chance
-	authenticated.HandleFunc("/resume-review", handlers.ResumeReview).Methods("POST")             // Route for reviewing a resume
+	verified.Handle("/cover-letter", middleware.WithScope(models.ScopeAI, coverLetterHandler(cfg))).Methods("POST")                                 // Route for generating a cover letter with the configured provider
+	verified.Handle("/calc-chance", middleware.WithScope(models.ScopeAI, problem.HandlerFunc(handlers.CalculateReplacementChance))).Methods("POST") // Route for calculating replacement chance
+	verified.Handle("/resume-review", middleware.WithScope(models.ScopeAI, problem.HandlerFunc(handlers.ResumeReview))).Methods("POST")             // Route for reviewing a resume
 
 	// Resume CRUD
+	authenticated.Handle("/user/{userID}/resumes/{resumeID}/makeDefault", middleware.WithScope(models.ScopeResumesWrite, problem.HandlerFunc(resumes.SetDefaultResume))).Methods("POST").Name("setDefaultResume") // Route for making a resume the user's default
+	authenticated.Handle("/makeDefault", middleware.WithScope(models.ScopeResumesWrite, deprecatedMakeDefault(middleware.RequireOwner(problem.HandlerFunc(resumes.SetDefaultResume))))).Methods("POST")           // Deprecated route for making a resume the default, with the IDs in the query
+	authenticated.Handle("/user/{userID}/resumes", middleware.WithScope(models.ScopeResumesWrite, problem.HandlerFunc(resumes.AddResume))).Methods("POST").Name("addResume")
+	authenticated.Handle("/user/{userID}/resumes/{resumeID}", middleware.WithScope(models.ScopeUserRead, problem.HandlerFunc(resumes.GetResume))).Methods("GET").Name("getResume")
+	authenticated.Handle("/user/{userID}/resumes/{resumeID}", middleware.WithScope(models.ScopeResumesWrite, problem.HandlerFunc(resumes.UpdateResume))).Methods("PUT").Name("updateResume")
+	authenticated.Handle("/user/{userID}/resumes/{resumeID}", middleware.WithScope(models.ScopeResumesWrite, problem.HandlerFunc(resumes.PatchResume))).Methods("PATCH").Name("patchResume")
+	authenticated.Handle("/user/{userID}/resumes/{resumeID}", middleware.WithScope(models.ScopeResumesWrite, problem.HandlerFunc(resumes.DeleteResume))).Methods("DELETE").Name("deleteResume")
+}
 
-	authenticated.HandleFunc("/makeDefault", handlers.SetDefaultResumeHandler).Methods("POST")
-	authenticated.HandleFunc("/user/{userID}/resumes", handlers.AddResumeHandler).Methods("POST")
-	authenticated.HandleFunc("/user/{userID}/resumes/{resumeID}", handlers.UpdateResumeHandler).Methods("PUT")
-	authenticated.HandleFunc("/user/{userID}/resumes/{resumeID}", handlers.DeleteResumeHandler).Methods("DELETE")
+// coverLetterHandler picks the cover letter handler of the configured provider
+func coverLetterHandler(cfg *config.Config) problem.HandlerFunc {
+	if cfg.AI.CoverLetterProvider == config.ProviderOpenAI {
+		return handlers.OpenAICoverLetterHandler
+	}
+	return handlers.GeminiCoverLetterHandler
+}
+
+// deprecatedMakeDefault keeps the old POST /api/makeDefault working. Its IDs
+// come from the userID and resumeID query parameters, userID defaulting to the
+// caller, and the owner check runs again once they are known. Responses carry
+// a Deprecation header and link to the route that replaces it.
+func deprecatedMakeDefault(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		userID, resumeID := query.Get("userID"), query.Get("resumeID")
+		if claims, ok := middleware.ClaimsFromContext(r.Context()); ok && userID == "" {
+			userID = claims.UserID
+		}
+		logging.FromContext(r.Context()).Warn("deprecated route called", "route", "/api/makeDefault")
+
+		successor := fmt.Sprintf("/api/user/%s/resumes/%s/makeDefault", url.PathEscape(userID), url.PathEscape(resumeID))
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+successor+`>; rel="successor-version"`)
+		next.ServeHTTP(w, mux.SetURLVars(r, map[string]string{"userID": userID, "resumeID": resumeID}))
+	})
+}
+
+// requiredVars are the path variables read by the handlers of named routes
+var requiredVars = map[string][]string{
+	"oauthLogin":           {"provider"},
+	"oauthCallback":        {"provider"},
+	"oauthLink":            {"provider"},
+	"revokeAPIKey":         {"keyID"},
+	"getUser":              {"id"},
+	"getUserByEmail":       {"email"},
+	"getUserByUsername":    {"username"},
+	"updateUser":           {"id"},
+	"updateUserByEmail":    {"email"},
+	"updateUserByUsername": {"username"},
+	"getSkillsByUserID":    {"id"},
+	"getSkillsByUsername":  {"username"},
+	"getSkillsByEmail":     {"email"},
+	"disableUser":          {"targetID"},
+	"enableUser":           {"targetID"},
+	"setUserRole":          {"targetID"},
+	"impersonateUser":      {"targetID"},
+	"addResume":            {"userID"},
+	"getResume":            {"userID", "resumeID"},
+	"updateResume":         {"userID", "resumeID"},
+	"patchResume":          {"userID", "resumeID"},
+	"deleteResume":         {"userID", "resumeID"},
+	"setDefaultResume":     {"userID", "resumeID"},
+}
+
+// ValidateRoutes fails when a route can never be reached or cannot work: two
+// routes share a path and method, an earlier route takes every request a later
+// one would match, or a route lacks a path variable its handler reads
+func ValidateRoutes(router *mux.Router) error {
+	seen := map[string]bool{}
+	var duplicates, unreachable, missing []string
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			// Subrouters registered with Use or NewRoute have no path of their own
+			return nil
+		}
+		if route.GetHandler() == nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{"*"}
+		}
+		for _, method := range methods {
+			key := method + " " + path
+			if seen[key] || seen["* "+path] || (method == "*" && seenPath(seen, path)) {
+				duplicates = append(duplicates, key)
+			} else if earlier := shadowedBy(router, route, method, path); earlier != "" {
+				unreachable = append(unreachable, key+" (taken by "+earlier+")")
+			}
+			seen[key] = true
+		}
+		if vars := missingVars(route); len(vars) > 0 {
+			missing = append(missing, path+" lacks "+strings.Join(vars, ", "))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, check := range []struct {
+		kind   string
+		routes []string
+	}{
+		{"duplicate routes", duplicates},
+		{"unreachable routes", unreachable},
+		{"routes missing path variables", missing},
+	} {
+		if len(check.routes) > 0 {
+			sort.Strings(check.routes)
+			errs = append(errs, fmt.Errorf("%s: %s", check.kind, strings.Join(check.routes, "; ")))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// pathVar matches a variable of a path template such as {id} or {id:[0-9]+}
+var pathVar = regexp.MustCompile(`\{([^{}:]+)(:[^{}]*)?\}`)
+
+// shadowedBy returns the template of an earlier route that the router picks
+// for a request the route should serve. The request fills each variable with
+// a sample value, so routes with their own variable patterns are skipped.
+func shadowedBy(router *mux.Router, route *mux.Route, method, path string) string {
+	for _, v := range pathVar.FindAllStringSubmatch(path, -1) {
+		if v[2] != "" {
+			return ""
+		}
+	}
+	if method == "*" {
+		method = http.MethodGet
+	}
+	sample := pathVar.ReplaceAllString(path, "000000000000000000000000")
+	req, err := http.NewRequest(method, sample, nil)
+	if err != nil {
+		return ""
+	}
+
+	var match mux.RouteMatch
+	if !router.Match(req, &match) || match.Route == nil || match.Route == route {
+		return ""
+	}
+	template, _ := match.Route.GetPathTemplate()
+	return template
+}
+
+// missingVars returns the required path variables the route does not define
+func missingVars(route *mux.Route) []string {
+	defined, _ := route.GetVarNames()
+	var missing []string
+	for _, name := range requiredVars[route.GetName()] {
+		if !slices.Contains(defined, name) {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
 
-	// This is Cover letter handler using Open AI (to be used only when OPENAI key is present)
-	authenticated.HandleFunc("/cover-letter", handlers.OpenAICoverLetterHandler).Methods("POST")
+// seenPath reports whether any method was registered for path
+func seenPath(seen map[string]bool, path string) bool {
+	for key := range seen {
+		if _, registered, _ := strings.Cut(key, " "); registered == path {
+			return true
+		}
+	}
+	return false
 }
 
 func RouteHandler(w http.ResponseWriter, r *http.Request) {
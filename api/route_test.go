@@ -0,0 +1,298 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"profolio-vercel/config"
+	"profolio-vercel/handlers"
+	"profolio-vercel/lockout"
+	"profolio-vercel/middleware"
+	"profolio-vercel/models"
+	"profolio-vercel/problem"
+	"profolio-vercel/store"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRegisteredRoutesAreValid(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc("/", IndexHandler).Methods("GET")
+	RegisterUserRoutes(router, config.Defaults(), handlers.MemoryStores(store.NewMemory()))
+	if err := ValidateRoutes(router); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateRoutes(t *testing.T) {
+	ok := http.HandlerFunc(RouteHandler)
+	tests := []struct {
+		name     string
+		register func(router *mux.Router)
+		want     string
+	}{
+		{"valid", func(router *mux.Router) {
+			router.Handle("/keys/mine", ok).Methods("GET")
+			router.Handle("/keys/{keyID}", ok).Methods("GET").Name("revokeAPIKey")
+		}, ""},
+		{"duplicate", func(router *mux.Router) {
+			router.Handle("/keys", ok).Methods("GET")
+			router.Handle("/keys", ok).Methods("GET")
+		}, "duplicate routes: GET /keys"},
+		{"duplicate in a subrouter", func(router *mux.Router) {
+			api := router.PathPrefix("/api").Subrouter()
+			api.Handle("/keys", ok).Methods("POST")
+			api.NewRoute().Subrouter().Handle("/keys", ok).Methods("POST")
+		}, "duplicate routes: POST /api/keys"},
+		{"shadowed by an earlier variable", func(router *mux.Router) {
+			router.Handle("/keys/{keyID}", ok).Methods("GET").Name("revokeAPIKey")
+			router.Handle("/keys/mine", ok).Methods("GET")
+		}, "unreachable routes: GET /keys/mine (taken by /keys/{keyID})"},
+		{"shadowed by a prefix", func(router *mux.Router) {
+			router.PathPrefix("/api").Handler(ok)
+			router.Handle("/api/keys", ok).Methods("GET")
+		}, "unreachable routes: GET /api/keys (taken by /api)"},
+		{"missing variables", func(router *mux.Router) {
+			router.Handle("/makeDefault", ok).Methods("POST").Name("setDefaultResume")
+		}, "routes missing path variables: /makeDefault lacks userID, resumeID"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := mux.NewRouter()
+			tt.register(router)
+			err := ValidateRoutes(router)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("ValidateRoutes() = %v, want nil", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("ValidateRoutes() = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// routeFixture is the memory-backed data the route table runs against
+type routeFixture struct {
+	tokens  map[string]string // Access tokens by username
+	replace *strings.Replacer // Fills {alice}, {bob} and {resume} in paths
+}
+
+func newRouteFixture(t *testing.T) (*mux.Router, routeFixture) {
+	t.Helper()
+	cfg := config.Defaults()
+	cfg.Env = config.EnvTest
+	cfg.JWT.Secret = "test-secret"
+	handlers.Configure(cfg)
+	if err := middleware.Configure(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	m := store.NewMemory()
+	handlers.SetAttemptStore(lockout.NewMemoryStore())
+	middleware.SetStores(middleware.Stores{Users: m, Auth: m, APIKeys: m, Revocations: m})
+
+	ctx := context.Background()
+	f := routeFixture{tokens: map[string]string{}}
+	ids := map[string]string{}
+	for _, account := range []struct{ username, role string }{
+		{"alice", models.RoleUser},
+		{"bob", models.RoleUser},
+		{"sam", models.RoleSupport},
+		{"ada", models.RoleAdmin},
+	} {
+		email := account.username + "@example.com"
+		authUser := models.AuthUser{Username: account.username, Email: email, Role: account.role}
+		user, err := m.CreateAccount(ctx, authUser, models.User{Basics: models.Basics{Username: account.username, Email: email}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.tokens[account.username], err = middleware.GenerateJWT(user.ID, authUser); err != nil {
+			t.Fatal(err)
+		}
+		ids[account.username] = user.ID.Hex()
+	}
+
+	resumeID := primitive.NewObjectID()
+	aliceID, _ := primitive.ObjectIDFromHex(ids["alice"])
+	if err := m.AddResume(ctx, aliceID, models.Resume{ID: resumeID, Name: "Engineering"}); err != nil {
+		t.Fatal(err)
+	}
+	f.replace = strings.NewReplacer("{alice}", ids["alice"], "{bob}", ids["bob"], "{resume}", resumeID.Hex())
+
+	router := mux.NewRouter()
+	router.NotFoundHandler = problem.NotFoundHandler
+	router.MethodNotAllowedHandler = problem.MethodNotAllowedHandler
+	RegisterUserRoutes(router, cfg, handlers.MemoryStores(m))
+	return router, f
+}
+
+func TestUserRoutes(t *testing.T) {
+	resume := `{"name":"Design"}`
+	tests := []struct {
+		method string
+		path   string
+		as     string // Username whose access token is sent, if any
+		body   string
+		want   int
+	}{
+		// Public routes
+		{"POST", "/api/signup", "", `{"username":"carol","email":"carol@example.com","password":"correct horse"}`, http.StatusCreated},
+		{"POST", "/api/signin", "", `{"email":"alice@example.com","password":"wrong horse"}`, http.StatusUnauthorized},
+		{"GET", "/api/skills", "", "", http.StatusOK},
+		{"GET", "/.well-known/jwks.json", "", "", http.StatusOK},
+		{"DELETE", "/.well-known/jwks.json", "", "", http.StatusMethodNotAllowed},
+		{"POST", "/api/token/refresh", "", `{"refreshToken":"unknown"}`, http.StatusUnauthorized},
+		{"POST", "/api/password/reset", "", `{"email":"alice@example.com"}`, http.StatusAccepted},
+		{"POST", "/api/password/reset/confirm", "", `{"token":"unknown","password":"correct horse"}`, http.StatusBadRequest},
+		{"GET", "/api/verify-email?token=unknown", "", "", http.StatusBadRequest},
+		{"GET", "/api/oauth/unknown/login", "", "", http.StatusNotFound},
+		{"GET", "/api/oauth/unknown/callback", "", "", http.StatusNotFound},
+		{"GET", "/api/unknown", "", "", http.StatusNotFound},
+
+		// Every authenticated route needs a token
+		{"POST", "/api/signout", "", "", http.StatusUnauthorized},
+		{"POST", "/api/signout/all", "", "", http.StatusUnauthorized},
+		{"POST", "/api/2fa/enroll", "", "", http.StatusUnauthorized},
+		{"POST", "/api/2fa/confirm", "", "", http.StatusUnauthorized},
+		{"POST", "/api/2fa/disable", "", "", http.StatusUnauthorized},
+		{"POST", "/api/account/email", "", "", http.StatusUnauthorized},
+		{"POST", "/api/account/username", "", "", http.StatusUnauthorized},
+		{"POST", "/api/oauth/github/link", "", "", http.StatusUnauthorized},
+		{"POST", "/api/keys", "", "", http.StatusUnauthorized},
+		{"GET", "/api/keys", "", "", http.StatusUnauthorized},
+		{"DELETE", "/api/keys/{resume}", "", "", http.StatusUnauthorized},
+		{"GET", "/api/audit", "", "", http.StatusUnauthorized},
+		{"POST", "/api/verify-email/resend", "", "", http.StatusUnauthorized},
+		{"GET", "/api/user/{alice}", "", "", http.StatusUnauthorized},
+		{"POST", "/api/cover-letter", "", "", http.StatusUnauthorized},
+		{"POST", "/api/user/{alice}/resumes", "", resume, http.StatusUnauthorized},
+
+		// Sessions and account settings
+		{"POST", "/api/signout", "alice", "", http.StatusOK},
+		{"POST", "/api/signout/all", "alice", "", http.StatusOK},
+		{"POST", "/api/oauth/unknown/link", "alice", "", http.StatusNotFound},
+
+		// Profiles, addressed by id, email or username
+		{"POST", "/api/user", "alice", `{"basics":{"email":"alice@example.com"}}`, http.StatusConflict},
+		{"GET", "/api/user", "alice", "", http.StatusForbidden},
+		{"GET", "/api/user", "sam", "", http.StatusOK},
+		{"GET", "/api/user/{alice}", "alice", "", http.StatusOK},
+		{"GET", "/api/user/{alice}", "bob", "", http.StatusForbidden},
+		{"GET", "/api/user/{alice}", "sam", "", http.StatusOK},
+		{"GET", "/api/user/email/alice@example.com", "alice", "", http.StatusOK},
+		{"GET", "/api/user/email/alice@example.com", "bob", "", http.StatusForbidden},
+		{"GET", "/api/user/username/alice", "alice", "", http.StatusOK},
+		{"GET", "/api/user/username/alice", "bob", "", http.StatusForbidden},
+		{"PATCH", "/api/user/{alice}", "alice", `{"basics":{"name":"Alice"}}`, http.StatusOK},
+		{"PATCH", "/api/user/{alice}", "bob", `{"basics":{"name":"Alice"}}`, http.StatusForbidden},
+		{"PATCH", "/api/user/{alice}", "sam", `{"basics":{"name":"Alice"}}`, http.StatusForbidden},
+		{"PATCH", "/api/user/{alice}", "ada", `{"basics":{"name":"Alice"}}`, http.StatusOK},
+		{"PATCH", "/api/user/email/alice@example.com", "bob", `{"basics":{"name":"Alice"}}`, http.StatusForbidden},
+		{"PATCH", "/api/user/username/alice", "bob", `{"basics":{"name":"Alice"}}`, http.StatusForbidden},
+		{"GET", "/api/user/id/{alice}/skills", "alice", "", http.StatusOK},
+		{"GET", "/api/user/id/{alice}/skills", "bob", "", http.StatusForbidden},
+		{"GET", "/api/user/username/alice/skills", "bob", "", http.StatusForbidden},
+		{"GET", "/api/user/email/alice@example.com/skills", "bob", "", http.StatusForbidden},
+
+		// Admin routes need their permission
+		{"GET", "/api/admin/users", "alice", "", http.StatusForbidden},
+		{"GET", "/api/admin/users", "sam", "", http.StatusOK},
+		{"POST", "/api/admin/users/{bob}/disable", "sam", "", http.StatusForbidden},
+		{"POST", "/api/admin/users/{bob}/enable", "sam", "", http.StatusForbidden},
+		{"PUT", "/api/admin/users/{bob}/role", "sam", `{"role":"admin"}`, http.StatusForbidden},
+		{"GET", "/api/admin/audit", "sam", "", http.StatusForbidden},
+		{"POST", "/api/admin/users/{bob}/impersonate", "sam", "", http.StatusForbidden},
+
+		// AI routes need a verified email
+		{"POST", "/api/cover-letter", "alice", `{}`, http.StatusForbidden},
+		{"POST", "/api/calc-chance", "alice", `{}`, http.StatusForbidden},
+		{"POST", "/api/resume-review", "alice", `{}`, http.StatusForbidden},
+
+		// Resumes
+		{"POST", "/api/user/{alice}/resumes", "alice", resume, http.StatusCreated},
+		{"POST", "/api/user/{alice}/resumes", "bob", resume, http.StatusForbidden},
+		{"GET", "/api/user/{alice}/resumes/{resume}", "alice", "", http.StatusOK},
+		{"GET", "/api/user/{alice}/resumes/{resume}", "bob", "", http.StatusForbidden},
+		{"PUT", "/api/user/{alice}/resumes/{resume}", "alice", resume, http.StatusOK},
+		{"PUT", "/api/user/{alice}/resumes/{resume}", "bob", resume, http.StatusForbidden},
+		{"PATCH", "/api/user/{alice}/resumes/{resume}", "bob", `{"name":"Mine"}`, http.StatusForbidden},
+		{"DELETE", "/api/user/{alice}/resumes/{resume}", "bob", "", http.StatusForbidden},
+		{"DELETE", "/api/user/{alice}/resumes/{resume}", "ada", "", http.StatusOK},
+		{"POST", "/api/user/{alice}/resumes/{resume}/makeDefault", "alice", "", http.StatusOK},
+		{"POST", "/api/user/{alice}/resumes/{resume}/makeDefault", "bob", "", http.StatusForbidden},
+		{"POST", "/api/makeDefault?resumeID={resume}", "alice", "", http.StatusOK},
+		{"POST", "/api/makeDefault?userID={alice}&resumeID={resume}", "alice", "", http.StatusOK},
+		{"POST", "/api/makeDefault?userID={alice}&resumeID={resume}", "bob", "", http.StatusForbidden},
+		{"POST", "/api/makeDefault?resumeID={resume}", "bob", "", http.StatusNotFound},
+		{"POST", "/api/makeDefault", "alice", "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		name := tt.method + " " + tt.path
+		if tt.as != "" {
+			name += " as " + tt.as
+		}
+		t.Run(name, func(t *testing.T) {
+			router, f := newRouteFixture(t)
+			r := httptest.NewRequest(tt.method, f.replace.Replace(tt.path), strings.NewReader(tt.body))
+			if tt.body != "" {
+				r.Header.Set("Content-Type", "application/json")
+			}
+			if tt.as != "" {
+				r.Header.Set("Authorization", "Bearer "+f.tokens[tt.as])
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestDeprecatedMakeDefault(t *testing.T) {
+	router, f := newRouteFixture(t)
+	r := httptest.NewRequest("POST", f.replace.Replace("/api/makeDefault?resumeID={resume}"), nil)
+	r.Header.Set("Authorization", "Bearer "+f.tokens["alice"])
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	successor := f.replace.Replace(`</api/user/{alice}/resumes/{resume}/makeDefault>; rel="successor-version"`)
+	if w.Code != http.StatusOK || w.Header().Get("Deprecation") != "true" || w.Header().Get("Link") != successor {
+		t.Errorf("status = %d, headers = %v", w.Code, w.Header())
+	}
+}
+
+func TestMetricsRoute(t *testing.T) {
+	tests := []struct {
+		as   string
+		want int
+	}{
+		{"", http.StatusUnauthorized},
+		{"alice", http.StatusForbidden},
+		{"sam", http.StatusForbidden},
+		{"ada", http.StatusOK},
+	}
+	for _, tt := range tests {
+		name := "anonymous"
+		if tt.as != "" {
+			name = "as " + tt.as
+		}
+		t.Run(name, func(t *testing.T) {
+			router, f := newRouteFixture(t)
+			registerMetricsRoute(router)
+			r := httptest.NewRequest("GET", "/metrics", nil)
+			if tt.as != "" {
+				r.Header.Set("Authorization", "Bearer "+f.tokens[tt.as])
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
@@ -1,10 +1,11 @@
 package api
 
 import (
-	"fmt"
+	"log/slog"
 	"net/http"
-	"profolio-vercel/handlers"
-	"strings"
+	"profolio-vercel/config"
+	"profolio-vercel/problem"
+	"sync"
 )
 
 type User struct {
@@ -14,13 +15,39 @@ type User struct {
 	Username string `json:"username" bson:"username"`
 }
 
+var (
+	router   http.Handler
+	routerMu sync.Mutex
+)
+
+// Handler is the entry point for Vercel. The configuration is loaded and the
+// router built on the first request, then reused while the function stays warm.
+// A request that finds the database unreachable fails, and the next one tries again.
 func Handler(w http.ResponseWriter, r *http.Request) {
-	path := strings.TrimPrefix(r.URL.Path, "/")
+	handler, err := loadRouter()
+	if err != nil {
+		problem.Write(w, r, problem.Unavailable("server_unavailable", "Server is not ready"))
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
 
-	switch {
-	case strings.HasPrefix(path, "users"):
-		handlers.UserHandler(w, r) // Delegate to UserHandler
-	default:
-		fmt.Fprintf(w, "Welcome to the main handler!")
+// loadRouter builds the router unless an earlier request already did
+func loadRouter() (http.Handler, error) {
+	routerMu.Lock()
+	defer routerMu.Unlock()
+	if router != nil {
+		return router, nil
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		slog.Error("invalid configuration", "error", err)
+		return nil, err
+	}
+	if router, err = NewRouter(cfg); err != nil {
+		slog.Error("starting", "error", err)
+		return nil, err
 	}
+	return router, nil
 }
@@ -2,30 +2,423 @@
 package config
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
 )
 
-func LoadEnv() {
-	if err := godotenv.Load(); err != nil {
-		log.Print("No .env file found")
+// Environments a Config can be loaded for, picked by APP_ENV
+const (
+	EnvDevelopment = "development"
+	EnvProduction  = "production"
+	EnvTest        = "test"
+)
+
+// Cover letter providers accepted in COVER_LETTER_PROVIDER
+const (
+	ProviderGemini = "gemini"
+	ProviderOpenAI = "openai"
+)
+
+// Config is every setting the API reads. Fields are filled, in increasing
+// priority, from defaults, the optional CONFIG_FILE, the profile for the
+// environment in that file, and the environment variable named by the env tag.
+// Fields tagged secret are redacted by String.
+type Config struct {
+	Env      string `yaml:"env" env:"APP_ENV"`
+	Port     string `yaml:"port" env:"PORT"`
+	AppURL   string `yaml:"appURL" env:"APP_URL"`
+	MongoURI string `yaml:"mongoURI" env:"MONGODB_URI,MONGO_URL" secret:"true"` // Must reach a replica set, as signup runs in a transaction
+
+	Log     LogConfig     `yaml:"log"`
+	Tracing TracingConfig `yaml:"tracing"`
+	Server  ServerConfig  `yaml:"server"`
+	JWT     JWTConfig     `yaml:"jwt"`
+	OAuth   OAuthConfig   `yaml:"oauth"`
+	SMTP    SMTPConfig    `yaml:"smtp"`
+	AI      AIConfig      `yaml:"ai"`
+}
+
+// LogConfig sets the level (debug, info, warn or error) and the format (json or text)
+type LogConfig struct {
+	Level  string `yaml:"level" env:"LOG_LEVEL"`
+	Format string `yaml:"format" env:"LOG_FORMAT"`
+}
+
+// Trace exporters accepted in OTEL_TRACES_EXPORTER
+const (
+	TracingNone = "none"
+	TracingOTLP = "otlp"
+)
+
+// TracingConfig turns on OpenTelemetry trace export. The endpoint is an OTLP
+// over HTTP URL such as http://collector:4318; without one the exporter's own
+// OTEL_EXPORTER_OTLP_* variables apply.
+type TracingConfig struct {
+	Exporter    string `yaml:"exporter" env:"OTEL_TRACES_EXPORTER"`
+	Endpoint    string `yaml:"endpoint" env:"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT,OTEL_EXPORTER_OTLP_ENDPOINT"`
+	ServiceName string `yaml:"serviceName" env:"OTEL_SERVICE_NAME"`
+}
+
+// ServerConfig bounds how long a connection may take at each stage, and how
+// long in-flight requests get to finish after SIGTERM. DrainDelay is how long
+// /readyz fails before the listener closes, so the load balancer sees it and
+// stops routing new requests to the instance first. TrustedProxies is a
+// comma-separated list of the IPs or CIDR ranges of the proxies in front of
+// the API, the only peers whose X-Forwarded-For is believed.
+type ServerConfig struct {
+	ReadHeaderTimeout time.Duration `yaml:"readHeaderTimeout" env:"SERVER_READ_HEADER_TIMEOUT"`
+	ReadTimeout       time.Duration `yaml:"readTimeout" env:"SERVER_READ_TIMEOUT"`
+	WriteTimeout      time.Duration `yaml:"writeTimeout" env:"SERVER_WRITE_TIMEOUT"`
+	IdleTimeout       time.Duration `yaml:"idleTimeout" env:"SERVER_IDLE_TIMEOUT"`
+	ShutdownTimeout   time.Duration `yaml:"shutdownTimeout" env:"SERVER_SHUTDOWN_TIMEOUT"`
+	DrainDelay        time.Duration `yaml:"drainDelay" env:"SHUTDOWN_DRAIN_DELAY"`
+	TrustedProxies    string        `yaml:"trustedProxies" env:"TRUSTED_PROXIES"`
+}
+
+// ParseTrustedProxies returns the ranges in TrustedProxies, a bare IP being a
+// range of one address
+func (s ServerConfig) ParseTrustedProxies() ([]*net.IPNet, error) {
+	var ranges []*net.IPNet
+	for _, entry := range strings.Split(s.TrustedProxies, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("TRUSTED_PROXIES must list IPs or CIDR ranges, got %q", entry)
+			}
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 8 * net.IPv6len
+			}
+			entry += "/" + strconv.Itoa(bits)
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("TRUSTED_PROXIES must list IPs or CIDR ranges, got %q", entry)
+		}
+		ranges = append(ranges, ipNet)
+	}
+	return ranges, nil
+}
+
+// JWTConfig selects how access tokens are signed. Without KeysDir tokens are
+// signed with the Secret HMAC key.
+type JWTConfig struct {
+	Secret      string `yaml:"secret" env:"NEXTAUTH_SECRET" secret:"true"`
+	KeysDir     string `yaml:"keysDir" env:"JWT_KEYS_DIR"`
+	ActiveKeyID string `yaml:"activeKeyID" env:"JWT_ACTIVE_KEY_ID"`
+}
+
+// OAuthConfig enables every login provider whose client ID is set
+type OAuthConfig struct {
+	RedirectBaseURL string `yaml:"redirectBaseURL" env:"OAUTH_REDIRECT_BASE_URL"`
+	SuccessURL      string `yaml:"successURL" env:"OAUTH_SUCCESS_URL"`
+
+	GitHubClientID     string `yaml:"githubClientID" env:"GITHUB_CLIENT_ID"`
+	GitHubClientSecret string `yaml:"githubClientSecret" env:"GITHUB_CLIENT_SECRET" secret:"true"`
+	GoogleClientID     string `yaml:"googleClientID" env:"GOOGLE_CLIENT_ID"`
+	GoogleClientSecret string `yaml:"googleClientSecret" env:"GOOGLE_CLIENT_SECRET" secret:"true"`
+	OIDCIssuer         string `yaml:"oidcIssuer" env:"OIDC_ISSUER"`
+	OIDCClientID       string `yaml:"oidcClientID" env:"OIDC_CLIENT_ID"`
+	OIDCClientSecret   string `yaml:"oidcClientSecret" env:"OIDC_CLIENT_SECRET" secret:"true"`
+	OIDCProviderName   string `yaml:"oidcProviderName" env:"OIDC_PROVIDER_NAME"`
+}
+
+// SMTPConfig sends mail through a relay when Host is set. Development and
+// test runs without one log mail to LogFile (or the standard logger) instead.
+type SMTPConfig struct {
+	Host     string `yaml:"host" env:"SMTP_HOST"`
+	Port     string `yaml:"port" env:"SMTP_PORT"`
+	Username string `yaml:"username" env:"SMTP_USERNAME"`
+	Password string `yaml:"password" env:"SMTP_PASSWORD" secret:"true"`
+	From     string `yaml:"from" env:"MAIL_FROM"`
+	LogFile  string `yaml:"logFile" env:"MAIL_LOG_FILE"`
+}
+
+// AIConfig holds the keys of the AI services
+type AIConfig struct {
+	CoverLetterProvider string `yaml:"coverLetterProvider" env:"COVER_LETTER_PROVIDER"`
+	OpenAIAPIKey        string `yaml:"openaiAPIKey" env:"OPENAI_API_KEY" secret:"true"`
+	GeminiAPIKey        string `yaml:"geminiAPIKey" env:"GEMINI_API_KEY" secret:"true"`
+}
+
+// fileConfig is the layout of CONFIG_FILE: settings shared by every
+// environment plus a profile per environment that overrides them
+type fileConfig struct {
+	Config   `yaml:",inline"`
+	Profiles map[string]yaml.Node `yaml:"profiles"`
+}
+
+// Defaults returns the settings for local development, which packages use
+// until they are configured
+func Defaults() *Config {
+	return &Config{
+		Env:    EnvDevelopment,
+		Port:   "8080",
+		AppURL: "http://localhost:3000",
+		Log:    LogConfig{Level: "info", Format: "json"},
+		Tracing: TracingConfig{
+			Exporter:    TracingNone,
+			ServiceName: "profolio-api",
+		},
+		Server: ServerConfig{
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       15 * time.Second,
+			// The AI routes wait on the provider, which can take a while
+			WriteTimeout:    60 * time.Second,
+			IdleTimeout:     120 * time.Second,
+			ShutdownTimeout: 20 * time.Second,
+			// A few readiness probes at the usual 5s period
+			DrainDelay: 15 * time.Second,
+		},
+		OAuth: OAuthConfig{
+			RedirectBaseURL:  "http://localhost:8080",
+			OIDCProviderName: "oidc",
+		},
+		SMTP: SMTPConfig{Port: "587"},
+	}
+}
+
+// Load reads the configuration once at startup. The environment is APP_ENV,
+// set in the process or in .env, or else the env key of CONFIG_FILE. Then the
+// .env.<environment> and .env files are loaded, the first winning over the
+// second, without overriding variables that are already set, and the
+// environment's profile is applied. CONFIG_FILE itself is read from the
+// process or .env.
+func Load() (*Config, error) {
+	shared, err := readDotenv(".env")
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := *Defaults()
+	var profiles map[string]yaml.Node
+	path := lookupEnv("CONFIG_FILE", shared)
+	if path != "" {
+		if profiles, err = cfg.loadFile(path); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	env := lookupEnv("APP_ENV", shared)
+	if env == "" {
+		env = cfg.Env
+	}
+
+	specific, err := readDotenv(".env." + env)
+	if err != nil {
+		return nil, err
+	}
+	for _, vars := range []map[string]string{specific, shared} {
+		for name, value := range vars {
+			if _, ok := os.LookupEnv(name); !ok {
+				os.Setenv(name, value)
+			}
+		}
 	}
+
+	if profile, ok := profiles[env]; ok {
+		if err := profile.Decode(&cfg); err != nil {
+			return nil, fmt.Errorf("%s: profile %s: %w", path, env, err)
+		}
+	}
+	cfg.Env = env
+	if err := applyEnv(reflect.ValueOf(&cfg).Elem()); err != nil {
+		return nil, err
+	}
+
+	// Picked after the file is read so the file can choose it
+	if cfg.AI.CoverLetterProvider == "" {
+		cfg.AI.CoverLetterProvider = ProviderGemini
+		if cfg.AI.OpenAIAPIKey != "" {
+			cfg.AI.CoverLetterProvider = ProviderOpenAI
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// readDotenv reads the variables of a .env file, which may not exist
+func readDotenv(name string) (map[string]string, error) {
+	vars, err := godotenv.Read(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return vars, nil
+}
+
+// lookupEnv returns the variable from the process, or else from dotenv
+func lookupEnv(name string, dotenv map[string]string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return dotenv[name]
+}
+
+// loadFile applies the shared settings of a YAML file and returns its
+// profiles, which are applied once the environment is known
+func (c *Config) loadFile(path string) (map[string]yaml.Node, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	file := fileConfig{Config: *c}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	*c = file.Config
+	return file.Profiles, nil
+}
+
+// applyEnv overwrites each field that has an env tag with the first of its
+// variables that is set
+func applyEnv(v reflect.Value) error {
+	var errs []error
+	for i := 0; i < v.NumField(); i++ {
+		field, spec := v.Field(i), v.Type().Field(i)
+		if field.Kind() == reflect.Struct {
+			errs = append(errs, applyEnv(field))
+			continue
+		}
+		tag := spec.Tag.Get("env")
+		if tag == "" {
+			continue
+		}
+		for _, name := range strings.Split(tag, ",") {
+			value, ok := os.LookupEnv(name)
+			if !ok || value == "" {
+				continue
+			}
+			if field.Type() == reflect.TypeOf(time.Duration(0)) {
+				d, err := time.ParseDuration(value)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s must be a duration such as 10s, got %q", name, value))
+					break
+				}
+				field.SetInt(int64(d))
+			} else {
+				field.SetString(value)
+			}
+			break
+		}
+	}
+	return errors.Join(errs...)
 }
 
-func GetMongoURI() string {
-	uri, exists := os.LookupEnv("MONGO_URL")
-	if !exists {
-		log.Fatal("MONGO_URL not set in environment")
+// Validate reports every setting that is missing or invalid at once
+func (c *Config) Validate() error {
+	var errs []error
+	switch c.Env {
+	case EnvDevelopment, EnvProduction, EnvTest:
+	default:
+		errs = append(errs, fmt.Errorf("APP_ENV must be %s, %s or %s, got %q", EnvDevelopment, EnvProduction, EnvTest, c.Env))
+	}
+	if port, err := strconv.Atoi(c.Port); err != nil || port <= 0 || port > 65535 {
+		errs = append(errs, fmt.Errorf("PORT must be a port number, got %q", c.Port))
+	}
+	timeouts := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"SERVER_READ_HEADER_TIMEOUT", c.Server.ReadHeaderTimeout},
+		{"SERVER_READ_TIMEOUT", c.Server.ReadTimeout},
+		{"SERVER_WRITE_TIMEOUT", c.Server.WriteTimeout},
+		{"SERVER_IDLE_TIMEOUT", c.Server.IdleTimeout},
+		{"SERVER_SHUTDOWN_TIMEOUT", c.Server.ShutdownTimeout},
+	}
+	for _, timeout := range timeouts {
+		if timeout.value <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive, got %v", timeout.name, timeout.value))
+		}
+	}
+	if c.Server.DrainDelay < 0 {
+		errs = append(errs, fmt.Errorf("SHUTDOWN_DRAIN_DELAY must not be negative, got %v", c.Server.DrainDelay))
+	}
+	if _, err := c.Server.ParseTrustedProxies(); err != nil {
+		errs = append(errs, err)
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		errs = append(errs, fmt.Errorf("LOG_LEVEL must be debug, info, warn or error, got %q", c.Log.Level))
+	}
+	if c.Log.Format != "json" && c.Log.Format != "text" {
+		errs = append(errs, fmt.Errorf("LOG_FORMAT must be json or text, got %q", c.Log.Format))
+	}
+	if c.Tracing.Exporter != TracingNone && c.Tracing.Exporter != TracingOTLP {
+		errs = append(errs, fmt.Errorf("OTEL_TRACES_EXPORTER must be %s or %s, got %q", TracingNone, TracingOTLP, c.Tracing.Exporter))
 	}
-	return uri
+	if c.JWT.Secret == "" && c.JWT.KeysDir == "" {
+		errs = append(errs, errors.New("NEXTAUTH_SECRET or JWT_KEYS_DIR must be set to sign tokens"))
+	}
+	if c.OAuth.OIDCClientID != "" && c.OAuth.OIDCIssuer == "" {
+		errs = append(errs, errors.New("OIDC_CLIENT_ID is set but OIDC_ISSUER is not"))
+	}
+
+	switch c.AI.CoverLetterProvider {
+	case ProviderGemini, ProviderOpenAI:
+	default:
+		errs = append(errs, fmt.Errorf("COVER_LETTER_PROVIDER must be %q or %q, got %q", ProviderGemini, ProviderOpenAI, c.AI.CoverLetterProvider))
+	}
+	if c.AI.CoverLetterProvider == ProviderOpenAI && c.AI.OpenAIAPIKey == "" {
+		errs = append(errs, errors.New("COVER_LETTER_PROVIDER is openai but OPENAI_API_KEY is not set"))
+	}
+
+	// A production deployment must not quietly fall back to local defaults
+	if c.Env == EnvProduction {
+		if c.MongoURI == "" {
+			errs = append(errs, errors.New("MONGODB_URI must be set in production"))
+		}
+		if strings.Contains(c.AppURL, "localhost") {
+			errs = append(errs, errors.New("APP_URL must be set in production"))
+		}
+		// Mail is only logged without a relay, so links would never arrive
+		if c.SMTP.Host == "" {
+			errs = append(errs, errors.New("SMTP_HOST must be set in production"))
+		}
+		if c.SMTP.From == "" {
+			errs = append(errs, errors.New("MAIL_FROM must be set in production"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// String prints the configuration with every secret redacted, for startup logs
+func (c Config) String() string {
+	var b strings.Builder
+	writeFields(&b, reflect.ValueOf(c), "")
+	return strings.TrimSuffix(b.String(), "\n")
 }
 
-func GetOpenAIAPIKey() string {
-	uri, exists := os.LookupEnv("OPENAI_API_KEY")
-	if !exists {
-		log.Fatal("OPENAI_API_KEY not set in environment")
+func writeFields(b *strings.Builder, v reflect.Value, prefix string) {
+	for i := 0; i < v.NumField(); i++ {
+		field, spec := v.Field(i), v.Type().Field(i)
+		name := prefix + spec.Tag.Get("yaml")
+		if field.Kind() == reflect.Struct {
+			writeFields(b, field, name+".")
+			continue
+		}
+		value := fmt.Sprint(field.Interface())
+		if spec.Tag.Get("secret") == "true" && value != "" {
+			value = "[redacted]"
+		}
+		fmt.Fprintf(b, "%s=%s\n", name, value)
 	}
-	return uri
 }
@@ -0,0 +1,218 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		proxies string
+		ranges  int
+		valid   bool
+	}{
+		{"", 0, true},
+		{"10.0.0.0/8, 192.0.2.1", 2, true},
+		{"2001:db8::1", 1, true},
+		{"10.0.0.0/8,not-an-ip", 0, false},
+		{"10.0.0.0/33", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.proxies, func(t *testing.T) {
+			ranges, err := ServerConfig{TrustedProxies: tt.proxies}.ParseTrustedProxies()
+			if (err == nil) != tt.valid {
+				t.Fatalf("ParseTrustedProxies() error = %v, want valid %v", err, tt.valid)
+			}
+			if len(ranges) != tt.ranges {
+				t.Errorf("ParseTrustedProxies() = %d ranges, want %d", len(ranges), tt.ranges)
+			}
+		})
+	}
+}
+
+func TestValidateRequiresMailInProduction(t *testing.T) {
+	cfg := Defaults()
+	cfg.Env = EnvProduction
+	cfg.MongoURI = "mongodb://db"
+	cfg.AppURL = "https://profolio.example.com"
+	cfg.JWT.Secret = "secret"
+	cfg.AI.CoverLetterProvider = ProviderGemini
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "SMTP_HOST") {
+		t.Fatalf("Validate() = %v, want SMTP_HOST to be required", err)
+	}
+
+	cfg.SMTP.Host = "smtp.example.com"
+	cfg.SMTP.From = "ProFolio <no-reply@example.com>"
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+}
+
+// unsetenv removes the variable for the test, restoring it afterwards. Load
+// sets what the .env files hold, so those variables are removed too.
+func unsetenv(t *testing.T, name string) {
+	t.Helper()
+	t.Setenv(name, "")
+	os.Unsetenv(name)
+}
+
+func TestLoad(t *testing.T) {
+	const configFile = `
+port: "9000"
+log:
+  level: info
+profiles:
+  test:
+    port: "9100"
+  production:
+    port: "9400"
+`
+	tests := []struct {
+		name    string
+		files   map[string]string // Files in the working directory
+		environ map[string]string
+		env     string
+		port    string
+		level   string
+	}{
+		{
+			name:    "defaults",
+			environ: map[string]string{"CONFIG_FILE": ""},
+			env:     EnvDevelopment, port: "8080", level: "info",
+		},
+		{
+			name:    "shared file settings",
+			environ: map[string]string{"APP_ENV": EnvDevelopment},
+			env:     EnvDevelopment, port: "9000", level: "info",
+		},
+		{
+			name:    "profile over the file",
+			environ: map[string]string{"APP_ENV": EnvTest},
+			env:     EnvTest, port: "9100", level: "info",
+		},
+		{
+			name:    "variable over the profile",
+			environ: map[string]string{"APP_ENV": EnvTest, "PORT": "9200"},
+			env:     EnvTest, port: "9200", level: "info",
+		},
+		{
+			name:  "env key of the file picks the profile",
+			files: map[string]string{"config.yaml": "env: test\n" + configFile},
+			env:   EnvTest, port: "9100", level: "info",
+		},
+		{
+			name:    "APP_ENV over the env key of the file",
+			files:   map[string]string{"config.yaml": "env: test\n" + configFile},
+			environ: map[string]string{"APP_ENV": EnvDevelopment},
+			env:     EnvDevelopment, port: "9000", level: "info",
+		},
+		{
+			name: "APP_ENV in .env picks the profile and .env file",
+			files: map[string]string{
+				".env":      "APP_ENV=test\nLOG_LEVEL=warn\n",
+				".env.test": "LOG_LEVEL=debug\n",
+			},
+			env: EnvTest, port: "9100", level: "debug",
+		},
+		{
+			name: "env key of the file picks the .env file",
+			files: map[string]string{
+				"config.yaml":     "env: test\n" + configFile,
+				".env.test":       "PORT=9300\n",
+				".env.production": "PORT=9500\n",
+			},
+			env: EnvTest, port: "9300", level: "info",
+		},
+		{
+			name: "CONFIG_FILE in .env",
+			files: map[string]string{
+				".env":       "CONFIG_FILE=other.yaml\n",
+				"other.yaml": "port: \"9600\"\n",
+			},
+			environ: map[string]string{"CONFIG_FILE": "", "APP_ENV": EnvTest},
+			env:     EnvTest, port: "9600", level: "info",
+		},
+		{
+			name:    "process over .env",
+			files:   map[string]string{".env": "APP_ENV=test\nLOG_LEVEL=warn\n"},
+			environ: map[string]string{"APP_ENV": EnvDevelopment, "LOG_LEVEL": "error"},
+			env:     EnvDevelopment, port: "9000", level: "error",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			files := map[string]string{"config.yaml": configFile}
+			for name, content := range tt.files {
+				files[name] = content
+			}
+			for name, content := range files {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			wd, err := os.Getwd()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chdir(dir); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { os.Chdir(wd) })
+
+			for _, name := range []string{"APP_ENV", "PORT", "LOG_LEVEL", "CONFIG_FILE", "MONGODB_URI", "MONGO_URL"} {
+				unsetenv(t, name)
+			}
+			t.Setenv("NEXTAUTH_SECRET", "secret")
+			t.Setenv("CONFIG_FILE", "config.yaml")
+			for name, value := range tt.environ {
+				if value == "" {
+					unsetenv(t, name)
+				} else {
+					t.Setenv(name, value)
+				}
+			}
+
+			cfg, err := Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Env != tt.env || cfg.Port != tt.port || cfg.Log.Level != tt.level {
+				t.Errorf("env, port, level = %s, %s, %s, want %s, %s, %s", cfg.Env, cfg.Port, cfg.Log.Level, tt.env, tt.port, tt.level)
+			}
+		})
+	}
+}
+
+func TestStringRedactsSecrets(t *testing.T) {
+	cfg := Defaults()
+	cfg.MongoURI = "mongodb://user:hunter2@db"
+	cfg.JWT.Secret = "jwt-secret"
+	cfg.OAuth.GitHubClientID = "github-client"
+	cfg.OAuth.GitHubClientSecret = "github-secret"
+	cfg.OAuth.GoogleClientSecret = "google-secret"
+	cfg.OAuth.OIDCClientSecret = "oidc-secret"
+	cfg.AI.OpenAIAPIKey = "openai-key"
+	cfg.AI.GeminiAPIKey = "gemini-key"
+
+	s := cfg.String()
+	for _, secret := range []string{"hunter2", "jwt-secret", "github-secret", "google-secret", "oidc-secret", "openai-key", "gemini-key"} {
+		if strings.Contains(s, secret) {
+			t.Errorf("String() shows %q:\n%s", secret, s)
+		}
+	}
+	for _, line := range []string{
+		"mongoURI=[redacted]",
+		"jwt.secret=[redacted]",
+		"oauth.githubClientID=github-client",
+		"smtp.password=\n", // Unset secrets show as unset
+		"port=8080",
+		"server.readTimeout=15s",
+	} {
+		if !strings.Contains(s+"\n", line) {
+			t.Errorf("String() has no %q:\n%s", line, s)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"profolio-vercel/logging"
+	"profolio-vercel/middleware"
+	"profolio-vercel/models"
+	"profolio-vercel/problem"
+	"profolio-vercel/store"
+	"profolio-vercel/validation"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// AccountHandlers serve the account settings: email, username, password and
+// email verification
+type AccountHandlers struct {
+	Stores
+}
+
+// callerAccount loads the profile and credentials of the signed in user
+func (s Stores) callerAccount(ctx context.Context, r *http.Request) (models.User, models.AuthUser, error) {
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		return models.User{}, models.AuthUser{}, middleware.ErrMissingClaims
+	}
+	userID, err := claims.ObjectID()
+	if err != nil {
+		return models.User{}, models.AuthUser{}, errInvalidUserID
+	}
+	user, authUser, err := s.findAuthUserByUserID(ctx, userID)
+	if err == store.ErrNotFound {
+		return user, authUser, errUserNotFound
+	} else if err != nil {
+		return user, authUser, problem.Internal("Error finding user", err)
+	}
+	return user, authUser, nil
+}
+
+// changeAccount renames the caller's account in auth_users and users. The
+// email and username are in every token, so the old sessions are ended and the
+// response carries tokens that name the account as it is now.
+func (s Stores) changeAccount(ctx context.Context, w http.ResponseWriter, r *http.Request, user models.User, authUser models.AuthUser, change store.AccountChange) error {
+	if err := s.Auth.ChangeAccount(ctx, authUser.Email, change); err != nil {
+		return err
+	}
+	if err := s.revokeAllSessions(ctx, user.ID); err != nil {
+		return problem.Internal("Error revoking sessions", err)
+	}
+
+	event := models.AuditEvent{Action: models.AuditAccountChanged, TargetID: user.ID.Hex()}
+	if change.Email != "" {
+		event.Changes = append(event.Changes, models.FieldChange{Field: "email", From: authUser.Email, To: change.Email})
+		authUser.Email = change.Email
+		authUser.EmailVerified = false
+	}
+	if change.Username != "" {
+		event.Changes = append(event.Changes, models.FieldChange{Field: "username", From: authUser.Username, To: change.Username})
+		authUser.Username = change.Username
+	}
+	s.recordAudit(ctx, r, event)
+
+	tokens, err := s.issueTokens(ctx, user.ID, authUser, "")
+	if err != nil {
+		return tokenError(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tokens)
+	return nil
+}
+
+// ChangeEmail moves the account to a new email address. The caller
+// confirms with their password, and the new address has to be verified again.
+func (h *AccountHandlers) ChangeEmail(w http.ResponseWriter, r *http.Request) error {
+	var body struct {
+		Email    string `json:"email" validate:"required,email,max=254"`
+		Password string `json:"password" validate:"required"`
+	}
+	if err := decodeStrict(r, &body); err != nil {
+		return err
+	}
+	body.Email = normalizeEmail(body.Email)
+	if err := validation.Struct(body); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
+	defer cancel()
+
+	user, authUser, err := h.callerAccount(ctx, r)
+	if err != nil {
+		return err
+	}
+	if authUser.Password == "" {
+		return problem.Forbidden("password_required", "Set a password with a password reset before changing your email")
+	}
+
+	// A stolen session must not be enough to take over the account
+	guard := signinGuard()
+	keys := []string{signinIPKey(r), accountKey(authUser.Email)}
+	if wait, err := guard.Check(ctx, keys...); err != nil {
+		return problem.Internal("Error checking signin attempts", err)
+	} else if wait > 0 {
+		return lockedOut(w, wait)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(authUser.Password), []byte(body.Password)) != nil {
+		return signInFailure(ctx, w, guard, keys)
+	}
+	guard.Succeed(ctx, accountKey(authUser.Email))
+
+	if body.Email == authUser.Email {
+		return problem.Invalid("email_unchanged", "This is already your email address")
+	}
+	if err := h.changeAccount(ctx, w, r, user, authUser, store.AccountChange{Email: body.Email}); err != nil {
+		return err
+	}
+
+	if err := h.sendVerificationEmail(ctx, user.ID, body.Email); err != nil {
+		logging.FromContext(r.Context()).Error("sending verification email", "error", err)
+	}
+	return nil
+}
+
+// ChangeUsername gives the account a new username
+func (h *AccountHandlers) ChangeUsername(w http.ResponseWriter, r *http.Request) error {
+	var body struct {
+		Username string `json:"username" validate:"required,username"`
+	}
+	if err := decodeStrict(r, &body); err != nil {
+		return err
+	}
+	if err := validation.Struct(body); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
+	defer cancel()
+
+	user, authUser, err := h.callerAccount(ctx, r)
+	if err != nil {
+		return err
+	}
+	if body.Username == authUser.Username {
+		return problem.Invalid("username_unchanged", "This is already your username")
+	}
+	return h.changeAccount(ctx, w, r, user, authUser, store.AccountChange{Username: body.Username})
+}
@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"profolio-vercel/middleware"
+	"profolio-vercel/models"
+	"profolio-vercel/problem"
+	"profolio-vercel/store"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AdminHandlers serve the staff actions on other users' accounts
+type AdminHandlers struct {
+	Stores
+}
+
+// findAdminTarget loads the user named by the {targetID} route variable
+func (s Stores) findAdminTarget(ctx context.Context, r *http.Request) (models.User, models.AuthUser, error) {
+	targetID, err := primitive.ObjectIDFromHex(mux.Vars(r)["targetID"])
+	if err != nil {
+		return models.User{}, models.AuthUser{}, errInvalidUserID
+	}
+
+	user, authUser, err := s.findAuthUserByUserID(ctx, targetID)
+	if err == store.ErrNotFound {
+		return user, authUser, errUserNotFound
+	} else if err != nil {
+		return user, authUser, problem.Internal("Error finding user", err)
+	}
+	return user, authUser, nil
+}
+
+func (h *AdminHandlers) DisableUser(w http.ResponseWriter, r *http.Request) error {
+	return h.setUserDisabled(w, r, true)
+}
+
+func (h *AdminHandlers) EnableUser(w http.ResponseWriter, r *http.Request) error {
+	return h.setUserDisabled(w, r, false)
+}
+
+// setUserDisabled disables or re-enables an account. Disabling also ends every
+// session of the user, so their access tokens stop working right away.
+func (h *AdminHandlers) setUserDisabled(w http.ResponseWriter, r *http.Request, disabled bool) error {
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		return middleware.ErrMissingClaims
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
+	defer cancel()
+
+	user, authUser, err := h.findAdminTarget(ctx, r)
+	if err != nil {
+		return err
+	}
+	if user.ID.Hex() == claims.UserID {
+		return problem.Invalid("self_disable", "You cannot disable your own account")
+	}
+	// Admins are never disabled, so the last one can't be either
+	if authUser.Role == models.RoleAdmin {
+		return problem.Forbidden("admin_protected", "Admins cannot be disabled")
+	}
+
+	err = h.Auth.UpdateAuthUser(ctx, authUser.Email, bson.M{"disabled": disabled})
+	if err != nil {
+		return problem.Internal("Error updating user", err)
+	}
+
+	action := models.AuditUserEnabled
+	if disabled {
+		action = models.AuditUserDisabled
+		if err := h.revokeAllSessions(ctx, user.ID); err != nil {
+			return problem.Internal("Error revoking sessions", err)
+		}
+	}
+	h.recordAudit(ctx, r, models.AuditEvent{Action: action, TargetID: user.ID.Hex()})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": user.ID, "disabled": disabled})
+	return nil
+}
+
+func validRole(role string) bool {
+	for _, known := range models.Roles {
+		if role == known {
+			return true
+		}
+	}
+	return false
+}
+
+// SetUserRole changes a user's role. Their sessions are ended so the
+// role in their access tokens cannot go stale.
+func (h *AdminHandlers) SetUserRole(w http.ResponseWriter, r *http.Request) error {
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		return middleware.ErrMissingClaims
+	}
+
+	var body struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || !validRole(body.Role) {
+		return errInvalidBody
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
+	defer cancel()
+
+	user, authUser, err := h.findAdminTarget(ctx, r)
+	if err != nil {
+		return err
+	}
+	if user.ID.Hex() == claims.UserID {
+		return problem.Invalid("self_role_change", "You cannot change your own role")
+	}
+
+	// Another admin may be demoting the caller at the same time, so the store
+	// checks that an admin is left
+	err = h.Auth.ChangeRole(ctx, authUser.Email, body.Role)
+	if err == store.ErrLastAdmin {
+		return problem.Conflict("last_admin", "The last admin cannot be demoted")
+	} else if err != nil {
+		return problem.Internal("Error updating user", err)
+	}
+	if err := h.revokeAllSessions(ctx, user.ID); err != nil {
+		return problem.Internal("Error revoking sessions", err)
+	}
+
+	h.recordAudit(ctx, r, models.AuditEvent{
+		Action:   models.AuditUserRoleChanged,
+		TargetID: user.ID.Hex(),
+		Details:  map[string]interface{}{"from": authUser.Role, "to": body.Role},
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": user.ID, "role": body.Role})
+	return nil
+}
+
+// ImpersonateUser issues a short-lived access token that acts as the
+// target user. It carries no refresh token and names the admin in its act claim.
+func (h *AdminHandlers) ImpersonateUser(w http.ResponseWriter, r *http.Request) error {
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		return middleware.ErrMissingClaims
+	}
+	if claims.Actor != nil {
+		return problem.Forbidden("impersonation_denied", "Impersonated sessions cannot impersonate")
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
+	defer cancel()
+
+	user, authUser, err := h.findAdminTarget(ctx, r)
+	if err != nil {
+		return err
+	}
+	if user.ID.Hex() == claims.UserID {
+		return problem.Invalid("self_impersonation", "You cannot impersonate yourself")
+	}
+	if authUser.Role == models.RoleAdmin {
+		return problem.Forbidden("admin_protected", "Admins cannot be impersonated")
+	}
+	if authUser.Disabled {
+		return problem.Forbidden("account_disabled", "Account is disabled")
+	}
+
+	accessToken, err := middleware.GenerateImpersonationJWT(user.ID, authUser, middleware.Actor{
+		Subject:  claims.UserID,
+		Username: claims.Username,
+	})
+	if err != nil {
+		return problem.Internal("Error generating token", err)
+	}
+
+	h.recordAudit(ctx, r, models.AuditEvent{Action: models.AuditUserImpersonated, TargetID: user.ID.Hex()})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"accessToken": accessToken,
+		"expiresIn":   int(middleware.ImpersonationTTL.Seconds()),
+	})
+	return nil
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"profolio-vercel/models"
+	"profolio-vercel/store"
+)
+
+// createAccounts signs up a user for each username with the role
+func createAccounts(t *testing.T, m *store.Memory, roles map[string]string) map[string]models.User {
+	t.Helper()
+	users := map[string]models.User{}
+	for username, role := range roles {
+		email := username + "@example.com"
+		user, err := m.CreateAccount(context.Background(),
+			models.AuthUser{Username: username, Email: email, Password: "unknown", Role: role},
+			models.User{Basics: models.Basics{Username: username, Email: email}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		users[username] = user
+	}
+	return users
+}
+
+func TestSetUserRole(t *testing.T) {
+	m := testStores(t)
+	users := createAccounts(t, m, map[string]string{"ada": models.RoleAdmin, "grace": models.RoleAdmin, "bob": models.RoleUser})
+	h := &AdminHandlers{Stores: MemoryStores(m)}
+	setRole := func(caller, target, role string) *httptest.ResponseRecorder {
+		return call{
+			method: "PUT",
+			body:   `{"role":"` + role + `"}`,
+			vars:   map[string]string{"targetID": users[target].ID.Hex()},
+			claims: claimsFor(users[caller], models.RoleAdmin),
+		}.serve(h.SetUserRole)
+	}
+	role := func(username string) string {
+		t.Helper()
+		authUser, err := m.FindAuthUser(context.Background(), username+"@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return authUser.Role
+	}
+
+	if w := setRole("ada", "ada", models.RoleUser); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "self_role_change") {
+		t.Errorf("own role: status = %d: %s", w.Code, w.Body)
+	}
+	if w := setRole("ada", "bob", "owner"); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown role: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := setRole("ada", "bob", models.RoleSupport); w.Code != http.StatusOK || role("bob") != models.RoleSupport {
+		t.Errorf("promotion: status = %d, role = %q", w.Code, role("bob"))
+	}
+	if w := setRole("ada", "grace", models.RoleUser); w.Code != http.StatusOK || role("grace") != models.RoleUser {
+		t.Errorf("demoting another admin: status = %d, role = %q", w.Code, role("grace"))
+	}
+
+	// Had grace demoted ada at the same moment, her request must find ada is the last admin
+	w := setRole("grace", "ada", models.RoleUser)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "last_admin") || role("ada") != models.RoleAdmin {
+		t.Errorf("last admin: status = %d, role = %q: %s", w.Code, role("ada"), w.Body)
+	}
+}
+
+func TestLastAdminCountsEnabledAdmins(t *testing.T) {
+	m := testStores(t)
+	createAccounts(t, m, map[string]string{"ada": models.RoleAdmin, "grace": models.RoleAdmin})
+	ctx := context.Background()
+	if err := m.UpdateAuthUser(ctx, "grace@example.com", map[string]interface{}{"disabled": true}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.ChangeRole(ctx, "ada@example.com", models.RoleUser); err != store.ErrLastAdmin {
+		t.Errorf("demoting the last enabled admin: %v, want %v", err, store.ErrLastAdmin)
+	}
+	if err := m.ChangeRole(ctx, "ada@example.com", models.RoleAdmin); err != nil {
+		t.Errorf("keeping the admin role: %v", err)
+	}
+	if err := m.ChangeRole(ctx, "grace@example.com", models.RoleUser); err != nil {
+		t.Errorf("demoting a disabled admin: %v", err)
+	}
+	if err := m.ChangeRole(ctx, "nobody@example.com", models.RoleUser); err != store.ErrNotFound {
+		t.Errorf("unknown account: %v, want %v", err, store.ErrNotFound)
+	}
+}
+
+func TestAdminsCannotBeDisabled(t *testing.T) {
+	m := testStores(t)
+	users := createAccounts(t, m, map[string]string{"ada": models.RoleAdmin, "grace": models.RoleAdmin})
+	h := &AdminHandlers{Stores: MemoryStores(m)}
+
+	for target, want := range map[string]int{"ada": http.StatusBadRequest, "grace": http.StatusForbidden} {
+		w := call{method: "POST", vars: map[string]string{"targetID": users[target].ID.Hex()}, claims: claimsFor(users["ada"], models.RoleAdmin)}.serve(h.DisableUser)
+		if w.Code != want {
+			t.Errorf("disabling %s: status = %d, want %d", target, w.Code, want)
+		}
+	}
+}
@@ -1,41 +1,40 @@
 package handlers
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
-	"os"
+	"time"
 
 	"profolio-vercel/config"
+	"profolio-vercel/logging"
+	"profolio-vercel/metrics"
+	"profolio-vercel/problem"
 
 	"github.com/google/generative-ai-go/genai"
 	openai "github.com/sashabaranov/go-openai"
-	"google.golang.org/api/option"
 )
 
-func GeminiCoverLetterHandler(w http.ResponseWriter, r *http.Request) {
+func GeminiCoverLetterHandler(w http.ResponseWriter, r *http.Request) error {
 	var userInput struct {
 		Message string          `json:"message"`
 		Profile json.RawMessage `json:"profile"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&userInput); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+		return errInvalidBody
 	}
 
 	var profile map[string]interface{}
 	if err := json.Unmarshal(userInput.Profile, &profile); err != nil {
-		http.Error(w, "Invalid profile format", http.StatusBadRequest)
-		return
+		return problem.Invalid("invalid_profile", "Invalid profile format")
 	}
 
-	ctx := context.Background()
+	ctx := r.Context()
 
-	client, err := genai.NewClient(ctx, option.WithAPIKey(os.Getenv("GEMINI_API_KEY")))
+	client, err := geminiClient(ctx)
 	if err != nil {
-		log.Fatal(err)
+		logging.FromContext(r.Context()).Error("creating Gemini client", "error", err)
+		return problem.BadGateway("ai_failed", "Error generating cover letter", err)
 	}
 	defer client.Close()
 	context := "write a cover letter based on this Job Description, you are truthful and doesn't lie about your skills. The user's information is given, autofill prefill all the details from Profile Information in the letter, no  []."
@@ -45,34 +44,45 @@ func GeminiCoverLetterHandler(w http.ResponseWriter, r *http.Request) {
 		genai.Text(fmt.Sprintf("Profile %s", userInput.Profile)),
 		genai.Text(context),
 	}
-	resp, err := model.GenerateContent(ctx, prompt...)
-	if err != nil {
-		log.Fatal(err)
+	spanCtx, span := startAISpan(ctx, config.ProviderGemini, "cover_letter", "gemini-1.0-pro")
+	start := time.Now()
+	resp, err := model.GenerateContent(spanCtx, prompt...)
+	var promptTokens, completionTokens int
+	if err == nil && resp.UsageMetadata != nil {
+		promptTokens, completionTokens = int(resp.UsageMetadata.PromptTokenCount), int(resp.UsageMetadata.CandidatesTokenCount)
 	}
-
-	fmt.Println("Generated text content:")
-	fmt.Println(resp.Candidates[0].Content.Parts[0])
+	metrics.ObserveAICall(config.ProviderGemini, "cover_letter", start, err, promptTokens, completionTokens)
+	endAISpan(span, err, promptTokens, completionTokens)
+	if err != nil || len(resp.Candidates) == 0 || resp.Candidates[0].Content == nil || len(resp.Candidates[0].Content.Parts) == 0 {
+		logging.FromContext(r.Context()).Error("generating cover letter", "provider", "gemini", "error", err)
+		return problem.BadGateway("ai_failed", "Error generating cover letter", err)
+	}
+	logging.FromContext(r.Context()).Debug("generated cover letter", "provider", "gemini", "candidates", len(resp.Candidates))
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp.Candidates[0].Content.Parts[0])
+	return nil
 }
 
-func OpenAICoverLetterHandler(w http.ResponseWriter, r *http.Request) {
-	aiKey := config.GetOpenAIAPIKey()
-	client := openai.NewClient(aiKey)
+func OpenAICoverLetterHandler(w http.ResponseWriter, r *http.Request) error {
+	client, err := openAIClient()
+	if err != nil {
+		return err
+	}
 	var userInput struct {
 		Message string          `json:"message"`
 		Profile json.RawMessage `json:"profile"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&userInput); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+		return errInvalidBody
 	}
 
 	profileStr := string(userInput.Profile)
 
-	resp, err := client.CreateChatCompletion(
-		context.Background(),
+	resp, err := chatCompletion(
+		r.Context(),
+		client,
+		"cover_letter",
 		openai.ChatCompletionRequest{
 			Model: openai.GPT3Dot5Turbo,
 			Messages: []openai.ChatCompletionMessage{
@@ -92,17 +102,19 @@ func OpenAICoverLetterHandler(w http.ResponseWriter, r *http.Request) {
 		},
 	)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("ChatCompletion error: %v", err), http.StatusInternalServerError)
-		return
+		return problem.BadGateway("ai_failed", "Error calling OpenAI", err)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp.Choices[0].Message.Content)
+	return nil
 }
 
-func CalculateReplacementChance(w http.ResponseWriter, r *http.Request) {
-	aiKey := config.GetOpenAIAPIKey()
-	client := openai.NewClient(aiKey)
+func CalculateReplacementChance(w http.ResponseWriter, r *http.Request) error {
+	client, err := openAIClient()
+	if err != nil {
+		return err
+	}
 	var userInput struct {
 		Profile  json.RawMessage `json:"profile"`
 		Position string          `json:"position"`
@@ -110,12 +122,13 @@ func CalculateReplacementChance(w http.ResponseWriter, r *http.Request) {
 
 	profileStr := string(userInput.Profile)
 	if err := json.NewDecoder(r.Body).Decode(&userInput); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+		return errInvalidBody
 	}
 
-	resp, err := client.CreateChatCompletion(
-		context.Background(),
+	resp, err := chatCompletion(
+		r.Context(),
+		client,
+		"replacement_chance",
 		openai.ChatCompletionRequest{
 			Model:     openai.GPT3Dot5Turbo,
 			MaxTokens: 20,
@@ -136,28 +149,31 @@ func CalculateReplacementChance(w http.ResponseWriter, r *http.Request) {
 		},
 	)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("ChatCompletion error: %v", err), http.StatusInternalServerError)
-		return
+		return problem.BadGateway("ai_failed", "Error calling OpenAI", err)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp.Choices[0].Message.Content)
+	return nil
 }
 
-func ResumeReview(w http.ResponseWriter, r *http.Request) {
-	aiKey := config.GetOpenAIAPIKey()
-	client := openai.NewClient(aiKey)
+func ResumeReview(w http.ResponseWriter, r *http.Request) error {
+	client, err := openAIClient()
+	if err != nil {
+		return err
+	}
 	var userInput struct {
 		Resume string `json:"resume"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&userInput); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+		return errInvalidBody
 	}
 
-	resp, err := client.CreateChatCompletion(
-		context.Background(),
+	resp, err := chatCompletion(
+		r.Context(),
+		client,
+		"resume_review",
 		openai.ChatCompletionRequest{
 			Model: openai.GPT3Dot5Turbo,
 			Messages: []openai.ChatCompletionMessage{
@@ -173,10 +189,10 @@ func ResumeReview(w http.ResponseWriter, r *http.Request) {
 		},
 	)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("ChatCompletion error: %v", err), http.StatusInternalServerError)
-		return
+		return problem.BadGateway("ai_failed", "Error calling OpenAI", err)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp.Choices[0].Message.Content)
+	return nil
 }
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"profolio-vercel/middleware"
+	"profolio-vercel/models"
+	"profolio-vercel/problem"
+	"profolio-vercel/store"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxAPIKeys is how many active keys a user can hold
+const maxAPIKeys = 20
+
+// newAPIKey returns a key of the form pf_<prefix>_<secret> and its prefix
+func newAPIKey() (string, string, error) {
+	prefix := make([]byte, 4)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(prefix); err != nil {
+		return "", "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	p := hex.EncodeToString(prefix)
+	return "pf_" + p + "_" + base64.RawURLEncoding.EncodeToString(secret), p, nil
+}
+
+// APIKeyHandlers serve the caller's API keys
+type APIKeyHandlers struct {
+	Stores
+}
+
+func validScope(scope string) bool {
+	for _, known := range models.APIKeyScopes {
+		if scope == known {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *APIKeyHandlers) Create(w http.ResponseWriter, r *http.Request) error {
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		return middleware.ErrMissingClaims
+	}
+	userID, err := claims.ObjectID()
+	if err != nil {
+		return errInvalidUserID
+	}
+
+	var body struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expiresInDays"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Name == "" || len(body.Scopes) == 0 {
+		return errInvalidBody
+	}
+	for _, scope := range body.Scopes {
+		if !validScope(scope) {
+			return problem.Invalid("unknown_scope", fmt.Sprintf("Unknown scope %q", scope))
+		}
+	}
+	if body.ExpiresInDays < 0 {
+		return problem.Invalid("invalid_expiry", "expiresInDays must not be negative")
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
+	defer cancel()
+
+	// Expired keys don't count, as they can't be used any more
+	now := time.Now()
+	count, err := h.APIKeys.CountAPIKeys(ctx, userID, now)
+	if err != nil {
+		return problem.Internal("Error counting API keys", err)
+	}
+	if count >= maxAPIKeys {
+		return problem.Invalid("api_key_limit", fmt.Sprintf("Maximum number of API keys (%d) reached", maxAPIKeys))
+	}
+
+	key, prefix, err := newAPIKey()
+	if err != nil {
+		return problem.Internal("Error generating API key", err)
+	}
+
+	apiKey := models.APIKey{
+		ID:        primitive.NewObjectID(),
+		UserID:    userID,
+		Name:      body.Name,
+		Prefix:    prefix,
+		KeyHash:   middleware.HashAPIKey(key),
+		Scopes:    body.Scopes,
+		CreatedAt: now,
+	}
+	if body.ExpiresInDays > 0 {
+		expiresAt := now.AddDate(0, 0, body.ExpiresInDays)
+		apiKey.ExpiresAt = &expiresAt
+	}
+
+	if err := h.APIKeys.InsertAPIKey(ctx, apiKey); err != nil {
+		return problem.Internal("Error saving API key", err)
+	}
+
+	// The key itself is only ever shown in this response
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"key":    key,
+		"apiKey": apiKey,
+	})
+	return nil
+}
+
+func (h *APIKeyHandlers) List(w http.ResponseWriter, r *http.Request) error {
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		return middleware.ErrMissingClaims
+	}
+	userID, err := claims.ObjectID()
+	if err != nil {
+		return errInvalidUserID
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
+	defer cancel()
+
+	apiKeys, err := h.APIKeys.ListAPIKeys(ctx, userID)
+	if err != nil {
+		return problem.Internal("Error listing API keys", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(apiKeys)
+	return nil
+}
+
+func (h *APIKeyHandlers) Revoke(w http.ResponseWriter, r *http.Request) error {
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		return middleware.ErrMissingClaims
+	}
+	userID, err := claims.ObjectID()
+	if err != nil {
+		return errInvalidUserID
+	}
+	keyID, err := primitive.ObjectIDFromHex(mux.Vars(r)["keyID"])
+	if err != nil {
+		return problem.Invalid("invalid_api_key_id", "Invalid API key ID")
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
+	defer cancel()
+
+	err = h.APIKeys.RevokeAPIKey(ctx, userID, keyID, time.Now())
+	if err == store.ErrNotFound {
+		return problem.NotFound("api_key_not_found", "API key not found")
+	} else if err != nil {
+		return problem.Internal("Error revoking API key", err)
+	}
+
+	h.recordAudit(ctx, r, models.AuditEvent{
+		Action:   models.AuditAPIKeyRevoked,
+		TargetID: userID.Hex(),
+		Details:  map[string]interface{}{"apiKeyId": keyID.Hex()},
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "API key revoked"})
+	return nil
+}
@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"profolio-vercel/middleware"
+	"profolio-vercel/models"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCreateAPIKey(t *testing.T) {
+	m := testStores(t)
+	f := newFixture(t, m)
+	h := &APIKeyHandlers{Stores: MemoryStores(m)}
+	claims := claimsFor(f.alice, models.RoleUser)
+
+	w := call{method: "POST", body: `{"name":"ci","scopes":["user:read"],"expiresInDays":30}`, claims: claims}.serve(h.Create)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var created struct {
+		Key    string                 `json:"key"`
+		APIKey map[string]interface{} `json:"apiKey"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(created.Key, "pf_"+created.APIKey["prefix"].(string)+"_") {
+		t.Errorf("key %q does not start with its prefix %v", created.Key, created.APIKey["prefix"])
+	}
+	if _, ok := created.APIKey["keyHash"]; ok {
+		t.Error("the response shows the hash")
+	}
+
+	// Only the hash is stored, and listings show neither the key nor the hash
+	stored, err := m.ListAPIKeys(context.Background(), f.alice.ID)
+	if err != nil || len(stored) != 1 {
+		t.Fatalf("stored keys = %v, %v", stored, err)
+	}
+	if stored[0].KeyHash != middleware.HashAPIKey(created.Key) {
+		t.Errorf("stored hash = %q", stored[0].KeyHash)
+	}
+	if stored[0].ExpiresAt == nil || stored[0].ExpiresAt.Sub(time.Now()) < 29*24*time.Hour {
+		t.Errorf("expires at %v", stored[0].ExpiresAt)
+	}
+	w = call{method: "GET", claims: claims}.serve(h.List)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), created.Key) || strings.Contains(w.Body.String(), stored[0].KeyHash) {
+		t.Errorf("list answered %d: %s", w.Code, w.Body)
+	}
+
+	for _, body := range []string{
+		`{"scopes":["user:read"]}`,
+		`{"name":"ci","scopes":[]}`,
+		`{"name":"ci","scopes":["admin"]}`,
+		`{"name":"ci","scopes":["user:read"],"expiresInDays":-1}`,
+	} {
+		if w := (call{method: "POST", body: body, claims: claims}).serve(h.Create); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestAPIKeyLimit(t *testing.T) {
+	m := testStores(t)
+	f := newFixture(t, m)
+	h := &APIKeyHandlers{Stores: MemoryStores(m)}
+	ctx := context.Background()
+
+	// Revoked and expired keys can't be used, so they leave room for new ones
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	for i := 0; i < maxAPIKeys-1; i++ {
+		key := models.APIKey{UserID: f.alice.ID, Name: "active", Scopes: []string{models.ScopeUserRead}, CreatedAt: time.Now()}
+		if i%2 == 0 {
+			key.ExpiresAt = &future
+		}
+		if err := m.InsertAPIKey(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []models.APIKey{
+		{UserID: f.alice.ID, Name: "revoked", RevokedAt: &past},
+		{UserID: f.alice.ID, Name: "expired", ExpiresAt: &past},
+		{UserID: f.bob.ID, Name: "bob's"},
+	} {
+		if err := m.InsertAPIKey(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	body := `{"name":"ci","scopes":["user:read"]}`
+	if w := (call{method: "POST", body: body, claims: claimsFor(f.alice, models.RoleUser)}).serve(h.Create); w.Code != http.StatusCreated {
+		t.Fatalf("last key: status = %d: %s", w.Code, w.Body)
+	}
+	w := call{method: "POST", body: body, claims: claimsFor(f.alice, models.RoleUser)}.serve(h.Create)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "api_key_limit") {
+		t.Errorf("key over the limit: status = %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestRevokeAPIKey(t *testing.T) {
+	m := testStores(t)
+	f := newFixture(t, m)
+	h := &APIKeyHandlers{Stores: MemoryStores(m)}
+	key := models.APIKey{ID: primitive.NewObjectID(), UserID: f.alice.ID, Name: "ci", CreatedAt: time.Now()}
+	if err := m.InsertAPIKey(context.Background(), key); err != nil {
+		t.Fatal(err)
+	}
+	revoke := func(user models.User, keyID string) int {
+		return call{method: "DELETE", vars: map[string]string{"keyID": keyID}, claims: claimsFor(user, models.RoleUser)}.serve(h.Revoke).Code
+	}
+
+	if got := revoke(f.bob, key.ID.Hex()); got != http.StatusNotFound {
+		t.Errorf("another user's key: status = %d, want %d", got, http.StatusNotFound)
+	}
+	if got := revoke(f.alice, "nope"); got != http.StatusBadRequest {
+		t.Errorf("invalid ID: status = %d, want %d", got, http.StatusBadRequest)
+	}
+	if got := revoke(f.alice, key.ID.Hex()); got != http.StatusOK {
+		t.Errorf("status = %d, want %d", got, http.StatusOK)
+	}
+	if got := revoke(f.alice, key.ID.Hex()); got != http.StatusNotFound {
+		t.Errorf("revoked again: status = %d, want %d", got, http.StatusNotFound)
+	}
+
+	events := m.AuditEvents()
+	if len(events) != 1 || events[0].Action != models.AuditAPIKeyRevoked || events[0].Details["apiKeyId"] != key.ID.Hex() {
+		t.Errorf("audit events = %+v", events)
+	}
+}
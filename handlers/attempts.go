@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"profolio-vercel/lockout"
+	"profolio-vercel/problem"
+)
+
+var (
+	// signinPolicy locks out an IP or account after repeated wrong passwords or codes
+	signinPolicy = lockout.Policy{
+		FreeAttempts: 5,
+		BaseDelay:    30 * time.Second,
+		MaxDelay:     time.Hour,
+		Window:       time.Hour,
+	}
+
+	// signupPolicy slows down mass account creation from a single IP
+	signupPolicy = lockout.Policy{
+		FreeAttempts: 10,
+		BaseDelay:    time.Minute,
+		MaxDelay:     24 * time.Hour,
+		Window:       24 * time.Hour,
+	}
+
+	// resetPolicy limits how many reset links an IP can ask for, and how
+	// many can be mailed to one address
+	resetPolicy = lockout.Policy{
+		FreeAttempts: 5,
+		BaseDelay:    time.Minute,
+		MaxDelay:     24 * time.Hour,
+		Window:       time.Hour,
+	}
+
+	// attemptStore shares the counters through Mongo, set by SetClient, so
+	// lockouts hold across serverless instances
+	attemptStore lockout.Store
+)
+
+// SetAttemptStore replaces the store of failed attempt counters
+func SetAttemptStore(store lockout.Store) {
+	attemptStore = store
+}
+
+func signinGuard() *lockout.Guard {
+	return &lockout.Guard{Store: attemptStore, Policy: signinPolicy}
+}
+
+func signupGuard() *lockout.Guard {
+	return &lockout.Guard{Store: attemptStore, Policy: signupPolicy}
+}
+
+func resetGuard() *lockout.Guard {
+	return &lockout.Guard{Store: attemptStore, Policy: resetPolicy}
+}
+
+// signinIPKey, signupIPKey and resetIPKey count an IP's attempts apart, as the two
+// policies would otherwise read each other's counters from the shared store
+func signinIPKey(r *http.Request) string {
+	return "signin:ip:" + clientIP(r)
+}
+
+func signupIPKey(r *http.Request) string {
+	return "signup:ip:" + clientIP(r)
+}
+
+func resetIPKey(r *http.Request) string {
+	return "reset:ip:" + clientIP(r)
+}
+
+func accountKey(email string) string {
+	return "signin:account:" + normalizeEmail(email)
+}
+
+func resetAccountKey(email string) string {
+	return "reset:account:" + normalizeEmail(email)
+}
+
+// clientIP returns the caller's address. X-Forwarded-For is only read when the
+// peer is one of the trusted proxies, and then the caller is the last entry
+// that isn't a trusted proxy itself; anyone else could write any address there.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trustedProxy(host) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if ip == "" {
+			continue
+		}
+		if !trustedProxy(ip) {
+			return ip
+		}
+		host = ip
+	}
+	return host
+}
+
+// trustedProxy reports whether ip is in one of the configured TrustedProxies
+func trustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// lockedOut sets Retry-After and fails a request that has to wait before trying again
+func lockedOut(w http.ResponseWriter, wait time.Duration) error {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", fmt.Sprint(seconds))
+	return problem.TooManyRequests("locked_out", fmt.Sprintf("Too many attempts, try again in %d seconds", seconds))
+}
+
+// signInFailure counts a wrong password or code and fails with 401, or with
+// 429 once the failure locks the caller out
+func signInFailure(ctx context.Context, w http.ResponseWriter, guard *lockout.Guard, keys []string) error {
+	wait, err := guard.Fail(ctx, keys...)
+	if err != nil {
+		return problem.Internal("Error recording signin attempt", err)
+	}
+	if wait > 0 {
+		return lockedOut(w, wait)
+	}
+	return problem.Unauthorized("invalid_credentials", "Invalid user credentials")
+}
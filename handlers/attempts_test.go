@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"profolio-vercel/config"
+)
+
+func TestClientIP(t *testing.T) {
+	cfg := config.Defaults()
+	cfg.Server.TrustedProxies = "10.0.0.0/8, 192.0.2.1"
+	Configure(cfg)
+	t.Cleanup(func() { Configure(config.Defaults()) })
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		want       string
+	}{
+		{"direct", "203.0.113.7:4000", "", "203.0.113.7"},
+		{"spoofed by an untrusted peer", "203.0.113.7:4000", "198.51.100.1", "203.0.113.7"},
+		{"through a trusted proxy", "10.1.2.3:4000", "198.51.100.1", "198.51.100.1"},
+		{"through a chain of trusted proxies", "10.1.2.3:4000", "198.51.100.1, 192.0.2.1", "198.51.100.1"},
+		{"spoofed entry before the proxy's", "10.1.2.3:4000", "1.1.1.1, 198.51.100.1", "198.51.100.1"},
+		{"trusted proxy without the header", "192.0.2.1:4000", "", "192.0.2.1"},
+		{"only trusted proxies", "10.1.2.3:4000", "10.9.9.9, 192.0.2.1", "10.9.9.9"},
+		{"empty entries", "10.1.2.3:4000", "198.51.100.1, , ", "198.51.100.1"},
+		{"IPv6 peer", "[2001:db8::1]:4000", "198.51.100.1", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/signin", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if got := clientIP(r); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// Every X-Forwarded-For header counts, the last one being the nearest proxy's
+	r := httptest.NewRequest("POST", "/signin", nil)
+	r.RemoteAddr = "10.1.2.3:4000"
+	r.Header.Add("X-Forwarded-For", "198.51.100.1")
+	r.Header.Add("X-Forwarded-For", "198.51.100.2, 192.0.2.1")
+	if got := clientIP(r); got != "198.51.100.2" {
+		t.Errorf("clientIP() with two headers = %q, want %q", got, "198.51.100.2")
+	}
+}
+
+func TestAttemptKeysArePerPolicy(t *testing.T) {
+	r := httptest.NewRequest("POST", "/signup", nil)
+	if signinIPKey(r) == signupIPKey(r) {
+		t.Errorf("signin and signup share the key %q", signinIPKey(r))
+	}
+	if resetIPKey(r) == signinIPKey(r) || resetIPKey(r) == signupIPKey(r) {
+		t.Errorf("password resets share the key %q", resetIPKey(r))
+	}
+	if resetAccountKey("alice@example.com") == accountKey("alice@example.com") {
+		t.Errorf("password resets share the key %q", accountKey("alice@example.com"))
+	}
+}
@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"profolio-vercel/logging"
+	"profolio-vercel/metrics"
+	"profolio-vercel/middleware"
+	"profolio-vercel/models"
+	"profolio-vercel/problem"
+	"profolio-vercel/store"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AuditHandlers serve the audit log
+type AuditHandlers struct {
+	Stores
+}
+
+// recordAudit appends an event to audit_events, filling in who made the request
+// and from where. Failures are logged rather than failing the request.
+func (s Stores) recordAudit(ctx context.Context, r *http.Request, event models.AuditEvent) {
+	if claims, ok := middleware.ClaimsFromContext(r.Context()); ok && event.ActorID == "" {
+		event.ActorID = claims.UserID
+		if claims.Actor != nil {
+			// Impersonated requests are attributed to the admin behind them
+			event.ActorID = claims.Actor.Subject
+			if event.Details == nil {
+				event.Details = map[string]interface{}{}
+			}
+			event.Details["impersonating"] = claims.UserID
+		}
+		if claims.APIKeyID != "" {
+			if event.Details == nil {
+				event.Details = map[string]interface{}{}
+			}
+			event.Details["apiKeyId"] = claims.APIKeyID
+		}
+	}
+	event.IP = clientIP(r)
+	event.UserAgent = r.UserAgent()
+	event.CreatedAt = time.Now()
+
+	if err := s.Audit.RecordAudit(ctx, event); err != nil {
+		logging.FromContext(r.Context()).Error("recording audit event", "action", event.Action, "error", err)
+	}
+}
+
+// recordSignIn records a successful signin; method is "password", "totp" or a login provider
+func (s Stores) recordSignIn(ctx context.Context, r *http.Request, userID primitive.ObjectID, method string) {
+	metrics.SignIns.WithLabelValues(method, "success").Inc()
+	s.recordAudit(ctx, r, models.AuditEvent{
+		Action:   models.AuditSignIn,
+		ActorID:  userID.Hex(),
+		TargetID: userID.Hex(),
+		Details:  map[string]interface{}{"method": method},
+	})
+}
+
+// recordSignInFailure records a rejected signin. targetID is empty when the
+// email did not match any account.
+func (s Stores) recordSignInFailure(ctx context.Context, r *http.Request, method, email, targetID, reason string) {
+	metrics.SignIns.WithLabelValues(method, reason).Inc()
+	s.recordAudit(ctx, r, models.AuditEvent{
+		Action:   models.AuditSignInFailed,
+		TargetID: targetID,
+		Details:  map[string]interface{}{"method": method, "email": email, "reason": reason},
+	})
+}
+
+// recordUserUpdate records a PATCH of a users document with the fields it changed
+func (s Stores) recordUserUpdate(ctx context.Context, r *http.Request, before bson.M, updates map[string]interface{}) {
+	event := models.AuditEvent{Action: models.AuditUserUpdated, Changes: fieldChanges(before, updates)}
+	if id, ok := before["_id"].(primitive.ObjectID); ok {
+		event.TargetID = id.Hex()
+	}
+	s.recordAudit(ctx, r, event)
+}
+
+// userIDByEmail returns the users document ID for an email, or "" when there is none
+func userIDByEmail(ctx context.Context, users store.UserStore, email string) string {
+	user, err := users.FindUser(ctx, store.ByEmail(email))
+	if err != nil {
+		return ""
+	}
+	return user.ID.Hex()
+}
+
+// lookupField returns the value at a dotted path such as "basics.name" or
+// "resumes.0.title" in a decoded document
+func lookupField(doc bson.M, path string) interface{} {
+	value, _ := findField(doc, path)
+	return value
+}
+
+// findField is lookupField that also reports whether the path exists
+func findField(doc bson.M, path string) (interface{}, bool) {
+	var current interface{} = doc
+	for _, part := range strings.Split(path, ".") {
+		switch v := current.(type) {
+		case bson.M:
+			value, ok := v[part]
+			if !ok {
+				return nil, false
+			}
+			current = value
+		case bson.A:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			current = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// sameValue compares a stored value with one decoded from a request body. Their
+// Go types differ (int32 against float64 and so on), so both are compared as JSON.
+func sameValue(a, b interface{}) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	if errA != nil || errB != nil {
+		return reflect.DeepEqual(a, b)
+	}
+	return string(ja) == string(jb)
+}
+
+// fieldChanges lists the fields a $set of updates changes in the document as
+// it was before the update, in field order
+func fieldChanges(before bson.M, updates map[string]interface{}) []models.FieldChange {
+	changes := []models.FieldChange{}
+	for field, value := range updates {
+		old := lookupField(before, field)
+		if !sameValue(old, value) {
+			changes = append(changes, models.FieldChange{Field: field, From: old, To: value})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Field < changes[j].Field })
+	return changes
+}
+
+// documentChanges diffs two versions of a whole document, such as a resume
+// that was replaced. Field names are prefixed with prefix.
+func documentChanges(prefix string, before, after bson.M) []models.FieldChange {
+	updates := map[string]interface{}{}
+	for field := range before {
+		updates[field] = nil
+	}
+	for field, value := range after {
+		updates[field] = value
+	}
+
+	changes := fieldChanges(before, updates)
+	for i := range changes {
+		changes[i].Field = prefix + changes[i].Field
+	}
+	return changes
+}
+
+// auditFilter reads the filter of the audit listings from the action, actorId
+// and targetId query parameters
+func auditFilter(r *http.Request) store.AuditFilter {
+	query := r.URL.Query()
+	return store.AuditFilter{
+		Action:   query.Get("action"),
+		ActorID:  query.Get("actorId"),
+		TargetID: query.Get("targetId"),
+	}
+}
+
+// writeAuditEvents answers with one page of the events matching filter, newest first
+func (s Stores) writeAuditEvents(w http.ResponseWriter, r *http.Request, filter store.AuditFilter) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
+	defer cancel()
+
+	page, limit := pagination(r)
+	events, total, err := s.Audit.ListAudit(ctx, filter, (page-1)*limit, limit)
+	if err != nil {
+		return problem.Internal("Error reading audit events", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"events": events,
+		"page":   page,
+		"limit":  limit,
+		"total":  total,
+	})
+	return nil
+}
+
+// List lets admins search every audit event
+func (h *AuditHandlers) List(w http.ResponseWriter, r *http.Request) error {
+	return h.writeAuditEvents(w, r, auditFilter(r))
+}
+
+// ListMine lists the events the caller performed or was the target of
+func (h *AuditHandlers) ListMine(w http.ResponseWriter, r *http.Request) error {
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		return middleware.ErrMissingClaims
+	}
+
+	// Only the action filter applies; the user is fixed to the caller
+	filter := store.AuditFilter{Action: r.URL.Query().Get("action"), UserID: claims.UserID}
+	return h.writeAuditEvents(w, r, filter)
+}
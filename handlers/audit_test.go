@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"profolio-vercel/models"
+)
+
+func TestAuditListings(t *testing.T) {
+	m := testStores(t)
+	f := newFixture(t, m)
+	alice, bob := f.alice.ID.Hex(), f.bob.ID.Hex()
+	start := time.Now()
+	for i, event := range []models.AuditEvent{
+		{Action: models.AuditSignIn, ActorID: alice, TargetID: alice},
+		{Action: models.AuditSignIn, ActorID: bob, TargetID: bob},
+		{Action: models.AuditUserUpdated, ActorID: bob, TargetID: alice},
+		{Action: models.AuditTokenRevoked, ActorID: alice, TargetID: alice},
+	} {
+		event.CreatedAt = start.Add(time.Duration(i) * time.Second)
+		if err := m.RecordAudit(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := &AuditHandlers{Stores: MemoryStores(m)}
+
+	tests := []struct {
+		name    string
+		handler func(http.ResponseWriter, *http.Request) error
+		target  string
+		want    []string // Actions, newest first
+		total   int64
+	}{
+		{"mine", h.ListMine, "/api/audit", []string{models.AuditTokenRevoked, models.AuditUserUpdated, models.AuditSignIn}, 3},
+		{"mine by action", h.ListMine, "/api/audit?action=" + models.AuditSignIn, []string{models.AuditSignIn}, 1},
+		{"mine ignores other users", h.ListMine, "/api/audit?actorId=" + bob, []string{models.AuditTokenRevoked, models.AuditUserUpdated, models.AuditSignIn}, 3},
+		{"all by actor", h.List, "/api/admin/audit?actorId=" + bob, []string{models.AuditUserUpdated, models.AuditSignIn}, 2},
+		{"all by target, paged", h.List, "/api/admin/audit?targetId=" + alice + "&limit=2&page=2", []string{models.AuditSignIn}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := call{method: "GET", target: tt.target, claims: claimsFor(f.alice, models.RoleAdmin)}.serve(tt.handler)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+
+			var page struct {
+				Events []models.AuditEvent `json:"events"`
+				Total  int64               `json:"total"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, event := range page.Events {
+				got = append(got, event.Action)
+			}
+			if len(got) != len(tt.want) || page.Total != tt.total {
+				t.Fatalf("events = %v of %d, want %v of %d", got, page.Total, tt.want, tt.total)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("events = %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
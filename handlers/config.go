@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"profolio-vercel/config"
+	"profolio-vercel/metrics"
+	"profolio-vercel/problem"
+	"profolio-vercel/tracing"
+
+	"github.com/google/generative-ai-go/genai"
+	openai "github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/option"
+)
+
+var (
+	// appConfig is what the handlers read their settings from until Configure is called
+	appConfig = config.Defaults()
+
+	// trustedProxies are the parsed Server.TrustedProxies of appConfig
+	trustedProxies []*net.IPNet
+)
+
+// Configure sets the configuration the handlers read. It must be called before
+// the first request, as the mailer and login providers are built from it once.
+// cfg must have passed Validate.
+func Configure(cfg *config.Config) {
+	appConfig = cfg
+	trustedProxies, _ = cfg.Server.ParseTrustedProxies()
+}
+
+// openAIClient fails with 503 when no OpenAI key is configured
+func openAIClient() (*openai.Client, error) {
+	if appConfig.AI.OpenAIAPIKey == "" {
+		return nil, problem.Unavailable("ai_not_configured", "OpenAI is not configured")
+	}
+	openaiConfig := openai.DefaultConfig(appConfig.AI.OpenAIAPIKey)
+	openaiConfig.HTTPClient = &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
+	return openai.NewClientWithConfig(openaiConfig), nil
+}
+
+// geminiClient returns a Gemini client whose requests carry the trace context
+func geminiClient(ctx context.Context) (*genai.Client, error) {
+	return genai.NewClient(ctx,
+		option.WithAPIKey(appConfig.AI.GeminiAPIKey),
+		option.WithHTTPClient(&http.Client{Transport: geminiTransport(appConfig.AI.GeminiAPIKey)}),
+	)
+}
+
+// geminiTransport traces each request and sets the API key on it, which the
+// Gemini client leaves out once it is given its own HTTP client
+func geminiTransport(apiKey string) http.RoundTripper {
+	return otelhttp.NewTransport(apiKeyTransport{key: apiKey, next: http.DefaultTransport})
+}
+
+type apiKeyTransport struct {
+	key  string
+	next http.RoundTripper
+}
+
+func (t apiKeyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("x-goog-api-key", t.key)
+	return t.next.RoundTrip(r)
+}
+
+// chatCompletion calls OpenAI and records the call and its token usage under operation
+func chatCompletion(ctx context.Context, client *openai.Client, operation string, req openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	ctx, span := startAISpan(ctx, config.ProviderOpenAI, operation, req.Model)
+	start := time.Now()
+	resp, err := client.CreateChatCompletion(ctx, req)
+	metrics.ObserveAICall(config.ProviderOpenAI, operation, start, err, resp.Usage.PromptTokens, resp.Usage.CompletionTokens)
+	endAISpan(span, err, resp.Usage.PromptTokens, resp.Usage.CompletionTokens)
+	return resp, err
+}
+
+// startAISpan opens a client span around a call to an AI provider
+func startAISpan(ctx context.Context, provider, operation, model string) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(ctx, provider+"."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("gen_ai.system", provider),
+			attribute.String("gen_ai.operation.name", operation),
+			attribute.String("gen_ai.request.model", model),
+		),
+	)
+}
+
+// endAISpan records the outcome and token usage of an AI call
+func endAISpan(span trace.Span, err error, promptTokens, completionTokens int) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.SetAttributes(
+		attribute.Int("gen_ai.usage.input_tokens", promptTokens),
+		attribute.Int("gen_ai.usage.output_tokens", completionTokens),
+	)
+	span.End()
+}
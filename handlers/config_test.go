@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"profolio-vercel/tracing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestGeminiTransportPropagatesTrace(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	var header http.Header
+	gemini := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+	}))
+	defer gemini.Close()
+
+	ctx, parent := tracing.Tracer().Start(context.Background(), "gemini.cover_letter")
+	req, _ := http.NewRequestWithContext(ctx, "POST", gemini.URL, nil)
+	resp, err := (&http.Client{Transport: geminiTransport("gemini-key")}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	parent.End()
+
+	if got := header.Get("x-goog-api-key"); got != "gemini-key" {
+		t.Errorf("x-goog-api-key = %q", got)
+	}
+	spans := exporter.GetSpans()
+	if len(spans) != 2 || spans[0].SpanKind != trace.SpanKindClient {
+		t.Fatalf("spans = %+v, want an HTTP client span and its parent", spans)
+	}
+	want := "00-" + parent.SpanContext().TraceID().String() + "-" + spans[0].SpanContext.SpanID().String() + "-01"
+	if got := header.Get("traceparent"); got != want {
+		t.Errorf("traceparent = %q, want %q", got, want)
+	}
+}
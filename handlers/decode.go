@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"profolio-vercel/problem"
+)
+
+// decodeStrict decodes the request body into v, rejecting fields v does not
+// have and values of the wrong type with the field at fault
+func decodeStrict(r *http.Request, v interface{}) error {
+	return strictDecode(json.NewDecoder(r.Body), v)
+}
+
+// unmarshalStrict is decodeStrict for a body that has already been read
+func unmarshalStrict(data []byte, v interface{}) error {
+	return strictDecode(json.NewDecoder(bytes.NewReader(data)), v)
+}
+
+func strictDecode(decoder *json.Decoder, v interface{}) error {
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if err == nil {
+		return nil
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return problem.Invalid("invalid_body", "Invalid request body",
+			problem.Field(typeErr.Field, "invalid_type", typeErr.Field+" must be "+jsonType(typeErr.Type.Kind().String())))
+	}
+	// encoding/json has no typed error for unknown fields
+	if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		name = strings.Trim(name, `"`)
+		return problem.Invalid("invalid_body", "Invalid request body",
+			problem.Field(name, "not_writable", name+" cannot be set here"))
+	}
+	return errInvalidBody
+}
+
+// jsonType names a Go kind the way a JSON client would
+func jsonType(kind string) string {
+	switch kind {
+	case "string":
+		return "a string"
+	case "bool":
+		return "a boolean"
+	case "slice", "array":
+		return "an array"
+	case "struct", "map", "ptr":
+		return "an object"
+	default:
+		return "a number"
+	}
+}
@@ -0,0 +1,14 @@
+package handlers
+
+import "profolio-vercel/problem"
+
+// Failures shared by many handlers
+var (
+	errInvalidBody   = problem.Invalid("invalid_body", "Invalid request body")
+	errInvalidUserID = problem.Invalid("invalid_user_id", "Invalid user ID")
+	errUserNotFound  = problem.NotFound("user_not_found", "User not found")
+
+	errInvalidResumeID    = problem.Invalid("invalid_resume_id", "Invalid resume ID")
+	errResumeNotFound     = problem.NotFound("resume_not_found", "Resume not found")
+	errPreconditionFailed = problem.PreconditionFailed("precondition_failed", "The resource has changed since it was read")
+)
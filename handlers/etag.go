@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"profolio-vercel/store"
+)
+
+// etag formats the version of a users document or resume as a strong entity tag
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// entityTags splits an If-Match or If-None-Match header into its tags
+func entityTags(header string) []string {
+	var tags []string
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// ifMatch checks the If-Match header of a write against the current version
+// of its document. It returns the version the write must still find, which is
+// store.AnyVersion when the request has no If-Match or matches any version.
+// Weak tags never match, as If-Match uses the strong comparison.
+func ifMatch(r *http.Request, current int64) (int64, error) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return store.AnyVersion, nil
+	}
+	for _, tag := range entityTags(header) {
+		if tag == "*" {
+			return store.AnyVersion, nil
+		}
+		if tag == etag(current) {
+			return current, nil
+		}
+	}
+	return 0, errPreconditionFailed
+}
+
+// notModified reports whether the If-None-Match header of a read matches the
+// current version. It uses the weak comparison, so W/ tags match too.
+func notModified(r *http.Request, current int64) bool {
+	for _, tag := range entityTags(r.Header.Get("If-None-Match")) {
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag(current) {
+			return true
+		}
+	}
+	return false
+}
+
+// versionError explains a store.ErrVersionMismatch from a write. With If-Match
+// the precondition failed; without it the document changed between being read
+// and written, which problem.From reports as a conflict.
+func versionError(r *http.Request, err error) error {
+	if err == store.ErrVersionMismatch && r.Header.Get("If-Match") != "" {
+		return errPreconditionFailed
+	}
+	return err
+}
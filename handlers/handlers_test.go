@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"profolio-vercel/config"
+	"profolio-vercel/lockout"
+	"profolio-vercel/mailer"
+	"profolio-vercel/middleware"
+	"profolio-vercel/models"
+	"profolio-vercel/problem"
+	"profolio-vercel/store"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// mailbox keeps the mail the handlers send instead of delivering it
+type mailbox struct {
+	mu   sync.Mutex
+	sent []mailer.Message
+}
+
+func (b *mailbox) Send(ctx context.Context, msg mailer.Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sent = append(b.sent, msg)
+	return nil
+}
+
+// testStores configures the handlers for a test against empty in-memory stores
+func testStores(t *testing.T, skills ...models.SkillCollection) *store.Memory {
+	t.Helper()
+	cfg := config.Defaults()
+	cfg.Env = config.EnvTest
+	cfg.JWT.Secret = "test-secret"
+	Configure(cfg)
+	if err := middleware.Configure(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	m := store.NewMemory(skills...)
+	middleware.SetStores(middleware.Stores{Users: m, Auth: m, APIKeys: m, Revocations: m})
+	SetAttemptStore(lockout.NewMemoryStore())
+	SetMailer(&mailbox{})
+	return m
+}
+
+// fixture is the data every handler test starts from: alice, who has one
+// resume, and bob, who has none
+type fixture struct {
+	alice, bob models.User
+	resumeID   primitive.ObjectID
+}
+
+func newFixture(t *testing.T, m *store.Memory) fixture {
+	t.Helper()
+	ctx := context.Background()
+	var f fixture
+	var err error
+
+	f.resumeID = primitive.NewObjectID()
+	f.alice, err = m.InsertUser(ctx, models.User{
+		Basics:  models.Basics{Name: "Alice", Username: "alice", Email: "alice@example.com"},
+		Resumes: []models.Resume{{ID: f.resumeID, Name: "Engineering"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.bob, err = m.InsertUser(ctx, models.User{Basics: models.Basics{Username: "bob", Email: "bob@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// claimsFor returns the claims of a signed in user with the role
+func claimsFor(user models.User, role string) *middleware.Claims {
+	return &middleware.Claims{UserID: user.ID.Hex(), Email: user.Basics.Email, Role: role}
+}
+
+// call is one request to a handler
+type call struct {
+	method string
+	target string
+	body   string
+	header map[string]string
+	vars   map[string]string
+	claims *middleware.Claims
+}
+
+// serve runs the handler for the call like the router would, past the
+// authentication middleware, and records the response
+func (c call) serve(handler func(http.ResponseWriter, *http.Request) error) *httptest.ResponseRecorder {
+	target := c.target
+	if target == "" {
+		target = "/"
+	}
+	r := httptest.NewRequest(c.method, target, strings.NewReader(c.body))
+	if c.body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	for name, value := range c.header {
+		r.Header.Set(name, value)
+	}
+	if c.vars != nil {
+		r = mux.SetURLVars(r, c.vars)
+	}
+	if c.claims != nil {
+		r = r.WithContext(middleware.WithClaims(r.Context(), c.claims))
+	}
+	w := httptest.NewRecorder()
+	problem.HandlerFunc(handler).ServeHTTP(w, r)
+	return w
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"profolio-vercel/config"
+	"profolio-vercel/logging"
+	"profolio-vercel/shared"
+)
+
+// draining is set once shutdown starts, so the load balancer stops sending
+// new requests while the in-flight ones finish
+var draining atomic.Bool
+
+// StartDraining makes /readyz fail from now on
+func StartDraining() {
+	draining.Store(true)
+}
+
+// HealthzHandler reports that the process is up. It never checks dependencies,
+// so a database outage does not get every instance restarted.
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// ReadyzHandler reports whether this instance should receive traffic: it is
+// not shutting down, Mongo answers and the cover letter provider has a key
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{}
+	ready := true
+	fail := func(name, reason string) {
+		checks[name] = reason
+		ready = false
+	}
+
+	if draining.Load() {
+		fail("server", "shutting down")
+	} else {
+		checks["server"] = "ok"
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	if err := shared.Ping(ctx); err != nil {
+		// The error can name hosts and users, so it only goes to the log
+		logging.FromContext(r.Context()).Warn("readiness check failed", "check", "mongo", "error", err)
+		fail("mongo", "unreachable")
+	} else {
+		checks["mongo"] = "ok"
+	}
+
+	key := appConfig.AI.GeminiAPIKey
+	if appConfig.AI.CoverLetterProvider == config.ProviderOpenAI {
+		key = appConfig.AI.OpenAIAPIKey
+	}
+	if key == "" {
+		fail("ai", "no API key for "+appConfig.AI.CoverLetterProvider)
+	} else {
+		checks["ai"] = "ok"
+	}
+
+	status := "ok"
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		status = "unavailable"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": status, "checks": checks})
+}
@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadyzHidesErrors(t *testing.T) {
+	testStores(t)
+
+	// No database is connected in tests, so the mongo check fails
+	w := httptest.NewRecorder()
+	ReadyzHandler(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	var body struct {
+		Checks map[string]string `json:"checks"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if got := body.Checks["mongo"]; got != "unreachable" {
+		t.Errorf("mongo check = %q, want a fixed message", got)
+	}
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"profolio-vercel/store"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var indexesOnce sync.Once
+
+// uniqueNonEmpty is a unique index on field that ignores documents where the
+// field is missing or empty, as it is on profiles added without a username
+func uniqueNonEmpty(field, name string) mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys: bson.D{{Key: field, Value: 1}},
+		Options: options.Index().
+			SetName(name).
+			SetUnique(true).
+			SetPartialFilterExpression(bson.M{field: bson.M{"$gt": ""}}),
+	}
+}
+
+// collectionIndexes lists the indexes every collection the API owns depends on
+var collectionIndexes = map[string][]mongo.IndexModel{
+	"oauth_states": {
+		{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	},
+	"refresh_tokens": {
+		{Keys: bson.D{{Key: "tokenHash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "family", Value: 1}}},
+		{Keys: bson.D{{Key: "userId", Value: 1}}},
+		{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	},
+	"action_tokens": {
+		{Keys: bson.D{{Key: "tokenHash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "userId", Value: 1}, {Key: "purpose", Value: 1}}},
+		{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	},
+	"api_keys": {
+		{Keys: bson.D{{Key: "keyHash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "userId", Value: 1}}},
+	},
+	"audit_events": {
+		{Keys: bson.D{{Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "targetId", Value: 1}, {Key: "createdAt", Value: -1}}},
+		{Keys: bson.D{{Key: "actorId", Value: 1}, {Key: "createdAt", Value: -1}}},
+	},
+	"auth_users": {
+		uniqueNonEmpty("email", store.EmailIndex),
+		uniqueNonEmpty("username", store.UsernameIndex),
+		{Keys: bson.D{{Key: "identities.key", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+	},
+	"login_attempts": {
+		{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	},
+	"revoked_tokens": {
+		{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	},
+	"users": {
+		uniqueNonEmpty("basics.email", store.EmailIndex),
+		uniqueNonEmpty("basics.username", store.UsernameIndex),
+	},
+}
+
+// EnsureIndexes creates the indexes in collectionIndexes. It only runs once per process.
+func EnsureIndexes() {
+	if client == nil {
+		return
+	}
+
+	indexesOnce.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		db := client.Database("profileFolio")
+		for name, indexes := range collectionIndexes {
+			if _, err := db.Collection(name).Indexes().CreateMany(ctx, indexes); err != nil {
+				slog.Error("creating indexes", "collection", name, "error", err)
+			}
+		}
+	})
+}
@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"profolio-vercel/models"
+	"profolio-vercel/store"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoTestURI names the deployment the Mongo tests run against; without it
+// they are skipped. It has to be a replica set, as accounts are created in
+// transactions. A throwaway one is enough:
+//
+//	docker run -d --name mongo-test -p 27017:27017 mongo:7 --replSet rs0
+//	docker exec mongo-test mongosh --quiet --eval 'rs.initiate()'
+//	MONGODB_TEST_URI='mongodb://localhost:27017/?directConnection=true' go test ./handlers -run Mongo
+//
+// The tests write to its profileFolio database and remove what they inserted.
+const mongoTestURI = "MONGODB_TEST_URI"
+
+// mongoTest configures the handlers for a test against the MONGODB_TEST_URI
+// deployment, with the indexes the API creates. The returned tag is part of
+// every email and username the test uses, keeping them apart from other runs.
+func mongoTest(t *testing.T) (*store.Mongo, string) {
+	t.Helper()
+	uri := os.Getenv(mongoTestURI)
+	if uri == "" {
+		t.Skip(mongoTestURI + " is not set")
+	}
+
+	testStores(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	connected, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := connected.Ping(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	client = connected
+	indexesOnce = sync.Once{}
+	EnsureIndexes()
+
+	tag := primitive.NewObjectID().Hex()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		db := connected.Database("profileFolio")
+		var userIDs []interface{}
+		if cursor, err := db.Collection("users").Find(ctx, bson.M{"basics.email": bson.M{"$regex": tag}}); err == nil {
+			var users []models.User
+			cursor.All(ctx, &users)
+			for _, user := range users {
+				userIDs = append(userIDs, user.ID)
+			}
+		}
+		db.Collection("auth_users").DeleteMany(ctx, bson.M{"email": bson.M{"$regex": tag}})
+		db.Collection("users").DeleteMany(ctx, bson.M{"basics.email": bson.M{"$regex": tag}})
+		if len(userIDs) > 0 {
+			db.Collection("refresh_tokens").DeleteMany(ctx, bson.M{"userId": bson.M{"$in": userIDs}})
+			db.Collection("action_tokens").DeleteMany(ctx, bson.M{"userId": bson.M{"$in": userIDs}})
+		}
+		db.Collection("audit_events").DeleteMany(ctx, bson.M{"details.email": bson.M{"$regex": tag}})
+		client = nil
+		connected.Disconnect(ctx)
+	})
+	return store.NewMongo(connected), tag
+}
+
+func TestMongoDuplicatesAreConflicts(t *testing.T) {
+	m, tag := mongoTest(t)
+	auth, users := &AuthHandlers{Stores: MongoStores(m)}, &UserHandlers{Stores: MongoStores(m)}
+	signUp := func(username, email string) *httptest.ResponseRecorder {
+		body := `{"username":"` + username + `","email":"` + email + `","password":"correct horse"}`
+		return call{method: "POST", body: body}.serve(auth.SignUp)
+	}
+
+	email := "carol-" + tag + "@example.com"
+	if w := signUp("c"+tag, email); w.Code != http.StatusCreated {
+		t.Fatalf("sign up status = %d: %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		name string
+		call func() *httptest.ResponseRecorder
+		code string
+	}{
+		{"sign up with a taken email", func() *httptest.ResponseRecorder { return signUp("d"+tag, strings.ToUpper(email)) }, "email_taken"},
+		{"sign up with a taken username", func() *httptest.ResponseRecorder { return signUp("c"+tag, "dave-"+tag+"@example.com") }, "username_taken"},
+		{"profile with a taken email", func() *httptest.ResponseRecorder {
+			owner := models.User{ID: primitive.NewObjectID(), Basics: models.Basics{Email: email}}
+			return call{method: "POST", body: `{"basics":{"email":"` + email + `"}}`, claims: claimsFor(owner, models.RoleUser)}.serve(users.AddUser)
+		}, "email_taken"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := tt.call()
+			if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), tt.code) {
+				t.Errorf("status = %d, want %d %s: %s", w.Code, http.StatusConflict, tt.code, w.Body)
+			}
+		})
+	}
+}
+
+func TestMongoUniqueIndexesSkipEmptyValues(t *testing.T) {
+	m, tag := mongoTest(t)
+	ctx := context.Background()
+
+	// Profiles added without an account have no username, and many may exist
+	for _, name := range []string{"erin", "frank"} {
+		if _, err := m.InsertUser(ctx, models.User{Basics: models.Basics{Email: name + "-" + tag + "@example.com"}}); err != nil {
+			t.Fatalf("profile without a username: %v", err)
+		}
+	}
+
+	username := "g" + tag
+	if _, err := m.InsertUser(ctx, models.User{Basics: models.Basics{Username: username, Email: "grace-" + tag + "@example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := m.InsertUser(ctx, models.User{Basics: models.Basics{Username: username, Email: "heidi-" + tag + "@example.com"}})
+	if !errors.Is(err, store.ErrUsernameTaken) {
+		t.Errorf("taken username: %v, want %v", err, store.ErrUsernameTaken)
+	}
+	_, err = m.InsertUser(ctx, models.User{Basics: models.Basics{Email: "grace-" + tag + "@example.com"}})
+	if !errors.Is(err, store.ErrEmailTaken) {
+		t.Errorf("taken email: %v, want %v", err, store.ErrEmailTaken)
+	}
+}
+
+func TestMongoCreateAccountIsATransaction(t *testing.T) {
+	m, tag := mongoTest(t)
+	ctx := context.Background()
+
+	// A profile already holds the email in users but not in auth_users, so
+	// only the second insert fails; the first must not stay behind
+	email := "ivan-" + tag + "@example.com"
+	if _, err := m.InsertUser(ctx, models.User{Basics: models.Basics{Email: email}}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := m.CreateAccount(ctx,
+		models.AuthUser{Username: "i" + tag, Email: email, Password: "unknown", Role: models.RoleUser},
+		models.User{Basics: models.Basics{Username: "i" + tag, Email: email}})
+	if !errors.Is(err, store.ErrEmailTaken) {
+		t.Fatalf("CreateAccount: %v, want %v", err, store.ErrEmailTaken)
+	}
+	if _, err := m.FindAuthUser(ctx, email); err != store.ErrNotFound {
+		t.Errorf("the credentials were kept: %v", err)
+	}
+
+	// A complete account has both documents
+	email = "judy-" + tag + "@example.com"
+	user, err := m.CreateAccount(ctx,
+		models.AuthUser{Username: "j" + tag, Email: email, Password: "unknown", Role: models.RoleUser},
+		models.User{Basics: models.Basics{Username: "j" + tag, Email: email}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.FindAuthUser(ctx, email); err != nil {
+		t.Errorf("credentials: %v", err)
+	}
+	if found, err := m.FindUser(ctx, store.ByID(user.ID)); err != nil || found.Basics.Email != email {
+		t.Errorf("profile = %+v, %v", found.Basics, err)
+	}
+}
+
+func TestMongoConcurrentDemotionsKeepAnAdmin(t *testing.T) {
+	m, tag := mongoTest(t)
+	ctx := context.Background()
+	filter := bson.M{"role": models.RoleAdmin, "disabled": bson.M{"$ne": true}}
+	if n, err := client.Database("profileFolio").Collection("auth_users").CountDocuments(ctx, filter); err != nil || n > 0 {
+		t.Skipf("the database has %d admins of its own, %v", n, err)
+	}
+
+	emails := []string{"kim-" + tag + "@example.com", "lee-" + tag + "@example.com"}
+	for i, email := range emails {
+		username := string(rune('k'+i)) + tag
+		if _, err := m.CreateAccount(ctx,
+			models.AuthUser{Username: username, Email: email, Password: "unknown", Role: models.RoleAdmin},
+			models.User{Basics: models.Basics{Username: username, Email: email}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each admin demotes the other at once; one of them has to stay
+	errs := make([]error, len(emails))
+	var wg sync.WaitGroup
+	for i, email := range emails {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = m.ChangeRole(ctx, email, models.RoleUser)
+		}()
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, err := range errs {
+		if errors.Is(err, store.ErrLastAdmin) {
+			failed++
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := client.Database("profileFolio").Collection("auth_users").CountDocuments(ctx, filter); failed != 1 || n != 1 || err != nil {
+		t.Errorf("%d demotions refused, %d admins left, %v", failed, n, err)
+	}
+}
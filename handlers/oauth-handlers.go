@@ -0,0 +1,396 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"profolio-vercel/config"
+	"profolio-vercel/logging"
+	"profolio-vercel/middleware"
+	"profolio-vercel/models"
+	"profolio-vercel/oauth"
+	"profolio-vercel/problem"
+	"profolio-vercel/store"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/oauth2"
+)
+
+// oauthStateTTL is how long the user has to finish signing in at the provider
+const oauthStateTTL = 10 * time.Minute
+
+// oauthBrowserCookie ties a pending login to the browser that started it, so
+// a callback URL or link URL handed to someone else cannot be completed by them
+const oauthBrowserCookie = "oauth_browser"
+
+var (
+	oauthProviders     *oauth.Registry
+	oauthProvidersErr  error
+	oauthProvidersOnce sync.Once
+
+	errOAuthStateInvalid = problem.Invalid("oauth_state_invalid", "Invalid or expired login state")
+	errIdentityTaken     = problem.Conflict("identity_taken", "This account is already linked to another user")
+	errEmailNotOwned     = problem.Conflict("email_not_owned", "An account with this email exists; sign in with your password and link the provider from your account")
+	usernameDisallowed   = regexp.MustCompile(`[^a-z0-9_-]+`)
+)
+
+// OAuthHandlers serve social login and linking
+type OAuthHandlers struct {
+	Stores
+}
+
+// SetOAuthProviders replaces the providers built from the configuration
+func SetOAuthProviders(registry *oauth.Registry) {
+	oauthProvidersOnce.Do(func() {})
+	oauthProviders, oauthProvidersErr = registry, nil
+}
+
+func getOAuthProvider(name string) (oauth.Provider, error) {
+	oauthProvidersOnce.Do(func() {
+		oauthProviders, oauthProvidersErr = oauth.FromConfig(appConfig.OAuth)
+	})
+	if oauthProvidersErr != nil {
+		return nil, oauthProvidersErr
+	}
+	provider, ok := oauthProviders.Get(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %q", name)
+	}
+	return provider, nil
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// startOAuthFlow stores a pending login, sets the cookie that binds it to the
+// browser and returns the provider URL to send the browser to
+func (s Stores) startOAuthFlow(ctx context.Context, w http.ResponseWriter, provider oauth.Provider, linkUserID *primitive.ObjectID) (string, error) {
+	state, err := randomString()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomString()
+	if err != nil {
+		return "", err
+	}
+	browser, err := randomString()
+	if err != nil {
+		return "", err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	authURL, err := provider.AuthCodeURL(ctx, state, nonce, verifier)
+	if err != nil {
+		return "", err
+	}
+
+	err = s.Tokens.InsertOAuthState(ctx, models.OAuthState{
+		ID:          hashToken(state),
+		Provider:    provider.Name(),
+		BrowserHash: hashToken(browser),
+		Nonce:       nonce,
+		Verifier:    verifier,
+		LinkUserID:  linkUserID,
+		ExpiresAt:   time.Now().Add(oauthStateTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	setOAuthBrowserCookie(w, browser, oauthStateTTL)
+	return authURL, nil
+}
+
+// setOAuthBrowserCookie sets the browser cookie, or clears it when maxAge is 0.
+// Lax lets the browser send it on the provider's top-level redirect back.
+func setOAuthBrowserCookie(w http.ResponseWriter, value string, maxAge time.Duration) {
+	cookie := &http.Cookie{
+		Name:     oauthBrowserCookie,
+		Value:    value,
+		Path:     "/api/oauth",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   appConfig.Env == config.EnvProduction,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if maxAge == 0 {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
+
+func (h *OAuthHandlers) Login(w http.ResponseWriter, r *http.Request) error {
+	provider, err := getOAuthProvider(mux.Vars(r)["provider"])
+	if err != nil {
+		return problem.NotFound("unknown_provider", "Unknown login provider")
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
+	defer cancel()
+
+	authURL, err := h.startOAuthFlow(ctx, w, provider, nil)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("starting login", "provider", provider.Name(), "error", err)
+		return problem.BadGateway("provider_failed", "Error starting login", err)
+	}
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+	return nil
+}
+
+// Link starts linking a provider to the signed-in user. Browsers
+// don't send the bearer token on a redirect, so the URL is returned as JSON.
+// The frontend has to make the request with credentials so the browser keeps
+// the cookie the callback checks.
+func (h *OAuthHandlers) Link(w http.ResponseWriter, r *http.Request) error {
+	provider, err := getOAuthProvider(mux.Vars(r)["provider"])
+	if err != nil {
+		return problem.NotFound("unknown_provider", "Unknown login provider")
+	}
+
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		return middleware.ErrMissingClaims
+	}
+	userID, err := claims.ObjectID()
+	if err != nil {
+		return errInvalidUserID
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
+	defer cancel()
+
+	authURL, err := h.startOAuthFlow(ctx, w, provider, &userID)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("starting link", "provider", provider.Name(), "error", err)
+		return problem.BadGateway("provider_failed", "Error starting login", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"url": authURL})
+	return nil
+}
+
+func (h *OAuthHandlers) Callback(w http.ResponseWriter, r *http.Request) error {
+	provider, err := getOAuthProvider(mux.Vars(r)["provider"])
+	if err != nil {
+		return problem.NotFound("unknown_provider", "Unknown login provider")
+	}
+
+	query := r.URL.Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		return problem.Unauthorized("oauth_denied", "Login was not completed: "+providerErr)
+	}
+	code, stateParam := query.Get("code"), query.Get("state")
+	if code == "" || stateParam == "" {
+		return problem.Invalid("oauth_params_missing", "Missing code or state")
+	}
+
+	browser, err := r.Cookie(oauthBrowserCookie)
+	if err != nil {
+		return errOAuthStateInvalid
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
+	defer cancel()
+
+	// Each state can only be used once, and only by the browser that started it
+	state, err := h.Tokens.ConsumeOAuthState(ctx, hashToken(stateParam), provider.Name(), hashToken(browser.Value), time.Now())
+	if errors.Is(err, store.ErrNotFound) {
+		return errOAuthStateInvalid
+	} else if err != nil {
+		return problem.Internal("Error reading login state", err)
+	}
+	setOAuthBrowserCookie(w, "", 0)
+
+	identity, err := provider.Exchange(ctx, code, state.Nonce, state.Verifier)
+	if err != nil {
+		logging.FromContext(r.Context()).Warn("completing login", "provider", provider.Name(), "error", err)
+		return problem.Unauthorized("oauth_failed", "Error completing login")
+	}
+
+	user, authUser, err := h.resolveOAuthIdentity(ctx, identity, state.LinkUserID)
+	if errors.Is(err, errIdentityTaken) || errors.Is(err, errEmailNotOwned) {
+		return err
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("linking identity", "provider", provider.Name(), "error", err)
+		return problem.Internal("Error signing in", err)
+	}
+
+	if authUser.Disabled {
+		return tokenError(errAccountDisabled)
+	}
+
+	if authUser.TOTPEnabled {
+		return writeMFAChallenge(w, user.ID)
+	}
+
+	// The frontend can take over the tokens from the URL fragment, which never reaches a server
+	if successURL := appConfig.OAuth.SuccessURL; successURL != "" {
+		tokens, err := h.issueTokens(ctx, user.ID, authUser, "")
+		if err != nil {
+			return tokenError(err)
+		}
+		h.recordSignIn(ctx, r, user.ID, provider.Name())
+		fragment := url.Values{"accessToken": {tokens.AccessToken}, "refreshToken": {tokens.RefreshToken}}
+		http.Redirect(w, r, successURL+"#"+fragment.Encode(), http.StatusFound)
+		return nil
+	}
+
+	return h.writeSignInResponse(ctx, w, r, user, authUser, provider.Name())
+}
+
+// resolveOAuthIdentity finds or creates the user an external identity signs in as:
+//
+//  1. An identity that is already linked signs in its user.
+//  2. In a link flow the identity is attached to the signed-in user.
+//  3. A provider-verified email that matches an account whose email is also
+//     verified links to that account. When the local email is unverified the
+//     login is refused, so nobody can pre-register a victim's address.
+//  4. Otherwise a new account is created.
+func (s Stores) resolveOAuthIdentity(ctx context.Context, identity oauth.Identity, linkUserID *primitive.ObjectID) (models.User, models.AuthUser, error) {
+	identity.Email = normalizeEmail(identity.Email)
+	linked := models.ExternalIdentity{
+		Key:      identity.Provider + ":" + identity.Subject,
+		Provider: identity.Provider,
+		Subject:  identity.Subject,
+		Email:    identity.Email,
+		LinkedAt: time.Now(),
+	}
+
+	var user models.User
+	authUser, err := s.Identities.FindAuthUserByIdentity(ctx, linked.Key)
+	if err == nil {
+		if linkUserID != nil {
+			user, _, err := s.findAuthUserByUserID(ctx, *linkUserID)
+			if err != nil || user.Basics.Email != authUser.Email {
+				return user, authUser, errIdentityTaken
+			}
+		}
+		user, err = s.Users.FindUser(ctx, store.ByEmail(authUser.Email))
+		return user, authUser, err
+	} else if err != store.ErrNotFound {
+		return user, authUser, err
+	}
+
+	link := func(email string) (models.User, models.AuthUser, error) {
+		err := s.Identities.LinkIdentity(ctx, email, linked)
+		if errors.Is(err, store.ErrIdentityTaken) {
+			return user, authUser, errIdentityTaken
+		} else if err != nil {
+			return user, authUser, err
+		}
+		if authUser, err = s.Auth.FindAuthUser(ctx, email); err != nil {
+			return user, authUser, err
+		}
+		user, err = s.Users.FindUser(ctx, store.ByEmail(email))
+		return user, authUser, err
+	}
+
+	if linkUserID != nil {
+		user, _, err := s.findAuthUserByUserID(ctx, *linkUserID)
+		if err != nil {
+			return user, authUser, err
+		}
+		return link(user.Basics.Email)
+	}
+
+	if identity.Email != "" {
+		authUser, err = s.Auth.FindAuthUser(ctx, identity.Email)
+		if err == nil {
+			if !identity.EmailVerified || !authUser.EmailVerified {
+				return user, authUser, errEmailNotOwned
+			}
+			return link(authUser.Email)
+		} else if err != store.ErrNotFound {
+			return user, authUser, err
+		}
+	}
+
+	return s.createOAuthUser(ctx, identity, linked)
+}
+
+// createOAuthUser creates the auth_users and users documents for a first social login
+func (s Stores) createOAuthUser(ctx context.Context, identity oauth.Identity, linked models.ExternalIdentity) (models.User, models.AuthUser, error) {
+	if identity.Email == "" {
+		return models.User{}, models.AuthUser{}, errors.New("provider did not share an email address")
+	}
+
+	// A concurrent signup can take the username between the check and the insert
+	for attempt := 0; ; attempt++ {
+		username, err := s.availableUsername(ctx, identity)
+		if err != nil {
+			return models.User{}, models.AuthUser{}, err
+		}
+
+		// No password is set, so the account can only sign in through the provider until it is reset
+		authUser := models.AuthUser{
+			Username:      username,
+			Email:         identity.Email,
+			Role:          models.RoleUser,
+			EmailVerified: identity.EmailVerified,
+			Identities:    []models.ExternalIdentity{linked},
+		}
+		user := models.User{
+			Basics: models.Basics{
+				Name:     identity.Name,
+				Username: username,
+				Email:    identity.Email,
+			},
+		}
+
+		user, err = s.Auth.CreateAccount(ctx, authUser, user)
+		if errors.Is(err, store.ErrUsernameTaken) && attempt < 2 {
+			continue
+		} else if err != nil {
+			return models.User{}, models.AuthUser{}, err
+		}
+		return user, authUser, nil
+	}
+}
+
+// availableUsername derives a username from the provider handle or email and
+// adds a random suffix until it is not taken
+func (s Stores) availableUsername(ctx context.Context, identity oauth.Identity) (string, error) {
+	base := identity.Login
+	if base == "" {
+		base, _, _ = strings.Cut(identity.Email, "@")
+	}
+	base = usernameDisallowed.ReplaceAllString(strings.ToLower(base), "")
+	if base == "" {
+		base = "user"
+	}
+
+	candidate := base
+	for i := 0; i < 5; i++ {
+		taken, err := s.Identities.UsernameTaken(ctx, candidate)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return candidate, nil
+		}
+		suffix, err := randomString()
+		if err != nil {
+			return "", err
+		}
+		candidate = base + "-" + suffix[:6]
+	}
+	return "", errors.New("could not find an available username")
+}
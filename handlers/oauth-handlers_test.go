@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"profolio-vercel/models"
+	"profolio-vercel/oauth"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// stubProvider sends the browser to a fake provider and fails every exchange,
+// so a callback that gets past the state check answers oauth_failed
+type stubProvider struct{}
+
+func (stubProvider) Name() string { return "stub" }
+
+func (stubProvider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	return "https://provider.test/authorize?" + url.Values{"state": {state}}.Encode(), nil
+}
+
+func (stubProvider) Exchange(ctx context.Context, code, nonce, verifier string) (oauth.Identity, error) {
+	return oauth.Identity{}, errors.New("exchange refused")
+}
+
+// startStubLogin starts a login and returns the state sent to the provider and the browser cookie
+func startStubLogin(t *testing.T, h *OAuthHandlers) (string, *http.Cookie) {
+	t.Helper()
+	w := call{method: "GET", vars: map[string]string{"provider": "stub"}}.serve(h.Login)
+	if w.Code != http.StatusFound {
+		t.Fatalf("login status = %d: %s", w.Code, w.Body)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == oauthBrowserCookie {
+			return location.Query().Get("state"), cookie
+		}
+	}
+	t.Fatal("login set no browser cookie")
+	return "", nil
+}
+
+func TestOAuthLoginSetsBrowserCookie(t *testing.T) {
+	h := &OAuthHandlers{Stores: MemoryStores(testStores(t))}
+	SetOAuthProviders(oauth.NewRegistry(stubProvider{}))
+
+	_, cookie := startStubLogin(t, h)
+	if !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode || cookie.Value == "" || cookie.MaxAge <= 0 {
+		t.Errorf("cookie = %+v", cookie)
+	}
+}
+
+func TestOAuthCallbackRequiresTheBrowser(t *testing.T) {
+	tests := []struct {
+		name   string
+		cookie func(own *http.Cookie) string
+		want   int
+		retry  int // The same callback sent again by the browser that started the login
+	}{
+		// The stub refuses the exchange, so a 401 means the state was accepted
+		{"same browser", func(own *http.Cookie) string { return own.Value }, http.StatusUnauthorized, http.StatusBadRequest},
+		{"no cookie", func(own *http.Cookie) string { return "" }, http.StatusBadRequest, http.StatusUnauthorized},
+		{"another browser", func(own *http.Cookie) string { return "someone-else" }, http.StatusBadRequest, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &OAuthHandlers{Stores: MemoryStores(testStores(t))}
+			SetOAuthProviders(oauth.NewRegistry(stubProvider{}))
+			state, own := startStubLogin(t, h)
+
+			callback := call{
+				method: "GET",
+				target: "/api/oauth/stub/callback?" + url.Values{"code": {"code"}, "state": {state}}.Encode(),
+				vars:   map[string]string{"provider": "stub"},
+				header: map[string]string{},
+			}
+			if value := tt.cookie(own); value != "" {
+				callback.header["Cookie"] = oauthBrowserCookie + "=" + value
+			}
+			if w := callback.serve(h.Callback); w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+
+			callback.header["Cookie"] = oauthBrowserCookie + "=" + own.Value
+			if w := callback.serve(h.Callback); w.Code != tt.retry {
+				t.Errorf("status of the retry = %d, want %d: %s", w.Code, tt.retry, w.Body)
+			}
+		})
+	}
+}
+
+func TestResolveOAuthIdentity(t *testing.T) {
+	github := func(subject, email string, verified bool) oauth.Identity {
+		return oauth.Identity{Provider: "github", Subject: subject, Email: email, EmailVerified: verified, Login: "alice"}
+	}
+	tests := []struct {
+		name     string
+		identity oauth.Identity
+		link     string // Username of the signed-in user in a link flow
+		want     string // Email of the account signed in as
+		err      error
+	}{
+		{name: "linked identity", identity: github("1", "", false), want: "alice@example.com"},
+		{name: "linked identity in someone else's link flow", identity: github("1", "", false), link: "bob", err: errIdentityTaken},
+		{name: "link flow", identity: github("2", "other@example.com", true), link: "bob", want: "bob@example.com"},
+		{name: "verified email of a verified account", identity: github("2", "Alice@Example.com", true), want: "alice@example.com"},
+		{name: "unverified email at the provider", identity: github("2", "alice@example.com", false), err: errEmailNotOwned},
+		{name: "email of an unverified account", identity: github("2", "bob@example.com", true), err: errEmailNotOwned},
+		{name: "new account", identity: github("2", "carol@example.com", true), want: "carol@example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := testStores(t)
+			h := &OAuthHandlers{Stores: MemoryStores(m)}
+			ctx := context.Background()
+			ids := map[string]primitive.ObjectID{}
+			for _, account := range []models.AuthUser{
+				{Username: "alice", Email: "alice@example.com", EmailVerified: true, Identities: []models.ExternalIdentity{{Key: "github:1", Provider: "github", Subject: "1"}}},
+				{Username: "bob", Email: "bob@example.com"},
+			} {
+				user, err := m.CreateAccount(ctx, account, models.User{Basics: models.Basics{Username: account.Username, Email: account.Email}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids[account.Username] = user.ID
+			}
+
+			var linkUserID *primitive.ObjectID
+			if tt.link != "" {
+				id := ids[tt.link]
+				linkUserID = &id
+			}
+			user, authUser, err := h.resolveOAuthIdentity(ctx, tt.identity, linkUserID)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if tt.err != nil {
+				return
+			}
+			if user.Basics.Email != tt.want || authUser.Email != tt.want {
+				t.Errorf("signed in as %s / %s, want %s", user.Basics.Email, authUser.Email, tt.want)
+			}
+
+			// The identity now signs in the same account on its own
+			again, err := m.FindAuthUserByIdentity(ctx, "github:"+tt.identity.Subject)
+			if err != nil || again.Email != tt.want {
+				t.Errorf("identity is linked to %q, %v, want %s", again.Email, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateOAuthUserPicksAFreeUsername(t *testing.T) {
+	m := testStores(t)
+	h := &OAuthHandlers{Stores: MemoryStores(m)}
+	ctx := context.Background()
+	carol := models.AuthUser{Username: "carol", Email: "carol@example.com"}
+	if _, err := m.CreateAccount(ctx, carol, models.User{Basics: models.Basics{Username: "carol", Email: carol.Email}}); err != nil {
+		t.Fatal(err)
+	}
+
+	user, authUser, err := h.resolveOAuthIdentity(ctx, oauth.Identity{Provider: "github", Subject: "7", Email: "dave@example.com", Login: "Carol"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authUser.Username, "carol-") || user.Basics.Username != authUser.Username {
+		t.Errorf("username = %q / %q, want carol- and a suffix", authUser.Username, user.Basics.Username)
+	}
+}
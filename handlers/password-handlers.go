@@ -0,0 +1,168 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"profolio-vercel/logging"
+	"profolio-vercel/mailer"
+	"profolio-vercel/models"
+	"profolio-vercel/problem"
+	"profolio-vercel/store"
+	"profolio-vercel/validation"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// passwordResetTTL is how long a password reset link stays valid
+const passwordResetTTL = time.Hour
+
+var (
+	mailSender     mailer.Sender
+	mailSenderErr  error
+	mailSenderOnce sync.Once
+)
+
+// SetMailer replaces the mail sender built from the configuration
+func SetMailer(sender mailer.Sender) {
+	mailSenderOnce.Do(func() {})
+	mailSender, mailSenderErr = sender, nil
+}
+
+func getMailer() (mailer.Sender, error) {
+	mailSenderOnce.Do(func() {
+		mailSender, mailSenderErr = mailer.FromConfig(appConfig.Env, appConfig.SMTP)
+	})
+	return mailSender, mailSenderErr
+}
+
+// appLink builds a link into the frontend, which lives at the configured app URL
+func appLink(path, token string) string {
+	return appConfig.AppURL + path + "?token=" + url.QueryEscape(token)
+}
+
+func (h *AccountHandlers) RequestPasswordReset(w http.ResponseWriter, r *http.Request) error {
+	var body struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Email == "" {
+		return errInvalidBody
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
+	defer cancel()
+	email := normalizeEmail(body.Email)
+
+	// Every request counts towards the limits of its IP and of the address,
+	// registered or not, so the limit doesn't tell which emails have accounts
+	if wait, err := resetGuard().Fail(ctx, resetIPKey(r), resetAccountKey(email)); err != nil {
+		return problem.Internal("Error checking password reset attempts", err)
+	} else if wait > 0 {
+		return lockedOut(w, wait)
+	}
+
+	// The response is the same whether or not the email is registered and
+	// whether or not the mail went out; failures are only logged
+	if err := h.sendPasswordReset(ctx, email); err != nil {
+		logging.FromContext(r.Context()).Error("sending password reset email", "error", err)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"message": "If the email is registered, a reset link has been sent"})
+	return nil
+}
+
+// sendPasswordReset mails a reset link to the user with the email, if there is one
+func (s Stores) sendPasswordReset(ctx context.Context, email string) error {
+	user, err := s.Users.FindUser(ctx, store.ByEmail(email))
+	if err == store.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	token, err := s.createActionToken(ctx, user.ID, user.Basics.Email, models.PurposePasswordReset, passwordResetTTL)
+	if err != nil {
+		return err
+	}
+
+	sender, err := getMailer()
+	if err != nil {
+		return err
+	}
+	return sender.Send(ctx, mailer.Message{
+		To:      user.Basics.Email,
+		Subject: "Reset your ProFolio password",
+		Body: fmt.Sprintf("Someone asked to reset the password of your ProFolio account.\n\n"+
+			"Open this link within %v to choose a new password:\n%s\n\n"+
+			"If it wasn't you, you can ignore this email.", passwordResetTTL, appLink("/reset-password", token)),
+	})
+}
+
+func (h *AccountHandlers) ConfirmPasswordReset(w http.ResponseWriter, r *http.Request) error {
+	// The password follows the signup rule; it is checked before the token
+	// is used up, so a password bcrypt can't hash doesn't burn the link
+	var body struct {
+		Token    string `json:"token" validate:"required"`
+		Password string `json:"password" validate:"required,min=8,max=72"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Token == "" {
+		return errInvalidBody
+	}
+	if err := validation.Struct(body); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
+	defer cancel()
+
+	resetToken, err := h.consumeActionToken(ctx, body.Token, models.PurposePasswordReset)
+	if err == store.ErrNotFound {
+		return problem.Invalid("token_invalid", "Invalid or expired reset token")
+	} else if err != nil {
+		return problem.Internal("Error reading reset token", err)
+	}
+
+	user, authUser, err := h.findAuthUserByUserID(ctx, resetToken.UserID)
+	if err != nil {
+		return errUserNotFound
+	}
+
+	// A link mailed to an address the account has since moved away from
+	// must not reset the password of the account as it is now
+	if resetToken.Email == "" || resetToken.Email != authUser.Email {
+		return problem.Invalid("token_invalid", "Invalid or expired reset token")
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(body.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return problem.Internal("Error hashing password", err)
+	}
+
+	err = h.Auth.UpdateAuthUser(ctx, user.Basics.Email, bson.M{"password": string(hashedPassword)})
+	if err != nil {
+		return problem.Internal("Error saving password", err)
+	}
+
+	// Whoever knew the old password must not stay signed in
+	if err := h.revokeAllSessions(ctx, user.ID); err != nil {
+		return problem.Internal("Error revoking sessions", err)
+	}
+
+	h.recordAudit(ctx, r, models.AuditEvent{
+		Action:   models.AuditPasswordChanged,
+		ActorID:  user.ID.Hex(),
+		TargetID: user.ID.Hex(),
+		Details:  map[string]interface{}{"method": "reset"},
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Password reset successfully"})
+	return nil
+}
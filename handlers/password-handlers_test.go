@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"profolio-vercel/mailer"
+	"profolio-vercel/models"
+	"profolio-vercel/store"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// failingMailer fails every send, like an unreachable relay
+type failingMailer struct{}
+
+func (failingMailer) Send(ctx context.Context, msg mailer.Message) error {
+	return errors.New("connection refused")
+}
+
+func TestRequestPasswordReset(t *testing.T) {
+	tests := []struct {
+		name   string
+		email  string
+		sender mailer.Sender
+		sent   int
+	}{
+		{"registered email", "alice@example.com", &mailbox{}, 1},
+		{"unknown email", "carol@example.com", &mailbox{}, 0},
+		{"mail fails", "alice@example.com", failingMailer{}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := testStores(t)
+			newFixture(t, m)
+			SetMailer(tt.sender)
+			h := &AccountHandlers{Stores: MemoryStores(m)}
+
+			// Every case answers alike, so the response does not tell which emails are registered
+			w := call{method: "POST", body: `{"email":"` + tt.email + `"}`}.serve(h.RequestPasswordReset)
+			if w.Code != http.StatusAccepted {
+				t.Errorf("status = %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+			}
+			if box, ok := tt.sender.(*mailbox); ok && len(box.sent) != tt.sent {
+				t.Errorf("sent %d emails, want %d", len(box.sent), tt.sent)
+			}
+		})
+	}
+}
+
+func TestRequestPasswordResetIsRateLimited(t *testing.T) {
+	m := testStores(t)
+	newFixture(t, m)
+	box := &mailbox{}
+	SetMailer(box)
+	h := &AccountHandlers{Stores: MemoryStores(m)}
+
+	for i := 0; i < resetPolicy.FreeAttempts; i++ {
+		w := call{method: "POST", body: `{"email":"alice@example.com"}`}.serve(h.RequestPasswordReset)
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("request %d: status = %d: %s", i+1, w.Code, w.Body)
+		}
+	}
+
+	// Unknown addresses count alike, so the limit does not tell which emails are registered
+	for _, email := range []string{"alice@example.com", "carol@example.com"} {
+		w := call{method: "POST", body: `{"email":"` + email + `"}`}.serve(h.RequestPasswordReset)
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("%s: status = %d, want %d", email, w.Code, http.StatusTooManyRequests)
+		}
+		if w.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: no Retry-After", email)
+		}
+	}
+	if len(box.sent) != resetPolicy.FreeAttempts {
+		t.Errorf("sent %d emails, want %d", len(box.sent), resetPolicy.FreeAttempts)
+	}
+}
+
+func TestConfirmPasswordResetKeepsTheTokenOnABadPassword(t *testing.T) {
+	m := testStores(t)
+	h := &AccountHandlers{Stores: MemoryStores(m)}
+	ctx := context.Background()
+	user, err := m.CreateAccount(ctx,
+		models.AuthUser{Username: "alice", Email: "alice@example.com", Password: "unknown", Role: models.RoleUser},
+		models.User{Basics: models.Basics{Username: "alice", Email: "alice@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := h.createActionToken(ctx, user.ID, "alice@example.com", models.PurposePasswordReset, passwordResetTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// bcrypt can't hash more than 72 bytes; the password is refused before the link is used up
+	for _, password := range []string{"short", strings.Repeat("x", 73)} {
+		w := call{method: "POST", body: `{"token":"` + token + `","password":"` + password + `"}`}.serve(h.ConfirmPasswordReset)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%d byte password: status = %d, want %d: %s", len(password), w.Code, http.StatusBadRequest, w.Body)
+		}
+	}
+
+	w := call{method: "POST", body: `{"token":"` + token + `","password":"` + strings.Repeat("x", 72) + `"}`}.serve(h.ConfirmPasswordReset)
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+}
+
+func TestConfirmPasswordReset(t *testing.T) {
+	tests := []struct {
+		name    string
+		move    func(ctx context.Context, m *store.Memory) error // Moves the account after the link is mailed
+		want    int
+		dropped bool // Whether the move deleted the token
+	}{
+		{"current email", nil, http.StatusOK, false},
+		{"email changed since", func(ctx context.Context, m *store.Memory) error {
+			return m.ChangeAccount(ctx, "alice@example.com", store.AccountChange{Email: "carol@example.com"})
+		}, http.StatusBadRequest, true},
+		{"email changed and the token kept", func(ctx context.Context, m *store.Memory) error {
+			if err := m.UpdateAuthUser(ctx, "alice@example.com", bson.M{"email": "carol@example.com"}); err != nil {
+				return err
+			}
+			_, err := m.UpdateUser(ctx, store.ByEmail("alice@example.com"), store.AnyVersion, bson.M{"basics.email": "carol@example.com"})
+			return err
+		}, http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := testStores(t)
+			h := &AccountHandlers{Stores: MemoryStores(m)}
+			ctx := context.Background()
+			user, err := m.CreateAccount(ctx,
+				models.AuthUser{Username: "alice", Email: "alice@example.com", Password: "unknown", Role: models.RoleUser},
+				models.User{Basics: models.Basics{Username: "alice", Email: "alice@example.com"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, err := h.createActionToken(ctx, user.ID, "alice@example.com", models.PurposePasswordReset, passwordResetTTL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			email := "alice@example.com"
+			if tt.move != nil {
+				if err := tt.move(ctx, m); err != nil {
+					t.Fatal(err)
+				}
+				email = "carol@example.com"
+			}
+			if dropped := len(m.ActionTokens()) == 0; dropped != tt.dropped {
+				t.Errorf("token dropped by the move = %v, want %v", dropped, tt.dropped)
+			}
+
+			w := call{method: "POST", body: `{"token":"` + token + `","password":"a new password"}`}.serve(h.ConfirmPasswordReset)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			authUser, err := m.FindAuthUser(ctx, email)
+			if err != nil {
+				t.Fatal(err)
+			}
+			changed := bcrypt.CompareHashAndPassword([]byte(authUser.Password), []byte("a new password")) == nil
+			if changed != (tt.want == http.StatusOK) {
+				t.Errorf("password changed = %v", changed)
+			}
+		})
+	}
+}
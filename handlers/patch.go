@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"profolio-vercel/patch"
+	"profolio-vercel/problem"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// acceptPatch lists the PATCH formats, for the Accept-Patch header
+const acceptPatch = "application/json, " + patch.MergePatchType + ", " + patch.JSONPatchType
+
+// userPatchPaths are where a patch of a profile may write, the same fields
+// models.UserUpdate has
+var userPatchPaths = []string{
+	"/basics/name", "/basics/label", "/basics/image", "/basics/phone", "/basics/url",
+	"/basics/summary", "/basics/location", "/basics/profiles",
+	"/work", "/education", "/certificates", "/skills", "/languages", "/interests", "/projects",
+}
+
+// resumePatchPaths are where a patch of a resume may write. Its ID is fixed
+// and the default flag changes through /makeDefault.
+var resumePatchPaths = []string{
+	"/name", "/templateId", "/basics",
+	"/work", "/education", "/certificates", "/skills", "/languages", "/interests", "/projects",
+}
+
+// mediaType is the Content-Type of the request without its parameters
+func mediaType(r *http.Request) string {
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mt
+}
+
+// unsupportedPatch rejects a PATCH body in a format we don't read
+func unsupportedPatch(w http.ResponseWriter, accepted string) error {
+	w.Header().Set("Accept-Patch", accepted)
+	return problem.UnsupportedMediaType("PATCH bodies must be one of " + accepted)
+}
+
+// applyPatch applies the merge patch or JSON patch in the request body to
+// current, a model such as models.User, and decodes the result into patched,
+// a pointer to the same type. Only paths within writable may change.
+func applyPatch(r *http.Request, current, patched interface{}, writable []string) ([]patch.Change, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, errInvalidBody
+	}
+	doc, err := patch.Document(current)
+	if err != nil {
+		return nil, problem.Internal("Error reading the document", err)
+	}
+
+	var changes []patch.Change
+	if mediaType(r) == patch.MergePatchType {
+		var mergePatch interface{}
+		if err := json.Unmarshal(body, &mergePatch); err != nil {
+			return nil, errInvalidBody
+		}
+		doc, changes = patch.Merge(doc, mergePatch)
+	} else {
+		ops, err := patch.Parse(body)
+		if err != nil {
+			return nil, err
+		}
+		if doc, changes, err = patch.Apply(doc, ops); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(changes) == 0 {
+		return nil, problem.Invalid("empty_update", "The request changes no fields")
+	}
+	for _, change := range changes {
+		if !change.Within(writable...) {
+			return nil, problem.Invalid("invalid_patch", "The patch cannot be applied",
+				problem.Field(change.Pointer(), "not_writable", change.Pointer()+" cannot be set here"))
+		}
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, errInvalidBody
+	}
+	if err := unmarshalStrict(data, patched); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// storedDoc converts a model into the document Mongo stores for it
+func storedDoc(v interface{}) (bson.M, error) {
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.M
+	err = bson.Unmarshal(data, &doc)
+	return doc, err
+}
+
+// storedPath turns the segments of a JSON pointer into the dotted path Mongo
+// stores the value at, in a document of type t. Members are renamed from
+// their JSON name to the key the driver stores them under; array indexes and
+// map keys are kept as they are.
+func storedPath(t reflect.Type, segments []string) string {
+	parts := make([]string, len(segments))
+	for i, s := range segments {
+		parts[i] = s
+		for t != nil && t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		if t == nil {
+			continue
+		}
+		switch t.Kind() {
+		case reflect.Struct:
+			field, ok := jsonField(t, s)
+			if !ok {
+				t = nil
+				continue
+			}
+			parts[i], t = bsonKey(field), field.Type
+		case reflect.Slice, reflect.Array, reflect.Map:
+			t = t.Elem()
+		default:
+			t = nil
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// jsonField finds the field of the struct type t that JSON names name
+func jsonField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		jsonName, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if jsonName == "" {
+			jsonName = field.Name
+		}
+		if field.IsExported() && jsonName == name {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// bsonKey is the key the driver stores field under: the name in its bson
+// tag, or else its Go name lowercased
+func bsonKey(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("bson"), ",")
+	if name == "" {
+		name = strings.ToLower(field.Name)
+	}
+	return name
+}
+
+// patchUpdate turns the changes a patch made to model, such as models.User,
+// into one Mongo update. before and after are the stored documents the patch went from
+// and to. It also returns the new value of each written path, for the audit log.
+func patchUpdate(model interface{}, changes []patch.Change, before, after bson.M) (bson.M, map[string]interface{}) {
+	set, unset, push := bson.M{}, bson.M{}, bson.M{}
+	written := map[string]interface{}{}
+	for _, change := range changes {
+		path := storedPath(reflect.TypeOf(model), change.Path)
+		value, exists := findField(after, path)
+		written[path] = value
+
+		// A new element is pushed rather than rewriting its array, unless
+		// there is no array yet to push to
+		existing, _ := findField(before, path)
+		if _, isArray := existing.(bson.A); change.Kind == patch.Push && isArray {
+			element, _ := findField(after, path+"."+strconv.Itoa(change.Index))
+			modifiers := bson.M{"$each": bson.A{element}}
+			if !change.Append {
+				modifiers["$position"] = change.Index
+			}
+			push[path] = modifiers
+			continue
+		}
+
+		if exists {
+			set[path] = value
+		} else {
+			unset[path] = ""
+		}
+	}
+
+	update := bson.M{}
+	for operator, fields := range map[string]bson.M{"$set": set, "$unset": unset, "$push": push} {
+		if len(fields) > 0 {
+			update[operator] = fields
+		}
+	}
+	return update, written
+}
@@ -0,0 +1,254 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"profolio-vercel/models"
+	"profolio-vercel/patch"
+	"profolio-vercel/store"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestStoredPath(t *testing.T) {
+	tests := []struct {
+		model    interface{}
+		segments []string
+		want     string
+	}{
+		{models.User{}, []string{"basics", "location", "postalCode"}, "basics.location.postalcode"},
+		{models.User{}, []string{"work", "2", "highlights", "0"}, "work.2.highlights.0"},
+		{models.User{}, []string{"projects", "0", "githubUrl"}, "projects.0.githuburl"},
+		{models.Resume{}, []string{"templateId"}, "templateid"},
+		{models.Resume{}, []string{"_id"}, "_id"},
+		{&models.AuthUser{}, []string{"emailVerified"}, "emailVerified"},
+		{models.AuthUser{}, []string{"identities", "0", "linkedAt"}, "identities.0.linkedAt"},
+		{models.User{}, []string{"unknown", "Keep"}, "unknown.Keep"},
+	}
+	for _, tt := range tests {
+		if got := storedPath(reflect.TypeOf(tt.model), tt.segments); got != tt.want {
+			t.Errorf("storedPath(%T, %v) = %q, want %q", tt.model, tt.segments, got, tt.want)
+		}
+	}
+}
+
+// insertPatchable inserts carol, who has a job, two profiles and a resume
+func insertPatchable(t *testing.T, m *store.Memory) models.User {
+	t.Helper()
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	carol, err := m.InsertUser(context.Background(), models.User{
+		Basics: models.Basics{Username: "carol", Email: "carol@example.com", Profiles: []models.Profile{
+			{Network: "LinkedIn", Username: "carol"},
+			{Network: "GitHub", Username: "carol"},
+		}},
+		Work:    []models.WorkExperience{{Name: "Acme", Position: "Engineer", StartDate: start, Highlights: []string{"Shipped"}}},
+		Resumes: []models.Resume{{ID: primitive.NewObjectID(), Name: "Engineering"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return carol
+}
+
+func TestJSONPatchUser(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        int
+		check       func(t *testing.T, carol models.User)
+	}{
+		{
+			name: "add a highlight",
+			body: `[{"op":"add","path":"/work/0/highlights/-","value":"Led the team"}]`,
+			want: http.StatusOK,
+			check: func(t *testing.T, carol models.User) {
+				if got := carol.Work[0].Highlights; !slices.Equal(got, []string{"Shipped", "Led the team"}) {
+					t.Errorf("highlights = %v", got)
+				}
+			},
+		},
+		{
+			name: "remove a profile",
+			body: `[{"op":"remove","path":"/basics/profiles/0"}]`,
+			want: http.StatusOK,
+			check: func(t *testing.T, carol models.User) {
+				if got := carol.Basics.Profiles; len(got) != 1 || got[0].Network != "GitHub" {
+					t.Errorf("profiles = %v", got)
+				}
+			},
+		},
+		{
+			name: "replace a camel case member",
+			body: `[{"op":"add","path":"/basics/location/postalCode","value":"10115"}]`,
+			want: http.StatusOK,
+			check: func(t *testing.T, carol models.User) {
+				if got := carol.Basics.Location.PostalCode; got != "10115" {
+					t.Errorf("postal code = %q", got)
+				}
+			},
+		},
+		{
+			name:        "merge patch deletes with null",
+			contentType: patch.MergePatchType,
+			body:        `{"work":null}`,
+			want:        http.StatusOK,
+			check: func(t *testing.T, carol models.User) {
+				if len(carol.Work) != 0 {
+					t.Errorf("work = %v", carol.Work)
+				}
+			},
+		},
+		{
+			name: "failed test",
+			body: `[{"op":"add","path":"/work/0/highlights/-","value":"Led the team"},{"op":"test","path":"/work/0/name","value":"Initech"}]`,
+			want: http.StatusConflict,
+		},
+		{
+			name: "index out of range",
+			body: `[{"op":"remove","path":"/work/1"}]`,
+			want: http.StatusUnprocessableEntity,
+		},
+		{
+			name: "missing member",
+			body: `[{"op":"replace","path":"/basics/nickname","value":"C"}]`,
+			want: http.StatusUnprocessableEntity,
+		},
+		{
+			name: "not writable",
+			body: `[{"op":"replace","path":"/basics/email","value":"x@example.com"}]`,
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "invalid result",
+			body: `[{"op":"add","path":"/work/-","value":{"position":"Nameless"}}]`,
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "malformed patch",
+			body: `[{"op":"add","path":"work"}]`,
+			want: http.StatusBadRequest,
+		},
+		{
+			name:        "unsupported media type",
+			contentType: "text/plain",
+			body:        `[{"op":"remove","path":"/work/0"}]`,
+			want:        http.StatusUnsupportedMediaType,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := testStores(t)
+			carol := insertPatchable(t, m)
+			h := &UserHandlers{Stores: MemoryStores(m)}
+			contentType := tt.contentType
+			if contentType == "" {
+				contentType = patch.JSONPatchType
+			}
+
+			w := call{method: "PATCH", body: tt.body, vars: map[string]string{"id": carol.ID.Hex()},
+				header: map[string]string{"Content-Type": contentType}}.serve(h.UpdateUser)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want == http.StatusUnsupportedMediaType && w.Header().Get("Accept-Patch") == "" {
+				t.Error("no Accept-Patch")
+			}
+
+			stored, err := m.FindUser(context.Background(), store.ByID(carol.ID))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.check != nil {
+				tt.check(t, stored)
+			} else if !reflect.DeepEqual(stored.Work, carol.Work) || stored.Version != carol.Version {
+				t.Errorf("a rejected patch changed carol to %+v", stored)
+			}
+		})
+	}
+}
+
+func TestJSONPatchResume(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        int
+		check       func(t *testing.T, resume models.Resume)
+	}{
+		{
+			name: "replace a camel case member",
+			body: `[{"op":"add","path":"/templateId","value":"modern"}]`,
+			want: http.StatusOK,
+			check: func(t *testing.T, resume models.Resume) {
+				if resume.TemplateID != "modern" {
+					t.Errorf("template = %q", resume.TemplateID)
+				}
+			},
+		},
+		{
+			name: "copy the name",
+			body: `[{"op":"copy","from":"/name","path":"/basics/label"}]`,
+			want: http.StatusOK,
+			check: func(t *testing.T, resume models.Resume) {
+				if resume.Basics.Label != "Engineering" {
+					t.Errorf("label = %q", resume.Basics.Label)
+				}
+			},
+		},
+		{
+			name: "default flag",
+			body: `[{"op":"replace","path":"/isDefault","value":true}]`,
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "index out of range",
+			body: `[{"op":"add","path":"/work/1","value":{}}]`,
+			want: http.StatusUnprocessableEntity,
+		},
+		{
+			name: "failed test",
+			body: `[{"op":"test","path":"/name","value":"Design"}]`,
+			want: http.StatusConflict,
+		},
+		{
+			name:        "plain JSON",
+			contentType: "application/json",
+			body:        `{"name":"Renamed"}`,
+			want:        http.StatusUnsupportedMediaType,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := testStores(t)
+			carol := insertPatchable(t, m)
+			resumeID := carol.Resumes[0].ID
+			h := &ResumeHandlers{Stores: MemoryStores(m)}
+			contentType := tt.contentType
+			if contentType == "" {
+				contentType = patch.JSONPatchType
+			}
+
+			w := call{method: "PATCH", body: tt.body, vars: map[string]string{"userID": carol.ID.Hex(), "resumeID": resumeID.Hex()},
+				header: map[string]string{"Content-Type": contentType}}.serve(h.PatchResume)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+
+			stored, err := m.FindUser(context.Background(), store.ByID(carol.ID))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.check != nil {
+				tt.check(t, stored.Resumes[0])
+			} else if !reflect.DeepEqual(stored.Resumes[0], carol.Resumes[0]) {
+				t.Errorf("a rejected patch changed the resume to %+v", stored.Resumes[0])
+			}
+		})
+	}
+}
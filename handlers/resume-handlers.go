@@ -5,226 +5,330 @@ import (
 	"encoding/json"
 	"net/http"
 	"profolio-vercel/models"
+	"profolio-vercel/patch"
+	"profolio-vercel/problem"
+	"profolio-vercel/store"
+	"profolio-vercel/validation"
+	"strconv"
 	"time"
 
 	"github.com/gorilla/mux"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-func AddResumeHandler(w http.ResponseWriter, r *http.Request) {
+// ResumeHandlers serves the resumes embedded in each user
+type ResumeHandlers struct {
+	Stores
+}
+
+func (h *ResumeHandlers) AddResume(w http.ResponseWriter, r *http.Request) error {
 	vars := mux.Vars(r)
 	userID, err := primitive.ObjectIDFromHex(vars["userID"])
 	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
-		return
+		return errInvalidUserID
 	}
 
-	var resume models.Resume
-	err = json.NewDecoder(r.Body).Decode(&resume)
+	var body resumeBody
+	err = json.NewDecoder(r.Body).Decode(&body)
 	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+		return errInvalidBody
+	}
+	resume := body.Resume
+	if err := validation.Struct(resume); err != nil {
+		return err
 	}
 
 	resume.ID = primitive.NewObjectID()
+	resume.Version = 0
 
-	collection := client.Database("profileFolio").Collection("users")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
 	defer cancel()
 
-	var user models.User
-	err = collection.FindOne(ctx, bson.M{"_id": userID}).Decode(&user)
-	if err != nil {
-		http.Error(w, "User not found", http.StatusBadRequest)
-		return
-	}
-
-	if len(user.Resumes) >= 3 {
-		http.Error(w, "Maximum number of resumes (3) reached", http.StatusBadRequest)
-		return
-	}
-
 	// Add the new resume to the user's resumes
-	update := bson.M{"$push": bson.M{"resumes": resume}}
-	result, err := collection.UpdateOne(ctx, bson.M{"_id": userID}, update)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	err = h.Resumes.AddResume(ctx, userID, resume)
+	if err == store.ErrNotFound {
+		return errUserNotFound
+	} else if err == store.ErrResumeLimit {
+		return problem.Invalid("resume_limit", "Maximum number of resumes ("+strconv.Itoa(store.MaxResumes)+") reached")
+	} else if err != nil {
+		return err
 	}
 
-	if result.MatchedCount == 0 {
-		http.Error(w, "User not found", http.StatusNotFound)
-		return
-	}
+	h.recordAudit(ctx, r, models.AuditEvent{
+		Action:   models.AuditResumeCreated,
+		TargetID: userID.Hex(),
+		Changes:  []models.FieldChange{{Field: "resumes." + resume.ID.Hex(), To: resume}},
+	})
 
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"message": "Resume added successfully",
 		"id":      resume.ID,
 	})
+	return nil
+}
+
+// resumeBody is a resume as AddResume and UpdateResume read it. The default
+// flag only changes through makeDefault, so isDefault is decoded into a field
+// of its own, which shadows Resume.IsDefault, and ignored.
+type resumeBody struct {
+	models.Resume
+	IsDefault json.RawMessage `json:"isDefault,omitempty"`
 }
 
-func UpdateResumeHandler(w http.ResponseWriter, r *http.Request) {
+// resumeIDs reads the user and resume IDs from the URL
+func resumeIDs(r *http.Request) (userID, resumeID primitive.ObjectID, err error) {
 	vars := mux.Vars(r)
-	userID, err := primitive.ObjectIDFromHex(vars["userID"])
+	if userID, err = primitive.ObjectIDFromHex(vars["userID"]); err != nil {
+		return userID, resumeID, errInvalidUserID
+	}
+	if resumeID, err = primitive.ObjectIDFromHex(vars["resumeID"]); err != nil {
+		return userID, resumeID, errInvalidResumeID
+	}
+	return userID, resumeID, nil
+}
+
+// findResume loads one resume of the user
+func (h *ResumeHandlers) findResume(ctx context.Context, userID, resumeID primitive.ObjectID) (models.Resume, error) {
+	user, err := h.Users.FindUser(ctx, store.ByID(userID))
+	if err == store.ErrNotFound {
+		return models.Resume{}, errUserNotFound
+	} else if err != nil {
+		return models.Resume{}, err
+	}
+	for _, resume := range user.Resumes {
+		if resume.ID == resumeID {
+			return resume, nil
+		}
+	}
+	return models.Resume{}, errResumeNotFound
+}
+
+// resumeVersion is the version a write to the resume must find: the one the
+// If-Match header names, or store.AnyVersion for an unconditional request
+func (h *ResumeHandlers) resumeVersion(ctx context.Context, r *http.Request, userID, resumeID primitive.ObjectID) (int64, error) {
+	if r.Header.Get("If-Match") == "" {
+		return store.AnyVersion, nil
+	}
+	current, err := h.findResume(ctx, userID, resumeID)
+	if err != nil {
+		return 0, err
+	}
+	return ifMatch(r, current.Version)
+}
+
+// GetResume answers with one resume, tagged with its version
+func (h *ResumeHandlers) GetResume(w http.ResponseWriter, r *http.Request) error {
+	userID, resumeID, err := resumeIDs(r)
 	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
-		return
+		return err
 	}
 
-	resumeID, err := primitive.ObjectIDFromHex(vars["resumeID"])
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
+	defer cancel()
+
+	resume, err := h.findResume(ctx, userID, resumeID)
 	if err != nil {
-		http.Error(w, "Invalid resume ID", http.StatusBadRequest)
-		return
+		return err
 	}
 
-	var updates map[string]interface{}
-	err = json.NewDecoder(r.Body).Decode(&updates)
+	w.Header().Set("ETag", etag(resume.Version))
+	if notModified(r, resume.Version) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resume)
+	return nil
+}
+
+func (h *ResumeHandlers) UpdateResume(w http.ResponseWriter, r *http.Request) error {
+	userID, resumeID, err := resumeIDs(r)
 	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+		return err
 	}
 
-	updates["_id"] = resumeID
+	// The body replaces the whole resume, so it has to be a valid resume on its own
+	var body resumeBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return errInvalidBody
+	}
+	resume := body.Resume
+	if err := validation.Struct(resume); err != nil {
+		return err
+	}
+	resume.ID = resumeID
 
-	collection := client.Database("profileFolio").Collection("users")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
 	defer cancel()
 
-	// Update the specific resume in the user's resumes
-	update := bson.M{
-		"$set": bson.M{
-			"resumes.$[elem]": updates,
-		},
+	version, err := h.resumeVersion(ctx, r, userID, resumeID)
+	if err != nil {
+		return err
 	}
-	arrayFilters := options.Update().SetArrayFilters(options.ArrayFilters{
-		Filters: []interface{}{
-			bson.M{"elem._id": resumeID},
-		},
-	})
 
-	result, err := collection.UpdateOne(ctx, bson.M{"_id": userID}, update, arrayFilters)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	// Replace the resume, keeping the previous one for the audit log
+	previous, err := h.Resumes.UpdateResume(ctx, userID, resumeID, version, resume)
+	if err == store.ErrNotFound {
+		return errResumeNotFound
+	} else if err != nil {
+		return versionError(r, err)
 	}
 
-	if result.MatchedCount == 0 {
-		http.Error(w, "Resume not found", http.StatusNotFound)
-		return
+	replacement, err := storedDoc(resume)
+	if err != nil {
+		return err
 	}
+	newVersion := store.Version(previous) + 1
+	replacement["version"] = newVersion
+	// The store kept the default flag the body couldn't set
+	if isDefault, ok := previous["isdefault"]; ok {
+		replacement["isdefault"] = isDefault
+	} else {
+		delete(replacement, "isdefault")
+	}
+	h.recordAudit(ctx, r, models.AuditEvent{
+		Action:   models.AuditResumeUpdated,
+		TargetID: userID.Hex(),
+		Changes:  documentChanges("resumes."+resumeID.Hex()+".", previous, replacement),
+	})
 
+	w.Header().Set("ETag", etag(newVersion))
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"message": "Resume updated successfully"})
+	return nil
 }
 
-func DeleteResumeHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	userID, err := primitive.ObjectIDFromHex(vars["userID"])
-	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
-		return
+// PatchResume applies a merge patch or JSON patch to one resume, writing only
+// the members and arrays the patch touched
+func (h *ResumeHandlers) PatchResume(w http.ResponseWriter, r *http.Request) error {
+	switch mediaType(r) {
+	case patch.MergePatchType, patch.JSONPatchType:
+	default:
+		return unsupportedPatch(w, patch.MergePatchType+", "+patch.JSONPatchType)
 	}
 
-	resumeID, err := primitive.ObjectIDFromHex(vars["resumeID"])
+	userID, resumeID, err := resumeIDs(r)
 	if err != nil {
-		http.Error(w, "Invalid resume ID", http.StatusBadRequest)
-		return
+		return err
 	}
 
-	collection := client.Database("profileFolio").Collection("users")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
 	defer cancel()
 
-	// Remove the specific resume from the user's resumes
-	update := bson.M{
-		"$pull": bson.M{
-			"resumes": bson.M{"_id": resumeID},
-		},
+	current, err := h.findResume(ctx, userID, resumeID)
+	if err != nil {
+		return err
+	}
+	if _, err := ifMatch(r, current.Version); err != nil {
+		return err
+	}
+
+	var patched models.Resume
+	changes, err := applyPatch(r, current, &patched, resumePatchPaths)
+	if err != nil {
+		return err
+	}
+	if err := validation.Struct(patched); err != nil {
+		return err
+	}
+
+	before, err := storedDoc(current)
+	if err != nil {
+		return err
+	}
+	after, err := storedDoc(patched)
+	if err != nil {
+		return err
+	}
+	update, written := patchUpdate(patched, changes, before, after)
+
+	// The update was worked out from the version read above, so it may only
+	// apply to that version, keeping the previous resume for the audit log
+	previous, err := h.Resumes.PatchResume(ctx, userID, resumeID, current.Version, update)
+	if err == store.ErrNotFound {
+		return errResumeNotFound
+	} else if err != nil {
+		return versionError(r, err)
+	}
+
+	changed := fieldChanges(previous, written)
+	for i := range changed {
+		changed[i].Field = "resumes." + resumeID.Hex() + "." + changed[i].Field
 	}
+	h.recordAudit(ctx, r, models.AuditEvent{
+		Action:   models.AuditResumeUpdated,
+		TargetID: userID.Hex(),
+		Changes:  changed,
+	})
+
+	w.Header().Set("ETag", etag(store.Version(previous)+1))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Resume updated successfully"})
+	return nil
+}
+
+func (h *ResumeHandlers) DeleteResume(w http.ResponseWriter, r *http.Request) error {
+	userID, resumeID, err := resumeIDs(r)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
+	defer cancel()
 
-	result, err := collection.UpdateOne(ctx, bson.M{"_id": userID}, update)
+	version, err := h.resumeVersion(ctx, r, userID, resumeID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 
-	if result.ModifiedCount == 0 {
-		http.Error(w, "Resume not found", http.StatusNotFound)
-		return
+	// Remove the resume, keeping it for the audit log
+	removed, err := h.Resumes.DeleteResume(ctx, userID, resumeID, version)
+	if err == store.ErrNotFound {
+		return errResumeNotFound
+	} else if err != nil {
+		return versionError(r, err)
 	}
 
+	h.recordAudit(ctx, r, models.AuditEvent{
+		Action:   models.AuditResumeDeleted,
+		TargetID: userID.Hex(),
+		Changes:  []models.FieldChange{{Field: "resumes." + resumeID.Hex(), From: removed}},
+	})
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"message": "Resume deleted successfully"})
+	return nil
 }
 
-func SetDefaultResumeHandler(w http.ResponseWriter, r *http.Request) {
+func (h *ResumeHandlers) SetDefaultResume(w http.ResponseWriter, r *http.Request) error {
 	vars := mux.Vars(r)
 	userID, err := primitive.ObjectIDFromHex(vars["userID"])
 	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
-		return
+		return errInvalidUserID
 	}
 	resumeID, err := primitive.ObjectIDFromHex(vars["resumeID"])
 	if err != nil {
-		http.Error(w, "Invalid resume ID", http.StatusBadRequest)
-		return
+		return errInvalidResumeID
 	}
 
-	collection := client.Database("profileFolio").Collection("users")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
 	defer cancel()
 
-	var user models.User
-	err = collection.FindOne(ctx, bson.M{"_id": userID}).Decode(&user)
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			http.Error(w, "User not found", http.StatusNotFound)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-		return
-	}
-
-	resumeFound := false
-	updateNeeded := false
-	for i := range user.Resumes {
-		if user.Resumes[i].ID == resumeID {
-			resumeFound = true
-			if !user.Resumes[i].IsDefault {
-				user.Resumes[i].IsDefault = true
-				updateNeeded = true
-			}
-		} else if user.Resumes[i].IsDefault {
-			user.Resumes[i].IsDefault = false
-			updateNeeded = true
-		}
-	}
-
-	if !resumeFound {
-		http.Error(w, "Resume not found", http.StatusNotFound)
-		return
+	changed, err := h.Resumes.SetDefaultResume(ctx, userID, resumeID)
+	if err == store.ErrNotFound {
+		return errResumeNotFound
+	} else if err != nil {
+		return err
 	}
 
-	if !updateNeeded {
+	if !changed {
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(map[string]string{"message": "Resume is already set as default"})
-		return
-	}
-
-	_, err = collection.UpdateOne(
-		ctx,
-		bson.M{"_id": userID},
-		bson.M{"$set": bson.M{"resumes": user.Resumes}},
-	)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil
 	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"message": "Resume set as default successfully"})
+	return nil
 }
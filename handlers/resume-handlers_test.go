@@ -0,0 +1,239 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"profolio-vercel/models"
+	"profolio-vercel/store"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestResumeHandlers(t *testing.T) {
+	resumeBody := `{"name":"Design"}`
+	tests := []struct {
+		name    string
+		handler func(*ResumeHandlers, http.ResponseWriter, *http.Request) error
+		call    func(f fixture) call
+		want    int
+	}{
+		{
+			name:    "add",
+			handler: (*ResumeHandlers).AddResume,
+			call: func(f fixture) call {
+				return call{method: "POST", body: resumeBody, vars: map[string]string{"userID": f.alice.ID.Hex()}}
+			},
+			want: http.StatusCreated,
+		},
+		{
+			name:    "add for an unknown user",
+			handler: (*ResumeHandlers).AddResume,
+			call: func(f fixture) call {
+				return call{method: "POST", body: resumeBody, vars: map[string]string{"userID": primitive.NewObjectID().Hex()}}
+			},
+			want: http.StatusNotFound,
+		},
+		{
+			name:    "add an invalid resume",
+			handler: (*ResumeHandlers).AddResume,
+			call: func(f fixture) call {
+				return call{method: "POST", body: `{"templateId":1}`, vars: map[string]string{"userID": f.alice.ID.Hex()}}
+			},
+			want: http.StatusBadRequest,
+		},
+		{
+			name:    "add with an invalid email",
+			handler: (*ResumeHandlers).AddResume,
+			call: func(f fixture) call {
+				return call{method: "POST", body: `{"name":"Design","basics":{"email":"alice"}}`, vars: map[string]string{"userID": f.alice.ID.Hex()}}
+			},
+			want: http.StatusBadRequest,
+		},
+		{
+			name:    "get",
+			handler: (*ResumeHandlers).GetResume,
+			call: func(f fixture) call {
+				return call{method: "GET", vars: map[string]string{"userID": f.alice.ID.Hex(), "resumeID": f.resumeID.Hex()}}
+			},
+			want: http.StatusOK,
+		},
+		{
+			name:    "get an unknown resume",
+			handler: (*ResumeHandlers).GetResume,
+			call: func(f fixture) call {
+				return call{method: "GET", vars: map[string]string{"userID": f.alice.ID.Hex(), "resumeID": primitive.NewObjectID().Hex()}}
+			},
+			want: http.StatusNotFound,
+		},
+		{
+			name:    "get with an invalid resume id",
+			handler: (*ResumeHandlers).GetResume,
+			call: func(f fixture) call {
+				return call{method: "GET", vars: map[string]string{"userID": f.alice.ID.Hex(), "resumeID": "nope"}}
+			},
+			want: http.StatusBadRequest,
+		},
+		{
+			name:    "replace",
+			handler: (*ResumeHandlers).UpdateResume,
+			call: func(f fixture) call {
+				return call{method: "PUT", body: resumeBody, vars: map[string]string{"userID": f.alice.ID.Hex(), "resumeID": f.resumeID.Hex()},
+					header: map[string]string{"If-Match": etag(0)}}
+			},
+			want: http.StatusOK,
+		},
+		{
+			name:    "replace a stale version",
+			handler: (*ResumeHandlers).UpdateResume,
+			call: func(f fixture) call {
+				return call{method: "PUT", body: resumeBody, vars: map[string]string{"userID": f.alice.ID.Hex(), "resumeID": f.resumeID.Hex()},
+					header: map[string]string{"If-Match": etag(3)}}
+			},
+			want: http.StatusPreconditionFailed,
+		},
+		{
+			name:    "merge patch",
+			handler: (*ResumeHandlers).PatchResume,
+			call: func(f fixture) call {
+				return call{method: "PATCH", body: `{"name":"Renamed"}`, vars: map[string]string{"userID": f.alice.ID.Hex(), "resumeID": f.resumeID.Hex()},
+					header: map[string]string{"Content-Type": "application/merge-patch+json"}}
+			},
+			want: http.StatusOK,
+		},
+		{
+			name:    "patch as plain JSON",
+			handler: (*ResumeHandlers).PatchResume,
+			call: func(f fixture) call {
+				return call{method: "PATCH", body: `{"name":"Renamed"}`, vars: map[string]string{"userID": f.alice.ID.Hex(), "resumeID": f.resumeID.Hex()}}
+			},
+			want: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:    "delete",
+			handler: (*ResumeHandlers).DeleteResume,
+			call: func(f fixture) call {
+				return call{method: "DELETE", vars: map[string]string{"userID": f.alice.ID.Hex(), "resumeID": f.resumeID.Hex()}}
+			},
+			want: http.StatusOK,
+		},
+		{
+			name:    "delete another user's resume",
+			handler: (*ResumeHandlers).DeleteResume,
+			call: func(f fixture) call {
+				return call{method: "DELETE", vars: map[string]string{"userID": f.bob.ID.Hex(), "resumeID": f.resumeID.Hex()}}
+			},
+			want: http.StatusNotFound,
+		},
+		{
+			name:    "make default",
+			handler: (*ResumeHandlers).SetDefaultResume,
+			call: func(f fixture) call {
+				return call{method: "POST", vars: map[string]string{"userID": f.alice.ID.Hex(), "resumeID": f.resumeID.Hex()}}
+			},
+			want: http.StatusOK,
+		},
+		{
+			name:    "make an unknown resume default",
+			handler: (*ResumeHandlers).SetDefaultResume,
+			call: func(f fixture) call {
+				return call{method: "POST", vars: map[string]string{"userID": f.alice.ID.Hex(), "resumeID": primitive.NewObjectID().Hex()}}
+			},
+			want: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := testStores(t)
+			f := newFixture(t, m)
+			h := &ResumeHandlers{Stores: MemoryStores(m)}
+			w := tt.call(f).serve(func(w http.ResponseWriter, r *http.Request) error { return tt.handler(h, w, r) })
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestAddResumeLimit(t *testing.T) {
+	m := testStores(t)
+	f := newFixture(t, m)
+	h := &ResumeHandlers{Stores: MemoryStores(m)}
+	add := call{method: "POST", body: `{"name":"More"}`, vars: map[string]string{"userID": f.alice.ID.Hex()}}
+
+	// Alice starts with one resume
+	for i := 1; i < store.MaxResumes; i++ {
+		if w := add.serve(h.AddResume); w.Code != http.StatusCreated {
+			t.Fatalf("resume %d: status = %d: %s", i+1, w.Code, w.Body)
+		}
+	}
+	if w := add.serve(h.AddResume); w.Code != http.StatusBadRequest {
+		t.Errorf("status past the limit = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	user, err := m.FindUser(context.Background(), store.ByID(f.alice.ID))
+	if err != nil || len(user.Resumes) != store.MaxResumes {
+		t.Errorf("resumes = %d, %v", len(user.Resumes), err)
+	}
+	if events := m.AuditEvents(); len(events) != store.MaxResumes-1 || events[0].Action != models.AuditResumeCreated {
+		t.Errorf("audit events = %+v", events)
+	}
+}
+
+func TestResumeBodiesCannotSetDefault(t *testing.T) {
+	m := testStores(t)
+	f := newFixture(t, m)
+	h := &ResumeHandlers{Stores: MemoryStores(m)}
+	ctx := context.Background()
+	if _, err := m.SetDefaultResume(ctx, f.alice.ID, f.resumeID); err != nil {
+		t.Fatal(err)
+	}
+	defaults := func() []primitive.ObjectID {
+		t.Helper()
+		user, err := m.FindUser(ctx, store.ByID(f.alice.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []primitive.ObjectID
+		for _, resume := range user.Resumes {
+			if resume.IsDefault {
+				ids = append(ids, resume.ID)
+			}
+		}
+		return ids
+	}
+
+	w := call{method: "POST", body: `{"name":"Design","isDefault":true}`, vars: map[string]string{"userID": f.alice.ID.Hex()}}.serve(h.AddResume)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("add: status = %d: %s", w.Code, w.Body)
+	}
+	user, _ := m.FindUser(ctx, store.ByID(f.alice.ID))
+	added := user.Resumes[len(user.Resumes)-1].ID
+
+	for _, tt := range []struct {
+		resumeID primitive.ObjectID
+		body     string
+	}{
+		{added, `{"name":"Design","isDefault":true}`},
+		{f.resumeID, `{"name":"Engineering"}`},
+		{f.resumeID, `{"name":"Engineering","isDefault":false}`},
+	} {
+		vars := map[string]string{"userID": f.alice.ID.Hex(), "resumeID": tt.resumeID.Hex()}
+		if w := (call{method: "PUT", body: tt.body, vars: vars}).serve(h.UpdateResume); w.Code != http.StatusOK {
+			t.Fatalf("update with %s: status = %d: %s", tt.body, w.Code, w.Body)
+		}
+	}
+
+	if ids := defaults(); len(ids) != 1 || ids[0] != f.resumeID {
+		t.Errorf("default resumes = %v, want only %v", ids, f.resumeID)
+	}
+	for _, event := range m.AuditEvents() {
+		for _, change := range event.Changes {
+			if strings.HasSuffix(change.Field, ".isdefault") {
+				t.Errorf("audit event %s records a default flag change: %+v", event.Action, change)
+			}
+		}
+	}
+}
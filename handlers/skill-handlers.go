@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"profolio-vercel/models"
+	"profolio-vercel/store"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// SkillHandlers serves the skills collection and the skills of each user
+type SkillHandlers struct {
+	Stores
+}
+
+func (h *SkillHandlers) GetSkills(w http.ResponseWriter, r *http.Request) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
+	defer cancel()
+
+	skills, err := h.Skills.ListSkills(ctx)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(skills)
+	return nil
+}
+
+// writeUserSkills answers with the skills referenced by the user the lookup names
+func (h *SkillHandlers) writeUserSkills(w http.ResponseWriter, r *http.Request, lookup store.Lookup) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
+	defer cancel()
+
+	user, err := h.Users.FindUser(ctx, lookup)
+	if err == store.ErrNotFound {
+		return errUserNotFound
+	} else if err != nil {
+		return err
+	}
+
+	// Collect skill IDs from user skills
+	var skillIDs []primitive.ObjectID
+	for _, skill := range user.Skills {
+		skillIDs = append(skillIDs, skill.Keywords...)
+	}
+
+	if len(skillIDs) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode([]models.SkillCollection{})
+		return nil
+	}
+
+	skills, err := h.Skills.FindSkills(ctx, skillIDs)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(skills)
+	return nil
+}
+
+func (h *SkillHandlers) GetSkillsByUserID(w http.ResponseWriter, r *http.Request) error {
+	userID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		return errInvalidUserID
+	}
+	return h.writeUserSkills(w, r, store.ByID(userID))
+}
+
+func (h *SkillHandlers) GetSkillsByUsername(w http.ResponseWriter, r *http.Request) error {
+	return h.writeUserSkills(w, r, store.ByUsername(mux.Vars(r)["username"]))
+}
+
+func (h *SkillHandlers) GetSkillsByEmail(w http.ResponseWriter, r *http.Request) error {
+	return h.writeUserSkills(w, r, store.ByEmail(normalizeEmail(mux.Vars(r)["email"])))
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"profolio-vercel/models"
+	"profolio-vercel/store"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSkillHandlers(t *testing.T) {
+	golang := models.SkillCollection{ID: primitive.NewObjectID(), Name: "Go"}
+	mongo := models.SkillCollection{ID: primitive.NewObjectID(), Name: "MongoDB"}
+
+	tests := []struct {
+		name    string
+		handler func(*SkillHandlers, http.ResponseWriter, *http.Request) error
+		vars    func(f fixture) map[string]string
+		want    int
+		skills  []string
+	}{
+		{"list", (*SkillHandlers).GetSkills, nil, http.StatusOK, []string{"Go", "MongoDB"}},
+		{"by user id", (*SkillHandlers).GetSkillsByUserID,
+			func(f fixture) map[string]string { return map[string]string{"id": f.alice.ID.Hex()} }, http.StatusOK, []string{"Go"}},
+		{"by username without skills", (*SkillHandlers).GetSkillsByUsername,
+			func(f fixture) map[string]string { return map[string]string{"username": "bob"} }, http.StatusOK, []string{}},
+		{"by email", (*SkillHandlers).GetSkillsByEmail,
+			func(f fixture) map[string]string { return map[string]string{"email": "ALICE@example.com"} }, http.StatusOK, []string{"Go"}},
+		{"by unknown user id", (*SkillHandlers).GetSkillsByUserID,
+			func(f fixture) map[string]string { return map[string]string{"id": primitive.NewObjectID().Hex()} }, http.StatusNotFound, nil},
+		{"by invalid user id", (*SkillHandlers).GetSkillsByUserID,
+			func(f fixture) map[string]string { return map[string]string{"id": "nope"} }, http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := testStores(t, golang, mongo)
+			f := newFixture(t, m)
+			skills := []models.Skill{{Name: "Backend", Keywords: []primitive.ObjectID{golang.ID}}}
+			if _, err := m.UpdateUser(context.Background(), store.ByID(f.alice.ID), store.AnyVersion, map[string]interface{}{"skills": skills}); err != nil {
+				t.Fatal(err)
+			}
+
+			c := call{method: "GET"}
+			if tt.vars != nil {
+				c.vars = tt.vars(f)
+			}
+			h := &SkillHandlers{Stores: MemoryStores(m)}
+			w := c.serve(func(w http.ResponseWriter, r *http.Request) error { return tt.handler(h, w, r) })
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.skills == nil {
+				return
+			}
+
+			var got []models.SkillCollection
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			names := []string{}
+			for _, skill := range got {
+				names = append(names, skill.Name)
+			}
+			if len(names) != len(tt.skills) {
+				t.Fatalf("skills = %v, want %v", names, tt.skills)
+			}
+			for i := range names {
+				if names[i] != tt.skills[i] {
+					t.Errorf("skills = %v, want %v", names, tt.skills)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package handlers
+
+import (
+	"profolio-vercel/store"
+)
+
+// Stores are the repositories the handlers read and write through. Every
+// handler struct embeds them, so each one is built with the stores it serves.
+type Stores struct {
+	Users      store.UserStore
+	Auth       store.AuthStore
+	TwoFactor  store.TwoFactorStore
+	Identities store.IdentityStore
+	Resumes    store.ResumeStore
+	Skills     store.SkillStore
+	Tokens     store.TokenStore
+	APIKeys    store.APIKeyStore
+	Audit      store.AuditStore
+}
+
+// MongoStores returns stores that all go to the profileFolio database
+func MongoStores(m *store.Mongo) Stores {
+	return Stores{Users: m, Auth: m, TwoFactor: m, Identities: m, Resumes: m, Skills: m, Tokens: m, APIKeys: m, Audit: m}
+}
+
+// MemoryStores returns stores that all share one store.Memory, for tests
+func MemoryStores(m *store.Memory) Stores {
+	return Stores{Users: m, Auth: m, TwoFactor: m, Identities: m, Resumes: m, Skills: m, Tokens: m, APIKeys: m, Audit: m}
+}
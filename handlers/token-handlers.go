@@ -0,0 +1,255 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"profolio-vercel/middleware"
+	"profolio-vercel/models"
+	"profolio-vercel/problem"
+	"profolio-vercel/store"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// refreshTokenTTL is how long a refresh token can be exchanged for a new access token
+const refreshTokenTTL = 30 * 24 * time.Hour
+
+type tokenPair struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+// newOpaqueToken returns a random URL-safe token and the hash that gets stored
+func newOpaqueToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, hashToken(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// errAccountDisabled is returned instead of tokens for users an admin disabled
+var errAccountDisabled = errors.New("account is disabled")
+
+// issueTokens signs an access token and stores a new refresh token in the given
+// family. An empty family starts a new one, as happens on every sign in.
+func (s Stores) issueTokens(ctx context.Context, userID primitive.ObjectID, authUser models.AuthUser, family string) (tokenPair, error) {
+	if authUser.Disabled {
+		return tokenPair{}, errAccountDisabled
+	}
+
+	accessToken, err := middleware.GenerateJWT(userID, authUser)
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	refreshToken, tokenHash, err := newOpaqueToken()
+	if err != nil {
+		return tokenPair{}, err
+	}
+	if family == "" {
+		family = primitive.NewObjectID().Hex()
+	}
+
+	now := time.Now()
+	err = s.Tokens.InsertRefreshToken(ctx, models.RefreshToken{
+		UserID:    userID,
+		Family:    family,
+		TokenHash: tokenHash,
+		CreatedAt: now,
+		ExpiresAt: now.Add(refreshTokenTTL),
+	})
+	if err != nil {
+		return tokenPair{}, err
+	}
+
+	return tokenPair{AccessToken: accessToken, RefreshToken: refreshToken}, nil
+}
+
+// findAuthUserByUserID loads the credentials that belong to a users document
+func (s Stores) findAuthUserByUserID(ctx context.Context, userID primitive.ObjectID) (models.User, models.AuthUser, error) {
+	var authUser models.AuthUser
+	user, err := s.Users.FindUser(ctx, store.ByID(userID))
+	if err != nil {
+		return user, authUser, err
+	}
+
+	authUser, err = s.Auth.FindAuthUser(ctx, user.Basics.Email)
+	return user, authUser, err
+}
+
+// revokeAllSessions revokes every refresh token and access token of the user
+func (s Stores) revokeAllSessions(ctx context.Context, userID primitive.ObjectID) error {
+	if err := s.Tokens.RevokeRefreshTokens(ctx, userID, ""); err != nil {
+		return err
+	}
+	return middleware.RevokeAllForUser(ctx, userID.Hex())
+}
+
+func (h *AuthHandlers) RefreshToken(w http.ResponseWriter, r *http.Request) error {
+	var body struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.RefreshToken == "" {
+		return errInvalidBody
+	}
+
+	tokens := h.Tokens
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
+	defer cancel()
+
+	// Spend the token; only an unused, unrevoked and unexpired token matches
+	tokenHash := hashToken(body.RefreshToken)
+	current, err := tokens.SpendRefreshToken(ctx, tokenHash, time.Now())
+	if err == store.ErrNotFound {
+		// A token that was already rotated is being replayed, so the family is compromised
+		if spent, err := tokens.FindRefreshToken(ctx, tokenHash); err == nil && spent.UsedAt != nil {
+			if err := tokens.RevokeRefreshTokens(ctx, spent.UserID, spent.Family); err != nil {
+				return problem.Internal("Error revoking token family", err)
+			}
+		}
+		return problem.Unauthorized("refresh_token_invalid", "Invalid refresh token")
+	} else if err != nil {
+		return problem.Internal("Error reading refresh token", err)
+	}
+
+	user, authUser, err := h.findAuthUserByUserID(ctx, current.UserID)
+	if err != nil {
+		return problem.Unauthorized("refresh_token_invalid", "Invalid refresh token")
+	}
+
+	pair, err := h.issueTokens(ctx, user.ID, authUser, current.Family)
+	if err != nil {
+		return tokenError(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pair)
+	return nil
+}
+
+// tokenError explains why issueTokens refused
+func tokenError(err error) error {
+	if errors.Is(err, errAccountDisabled) {
+		return problem.Forbidden("account_disabled", "Account is disabled")
+	}
+	return problem.Internal("Error generating token", err)
+}
+
+func (h *AuthHandlers) SignOut(w http.ResponseWriter, r *http.Request) error {
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		return middleware.ErrMissingClaims
+	}
+
+	// The refresh token is optional; without it only the access token is revoked
+	var body struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		return errInvalidBody
+	}
+
+	userID, err := claims.ObjectID()
+	if err != nil {
+		return errInvalidUserID
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
+	defer cancel()
+
+	if body.RefreshToken != "" {
+		// Only the caller's own token is revoked
+		token, err := h.Tokens.FindRefreshToken(ctx, hashToken(body.RefreshToken))
+		if err == nil && token.UserID == userID {
+			err = h.Tokens.RevokeRefreshTokens(ctx, userID, token.Family)
+		}
+		if err != nil && err != store.ErrNotFound {
+			return problem.Internal("Error revoking refresh token", err)
+		}
+	}
+
+	if err := middleware.RevokeToken(ctx, claims); err != nil {
+		return problem.Internal("Error revoking access token", err)
+	}
+
+	h.recordAudit(ctx, r, models.AuditEvent{
+		Action:   models.AuditTokenRevoked,
+		TargetID: userID.Hex(),
+		Details:  map[string]interface{}{"tokenId": claims.ID, "refreshToken": body.RefreshToken != ""},
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Signed out successfully"})
+	return nil
+}
+
+func (h *AuthHandlers) SignOutEverywhere(w http.ResponseWriter, r *http.Request) error {
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		return middleware.ErrMissingClaims
+	}
+
+	userID, err := claims.ObjectID()
+	if err != nil {
+		return errInvalidUserID
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
+	defer cancel()
+
+	if err := h.revokeAllSessions(ctx, userID); err != nil {
+		return problem.Internal("Error revoking sessions", err)
+	}
+
+	h.recordAudit(ctx, r, models.AuditEvent{Action: models.AuditSessionsRevoked, TargetID: userID.Hex()})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Signed out of all sessions"})
+	return nil
+}
+
+// createActionToken stores a new single-use token for the user, mailed to email,
+// and returns it. Earlier unused tokens with the same purpose stop working.
+func (s Stores) createActionToken(ctx context.Context, userID primitive.ObjectID, email, purpose string, ttl time.Duration) (string, error) {
+	token, tokenHash, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	err = s.Tokens.ReplaceActionToken(ctx, models.ActionToken{
+		UserID:    userID,
+		Purpose:   purpose,
+		TokenHash: tokenHash,
+		Email:     email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// consumeActionToken marks a token as used and returns it. It returns
+// store.ErrNotFound when the token is unknown, expired or already used.
+func (s Stores) consumeActionToken(ctx context.Context, token, purpose string) (models.ActionToken, error) {
+	return s.Tokens.ConsumeActionToken(ctx, hashToken(token), purpose, time.Now())
+}
@@ -0,0 +1,305 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"profolio-vercel/middleware"
+	"profolio-vercel/models"
+	"profolio-vercel/problem"
+	"profolio-vercel/totp"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	totpIssuer         = "ProFolio"
+	recoveryCodeCount  = 10
+	recoveryCodeLength = 10
+	recoveryAlphabet   = "abcdefghjkmnpqrstuvwxyz23456789"
+)
+
+// TwoFactorHandlers serve TOTP enrollment and the second step of a two-factor sign in
+type TwoFactorHandlers struct {
+	Stores
+}
+
+// newRecoveryCodes returns one-time codes for the user and the hashes that get stored
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := randomRecoveryCode()
+		if err != nil {
+			return nil, nil, err
+		}
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// randomRecoveryCode draws recoveryCodeLength characters uniformly from
+// recoveryAlphabet. Random bytes at or above the largest multiple of the
+// alphabet's length are dropped, as taking them modulo the length would
+// favour the first characters.
+func randomRecoveryCode() (string, error) {
+	limit := 256 - 256%len(recoveryAlphabet)
+	code := make([]byte, 0, recoveryCodeLength)
+	b := make([]byte, recoveryCodeLength)
+	for len(code) < recoveryCodeLength {
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		for _, c := range b {
+			if int(c) < limit && len(code) < recoveryCodeLength {
+				code = append(code, recoveryAlphabet[int(c)%len(recoveryAlphabet)])
+			}
+		}
+	}
+	return string(code), nil
+}
+
+func hashRecoveryCode(code string) string {
+	return hashToken(strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", "")))
+}
+
+// verifySecondFactor accepts a TOTP code, or failing that a recovery code,
+// and records it so neither can be used again
+func (s Stores) verifySecondFactor(ctx context.Context, authUser models.AuthUser, code, recoveryCode string) (bool, error) {
+	if code != "" {
+		step, ok := totp.Validate(authUser.TOTPSecret, code, time.Now())
+		if !ok {
+			return false, nil
+		}
+		return s.TwoFactor.UseTOTPStep(ctx, authUser.Email, step)
+	}
+
+	if recoveryCode != "" {
+		return s.TwoFactor.UseRecoveryCode(ctx, authUser.Email, hashRecoveryCode(recoveryCode))
+	}
+
+	return false, nil
+}
+
+// currentAuthUser loads the caller's users and auth_users documents
+func (s Stores) currentAuthUser(ctx context.Context, r *http.Request) (models.User, models.AuthUser, bool) {
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok {
+		return models.User{}, models.AuthUser{}, false
+	}
+	userID, err := claims.ObjectID()
+	if err != nil {
+		return models.User{}, models.AuthUser{}, false
+	}
+	user, authUser, err := s.findAuthUserByUserID(ctx, userID)
+	return user, authUser, err == nil
+}
+
+func (h *TwoFactorHandlers) Enroll(w http.ResponseWriter, r *http.Request) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
+	defer cancel()
+
+	_, authUser, ok := h.currentAuthUser(ctx, r)
+	if !ok {
+		return errUserNotFound
+	}
+	if authUser.TOTPEnabled {
+		return problem.Conflict("totp_already_enabled", "Two-factor authentication is already enabled")
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return problem.Internal("Error generating secret", err)
+	}
+
+	// The secret only becomes active once the user confirms a code from it
+	if err := h.TwoFactor.SetPendingTOTP(ctx, authUser.Email, secret); err != nil {
+		return problem.Internal("Error saving secret", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"secret":     secret,
+		"otpauthUri": totp.URI(totpIssuer, authUser.Email, secret),
+	})
+	return nil
+}
+
+func (h *TwoFactorHandlers) Confirm(w http.ResponseWriter, r *http.Request) error {
+	var body struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Code == "" {
+		return errInvalidBody
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
+	defer cancel()
+
+	_, authUser, ok := h.currentAuthUser(ctx, r)
+	if !ok {
+		return errUserNotFound
+	}
+	if authUser.TOTPPendingSecret == "" {
+		return problem.Invalid("totp_not_enrolling", "Two-factor enrollment has not been started")
+	}
+
+	step, valid := totp.Validate(authUser.TOTPPendingSecret, body.Code, time.Now())
+	if !valid {
+		return problem.Invalid("code_invalid", "Invalid code")
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return problem.Internal("Error generating recovery codes", err)
+	}
+
+	if err := h.TwoFactor.EnableTOTP(ctx, authUser.Email, authUser.TOTPPendingSecret, step, hashes); err != nil {
+		return problem.Internal("Error enabling two-factor authentication", err)
+	}
+
+	// Recovery codes are only ever shown here
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":       "Two-factor authentication enabled",
+		"recoveryCodes": codes,
+	})
+	return nil
+}
+
+func (h *TwoFactorHandlers) Disable(w http.ResponseWriter, r *http.Request) error {
+	var body struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return errInvalidBody
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
+	defer cancel()
+
+	_, authUser, ok := h.currentAuthUser(ctx, r)
+	if !ok {
+		return errUserNotFound
+	}
+	if !authUser.TOTPEnabled {
+		return problem.Invalid("totp_not_enabled", "Two-factor authentication is not enabled")
+	}
+
+	valid, err := h.verifySecondFactor(ctx, authUser, body.Code, body.RecoveryCode)
+	if err != nil {
+		return problem.Internal("Error checking code", err)
+	}
+	if !valid {
+		return problem.Invalid("code_invalid", "Invalid code")
+	}
+
+	if err := h.TwoFactor.DisableTOTP(ctx, authUser.Email); err != nil {
+		return problem.Internal("Error disabling two-factor authentication", err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication disabled"})
+	return nil
+}
+
+// SignIn is the second step of a two-factor sign in. It exchanges the
+// challenge token from AuthHandlers.SignIn and a valid code for real tokens.
+func (h *TwoFactorHandlers) SignIn(w http.ResponseWriter, r *http.Request) error {
+	var body struct {
+		ChallengeToken string `json:"challengeToken"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recoveryCode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.ChallengeToken == "" {
+		return errInvalidBody
+	}
+
+	challenge, err := middleware.ParseMFAChallenge(body.ChallengeToken)
+	if err != nil {
+		return problem.Unauthorized("challenge_invalid", "Invalid or expired challenge")
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
+	defer cancel()
+
+	if used, err := challenge.Used(ctx); err != nil {
+		return problem.Internal("Error checking challenge", err)
+	} else if used {
+		return problem.Unauthorized("challenge_invalid", "Invalid or expired challenge")
+	}
+
+	user, authUser, err := h.findAuthUserByUserID(ctx, challenge.UserID)
+	if err != nil || !authUser.TOTPEnabled {
+		return problem.Unauthorized("challenge_invalid", "Invalid or expired challenge")
+	}
+
+	// Codes are guessable too, so they share the signin lockout
+	guard := signinGuard()
+	keys := []string{signinIPKey(r), accountKey(authUser.Email)}
+	if wait, err := guard.Check(ctx, keys...); err != nil {
+		return problem.Internal("Error checking signin attempts", err)
+	} else if wait > 0 {
+		h.recordSignInFailure(ctx, r, "totp", authUser.Email, user.ID.Hex(), "locked_out")
+		return lockedOut(w, wait)
+	}
+
+	valid, err := h.verifySecondFactor(ctx, authUser, body.Code, body.RecoveryCode)
+	if err != nil {
+		return problem.Internal("Error checking code", err)
+	}
+	if !valid {
+		h.recordSignInFailure(ctx, r, "totp", authUser.Email, user.ID.Hex(), "wrong_code")
+		return signInFailure(ctx, w, guard, keys)
+	}
+
+	guard.Succeed(ctx, accountKey(authUser.Email))
+
+	// A challenge is exchanged once; wrong codes before that don't use it up
+	if err := challenge.Use(ctx); err == middleware.ErrChallengeUsed {
+		return problem.Unauthorized("challenge_invalid", "Invalid or expired challenge")
+	} else if err != nil {
+		return problem.Internal("Error recording challenge", err)
+	}
+	return h.writeSignInResponse(ctx, w, r, user, authUser, "totp")
+}
+
+// writeSignInResponse issues tokens for a user who passed every sign in step.
+// method names the last step for the audit log.
+func (s Stores) writeSignInResponse(ctx context.Context, w http.ResponseWriter, r *http.Request, user models.User, authUser models.AuthUser, method string) error {
+	tokens, err := s.issueTokens(ctx, user.ID, authUser, "")
+	if err != nil {
+		return tokenError(err)
+	}
+	s.recordSignIn(ctx, r, user.ID, method)
+
+	response := map[string]interface{}{
+		"id":           user.ID,
+		"user":         user.Basics,
+		"accessToken":  tokens.AccessToken,
+		"refreshToken": tokens.RefreshToken,
+	}
+
+	json.NewEncoder(w).Encode(response)
+	return nil
+}
+
+// writeMFAChallenge answers the password step of a two-factor sign in
+func writeMFAChallenge(w http.ResponseWriter, userID primitive.ObjectID) error {
+	challenge, err := middleware.GenerateMFAChallenge(userID)
+	if err != nil {
+		return problem.Internal("Error generating token", err)
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"mfaRequired":    true,
+		"challengeToken": challenge,
+	})
+	return nil
+}
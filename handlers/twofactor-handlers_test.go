@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"profolio-vercel/models"
+	"profolio-vercel/store"
+	"profolio-vercel/totp"
+)
+
+// twoFactorFixture is dave, who signed up with a password and enabled TOTP
+type twoFactorFixture struct {
+	auth          *AuthHandlers
+	twoFactor     *TwoFactorHandlers
+	dave          models.User
+	secret        string
+	recoveryCodes []string
+}
+
+// codeAt returns dave's code for the step offset steps from now
+func (f twoFactorFixture) codeAt(t *testing.T, offset int64) string {
+	t.Helper()
+	code, err := totp.CodeAt(f.secret, totp.Step(time.Now())+offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+// challenge signs dave in with his password and returns the challenge token
+func (f twoFactorFixture) challenge(t *testing.T) string {
+	t.Helper()
+	w := call{method: "POST", body: `{"email":"dave@example.com","password":"correct horse"}`}.serve(f.auth.SignIn)
+	var body struct {
+		MFARequired    bool   `json:"mfaRequired"`
+		ChallengeToken string `json:"challengeToken"`
+		AccessToken    string `json:"accessToken"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || !body.MFARequired || body.ChallengeToken == "" || body.AccessToken != "" {
+		t.Fatalf("password step answered %d: %s", w.Code, w.Body)
+	}
+	return body.ChallengeToken
+}
+
+// signIn exchanges a challenge token and a code for tokens
+func (f twoFactorFixture) signIn(challenge, code, recoveryCode string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(map[string]string{"challengeToken": challenge, "code": code, "recoveryCode": recoveryCode})
+	return call{method: "POST", body: string(body)}.serve(f.twoFactor.SignIn)
+}
+
+func newTwoFactorFixture(t *testing.T) twoFactorFixture {
+	t.Helper()
+	m := testStores(t)
+	f := twoFactorFixture{auth: &AuthHandlers{Stores: MemoryStores(m)}, twoFactor: &TwoFactorHandlers{Stores: MemoryStores(m)}}
+	if w := (call{method: "POST", body: `{"username":"dave","email":"dave@example.com","password":"correct horse"}`}).serve(f.auth.SignUp); w.Code != http.StatusCreated {
+		t.Fatalf("sign up status = %d: %s", w.Code, w.Body)
+	}
+	var err error
+	if f.dave, err = m.FindUser(context.Background(), store.ByEmail("dave@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	claims := claimsFor(f.dave, models.RoleUser)
+
+	w := call{method: "POST", claims: claims}.serve(f.twoFactor.Enroll)
+	var enrollment struct{ Secret, OtpauthURI string }
+	if err := json.Unmarshal(w.Body.Bytes(), &enrollment); err != nil || enrollment.Secret == "" {
+		t.Fatalf("enroll answered %d: %s", w.Code, w.Body)
+	}
+	if !strings.HasPrefix(enrollment.OtpauthURI, "otpauth://totp/ProFolio:dave@example.com?") {
+		t.Errorf("otpauth URI = %q", enrollment.OtpauthURI)
+	}
+	f.secret = enrollment.Secret
+
+	w = call{method: "POST", body: `{"code":"` + f.codeAt(t, 0) + `"}`, claims: claims}.serve(f.twoFactor.Confirm)
+	var confirmation struct{ RecoveryCodes []string }
+	if err := json.Unmarshal(w.Body.Bytes(), &confirmation); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("confirm answered %d: %s", w.Code, w.Body)
+	}
+	f.recoveryCodes = confirmation.RecoveryCodes
+	return f
+}
+
+func TestTwoFactorEnrollment(t *testing.T) {
+	f := newTwoFactorFixture(t)
+	claims := claimsFor(f.dave, models.RoleUser)
+
+	if len(f.recoveryCodes) != recoveryCodeCount {
+		t.Errorf("got %d recovery codes, want %d", len(f.recoveryCodes), recoveryCodeCount)
+	}
+	seen := map[string]bool{}
+	for _, code := range f.recoveryCodes {
+		plain := strings.Replace(code, "-", "", 1)
+		if len(plain) != recoveryCodeLength || code[5] != '-' || strings.Trim(plain, recoveryAlphabet) != "" || seen[code] {
+			t.Errorf("recovery code %q", code)
+		}
+		seen[code] = true
+	}
+
+	if w := (call{method: "POST", claims: claims}).serve(f.twoFactor.Enroll); w.Code != http.StatusConflict {
+		t.Errorf("enrolling again: status = %d, want %d", w.Code, http.StatusConflict)
+	}
+	if w := (call{method: "POST", body: `{"code":"` + f.codeAt(t, 1) + `"}`, claims: claims}).serve(f.twoFactor.Confirm); w.Code != http.StatusBadRequest {
+		t.Errorf("confirming again: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestTwoFactorConfirmWrongCode(t *testing.T) {
+	m := testStores(t)
+	auth, twoFactor := &AuthHandlers{Stores: MemoryStores(m)}, &TwoFactorHandlers{Stores: MemoryStores(m)}
+	call{method: "POST", body: `{"username":"dave","email":"dave@example.com","password":"correct horse"}`}.serve(auth.SignUp)
+	dave, err := m.FindUser(context.Background(), store.ByEmail("dave@example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := claimsFor(dave, models.RoleUser)
+
+	if w := (call{method: "POST", body: `{"code":"123456"}`, claims: claims}).serve(twoFactor.Confirm); w.Code != http.StatusBadRequest {
+		t.Errorf("confirming before enrolling: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	call{method: "POST", claims: claims}.serve(twoFactor.Enroll)
+	for _, code := range []string{"000000", "12345"} {
+		if w := (call{method: "POST", body: `{"code":"` + code + `"}`, claims: claims}).serve(twoFactor.Confirm); w.Code != http.StatusBadRequest {
+			t.Errorf("confirming %q: status = %d, want %d", code, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	// Until a code is confirmed the password alone still signs in
+	w := call{method: "POST", body: `{"email":"dave@example.com","password":"correct horse"}`}.serve(auth.SignIn)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "mfaRequired") {
+		t.Errorf("sign in answered %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestTwoFactorSignIn(t *testing.T) {
+	f := newTwoFactorFixture(t)
+
+	// The code Confirm accepted cannot be used again
+	if w := f.signIn(f.challenge(t), f.codeAt(t, 0), ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("replayed code: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := f.signIn(f.challenge(t), "000000", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong code: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// A wrong code doesn't use up the challenge, but an exchange does
+	challenge := f.challenge(t)
+	if w := f.signIn(challenge, "000000", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong code: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	w := f.signIn(challenge, f.codeAt(t, 1), "")
+	var tokens struct{ AccessToken, RefreshToken string }
+	if err := json.Unmarshal(w.Body.Bytes(), &tokens); err != nil || w.Code != http.StatusOK || tokens.AccessToken == "" || tokens.RefreshToken == "" {
+		t.Fatalf("code: status = %d: %s", w.Code, w.Body)
+	}
+	if w := f.signIn(challenge, "", f.recoveryCodes[0]); w.Code != http.StatusUnauthorized {
+		t.Errorf("exchanged challenge: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// Only an intact challenge token passes
+	if w := f.signIn(tokens.AccessToken, "", f.recoveryCodes[0]); w.Code != http.StatusUnauthorized {
+		t.Errorf("access token: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := f.signIn(f.challenge(t)+"x", "", f.recoveryCodes[0]); w.Code != http.StatusUnauthorized {
+		t.Errorf("tampered challenge: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestTwoFactorRecoveryCodes(t *testing.T) {
+	f := newTwoFactorFixture(t)
+
+	// Recovery codes ignore case and the dash
+	code := strings.ToUpper(strings.Replace(f.recoveryCodes[3], "-", "", 1))
+	if w := f.signIn(f.challenge(t), "", code); w.Code != http.StatusOK {
+		t.Fatalf("recovery code: status = %d: %s", w.Code, w.Body)
+	}
+	if w := f.signIn(f.challenge(t), "", f.recoveryCodes[3]); w.Code != http.StatusUnauthorized {
+		t.Errorf("used recovery code: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := f.signIn(f.challenge(t), "", "aaaaa-aaaaa"); w.Code != http.StatusUnauthorized {
+		t.Errorf("unknown recovery code: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := f.signIn(f.challenge(t), "", f.recoveryCodes[4]); w.Code != http.StatusOK {
+		t.Errorf("another recovery code: status = %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestTwoFactorDisable(t *testing.T) {
+	f := newTwoFactorFixture(t)
+	claims := claimsFor(f.dave, models.RoleUser)
+
+	for _, body := range []string{`{"code":"000000"}`, `{"recoveryCode":"aaaaa-aaaaa"}`, `{}`} {
+		if w := (call{method: "POST", body: body, claims: claims}).serve(f.twoFactor.Disable); w.Code != http.StatusBadRequest {
+			t.Errorf("disabling with %s: status = %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+	if w := (call{method: "POST", body: `{"code":"` + f.codeAt(t, 1) + `"}`, claims: claims}).serve(f.twoFactor.Disable); w.Code != http.StatusOK {
+		t.Fatalf("disabling: status = %d: %s", w.Code, w.Body)
+	}
+	if w := (call{method: "POST", body: `{"code":"` + f.codeAt(t, 1) + `"}`, claims: claims}).serve(f.twoFactor.Disable); w.Code != http.StatusBadRequest {
+		t.Errorf("disabling again: status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	w := call{method: "POST", body: `{"email":"dave@example.com","password":"correct horse"}`}.serve(f.auth.SignIn)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "mfaRequired") {
+		t.Errorf("sign in answered %d: %s", w.Code, w.Body)
+	}
+}
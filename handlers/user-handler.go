@@ -3,16 +3,22 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
+	"profolio-vercel/lockout"
+	"profolio-vercel/logging"
 	"profolio-vercel/middleware"
 	"profolio-vercel/models"
-	"profolio-vercel/shared"
+	"profolio-vercel/patch"
+	"profolio-vercel/problem"
+	"profolio-vercel/store"
+	"profolio-vercel/validation"
 
 	"github.com/gorilla/mux"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"golang.org/x/crypto/bcrypt"
@@ -20,706 +26,432 @@ import (
 
 var client *mongo.Client
 
+// SetClient connects the attempt counters to the database and creates the
+// indexes the stores rely on. The handlers themselves get MongoStores.
 func SetClient(mongoClient *mongo.Client) {
-	client = shared.GetClient()
+	client = mongoClient
+	SetAttemptStore(lockout.NewMongoStore(mongoClient.Database("profileFolio").Collection("login_attempts")))
+	EnsureIndexes()
 }
 
-func UserHandler(w http.ResponseWriter, r *http.Request) {
-	SetClient(client)
-	if client == nil {
-		http.Error(w, "Database client not initialized", http.StatusInternalServerError)
-		return
-	}
-
-	path := strings.TrimPrefix(r.URL.Path, "/users")
-
-	switch r.Method {
-	case http.MethodGet:
-		handleGetRequest(w, r, path)
-	case http.MethodPost:
-		handlePostRequest(w, r)
-	case http.MethodPut:
-		handlePutRequest(w, r)
-	case http.MethodDelete:
-		handleDeleteRequest(w, r, path)
-	default:
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-	}
+// UserHandlers serves the profiles in the users collection
+type UserHandlers struct {
+	Stores
 }
 
-func handleGetRequest(w http.ResponseWriter, r *http.Request, path string) {
-
-	switch {
-	case path == "":
-		GetAllUsersHandler(w, r)
-	case strings.Contains(path, "@"):
-		// Assume it's an email
-		GetUserByEmailHandler(w, r)
-	case len(path) < 24:
-		// Assume it's a username
-		GetUserByUsernameHandler(w, r)
-	default:
-		// Assume it's a user ID
-		GetUserByIDHandler(w, r)
-	}
+// AuthHandlers serves signup, signin and the sessions they start
+type AuthHandlers struct {
+	Stores
 }
 
-func handlePostRequest(w http.ResponseWriter, r *http.Request) {
-	// Implement your logic for handling POST requests
-}
-
-func handlePutRequest(w http.ResponseWriter, r *http.Request) {
-	// Implement your logic for handling PUT requests
-}
-
-func handleDeleteRequest(w http.ResponseWriter, r *http.Request, path string) {
-	// Implement your logic for handling DELETE requests
-}
-
-func GetAllUsersHandler(w http.ResponseWriter, r *http.Request) {
-
-	collection := client.Database("profileFolio").Collection("users")
-	var users []models.User
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	// Find all users
-	cursor, err := collection.Find(ctx, bson.M{})
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer cursor.Close(ctx)
+// Page sizes accepted by the user listing
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
 
-	// Iterate through the cursor and decode each document
-	for cursor.Next(ctx) {
-		var user models.User
-		if err := cursor.Decode(&user); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		users = append(users, user)
+// pagination reads the page and limit query parameters, falling back to the
+// first page of defaultPageSize results
+func pagination(r *http.Request) (page, limit int64) {
+	page, limit = 1, defaultPageSize
+	if p, err := strconv.ParseInt(r.URL.Query().Get("page"), 10, 64); err == nil && p > 0 {
+		page = p
 	}
-
-	if err := cursor.Err(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(users); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if l, err := strconv.ParseInt(r.URL.Query().Get("limit"), 10, 64); err == nil && l > 0 {
+		limit = min(l, maxPageSize)
 	}
+	return page, limit
 }
 
-func GetUserByIDHandler(w http.ResponseWriter, r *http.Request) {
-
-	// path := strings.TrimPrefix(r.URL.Path, "/users/")
-	value := strings.TrimPrefix(r.URL.Path, "/users/")
-
-	id, err := primitive.ObjectIDFromHex(value)
-	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
-		return
+func (h *UserHandlers) GetAllUsers(w http.ResponseWriter, r *http.Request) error {
+	// Only staff may list other users
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok || !claims.Can(middleware.PermListUsers) {
+		return middleware.ErrForbidden
 	}
 
-	collection := client.Database("profileFolio").Collection("users")
-	var user models.User
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
 	defer cancel()
 
-	err = collection.FindOne(ctx, bson.M{"_id": id}).Decode(&user)
+	// Find one page of users, oldest first
+	page, limit := pagination(r)
+	users, total, err := h.Users.ListUsers(ctx, (page-1)*limit, limit)
 	if err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
-		return
+		return err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(user)
-}
-
-func GetUserByEmailHandler(w http.ResponseWriter, r *http.Request) {
-	// Get the email from the URL parameter
-	email := strings.TrimPrefix(r.URL.Path, "/users/")
-
-	collection := client.Database("profileFolio").Collection("users")
-	var user models.User
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	// Find user by email
-	err := collection.FindOne(ctx, bson.M{"basics.email": email}).Decode(&user)
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			http.Error(w, "User not found", http.StatusNotFound)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-		return
+	response := map[string]interface{}{
+		"users": users,
+		"page":  page,
+		"limit": limit,
+		"total": total,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(user)
+	json.NewEncoder(w).Encode(response)
+	return nil
 }
 
-func GetUserByUsernameHandler(w http.ResponseWriter, r *http.Request) {
-	// Get the username from the URL parameter
-	username := strings.TrimPrefix(r.URL.Path, "/users/")
-
-	collection := client.Database("profileFolio").Collection("users")
-	var user models.User
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// writeUser answers with the user the lookup names, tagged with its version
+func (h *UserHandlers) writeUser(w http.ResponseWriter, r *http.Request, lookup store.Lookup) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
 	defer cancel()
 
-	// Find user by username
-	err := collection.FindOne(ctx, bson.M{"basics.username": username}).Decode(&user)
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			http.Error(w, "User not found", http.StatusNotFound)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-		return
+	user, err := h.Users.FindUser(ctx, lookup)
+	if err == store.ErrNotFound {
+		return errUserNotFound
+	} else if err != nil {
+		return err
 	}
 
+	w.Header().Set("ETag", etag(user.Version))
+	if notModified(r, user.Version) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(user)
+	return nil
 }
 
-func UpdateUserByEmailHandler(w http.ResponseWriter, r *http.Request) {
-	// Get the email from the URL parameter
-	vars := mux.Vars(r)
-	email := vars["email"]
-
-	// Parse the request body
-	var updates map[string]interface{}
-	err := json.NewDecoder(r.Body).Decode(&updates)
+func (h *UserHandlers) GetUserByID(w http.ResponseWriter, r *http.Request) error {
+	id, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
 	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+		return errInvalidUserID
 	}
+	return h.writeUser(w, r, store.ByID(id))
+}
 
-	// Prepare the update document
-	update := bson.M{}
-	for key, value := range updates {
-		update[key] = value
-	}
+func (h *UserHandlers) GetUserByEmail(w http.ResponseWriter, r *http.Request) error {
+	return h.writeUser(w, r, store.ByEmail(normalizeEmail(mux.Vars(r)["email"])))
+}
 
-	collection := client.Database("profileFolio").Collection("users")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+func (h *UserHandlers) GetUserByUsername(w http.ResponseWriter, r *http.Request) error {
+	return h.writeUser(w, r, store.ByUsername(mux.Vars(r)["username"]))
+}
 
-	// Perform the update
-	result, err := collection.UpdateOne(
-		ctx,
-		bson.M{"basics.email": email},
-		bson.M{"$set": update},
-	)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+// updateUser applies the fields in the request body to the user the lookup names.
+// Only the fields of models.UserUpdate can be written. Merge patches and JSON
+// patches go to patchUser.
+func (h *UserHandlers) updateUser(w http.ResponseWriter, r *http.Request, lookup store.Lookup) error {
+	switch mediaType(r) {
+	case patch.MergePatchType, patch.JSONPatchType:
+		return h.patchUser(w, r, lookup)
+	case "", "application/json":
+	default:
+		return unsupportedPatch(w, acceptPatch)
 	}
 
-	if result.MatchedCount == 0 {
-		http.Error(w, "User not found", http.StatusNotFound)
-		return
+	var body models.UserUpdate
+	if err := decodeStrict(r, &body); err != nil {
+		return err
+	}
+	if err := validation.Struct(body); err != nil {
+		return err
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"message": "User updated successfully"})
-}
-
-func UpdateUserByUsernameHandler(w http.ResponseWriter, r *http.Request) {
-	// Get the username from the URL parameter
-	vars := mux.Vars(r)
-	username := vars["username"]
-
-	// Parse the request body
-	var updates map[string]interface{}
-	err := json.NewDecoder(r.Body).Decode(&updates)
+	update, err := body.Set()
 	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+		return errInvalidBody
 	}
-
-	// Prepare the update document
-	update := bson.M{}
-	for key, value := range updates {
-		update[key] = value
+	if len(update) == 0 {
+		return problem.Invalid("empty_update", "The request changes no fields")
 	}
 
-	collection := client.Database("profileFolio").Collection("users")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
 	defer cancel()
 
-	// Perform the update
-	result, err := collection.UpdateOne(
-		ctx,
-		bson.M{"basics.username": username},
-		bson.M{"$set": update},
-	)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	// The version is only read when the request is conditional
+	version := store.AnyVersion
+	if r.Header.Get("If-Match") != "" {
+		current, err := h.Users.FindUser(ctx, lookup)
+		if err == store.ErrNotFound {
+			return errUserNotFound
+		} else if err != nil {
+			return err
+		}
+		if version, err = ifMatch(r, current.Version); err != nil {
+			return err
+		}
 	}
 
-	if result.MatchedCount == 0 {
-		http.Error(w, "User not found", http.StatusNotFound)
-		return
+	// Perform the update, keeping the previous document for the audit log
+	before, err := h.Users.UpdateUser(ctx, lookup, version, update)
+	if err == store.ErrNotFound {
+		return errUserNotFound
+	} else if err != nil {
+		return versionError(r, err)
 	}
 
+	h.recordUserUpdate(ctx, r, before, update)
+
+	w.Header().Set("ETag", etag(store.Version(before)+1))
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"message": "User updated successfully"})
+	return nil
 }
 
-func SignUpHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
-		return
-	}
-
-	var user models.User
-	var authUser models.AuthUser
-	if err := json.NewDecoder(r.Body).Decode(&authUser); err != nil {
-		http.Error(w, "Error decoding request body", http.StatusBadRequest)
-		return
-	}
-
-	// Hash the password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(authUser.Password), bcrypt.DefaultCost)
-	if err != nil {
-		http.Error(w, "Error hashing password", http.StatusInternalServerError)
-		return
-	}
-	authUser.Password = string(hashedPassword)
-
-	userCollection := client.Database("profileFolio").Collection("users")
-	authCollection := client.Database("profileFolio").Collection("auth_users")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+// patchUser applies a merge patch or JSON patch to the user the lookup names,
+// writing only the members and arrays the patch touched
+func (h *UserHandlers) patchUser(w http.ResponseWriter, r *http.Request, lookup store.Lookup) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
 	defer cancel()
 
-	// Check if the user already exists
-	filter_email := bson.M{"email": authUser.Email}
-	filter_username := bson.M{"username": authUser.Username}
-
-	email_err := authCollection.FindOne(ctx, filter_email).Decode(&authUser)
-	username_err := authCollection.FindOne(ctx, filter_username).Decode(&authUser)
-
-	if email_err == nil {
-		http.Error(w, "Email already exists", http.StatusConflict)
-		return
-	} else if username_err == nil {
-		http.Error(w, "Username already exists", http.StatusConflict)
-		return
-	} else if email_err != mongo.ErrNoDocuments {
-		http.Error(w, "Error checking user existence", http.StatusInternalServerError)
-		return
+	current, err := h.Users.FindUser(ctx, lookup)
+	if err == store.ErrNotFound {
+		return errUserNotFound
+	} else if err != nil {
+		return err
 	}
 
-	// Insert into auth_users collection
-	_, auth_err := authCollection.InsertOne(ctx, authUser)
-	if auth_err != nil {
-		http.Error(w, "Error saving user credentials", http.StatusInternalServerError)
-		return
+	if _, err := ifMatch(r, current.Version); err != nil {
+		return err
 	}
 
-	// Create a new User object with only email
-	user = models.User{
-		Basics: models.Basics{
-			Username: authUser.Username,
-			Email:    authUser.Email,
-		},
-	}
-
-	// Insert into users collection
-	_, user_err := userCollection.InsertOne(ctx, user)
-	if user_err != nil {
-		http.Error(w, "Error saving user object", http.StatusInternalServerError)
-		return
-	}
-
-	var new_user models.User
-	collection := client.Database("profileFolio").Collection("users")
-	err = collection.FindOne(ctx, bson.M{"basics.email": authUser.Email}).Decode(&new_user)
+	var patched models.User
+	changes, err := applyPatch(r, current, &patched, userPatchPaths)
 	if err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
-		return
+		return err
 	}
-
-	// Generate JWT token
-	token, err := middleware.GenerateJWT()
-	if err != nil {
-		http.Error(w, "Error generating token", http.StatusInternalServerError)
-		return
-	}
-
-	w.WriteHeader(http.StatusCreated)
-	response := map[string]interface{}{
-		"message":     "User created successfully",
-		"id":          new_user.ID,
-		"accessToken": token,
-		"user":        new_user,
-	}
-	json.NewEncoder(w).Encode(response)
-}
-
-func SignInHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
-		return
-	}
-
-	var credentials struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
-		http.Error(w, "Error decoding request body", http.StatusBadRequest)
-		return
-	}
-
-	var authUser models.AuthUser
-	collection := client.Database("profileFolio").Collection("auth_users")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	// Find user by email
-	err := collection.FindOne(ctx, bson.M{"email": credentials.Email}).Decode(&authUser)
-	if err != nil {
-		http.Error(w, "Invalid user credentials", http.StatusUnauthorized)
-		return
+	if err := validation.Struct(patched); err != nil {
+		return err
 	}
 
-	// Check hashed password
-	err = bcrypt.CompareHashAndPassword([]byte(authUser.Password), []byte(credentials.Password))
+	before, err := storedDoc(current)
 	if err != nil {
-		http.Error(w, "Invalid user credentials", http.StatusUnauthorized)
-		return
+		return err
 	}
-
-	// Returning user schema
-	var user models.User
-	collection = client.Database("profileFolio").Collection("users")
-	err = collection.FindOne(ctx, bson.M{"basics.email": credentials.Email}).Decode(&user)
+	after, err := storedDoc(patched)
 	if err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
-		return
+		return err
 	}
+	update, written := patchUpdate(patched, changes, before, after)
 
-	// Generate JWT token
-	token, err := middleware.GenerateJWT()
-	if err != nil {
-		http.Error(w, "Error generating token", http.StatusInternalServerError)
-		return
+	// The update was worked out from the version read above, so it may only
+	// apply to that version, keeping the previous document for the audit log
+	previous, err := h.Users.PatchUser(ctx, store.ByID(current.ID), current.Version, update)
+	if err == store.ErrNotFound {
+		return errUserNotFound
+	} else if err != nil {
+		return versionError(r, err)
 	}
 
-	response := map[string]interface{}{
-		"id":          user.ID,
-		"user":        user.Basics,
-		"accessToken": token,
-	}
+	h.recordUserUpdate(ctx, r, previous, written)
 
-	json.NewEncoder(w).Encode(response)
+	w.Header().Set("ETag", etag(store.Version(previous)+1))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "User updated successfully"})
+	return nil
 }
 
-func GetUserHandler(w http.ResponseWriter, r *http.Request) {
-	collection := client.Database("profileFolio").Collection("users")
-	var user models.User
-	err := collection.FindOne(context.Background(), bson.M{}).Decode(&user)
+func (h *UserHandlers) UpdateUser(w http.ResponseWriter, r *http.Request) error {
+	// Get the user ID from the URL parameter
+	userID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return errInvalidUserID
 	}
-
-	json.NewEncoder(w).Encode(user)
+	return h.updateUser(w, r, store.ByID(userID))
 }
 
-func GetSkillsHandler(w http.ResponseWriter, r *http.Request) {
-	collection := client.Database("profileFolio").Collection("skills")
-	var skills []models.SkillCollection
-
-	cursor, err := collection.Find(context.Background(), bson.M{})
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer cursor.Close(context.Background())
-
-	for cursor.Next(context.Background()) {
-		var skill models.SkillCollection
-		if err := cursor.Decode(&skill); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		skills = append(skills, skill)
-	}
-
-	if err := cursor.Err(); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(skills); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
+func (h *UserHandlers) UpdateUserByEmail(w http.ResponseWriter, r *http.Request) error {
+	// Get the email from the URL parameter
+	return h.updateUser(w, r, store.ByEmail(normalizeEmail(mux.Vars(r)["email"])))
 }
 
-func GetSkillsByUserIDHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	userID, err := primitive.ObjectIDFromHex(vars["id"])
-	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
-		return
-	}
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	collection := client.Database("profileFolio").Collection("users")
-	var user models.User
+func (h *UserHandlers) UpdateUserByUsername(w http.ResponseWriter, r *http.Request) error {
+	// Get the username from the URL parameter
+	return h.updateUser(w, r, store.ByUsername(mux.Vars(r)["username"]))
+}
 
-	err = collection.FindOne(ctx, bson.M{"_id": userID}).Decode(&user)
+func (h *UserHandlers) AddUser(w http.ResponseWriter, r *http.Request) error {
+	var newUser models.User
+	err := json.NewDecoder(r.Body).Decode(&newUser)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			http.Error(w, "User not found", http.StatusNotFound)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-		return
+		return errInvalidBody
 	}
-
-	if len(user.Skills) == 0 {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode([]models.SkillCollection{})
-		return
+	newUser.Basics.Email = normalizeEmail(newUser.Basics.Email)
+	// Versions only ever come from the store
+	newUser.Version = 0
+	for i := range newUser.Resumes {
+		newUser.Resumes[i].Version = 0
 	}
-
-	// Collect skill IDs from user skills
-	var skillIDs []primitive.ObjectID
-	for _, skill := range user.Skills {
-		skillIDs = append(skillIDs, skill.Keywords...)
+	if err := validation.Struct(newUser); err != nil {
+		return err
 	}
 
-	if len(skillIDs) == 0 {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode([]models.SkillCollection{})
-		return
+	// Users may only create the profile that belongs to their own account
+	claims, ok := middleware.ClaimsFromContext(r.Context())
+	if !ok || (!claims.Can(middleware.PermManageAnyUser) && !strings.EqualFold(newUser.Basics.Email, claims.Email)) {
+		return middleware.ErrForbidden
 	}
 
-	skillCollection := client.Database("profileFolio").Collection("skills")
-	filter := bson.M{"_id": bson.M{"$in": skillIDs}}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
+	defer cancel()
 
-	cursor, err := skillCollection.Find(ctx, filter)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	// Insert new user without specifying ID; the unique index rejects an existing email
+	created, err := h.Users.InsertUser(ctx, newUser)
+	if errors.Is(err, store.ErrEmailTaken) {
+		return problem.Conflict("email_taken", "User with this email already exists")
+	} else if errors.Is(err, store.ErrUsernameTaken) {
+		return problem.Conflict("username_taken", "User with this username already exists")
+	} else if err != nil {
+		return err
 	}
-	defer cursor.Close(ctx)
 
-	var skills []models.SkillCollection
-	if err = cursor.All(ctx, &skills); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "User added successfully",
+		"id":      created.ID.Hex(),
+	})
+	return nil
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(skills)
+// normalizeEmail is applied to every email before it is stored or looked up,
+// so addresses differing only in case belong to the same account
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
 }
 
-func GetSkillsByUsernameHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	username := vars["username"]
+// SignUp creates an account and signs it in
+func (h *AuthHandlers) SignUp(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return problem.MethodNotAllowed("Invalid request method")
+	}
 
-	collection := client.Database("profileFolio").Collection("users")
 	var user models.User
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	err := collection.FindOne(ctx, bson.M{"basics.username": username}).Decode(&user)
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			http.Error(w, "User not found", http.StatusNotFound)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-		return
+	var authUser models.AuthUser
+	if err := json.NewDecoder(r.Body).Decode(&authUser); err != nil {
+		return errInvalidBody
 	}
-
-	if len(user.Skills) == 0 {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode([]models.SkillCollection{})
-		return
+	authUser.Email = normalizeEmail(authUser.Email)
+	if err := validation.Struct(authUser); err != nil {
+		return err
 	}
 
-	// Collect skill IDs from user skills
-	var skillIDs []primitive.ObjectID
-	for _, skill := range user.Skills {
-		skillIDs = append(skillIDs, skill.Keywords...)
-	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
+	defer cancel()
 
-	if len(skillIDs) == 0 {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode([]models.SkillCollection{})
-		return
+	// Every signup from an IP counts towards its limit
+	if wait, err := signupGuard().Fail(ctx, signupIPKey(r)); err != nil {
+		return problem.Internal("Error checking signup attempts", err)
+	} else if wait > 0 {
+		return lockedOut(w, wait)
 	}
 
-	skillCollection := client.Database("profileFolio").Collection("skills")
-	filter := bson.M{"_id": bson.M{"$in": skillIDs}}
-
-	cursor, err := skillCollection.Find(ctx, filter)
+	// Hash the password
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(authUser.Password), bcrypt.DefaultCost)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	defer cursor.Close(ctx)
-
-	var skills []models.SkillCollection
-	if err = cursor.All(ctx, &skills); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return problem.Internal("Error hashing password", err)
 	}
+	authUser.Password = string(hashedPassword)
+	authUser.Role = models.RoleUser // Roles are never taken from the request body
+	authUser.EmailVerified = false  // Nor is the verification state
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(skills)
-}
-
-func GetSkillsByEmailHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	email := vars["email"]
-
-	collection := client.Database("profileFolio").Collection("users")
-	var user models.User
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	err := collection.FindOne(ctx, bson.M{"basics.email": email}).Decode(&user)
-	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			http.Error(w, "User not found", http.StatusNotFound)
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-		return
+	// Create a new User object with only email
+	user = models.User{
+		Basics: models.Basics{
+			Username: authUser.Username,
+			Email:    authUser.Email,
+		},
 	}
 
-	if len(user.Skills) == 0 {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode([]models.SkillCollection{})
-		return
+	// Insert into auth_users and users together; the unique indexes reject duplicates
+	new_user, err := h.Auth.CreateAccount(ctx, authUser, user)
+	if errors.Is(err, store.ErrEmailTaken) {
+		return problem.Conflict("email_taken", "Email already exists")
+	} else if errors.Is(err, store.ErrUsernameTaken) {
+		return problem.Conflict("username_taken", "Username already exists")
+	} else if err != nil {
+		return problem.Internal("Error saving user", err)
 	}
 
-	// Collect skill IDs from user skills
-	var skillIDs []primitive.ObjectID
-	for _, skill := range user.Skills {
-		skillIDs = append(skillIDs, skill.Keywords...)
-	}
+	h.recordAudit(ctx, r, models.AuditEvent{
+		Action:   models.AuditSignUp,
+		ActorID:  new_user.ID.Hex(),
+		TargetID: new_user.ID.Hex(),
+		Details:  map[string]interface{}{"email": authUser.Email, "username": authUser.Username},
+	})
 
-	if len(skillIDs) == 0 {
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode([]models.SkillCollection{})
-		return
+	// The account works right away, but sensitive routes wait for verification
+	if err := h.sendVerificationEmail(ctx, new_user.ID, authUser.Email); err != nil {
+		logging.FromContext(r.Context()).Error("sending verification email", "error", err)
 	}
 
-	skillCollection := client.Database("profileFolio").Collection("skills")
-	filter := bson.M{"_id": bson.M{"$in": skillIDs}}
-
-	cursor, err := skillCollection.Find(ctx, filter)
+	// Generate access and refresh tokens
+	tokens, err := h.issueTokens(ctx, new_user.ID, authUser, "")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return problem.Internal("Error generating token", err)
 	}
-	defer cursor.Close(ctx)
 
-	var skills []models.SkillCollection
-	if err = cursor.All(ctx, &skills); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	w.WriteHeader(http.StatusCreated)
+	response := map[string]interface{}{
+		"message":      "User created successfully",
+		"id":           new_user.ID,
+		"accessToken":  tokens.AccessToken,
+		"refreshToken": tokens.RefreshToken,
+		"user":         new_user,
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(skills)
+	json.NewEncoder(w).Encode(response)
+	return nil
 }
 
-func AddUserHandler(w http.ResponseWriter, r *http.Request) {
-	var newUser models.User
-	err := json.NewDecoder(r.Body).Decode(&newUser)
-	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+// SignIn checks a password and answers with tokens or a two-factor challenge
+func (h *AuthHandlers) SignIn(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return problem.MethodNotAllowed("Invalid request method")
 	}
 
-	collection := client.Database("profileFolio").Collection("users")
-
-	// Check if user already exists
-	existingUser := models.User{}
-	err = collection.FindOne(context.Background(), bson.M{"email": bson.M{"$regex": primitive.Regex{Pattern: "^" + newUser.Basics.Email + "$", Options: "i"}}}).Decode(&existingUser)
-	if err == nil {
-		http.Error(w, "User with this email already exists", http.StatusConflict)
-		return
-	} else if err != mongo.ErrNoDocuments {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	var credentials struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
 	}
-
-	// Insert new user without specifying ID
-	result, err := collection.InsertOne(context.Background(), newUser)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil {
+		return errInvalidBody
 	}
+	credentials.Email = normalizeEmail(credentials.Email)
 
-	// Get the auto-generated ID
-	insertedID := result.InsertedID.(primitive.ObjectID)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 10*time.Second)
+	defer cancel()
 
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{
-		"message": "User added successfully",
-		"id":      insertedID.Hex(),
-	})
-}
+	// Back off callers that keep guessing, per IP and per account
+	guard := signinGuard()
+	keys := []string{signinIPKey(r), accountKey(credentials.Email)}
+	if wait, err := guard.Check(ctx, keys...); err != nil {
+		return problem.Internal("Error checking signin attempts", err)
+	} else if wait > 0 {
+		h.recordSignInFailure(ctx, r, "password", credentials.Email, "", "locked_out")
+		return lockedOut(w, wait)
+	}
 
-func UpdateUserHandler(w http.ResponseWriter, r *http.Request) {
-	// Get the user ID from the URL parameter
-	vars := mux.Vars(r)
-	userID, err := primitive.ObjectIDFromHex(vars["id"])
+	// Find user by email
+	authUser, err := h.Auth.FindAuthUser(ctx, credentials.Email)
 	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
-		return
+		h.recordSignInFailure(ctx, r, "password", credentials.Email, "", "unknown_email")
+		return signInFailure(ctx, w, guard, keys)
 	}
 
-	// Parse the request body
-	var updates map[string]interface{}
-	err = json.NewDecoder(r.Body).Decode(&updates)
+	// Check hashed password
+	err = bcrypt.CompareHashAndPassword([]byte(authUser.Password), []byte(credentials.Password))
 	if err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+		h.recordSignInFailure(ctx, r, "password", credentials.Email, userIDByEmail(ctx, h.Users, authUser.Email), "wrong_password")
+		return signInFailure(ctx, w, guard, keys)
 	}
 
-	// Prepare the update document
-	update := bson.M{}
-	for key, value := range updates {
-		update[key] = value
+	// Returning user schema
+	user, err := h.Users.FindUser(ctx, store.ByEmail(credentials.Email))
+	if err != nil {
+		return errUserNotFound
 	}
 
-	collection := client.Database("profileFolio").Collection("users")
-
-	// Perform the update
-	result, err := collection.UpdateOne(
-		context.Background(),
-		bson.M{"_id": userID},
-		bson.M{"$set": update},
-	)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if authUser.Disabled {
+		return tokenError(errAccountDisabled)
 	}
 
-	if result.MatchedCount == 0 {
-		http.Error(w, "User not found", http.StatusNotFound)
-		return
+	// Users with two-factor authentication get a challenge instead of tokens
+	if authUser.TOTPEnabled {
+		return writeMFAChallenge(w, user.ID)
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"message": "User updated successfully"})
+	guard.Succeed(ctx, accountKey(authUser.Email))
+	return h.writeSignInResponse(ctx, w, r, user, authUser, "password")
 }
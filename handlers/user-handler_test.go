@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+
+	"profolio-vercel/models"
+	"profolio-vercel/store"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestUserHandlers(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(*UserHandlers, http.ResponseWriter, *http.Request) error
+		call    func(f fixture) call
+		want    int
+	}{
+		{
+			name:    "get by id",
+			handler: (*UserHandlers).GetUserByID,
+			call:    func(f fixture) call { return call{method: "GET", vars: map[string]string{"id": f.alice.ID.Hex()}} },
+			want:    http.StatusOK,
+		},
+		{
+			name:    "get by unknown id",
+			handler: (*UserHandlers).GetUserByID,
+			call: func(f fixture) call {
+				return call{method: "GET", vars: map[string]string{"id": primitive.NewObjectID().Hex()}}
+			},
+			want: http.StatusNotFound,
+		},
+		{
+			name:    "get by invalid id",
+			handler: (*UserHandlers).GetUserByID,
+			call:    func(f fixture) call { return call{method: "GET", vars: map[string]string{"id": "nope"}} },
+			want:    http.StatusBadRequest,
+		},
+		{
+			name:    "get by email ignores case",
+			handler: (*UserHandlers).GetUserByEmail,
+			call: func(f fixture) call {
+				return call{method: "GET", vars: map[string]string{"email": "Alice@Example.com"}}
+			},
+			want: http.StatusOK,
+		},
+		{
+			name:    "get by unknown username",
+			handler: (*UserHandlers).GetUserByUsername,
+			call:    func(f fixture) call { return call{method: "GET", vars: map[string]string{"username": "carol"}} },
+			want:    http.StatusNotFound,
+		},
+		{
+			name:    "get unchanged version",
+			handler: (*UserHandlers).GetUserByID,
+			call: func(f fixture) call {
+				return call{method: "GET", vars: map[string]string{"id": f.alice.ID.Hex()}, header: map[string]string{"If-None-Match": etag(0)}}
+			},
+			want: http.StatusNotModified,
+		},
+		{
+			name:    "list as a user",
+			handler: (*UserHandlers).GetAllUsers,
+			call:    func(f fixture) call { return call{method: "GET", claims: claimsFor(f.alice, models.RoleUser)} },
+			want:    http.StatusForbidden,
+		},
+		{
+			name:    "list as support",
+			handler: (*UserHandlers).GetAllUsers,
+			call:    func(f fixture) call { return call{method: "GET", claims: claimsFor(f.alice, models.RoleSupport)} },
+			want:    http.StatusOK,
+		},
+		{
+			name:    "add own profile",
+			handler: (*UserHandlers).AddUser,
+			call: func(f fixture) call {
+				carol := models.User{ID: primitive.NewObjectID(), Basics: models.Basics{Email: "carol@example.com"}}
+				return call{method: "POST", body: `{"basics":{"email":"carol@example.com"}}`, claims: claimsFor(carol, models.RoleUser)}
+			},
+			want: http.StatusCreated,
+		},
+		{
+			name:    "add another user's profile",
+			handler: (*UserHandlers).AddUser,
+			call: func(f fixture) call {
+				return call{method: "POST", body: `{"basics":{"email":"carol@example.com"}}`, claims: claimsFor(f.bob, models.RoleUser)}
+			},
+			want: http.StatusForbidden,
+		},
+		{
+			name:    "add existing email",
+			handler: (*UserHandlers).AddUser,
+			call: func(f fixture) call {
+				return call{method: "POST", body: `{"basics":{"email":"bob@example.com"}}`, claims: claimsFor(f.bob, models.RoleUser)}
+			},
+			want: http.StatusConflict,
+		},
+		{
+			name:    "add invalid body",
+			handler: (*UserHandlers).AddUser,
+			call: func(f fixture) call {
+				return call{method: "POST", body: `{`, claims: claimsFor(f.bob, models.RoleUser)}
+			},
+			want: http.StatusBadRequest,
+		},
+		{
+			name:    "update",
+			handler: (*UserHandlers).UpdateUser,
+			call: func(f fixture) call {
+				return call{method: "PATCH", body: `{"basics":{"name":"Alice B"}}`, vars: map[string]string{"id": f.alice.ID.Hex()}}
+			},
+			want: http.StatusOK,
+		},
+		{
+			name:    "update a stale version",
+			handler: (*UserHandlers).UpdateUser,
+			call: func(f fixture) call {
+				return call{method: "PATCH", body: `{"basics":{"name":"Alice B"}}`, vars: map[string]string{"id": f.alice.ID.Hex()},
+					header: map[string]string{"If-Match": etag(7)}}
+			},
+			want: http.StatusPreconditionFailed,
+		},
+		{
+			name:    "update the email",
+			handler: (*UserHandlers).UpdateUser,
+			call: func(f fixture) call {
+				return call{method: "PATCH", body: `{"basics":{"email":"x@example.com"}}`, vars: map[string]string{"id": f.alice.ID.Hex()}}
+			},
+			want: http.StatusBadRequest,
+		},
+		{
+			name:    "update by unknown username",
+			handler: (*UserHandlers).UpdateUserByUsername,
+			call: func(f fixture) call {
+				return call{method: "PATCH", body: `{"basics":{"name":"Carol"}}`, vars: map[string]string{"username": "carol"}}
+			},
+			want: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := testStores(t)
+			f := newFixture(t, m)
+			h := &UserHandlers{Stores: MemoryStores(m)}
+			w := tt.call(f).serve(func(w http.ResponseWriter, r *http.Request) error { return tt.handler(h, w, r) })
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestUpdateUserIsAudited(t *testing.T) {
+	m := testStores(t)
+	f := newFixture(t, m)
+	h := &UserHandlers{Stores: MemoryStores(m)}
+
+	w := call{method: "PATCH", body: `{"basics":{"name":"Alice B"}}`, vars: map[string]string{"id": f.alice.ID.Hex()}}.serve(h.UpdateUser)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if got := w.Header().Get("ETag"); got != etag(1) {
+		t.Errorf("ETag = %s, want %s", got, etag(1))
+	}
+
+	user, err := m.FindUser(context.Background(), store.ByID(f.alice.ID))
+	if err != nil || user.Basics.Name != "Alice B" {
+		t.Errorf("name = %q, %v", user.Basics.Name, err)
+	}
+	events := m.AuditEvents()
+	if len(events) != 1 || events[0].Action != models.AuditUserUpdated {
+		t.Errorf("audit events = %+v", events)
+	}
+}
+
+func TestConcurrentSignUp(t *testing.T) {
+	m := testStores(t)
+	h := &AuthHandlers{Stores: MemoryStores(m)}
+	bodies := []string{
+		`{"username":"carol","email":"carol@example.com","password":"correct horse"}`,
+		`{"username":"caroline","email":"Carol@Example.com","password":"correct horse"}`,
+	}
+
+	start := make(chan struct{})
+	codes := make([]int, len(bodies))
+	var wg sync.WaitGroup
+	for i, body := range bodies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			codes[i] = call{method: "POST", body: body}.serve(h.SignUp).Code
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	slices.Sort(codes)
+	if codes[0] != http.StatusCreated || codes[1] != http.StatusConflict {
+		t.Errorf("statuses = %v, want one %d and one %d", codes, http.StatusCreated, http.StatusConflict)
+	}
+	if _, total, err := m.ListUsers(context.Background(), 0, 10); err != nil || total != 1 {
+		t.Errorf("users = %d, %v, want 1", total, err)
+	}
+}
+
+func TestAuthHandlers(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(*AuthHandlers, http.ResponseWriter, *http.Request) error
+		body    string
+		want    int
+	}{
+		{"sign up", (*AuthHandlers).SignUp,
+			`{"username":"carol","email":"carol@example.com","password":"correct horse"}`, http.StatusCreated},
+		{"sign up with a taken email", (*AuthHandlers).SignUp,
+			`{"username":"carol","email":"Dave@example.com","password":"correct horse"}`, http.StatusConflict},
+		{"sign up with a short password", (*AuthHandlers).SignUp,
+			`{"username":"carol","email":"carol@example.com","password":"short"}`, http.StatusBadRequest},
+		{"sign in", (*AuthHandlers).SignIn,
+			`{"email":"dave@example.com","password":"correct horse"}`, http.StatusOK},
+		{"sign in with a wrong password", (*AuthHandlers).SignIn,
+			`{"email":"dave@example.com","password":"wrong horse"}`, http.StatusUnauthorized},
+		{"sign in with an unknown email", (*AuthHandlers).SignIn,
+			`{"email":"erin@example.com","password":"correct horse"}`, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := testStores(t)
+			h := &AuthHandlers{Stores: MemoryStores(m)}
+			signUp := call{method: "POST", body: `{"username":"dave","email":"dave@example.com","password":"correct horse"}`}.serve(h.SignUp)
+			if signUp.Code != http.StatusCreated {
+				t.Fatalf("sign up status = %d: %s", signUp.Code, signUp.Body)
+			}
+
+			w := call{method: "POST", body: tt.body}.serve(func(w http.ResponseWriter, r *http.Request) error { return tt.handler(h, w, r) })
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if w.Code == http.StatusOK || w.Code == http.StatusCreated {
+				var tokens struct{ AccessToken, RefreshToken string }
+				if err := json.Unmarshal(w.Body.Bytes(), &tokens); err != nil || tokens.AccessToken == "" || tokens.RefreshToken == "" {
+					t.Errorf("response has no tokens: %s", w.Body)
+				}
+			}
+		})
+	}
+}
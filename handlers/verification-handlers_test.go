@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"profolio-vercel/models"
+	"profolio-vercel/store"
+)
+
+func TestVerifyEmail(t *testing.T) {
+	tests := []struct {
+		name     string
+		newEmail string // The account moves here after the link is mailed
+		want     int
+		verified bool
+	}{
+		{"current email", "", http.StatusOK, true},
+		{"email changed since", "carol@example.com", http.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := testStores(t)
+			h := &AccountHandlers{Stores: MemoryStores(m)}
+			ctx := context.Background()
+			user, err := m.CreateAccount(ctx,
+				models.AuthUser{Username: "alice", Email: "alice@example.com", Role: models.RoleUser},
+				models.User{Basics: models.Basics{Username: "alice", Email: "alice@example.com"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, err := h.createActionToken(ctx, user.ID, "alice@example.com", models.PurposeEmailVerification, emailVerificationTTL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			email := "alice@example.com"
+			if tt.newEmail != "" {
+				if err := m.ChangeAccount(ctx, email, store.AccountChange{Email: tt.newEmail}); err != nil {
+					t.Fatal(err)
+				}
+				email = tt.newEmail
+			}
+
+			w := call{method: "GET", target: "/api/verify-email?" + url.Values{"token": {token}}.Encode()}.serve(h.VerifyEmail)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			authUser, err := m.FindAuthUser(ctx, email)
+			if err != nil || authUser.EmailVerified != tt.verified {
+				t.Errorf("%s verified = %v, %v, want %v", email, authUser.EmailVerified, err, tt.verified)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+// Package lockout tracks failed attempts per key, such as a client IP or an
+// account, and locks the key out with exponential backoff once it keeps failing.
+package lockout
+
+import (
+	"context"
+	"time"
+)
+
+// Attempts is the failure history of one key
+type Attempts struct {
+	Failures    int
+	LockedUntil time.Time
+}
+
+// Store persists attempt counters. A counter is forgotten once the policy
+// window passes without a new failure.
+type Store interface {
+	Get(ctx context.Context, key string, now time.Time) (Attempts, error)
+	RecordFailure(ctx context.Context, key string, policy Policy, now time.Time) (Attempts, error)
+	Reset(ctx context.Context, key string) error
+}
+
+// Policy decides how long a key is locked after repeated failures
+type Policy struct {
+	FreeAttempts int           // failures allowed before the first lockout
+	BaseDelay    time.Duration // length of the first lockout, doubled for every further failure
+	MaxDelay     time.Duration // longest lockout
+	Window       time.Duration // how long failures are remembered
+}
+
+// LockoutFor returns how long a key is locked after its nth failure
+func (p Policy) LockoutFor(failures int) time.Duration {
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+
+	delay := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// Guard applies a policy to several keys at once; a request is locked out
+// when any of its keys is
+type Guard struct {
+	Store  Store
+	Policy Policy
+}
+
+// Check returns how long the caller has to wait, or zero when none of the keys are locked
+func (g *Guard) Check(ctx context.Context, keys ...string) (time.Duration, error) {
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range keys {
+		attempts, err := g.Store.Get(ctx, key, now)
+		if err != nil {
+			return 0, err
+		}
+		if remaining := attempts.LockedUntil.Sub(now); remaining > wait {
+			wait = remaining
+		}
+	}
+	return wait, nil
+}
+
+// Fail records a failed attempt against every key and returns the resulting lockout
+func (g *Guard) Fail(ctx context.Context, keys ...string) (time.Duration, error) {
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range keys {
+		attempts, err := g.Store.RecordFailure(ctx, key, g.Policy, now)
+		if err != nil {
+			return 0, err
+		}
+		if remaining := attempts.LockedUntil.Sub(now); remaining > wait {
+			wait = remaining
+		}
+	}
+	return wait, nil
+}
+
+// Succeed clears the counters of the given keys
+func (g *Guard) Succeed(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		if err := g.Store.Reset(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package lockout
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLockoutFor(t *testing.T) {
+	policy := Policy{FreeAttempts: 2, BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, 0},
+		{2, 0},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{5, 4 * time.Second},
+		{6, 8 * time.Second},
+		{7, 10 * time.Second},
+		{100, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := policy.LockoutFor(tt.failures); got != tt.want {
+			t.Errorf("LockoutFor(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+
+	// The cap applies to the first lockout too
+	capped := Policy{BaseDelay: time.Minute, MaxDelay: time.Second}
+	if got := capped.LockoutFor(1); got != time.Second {
+		t.Errorf("LockoutFor(1) = %v, want the %v cap", got, time.Second)
+	}
+}
+
+func TestGuard(t *testing.T) {
+	ctx := context.Background()
+	guard := &Guard{Store: NewMemoryStore(), Policy: Policy{
+		FreeAttempts: 1,
+		BaseDelay:    time.Minute,
+		MaxDelay:     time.Hour,
+		Window:       time.Hour,
+	}}
+
+	if wait, err := guard.Check(ctx, "ip", "account"); err != nil || wait != 0 {
+		t.Fatalf("new keys wait %v, %v", wait, err)
+	}
+	if wait, err := guard.Fail(ctx, "ip", "account"); err != nil || wait != 0 {
+		t.Fatalf("the free failure locked out for %v, %v", wait, err)
+	}
+
+	// A second failure on one key locks out every request that uses it
+	wait, err := guard.Fail(ctx, "account")
+	if err != nil || wait <= 0 || wait > time.Minute {
+		t.Fatalf("the second failure locked out for %v, %v", wait, err)
+	}
+	if wait, err := guard.Check(ctx, "ip", "account"); err != nil || wait <= 0 {
+		t.Errorf("locked account: wait %v, %v", wait, err)
+	}
+	if wait, err := guard.Check(ctx, "ip"); err != nil || wait != 0 {
+		t.Errorf("the IP alone: wait %v, %v", wait, err)
+	}
+
+	// Success clears the counters, so the next failure is free again
+	if err := guard.Succeed(ctx, "ip", "account"); err != nil {
+		t.Fatal(err)
+	}
+	if wait, err := guard.Check(ctx, "ip", "account"); err != nil || wait != 0 {
+		t.Errorf("after success: wait %v, %v", wait, err)
+	}
+	if wait, err := guard.Fail(ctx, "account"); err != nil || wait != 0 {
+		t.Errorf("a failure after success locked out for %v, %v", wait, err)
+	}
+}
+
+// brokenStore fails every call
+type brokenStore struct{}
+
+var errBroken = errors.New("store unavailable")
+
+func (brokenStore) Get(context.Context, string, time.Time) (Attempts, error) {
+	return Attempts{}, errBroken
+}
+
+func (brokenStore) RecordFailure(context.Context, string, Policy, time.Time) (Attempts, error) {
+	return Attempts{}, errBroken
+}
+
+func (brokenStore) Reset(context.Context, string) error {
+	return errBroken
+}
+
+func TestGuardReportsStoreErrors(t *testing.T) {
+	ctx := context.Background()
+	guard := &Guard{Store: brokenStore{}}
+	if _, err := guard.Check(ctx, "ip"); !errors.Is(err, errBroken) {
+		t.Errorf("Check: %v", err)
+	}
+	if _, err := guard.Fail(ctx, "ip"); !errors.Is(err, errBroken) {
+		t.Errorf("Fail: %v", err)
+	}
+	if err := guard.Succeed(ctx, "ip"); !errors.Is(err, errBroken) {
+		t.Errorf("Succeed: %v", err)
+	}
+}
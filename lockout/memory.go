@@ -0,0 +1,73 @@
+package lockout
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type memoryEntry struct {
+	Attempts
+	expiresAt time.Time
+}
+
+// MemoryStore keeps counters in process memory. It suits a single
+// long-running server; serverless instances should share a MongoStore.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string]*memoryEntry)}
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string, now time.Time) (Attempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok || !now.Before(entry.expiresAt) {
+		return Attempts{}, nil
+	}
+	return entry.Attempts, nil
+}
+
+func (s *MemoryStore) RecordFailure(ctx context.Context, key string, policy Policy, now time.Time) (Attempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.purge(now)
+
+	entry, ok := s.entries[key]
+	if !ok {
+		entry = &memoryEntry{}
+		s.entries[key] = entry
+	}
+	entry.Failures++
+	if lock := policy.LockoutFor(entry.Failures); lock > 0 {
+		entry.LockedUntil = now.Add(lock)
+	}
+	entry.expiresAt = now.Add(policy.Window)
+	if entry.LockedUntil.After(entry.expiresAt) {
+		entry.expiresAt = entry.LockedUntil
+	}
+	return entry.Attempts, nil
+}
+
+func (s *MemoryStore) Reset(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+	return nil
+}
+
+// purge drops expired entries so the map doesn't grow without bound
+func (s *MemoryStore) purge(now time.Time) {
+	for key, entry := range s.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(s.entries, key)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package lockout
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreExpiry(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	policy := Policy{FreeAttempts: 1, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: time.Hour}
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 2; i++ {
+		if _, err := s.RecordFailure(ctx, "ip", policy, start); err != nil {
+			t.Fatal(err)
+		}
+	}
+	attempts, _ := s.Get(ctx, "ip", start.Add(59*time.Minute))
+	if attempts.Failures != 2 || !attempts.LockedUntil.Equal(start.Add(time.Minute)) {
+		t.Errorf("within the window: %+v", attempts)
+	}
+
+	// Past the window the counter is forgotten and starts over
+	end := start.Add(time.Hour)
+	if attempts, _ := s.Get(ctx, "ip", end); attempts != (Attempts{}) {
+		t.Errorf("after the window: %+v", attempts)
+	}
+	attempts, _ = s.RecordFailure(ctx, "ip", policy, end)
+	if attempts.Failures != 1 || !attempts.LockedUntil.IsZero() {
+		t.Errorf("first failure after the window: %+v", attempts)
+	}
+}
+
+func TestMemoryStoreKeepsLockoutsLongerThanTheWindow(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	policy := Policy{BaseDelay: 2 * time.Hour, MaxDelay: 2 * time.Hour, Window: time.Hour}
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	s.RecordFailure(ctx, "ip", policy, start)
+	if attempts, _ := s.Get(ctx, "ip", start.Add(90*time.Minute)); attempts.Failures != 1 || !attempts.LockedUntil.Equal(start.Add(2*time.Hour)) {
+		t.Errorf("a lockout ended with the window: %+v", attempts)
+	}
+	if attempts, _ := s.Get(ctx, "ip", start.Add(2*time.Hour)); attempts != (Attempts{}) {
+		t.Errorf("after the lockout: %+v", attempts)
+	}
+}
+
+func TestMemoryStorePurgesExpiredCounters(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	policy := Policy{FreeAttempts: 10, Window: time.Minute}
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	s.RecordFailure(ctx, "a", policy, start)
+	s.RecordFailure(ctx, "b", policy, start)
+	s.RecordFailure(ctx, "c", policy, start.Add(time.Minute))
+	if len(s.entries) != 1 {
+		t.Errorf("%d counters kept, want only c's", len(s.entries))
+	}
+	if err := s.Reset(ctx, "c"); err != nil || len(s.entries) != 0 {
+		t.Errorf("reset left %d counters, %v", len(s.entries), err)
+	}
+}
@@ -0,0 +1,82 @@
+package lockout
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type mongoAttempts struct {
+	Key         string    `bson:"_id"`
+	Failures    int       `bson:"failures"`
+	LockedUntil time.Time `bson:"lockedUntil,omitempty"`
+	ExpiresAt   time.Time `bson:"expiresAt"`
+}
+
+// MongoStore keeps counters in a collection so every serverless instance
+// sees the same lockouts. The collection should have a TTL index on expiresAt.
+type MongoStore struct {
+	Collection *mongo.Collection
+}
+
+func NewMongoStore(collection *mongo.Collection) *MongoStore {
+	return &MongoStore{Collection: collection}
+}
+
+func (s *MongoStore) Get(ctx context.Context, key string, now time.Time) (Attempts, error) {
+	var doc mongoAttempts
+	err := s.Collection.FindOne(ctx, bson.M{"_id": key, "expiresAt": bson.M{"$gt": now}}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return Attempts{}, nil
+	} else if err != nil {
+		return Attempts{}, err
+	}
+	return Attempts{Failures: doc.Failures, LockedUntil: doc.LockedUntil}, nil
+}
+
+func (s *MongoStore) RecordFailure(ctx context.Context, key string, policy Policy, now time.Time) (Attempts, error) {
+	// Count the failure atomically; a counter past its window, which the TTL
+	// monitor may not have removed yet, starts over
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"failures": bson.M{"$cond": bson.A{
+				bson.M{"$gt": bson.A{"$expiresAt", now}},
+				bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$failures", 0}}, 1}},
+				1,
+			}},
+			"expiresAt": now.Add(policy.Window),
+		}}},
+	}
+
+	var doc mongoAttempts
+	err := s.Collection.FindOneAndUpdate(ctx, bson.M{"_id": key}, update,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&doc)
+	if err != nil {
+		return Attempts{}, err
+	}
+
+	if lock := policy.LockoutFor(doc.Failures); lock > 0 {
+		doc.LockedUntil = now.Add(lock)
+		expiresAt := doc.ExpiresAt
+		if doc.LockedUntil.After(expiresAt) {
+			expiresAt = doc.LockedUntil
+		}
+		_, err = s.Collection.UpdateOne(ctx, bson.M{"_id": key},
+			bson.M{"$set": bson.M{"lockedUntil": doc.LockedUntil, "expiresAt": expiresAt}},
+		)
+		if err != nil {
+			return Attempts{}, err
+		}
+	}
+
+	return Attempts{Failures: doc.Failures, LockedUntil: doc.LockedUntil}, nil
+}
+
+func (s *MongoStore) Reset(ctx context.Context, key string) error {
+	_, err := s.Collection.DeleteOne(ctx, bson.M{"_id": key})
+	return err
+}
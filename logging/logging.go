@@ -0,0 +1,79 @@
+// Package logging configures the structured slog logger and carries a
+// request-scoped logger through contexts.
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"profolio-vercel/config"
+)
+
+type contextKey struct{}
+
+// sensitiveKeys are attribute names whose values are never written out
+var sensitiveKeys = []string{"password", "token", "secret", "authorization", "cookie", "apikey", "api_key"}
+
+// emailPattern finds email addresses inside otherwise harmless values
+var emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+
+// New returns a logger writing JSON, or text for local development, at the
+// configured level, with sensitive values redacted
+func New(w io.Writer, cfg config.LogConfig) *slog.Logger {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		level = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redact}
+	if cfg.Format == "text" {
+		return slog.New(slog.NewTextHandler(w, opts))
+	}
+	return slog.New(slog.NewJSONHandler(w, opts))
+}
+
+// redact hides passwords, tokens and other secrets by attribute name and
+// masks email addresses wherever they appear in a string
+func redact(groups []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(key, sensitive) {
+			return slog.String(a.Key, "[redacted]")
+		}
+	}
+	if strings.Contains(key, "email") {
+		return slog.String(a.Key, MaskEmail(a.Value.String()))
+	}
+	if a.Value.Kind() == slog.KindString || a.Value.Kind() == slog.KindAny {
+		value := a.Value.Resolve().String()
+		if emailPattern.MatchString(value) {
+			return slog.String(a.Key, emailPattern.ReplaceAllStringFunc(value, MaskEmail))
+		}
+	}
+	return a
+}
+
+// MaskEmail keeps the first letter and the domain, so "jane@example.com"
+// becomes "j***@example.com"
+func MaskEmail(email string) string {
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok || local == "" {
+		return "[redacted]"
+	}
+	return local[:1] + "***@" + domain
+}
+
+// WithLogger returns a context carrying the logger
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the request's logger, or the default logger outside a request
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
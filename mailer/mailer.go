@@ -0,0 +1,118 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"profolio-vercel/config"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender delivers transactional email such as password reset links
+type Sender interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// FromConfig returns an SMTPSender when a host is configured. Without one
+// development and test runs get a LogSender writing to the log file (or the
+// standard logger); any other environment must not drop mail that way.
+func FromConfig(env string, cfg config.SMTPConfig) (Sender, error) {
+	if cfg.Host != "" {
+		port := cfg.Port
+		if port == "" {
+			port = "587"
+		}
+		return &SMTPSender{
+			Host:     cfg.Host,
+			Port:     port,
+			Username: cfg.Username,
+			Password: cfg.Password,
+			From:     cfg.From,
+		}, nil
+	}
+	if env != config.EnvDevelopment && env != config.EnvTest {
+		return nil, errors.New("SMTP_HOST is not configured")
+	}
+	return &LogSender{Path: cfg.LogFile}, nil
+}
+
+// SMTPSender sends mail through an SMTP relay using PLAIN auth
+type SMTPSender struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (s *SMTPSender) Send(ctx context.Context, msg Message) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- smtp.SendMail(net.JoinHostPort(s.Host, s.Port), auth, s.From, []string{msg.To}, s.format(msg))
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *SMTPSender) format(msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", s.From)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// LogSender appends every message to a file, or to the standard logger when
+// Path is empty. It is only for local development and tests.
+type LogSender struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (s *LogSender) Send(ctx context.Context, msg Message) error {
+	entry := fmt.Sprintf("To: %s\nSubject: %s\n\n%s\n---\n", msg.To, msg.Subject, msg.Body)
+	if s.Path == "" {
+		log.Print(entry)
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(entry)
+	return err
+}
@@ -0,0 +1,39 @@
+package mailer
+
+import (
+	"testing"
+
+	"profolio-vercel/config"
+)
+
+func TestFromConfig(t *testing.T) {
+	tests := []struct {
+		env   string
+		host  string
+		want  Sender
+		valid bool
+	}{
+		{config.EnvDevelopment, "", &LogSender{}, true},
+		{config.EnvTest, "", &LogSender{}, true},
+		{config.EnvProduction, "", nil, false},
+		{config.EnvProduction, "smtp.example.com", &SMTPSender{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env+"/"+tt.host, func(t *testing.T) {
+			sender, err := FromConfig(tt.env, config.SMTPConfig{Host: tt.host})
+			if (err == nil) != tt.valid {
+				t.Fatalf("FromConfig() error = %v, want valid %v", err, tt.valid)
+			}
+			switch tt.want.(type) {
+			case *LogSender:
+				if _, ok := sender.(*LogSender); !ok {
+					t.Errorf("FromConfig() = %T, want a LogSender", sender)
+				}
+			case *SMTPSender:
+				if _, ok := sender.(*SMTPSender); !ok {
+					t.Errorf("FromConfig() = %T, want an SMTPSender", sender)
+				}
+			}
+		})
+	}
+}
@@ -69,22 +69,77 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"profolio-vercel/api"
+	"profolio-vercel/config"
+	"profolio-vercel/handlers"
+	"profolio-vercel/shared"
+	"profolio-vercel/tracing"
+	"syscall"
+	"time"
 )
 
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	cfg, err := config.Load()
+	if err != nil {
+		slog.Error("invalid configuration", "error", err)
+		os.Exit(1)
 	}
+	handler, err := api.NewRouter(cfg)
+	if err != nil {
+		slog.Error("starting", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("starting", "config", cfg.String())
+
+	server := &http.Server{
+		Addr:              ":" + cfg.Port,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		ReadTimeout:       cfg.Server.ReadTimeout,
+		WriteTimeout:      cfg.Server.WriteTimeout,
+		IdleTimeout:       cfg.Server.IdleTimeout,
+	}
+
+	stop, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
 
-	http.HandleFunc("/", api.Handler)
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("server is running", "addr", "http://localhost:"+cfg.Port)
+		serveErr <- server.ListenAndServe()
+	}()
 
-	fmt.Printf("Server is running on http://localhost:%s\n", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		fmt.Printf("Error starting server: %s\n", err)
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("starting server", "error", err)
+			os.Exit(1)
+		}
+	case <-stop.Done():
+		slog.Info("shutting down", "grace", cfg.Server.ShutdownTimeout.String())
+	}
+
+	// Readiness fails first, and the listener stays open until the load
+	// balancer has noticed; then the in-flight requests drain
+	handlers.StartDraining()
+	slog.Info("draining", "delay", cfg.Server.DrainDelay.String())
+	time.Sleep(cfg.Server.DrainDelay)
+	ctx, cancelShutdown := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancelShutdown()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("draining requests", "error", err)
+	}
+	if err := tracing.Shutdown(ctx); err != nil {
+		slog.Error("flushing traces", "error", err)
+	}
+	if err := shared.Disconnect(ctx); err != nil {
+		slog.Error("disconnecting from MongoDB", "error", err)
 	}
+	slog.Info("server stopped")
 }
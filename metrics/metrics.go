@@ -0,0 +1,99 @@
+// Package metrics defines the Prometheus metrics the API exports on /metrics.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry holds every metric below plus the Go runtime and process collectors
+var Registry = prometheus.NewRegistry()
+
+var (
+	// HTTPRequests counts requests by method, mux route template and status
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests served, by method, route template and status code.",
+	}, []string{"method", "route", "status"})
+
+	// HTTPDuration observes request latency by method and route template
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency, by method and route template.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	// MongoDuration observes Mongo command latency by command name
+	MongoDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mongo_command_duration_seconds",
+		Help:    "Mongo command latency, by command name.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"command"})
+
+	// MongoErrors counts failed Mongo commands by command name
+	MongoErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongo_command_errors_total",
+		Help: "Mongo commands that failed, by command name.",
+	}, []string{"command"})
+
+	// AICalls counts calls to AI providers by provider, operation and outcome
+	AICalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ai_calls_total",
+		Help: "Calls to AI providers, by provider, operation and outcome (success or error).",
+	}, []string{"provider", "operation", "outcome"})
+
+	// AIDuration observes AI provider latency by provider and operation
+	AIDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ai_call_duration_seconds",
+		Help:    "AI provider call latency, by provider and operation.",
+		Buckets: []float64{.25, .5, 1, 2.5, 5, 10, 20, 30, 60},
+	}, []string{"provider", "operation"})
+
+	// AITokens counts tokens used by provider, operation and kind (prompt or completion)
+	AITokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ai_tokens_total",
+		Help: "Tokens used by AI providers, by provider, operation and kind (prompt or completion).",
+	}, []string{"provider", "operation", "kind"})
+
+	// SignIns counts signin attempts by method and outcome
+	SignIns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "signins_total",
+		Help: "Signin attempts, by method and outcome (success or the failure reason).",
+	}, []string{"method", "outcome"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests, HTTPDuration,
+		MongoDuration, MongoErrors,
+		AICalls, AIDuration, AITokens,
+		SignIns,
+	)
+}
+
+// Handler serves the registry in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// ObserveAICall records one AI provider call and the tokens it used
+func ObserveAICall(provider, operation string, start time.Time, err error, promptTokens, completionTokens int) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	AICalls.WithLabelValues(provider, operation, outcome).Inc()
+	AIDuration.WithLabelValues(provider, operation).Observe(time.Since(start).Seconds())
+	if promptTokens > 0 {
+		AITokens.WithLabelValues(provider, operation, "prompt").Add(float64(promptTokens))
+	}
+	if completionTokens > 0 {
+		AITokens.WithLabelValues(provider, operation, "completion").Add(float64(completionTokens))
+	}
+}
@@ -0,0 +1,21 @@
+package metrics
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/event"
+)
+
+// MongoMonitor times every command the Mongo client sends. It is set on the
+// client, so every store and collection is covered.
+func MongoMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+			MongoDuration.WithLabelValues(e.CommandName).Observe(e.Duration.Seconds())
+		},
+		Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+			MongoDuration.WithLabelValues(e.CommandName).Observe(e.Duration.Seconds())
+			MongoErrors.WithLabelValues(e.CommandName).Inc()
+		},
+	}
+}
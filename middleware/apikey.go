@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"profolio-vercel/problem"
+	"profolio-vercel/store"
+
+	"github.com/gorilla/mux"
+)
+
+// lastUsedResolution limits how often a key's lastUsedAt is written
+const lastUsedResolution = time.Minute
+
+// HashAPIKey returns the hash an API key is stored and looked up by
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// HasScope reports whether the caller may use the given scope. Session tokens
+// carry every scope; API keys only the ones they were created with.
+func (c *Claims) HasScope(scope string) bool {
+	if c.APIKeyID == "" {
+		return true
+	}
+	for _, granted := range c.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// scopedHandler marks a route that API keys with the scope may call
+type scopedHandler struct {
+	scope   string
+	handler http.Handler
+}
+
+func (h scopedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.handler.ServeHTTP(w, r)
+}
+
+// WithScope opens a route to API keys that were granted scope. Routes
+// registered without it only accept session tokens.
+func WithScope(scope string, handler http.Handler) http.Handler {
+	return scopedHandler{scope: scope, handler: handler}
+}
+
+// routeScope returns the scope of the matched route, if it has one
+func routeScope(r *http.Request) (string, bool) {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return "", false
+	}
+	scoped, ok := route.GetHandler().(scopedHandler)
+	return scoped.scope, ok
+}
+
+// Authenticate accepts either a bearer token, like JwtVerify, or an API key in
+// the X-API-Key header. API keys only reach routes registered WithScope.
+func Authenticate(next http.Handler) http.Handler {
+	verifyJWT := JwtVerify(next)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-API-Key")
+		if key == "" {
+			verifyJWT.ServeHTTP(w, r)
+			return
+		}
+
+		scope, scoped := routeScope(r)
+		if !scoped {
+			problem.Write(w, r, problem.Forbidden("api_key_not_allowed", "API keys cannot access this route"))
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+
+		claims, err := verifyAPIKey(ctx, key)
+		if err == store.ErrNotFound {
+			problem.Write(w, r, problem.Unauthorized("api_key_invalid", "Invalid API key"))
+			return
+		} else if err != nil {
+			problem.Write(w, r, problem.Internal("Error checking API key", err))
+			return
+		}
+
+		if !claims.HasScope(scope) {
+			problem.Write(w, r, problem.Forbidden("scope_missing", "API key is missing the "+scope+" scope"))
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithClaims(r.Context(), claims)))
+	})
+}
+
+// verifyAPIKey looks up an active key and builds claims for the user who owns it
+func verifyAPIKey(ctx context.Context, key string) (*Claims, error) {
+	if stores.APIKeys == nil || stores.Users == nil || stores.Auth == nil {
+		return nil, errNoDatabase
+	}
+
+	now := time.Now()
+	apiKey, err := stores.APIKeys.FindActiveAPIKey(ctx, HashAPIKey(key), now)
+	if err != nil {
+		return nil, err
+	}
+	user, err := stores.Users.FindUser(ctx, store.ByID(apiKey.UserID))
+	if err != nil {
+		return nil, err
+	}
+	authUser, err := stores.Auth.FindAuthUser(ctx, user.Basics.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys of disabled accounts stop working without being revoked
+	if authUser.Disabled {
+		return nil, store.ErrNotFound
+	}
+
+	if err := stores.APIKeys.TouchAPIKey(ctx, apiKey.ID, now, lastUsedResolution); err != nil {
+		return nil, err
+	}
+
+	return &Claims{
+		UserID:        user.ID.Hex(),
+		Username:      authUser.Username,
+		Email:         authUser.Email,
+		Role:          authUser.Role,
+		EmailVerified: authUser.EmailVerified,
+		APIKeyID:      apiKey.ID.Hex(),
+		Scopes:        apiKey.Scopes,
+	}, nil
+}
@@ -0,0 +1,121 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"profolio-vercel/models"
+	"profolio-vercel/store"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// createAccount signs up a user straight into the store
+func createAccount(t *testing.T, m *store.Memory, username string) models.User {
+	t.Helper()
+	email := username + "@example.com"
+	user, err := m.CreateAccount(context.Background(),
+		models.AuthUser{Username: username, Email: email, Password: "unknown", Role: models.RoleUser},
+		models.User{Basics: models.Basics{Username: username, Email: email}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// insertAPIKey stores a key for the user and returns the key itself
+func insertAPIKey(t *testing.T, m *store.Memory, user models.User, key models.APIKey) string {
+	t.Helper()
+	secret := "pf_test_" + primitive.NewObjectID().Hex()
+	key.UserID, key.KeyHash, key.CreatedAt = user.ID, HashAPIKey(secret), time.Now()
+	if err := m.InsertAPIKey(context.Background(), key); err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+func TestAuthenticateWithAPIKeys(t *testing.T) {
+	m := store.NewMemory()
+	SetStores(Stores{Users: m, Auth: m, APIKeys: m, Revocations: m})
+	t.Cleanup(func() { SetStores(Stores{}) })
+
+	alice, bob := createAccount(t, m, "alice"), createAccount(t, m, "bob")
+	if err := m.UpdateAuthUser(context.Background(), "bob@example.com", bson.M{"disabled": true}); err != nil {
+		t.Fatal(err)
+	}
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	keys := map[string]string{
+		"read":     insertAPIKey(t, m, alice, models.APIKey{Scopes: []string{models.ScopeUserRead}, ExpiresAt: &future}),
+		"ai":       insertAPIKey(t, m, alice, models.APIKey{Scopes: []string{models.ScopeAI}}),
+		"expired":  insertAPIKey(t, m, alice, models.APIKey{Scopes: []string{models.ScopeUserRead}, ExpiresAt: &past}),
+		"revoked":  insertAPIKey(t, m, alice, models.APIKey{Scopes: []string{models.ScopeUserRead}, RevokedAt: &past}),
+		"disabled": insertAPIKey(t, m, bob, models.APIKey{Scopes: []string{models.ScopeUserRead}}),
+		"unknown":  "pf_test_unknown",
+	}
+
+	router := mux.NewRouter()
+	router.Use(Authenticate)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, _ := ClaimsFromContext(r.Context())
+		w.Write([]byte(claims.UserID))
+	})
+	router.Handle("/scoped", WithScope(models.ScopeUserRead, ok))
+	router.Handle("/session-only", ok)
+
+	tests := []struct {
+		name string
+		path string
+		key  string
+		want int
+	}{
+		{"scope granted", "/scoped", "read", http.StatusOK},
+		{"scope missing", "/scoped", "ai", http.StatusForbidden},
+		{"route without a scope", "/session-only", "read", http.StatusForbidden},
+		{"expired", "/scoped", "expired", http.StatusUnauthorized},
+		{"revoked", "/scoped", "revoked", http.StatusUnauthorized},
+		{"disabled account", "/scoped", "disabled", http.StatusUnauthorized},
+		{"unknown", "/scoped", "unknown", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r.Header.Set("X-API-Key", keys[tt.key])
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if w.Code == http.StatusOK && w.Body.String() != alice.ID.Hex() {
+				t.Errorf("claims are for %q, want alice", w.Body)
+			}
+		})
+	}
+
+	listed, err := m.ListAPIKeys(context.Background(), alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keys that were accepted are marked used, even where their scope wasn't enough
+	accepted := map[string]bool{HashAPIKey(keys["read"]): true, HashAPIKey(keys["ai"]): true}
+	for _, key := range listed {
+		if used := key.LastUsedAt != nil; used != accepted[key.KeyHash] {
+			t.Errorf("key %v with scopes %v: used = %v", key.ID, key.Scopes, used)
+		}
+	}
+}
+
+func TestHasScope(t *testing.T) {
+	session := &Claims{}
+	apiKey := &Claims{APIKeyID: "k", Scopes: []string{models.ScopeUserRead}}
+	if !session.HasScope(models.ScopeAI) {
+		t.Error("a session token lacks a scope")
+	}
+	if !apiKey.HasScope(models.ScopeUserRead) || apiKey.HasScope(models.ScopeUserWrite) {
+		t.Errorf("API key scopes = %v", apiKey.Scopes)
+	}
+}
@@ -0,0 +1,128 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+
+	"profolio-vercel/models"
+	"profolio-vercel/problem"
+
+	"github.com/gorilla/mux"
+)
+
+// Permissions granted through roles
+const (
+	PermReadAnyUser   = "users:read"        // Read any user's profile
+	PermManageAnyUser = "users:manage"      // Change any user's profile and resumes
+	PermListUsers     = "users:list"        // List every user
+	PermDisableUsers  = "users:disable"     // Disable and re-enable accounts
+	PermImpersonate   = "users:impersonate" // Act as another user
+	PermManageRoles   = "users:roles"       // Change a user's role
+	PermReadAudit     = "audit:read"        // Search every user's audit events
+	PermReadMetrics   = "metrics:read"      // Scrape the Prometheus metrics
+)
+
+// rolePermissions maps each role to the permissions it grants
+var rolePermissions = map[string][]string{
+	models.RoleUser:    {},
+	models.RoleSupport: {PermReadAnyUser, PermListUsers},
+	models.RoleAdmin: {
+		PermReadAnyUser, PermManageAnyUser, PermListUsers,
+		PermDisableUsers, PermImpersonate, PermManageRoles, PermReadAudit,
+		PermReadMetrics,
+	},
+}
+
+var (
+	// ErrForbidden is the failure shared by every authorization check
+	ErrForbidden = problem.Forbidden("forbidden", "You are not allowed to access this resource")
+	// ErrMissingClaims means a route was mounted without JwtVerify in front of it
+	ErrMissingClaims = problem.Unauthorized("missing_claims", "Missing user claims")
+)
+
+// Can reports whether the caller's role grants the permission. Impersonated
+// sessions only ever carry the impersonated user's own role.
+func (c *Claims) Can(permission string) bool {
+	for _, granted := range rolePermissions[c.Role] {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// OwnsTarget reports whether the route variables address the caller's own user.
+// Routes may name the target user by "id", "userID", "email" or "username";
+// every variable present has to match. A route without any of them has no owner.
+func (c *Claims) OwnsTarget(vars map[string]string) bool {
+	if id, ok := vars["id"]; ok && id != c.UserID {
+		return false
+	}
+	if id, ok := vars["userID"]; ok && id != c.UserID {
+		return false
+	}
+	if email, ok := vars["email"]; ok && !strings.EqualFold(email, c.Email) {
+		return false
+	}
+	if username, ok := vars["username"]; ok && username != c.Username {
+		return false
+	}
+	return true
+}
+
+// RequireOwner only lets a request through when the user it targets is the
+// caller. Support staff may read any user and admins may also change them.
+// It must run after JwtVerify.
+func RequireOwner(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := ClaimsFromContext(r.Context())
+		if !ok {
+			problem.Write(w, r, ErrMissingClaims)
+			return
+		}
+
+		bypass := PermManageAnyUser
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			bypass = PermReadAnyUser
+		}
+
+		if !claims.Can(bypass) && !claims.OwnsTarget(mux.Vars(r)) {
+			problem.Write(w, r, ErrForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequirePermission only lets callers whose role grants the permission through.
+// It must run after JwtVerify.
+func RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := ClaimsFromContext(r.Context())
+			if !ok {
+				problem.Write(w, r, ErrMissingClaims)
+				return
+			}
+			if !claims.Can(permission) {
+				problem.Write(w, r, ErrForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// DenyImpersonation keeps impersonated sessions away from account settings such
+// as API keys and two-factor authentication. It must run after JwtVerify.
+func DenyImpersonation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := ClaimsFromContext(r.Context())
+		if ok && claims.Actor != nil {
+			problem.Write(w, r, problem.Forbidden("impersonation_denied", "Impersonated sessions cannot change account settings"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"profolio-vercel/models"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// MFAChallengeTTL is how long a user has to enter their TOTP code after the password step
+const MFAChallengeTTL = 5 * time.Minute
+
+// mfaChallengeAudience marks tokens that only prove the password step of a
+// two-factor sign in. JwtVerify never accepts them as access tokens.
+const mfaChallengeAudience = "mfa-challenge"
+
+// GenerateMFAChallenge issues the short-lived token exchanged for an access
+// token once the user passes the second factor
+func GenerateMFAChallenge(userID primitive.ObjectID) (string, error) {
+	tokenID, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	return signToken(jwt.RegisteredClaims{
+		ID:        tokenID,
+		Subject:   userID.Hex(),
+		Audience:  jwt.ClaimStrings{mfaChallengeAudience},
+		ExpiresAt: jwt.NewNumericDate(now.Add(MFAChallengeTTL)),
+		IssuedAt:  jwt.NewNumericDate(now),
+	})
+}
+
+// ErrChallengeUsed rejects a challenge token that was already exchanged
+var ErrChallengeUsed = errors.New("challenge token already used")
+
+// MFAChallenge is a verified challenge token
+type MFAChallenge struct {
+	UserID    primitive.ObjectID
+	tokenID   string
+	expiresAt time.Time
+}
+
+// ParseMFAChallenge verifies a challenge token. Whether it was already
+// exchanged is up to Used.
+func ParseMFAChallenge(tokenString string) (MFAChallenge, error) {
+	claims := &jwt.RegisteredClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, KeyFunc, jwt.WithAudience(mfaChallengeAudience))
+	if err != nil {
+		return MFAChallenge{}, err
+	}
+	if !token.Valid || claims.ID == "" || claims.ExpiresAt == nil {
+		return MFAChallenge{}, errors.New("invalid challenge token")
+	}
+	userID, err := primitive.ObjectIDFromHex(claims.Subject)
+	if err != nil {
+		return MFAChallenge{}, err
+	}
+	return MFAChallenge{UserID: userID, tokenID: claims.ID, expiresAt: claims.ExpiresAt.Time}, nil
+}
+
+// Used reports whether the challenge was already exchanged
+func (c MFAChallenge) Used(ctx context.Context) (bool, error) {
+	if stores.Revocations == nil {
+		return false, errNoDatabase
+	}
+	used, err := stores.Revocations.FindRevocations(ctx, []string{c.tokenID})
+	return len(used) > 0, err
+}
+
+// Use records the challenge as exchanged, so it cannot be exchanged again.
+// Of two concurrent exchanges only one succeeds; the other gets ErrChallengeUsed.
+func (c MFAChallenge) Use(ctx context.Context) error {
+	if stores.Revocations == nil {
+		return errNoDatabase
+	}
+	inserted, err := stores.Revocations.InsertRevocation(ctx, models.RevokedToken{
+		ID:        c.tokenID,
+		UserID:    c.UserID.Hex(),
+		ExpiresAt: c.expiresAt,
+	})
+	if err != nil {
+		return err
+	}
+	if !inserted {
+		return ErrChallengeUsed
+	}
+	return nil
+}
@@ -2,78 +2,234 @@ package middleware
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 
+	"profolio-vercel/config"
+	"profolio-vercel/models"
+	"profolio-vercel/problem"
+
 	"github.com/golang-jwt/jwt/v5"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-// Load the JWT secret from the environment
-var jwtSecret = []byte(os.Getenv("NEXTAUTH_SECRET"))
+// jwtSecret and keys sign and verify tokens; Configure sets them at startup
+var (
+	jwtSecret []byte
+	keys      *keySet // nil when tokens are HMAC signed with jwtSecret
+)
+
+// Configure sets the token signing keys. Asymmetric keys are read here, so a
+// broken keys directory stops the API at startup instead of failing requests.
+func Configure(cfg *config.Config) error {
+	set, err := loadKeySet(cfg.JWT)
+	if err != nil {
+		return err
+	}
+	jwtSecret, keys = []byte(cfg.JWT.Secret), set
+	return nil
+}
+
+func init() {
+	// Whole seconds can't tell whether a token was issued before or after a
+	// revocation in the same second, so iat and exp keep milliseconds
+	jwt.TimePrecision = time.Millisecond
+}
 
 type contextKey string
 
 const userClaimsKey contextKey = "userClaims"
 
+// AccessTokenTTL is how long an access token is accepted. Clients renew it
+// with a refresh token instead of holding a long-lived bearer token.
+const AccessTokenTTL = 15 * time.Minute
+
+// Claims identifies the signed-in user a token was issued to
+type Claims struct {
+	UserID        string `json:"uid"`
+	Username      string `json:"username"`
+	Email         string `json:"email"`
+	Role          string `json:"role,omitempty"`
+	EmailVerified bool   `json:"email_verified"`
+
+	// Set when an admin is acting as this user through impersonation
+	Actor *Actor `json:"act,omitempty"`
+
+	// Set instead of the registered claims when the caller used an API key
+	APIKeyID string   `json:"-"`
+	Scopes   []string `json:"-"`
+	jwt.RegisteredClaims
+}
+
+// Actor is the user really behind an impersonated token (RFC 8693 "act" claim)
+type Actor struct {
+	Subject  string `json:"sub"`
+	Username string `json:"username,omitempty"`
+}
+
+// ImpersonationTTL is how long an impersonation token is accepted. It cannot be refreshed.
+const ImpersonationTTL = 10 * time.Minute
+
+// ObjectID returns the user's ID in the users collection
+func (c *Claims) ObjectID() (primitive.ObjectID, error) {
+	return primitive.ObjectIDFromHex(c.UserID)
+}
+
+// ClaimsFromContext returns the claims JwtVerify attached to the request context
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(userClaimsKey).(*Claims)
+	return claims, ok
+}
+
+// WithClaims attaches the claims of the caller to a context
+func WithClaims(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, userClaimsKey, claims)
+}
+
+// KeyFunc returns the key a token is verified with. With asymmetric keys
+// configured the token's kid header selects one of the active verification
+// keys, otherwise tokens must be HMAC signed with NEXTAUTH_SECRET.
 func KeyFunc(token *jwt.Token) (interface{}, error) {
-	// Validate the algorithm - ES256 is the default
-	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	set := keys
+	if set == nil {
+		// Validate the algorithm - HS256 with the shared secret
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		// Return the secret signing key
+		return jwtSecret, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := set.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key: %q", kid)
 	}
-	// Return the secret signing key
-	return jwtSecret, nil
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %v for key %q", token.Header["alg"], kid)
+	}
+	return key.Public, nil
 }
 
-func GenerateJWT() (string, error) {
+// newTokenID returns a random identifier for the jti claim
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// GenerateJWT issues an access token for the user with the given users collection ID
+func GenerateJWT(userID primitive.ObjectID, authUser models.AuthUser) (string, error) {
+	tokenID, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+
 	// Define the token claims
-	claims := jwt.MapClaims{
-		"exp":   time.Now().Add(time.Hour * 24).Unix(), // Token expiration time: 24 hours
-		"iat":   time.Now().Unix(),                     // Token issuance time
+	now := time.Now()
+	claims := Claims{
+		UserID:        userID.Hex(),
+		Username:      authUser.Username,
+		Email:         authUser.Email,
+		Role:          authUser.Role,
+		EmailVerified: authUser.EmailVerified,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        tokenID,
+			Subject:   userID.Hex(),
+			ExpiresAt: jwt.NewNumericDate(now.Add(AccessTokenTTL)), // Token expiration time
+			IssuedAt:  jwt.NewNumericDate(now),                     // Token issuance time
+		},
 	}
 
-	// Create the token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return signToken(claims)
+}
 
-	// Sign the token with the secret key
-	tokenString, err := token.SignedString(jwtSecret)
+// GenerateImpersonationJWT issues a short-lived access token for the user that
+// records the admin acting as them in the act claim
+func GenerateImpersonationJWT(userID primitive.ObjectID, authUser models.AuthUser, actor Actor) (string, error) {
+	tokenID, err := newTokenID()
 	if err != nil {
 		return "", err
 	}
 
-	return tokenString, nil
+	now := time.Now()
+	claims := Claims{
+		UserID:        userID.Hex(),
+		Username:      authUser.Username,
+		Email:         authUser.Email,
+		Role:          authUser.Role,
+		EmailVerified: authUser.EmailVerified,
+		Actor:         &actor,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        tokenID,
+			Subject:   userID.Hex(),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ImpersonationTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+
+	return signToken(claims)
+}
+
+// signToken signs claims with the active asymmetric key, or with the
+// HMAC secret when no keys are configured
+func signToken(claims jwt.Claims) (string, error) {
+	set := keys
+	if set == nil {
+		// Sign the token with the secret key
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
+	}
+
+	token := jwt.NewWithClaims(set.active.Method, claims)
+	token.Header["kid"] = set.active.ID
+	return token.SignedString(set.active.Private)
 }
 
 func JwtVerify(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
-			http.Error(w, "authorization header is missing", http.StatusUnauthorized)
+			problem.Write(w, r, problem.Unauthorized("authorization_missing", "Authorization header is missing"))
 			return
 		}
 
 		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 		if tokenString == "" {
-			http.Error(w, "bearer token is missing", http.StatusUnauthorized)
+			problem.Write(w, r, problem.Unauthorized("token_missing", "Bearer token is missing"))
 			return
 		}
 
 		// Parse and verify the token
-		token, err := jwt.Parse(tokenString, KeyFunc)
+		claims := &Claims{}
+		token, err := jwt.ParseWithClaims(tokenString, claims, KeyFunc)
 		if err != nil {
-			http.Error(w, "invalid token", http.StatusUnauthorized)
+			problem.Write(w, r, problem.Unauthorized("token_invalid", "Invalid token"))
 			return
 		}
 
-		// Token is valid, add user information to the request context
-		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			ctx := context.WithValue(r.Context(), userClaimsKey, claims)
-			next.ServeHTTP(w, r.WithContext(ctx))
-		} else {
-			http.Error(w, "invalid token claims", http.StatusUnauthorized)
+		if !token.Valid || claims.UserID == "" || claims.ID == "" || len(claims.Audience) > 0 {
+			problem.Write(w, r, problem.Unauthorized("token_invalid", "Invalid token claims"))
+			return
+		}
+
+		// Reject tokens that were signed out
+		revoked, err := isRevoked(r.Context(), claims)
+		if err != nil {
+			problem.Write(w, r, problem.Internal("Error checking token revocation", err))
+			return
+		}
+		if revoked {
+			problem.Write(w, r, problem.Unauthorized("token_revoked", "Token has been revoked"))
 			return
 		}
+
+		// Token is valid, add user information to the request context
+		next.ServeHTTP(w, r.WithContext(WithClaims(r.Context(), claims)))
 	})
 }
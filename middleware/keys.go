@@ -0,0 +1,175 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"profolio-vercel/config"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signingKey is an asymmetric key loaded from a PEM file. Keys without a
+// private part are retired: they still verify tokens but never sign new ones.
+type signingKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private crypto.Signer
+	Public  crypto.PublicKey
+}
+
+// keySet holds every verification key, indexed by kid, and the key used for signing
+type keySet struct {
+	active *signingKey
+	keys   map[string]*signingKey
+}
+
+// loadKeySet reads the keys in the configured keys directory, one "<kid>.pem"
+// file per key. The active key ID picks the key new tokens are signed with.
+// Without a keys directory there is no key set, and the API keeps signing
+// with the HMAC secret.
+func loadKeySet(cfg config.JWTConfig) (*keySet, error) {
+	if cfg.KeysDir == "" {
+		return nil, nil
+	}
+	return readKeyDir(cfg.KeysDir, cfg.ActiveKeyID)
+}
+
+func readKeyDir(dir, activeID string) (*keySet, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no *.pem keys found in %s", dir)
+	}
+
+	set := &keySet{keys: make(map[string]*signingKey)}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		id := strings.TrimSuffix(filepath.Base(path), ".pem")
+		key, err := parseKey(id, data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		set.keys[id] = key
+	}
+
+	active, ok := set.keys[activeID]
+	if !ok {
+		return nil, fmt.Errorf("JWT_ACTIVE_KEY_ID %q does not match a key in %s", activeID, dir)
+	}
+	if active.Private == nil {
+		return nil, fmt.Errorf("active key %q has no private key", activeID)
+	}
+	set.active = active
+
+	return set, nil
+}
+
+// parseKey accepts PKCS#8 and PKCS#1 private keys and PKIX public keys
+func parseKey(id string, data []byte) (*signingKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	var parsed interface{}
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &signingKey{ID: id}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.Method, key.Private, key.Public = jwt.SigningMethodRS256, k, &k.PublicKey
+	case *rsa.PublicKey:
+		key.Method, key.Public = jwt.SigningMethodRS256, k
+	case ed25519.PrivateKey:
+		key.Method, key.Private, key.Public = jwt.SigningMethodEdDSA, k, k.Public()
+	case ed25519.PublicKey:
+		key.Method, key.Public = jwt.SigningMethodEdDSA, k
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+
+	if rsaKey, ok := key.Public.(*rsa.PublicKey); ok && rsaKey.N.BitLen() < 2048 {
+		return nil, fmt.Errorf("RSA keys must be at least 2048 bits")
+	}
+
+	return key, nil
+}
+
+// jwk is a public key in the JSON Web Key format (RFC 7517)
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+func (k *signingKey) jwk() jwk {
+	key := jwk{Kid: k.ID, Use: "sig", Alg: k.Method.Alg()}
+	switch pub := k.Public.(type) {
+	case *rsa.PublicKey:
+		key.Kty = "RSA"
+		key.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		key.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case ed25519.PublicKey:
+		key.Kty = "OKP"
+		key.Crv = "Ed25519"
+		key.X = base64.RawURLEncoding.EncodeToString(pub)
+	}
+	return key
+}
+
+// JWKSHandler publishes the public verification keys so other services can
+// verify access tokens without the signing secret
+func JWKSHandler(w http.ResponseWriter, r *http.Request) {
+	set := keys
+	response := struct {
+		Keys []jwk `json:"keys"`
+	}{Keys: []jwk{}}
+	if set != nil {
+		for _, key := range set.keys {
+			response.Keys = append(response.Keys, key.jwk())
+		}
+		sort.Slice(response.Keys, func(i, j int) bool { return response.Keys[i].Kid < response.Keys[j].Kid })
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,271 @@
+package middleware
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"profolio-vercel/config"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testKeys are generated once, as RSA keys take a while
+var testKeys = struct {
+	rsa, weakRSA *rsa.PrivateKey
+	ed25519      ed25519.PrivateKey
+}{}
+
+func init() {
+	var err error
+	if testKeys.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		panic(err)
+	}
+	if testKeys.weakRSA, err = rsa.GenerateKey(rand.Reader, 1024); err != nil {
+		panic(err)
+	}
+	if _, testKeys.ed25519, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		panic(err)
+	}
+}
+
+// encodePEM returns the PEM file of a key: PKCS#8 for private keys, PKIX for public ones
+func encodePEM(t *testing.T, key interface{}) string {
+	t.Helper()
+	var block pem.Block
+	var err error
+	switch k := key.(type) {
+	case *rsa.PublicKey, ed25519.PublicKey:
+		block.Type = "PUBLIC KEY"
+		block.Bytes, err = x509.MarshalPKIXPublicKey(k)
+	default:
+		block.Type = "PRIVATE KEY"
+		block.Bytes, err = x509.MarshalPKCS8PrivateKey(k)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&block))
+}
+
+// keyDir writes files into a new directory
+func keyDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// configureKeys configures the middleware with the keys directory and
+// restores HMAC signing after the test
+func configureKeys(t *testing.T, dir, activeID string) error {
+	t.Helper()
+	t.Cleanup(func() { keys, jwtSecret = nil, nil })
+	cfg := config.Defaults()
+	cfg.JWT = config.JWTConfig{Secret: "test-secret", KeysDir: dir, ActiveKeyID: activeID}
+	return Configure(cfg)
+}
+
+func TestReadKeyDir(t *testing.T) {
+	pkcs1 := string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(testKeys.rsa)}))
+	tests := []struct {
+		name   string
+		files  map[string]string
+		active string
+		err    string // Part of the error, when the directory is rejected
+	}{
+		{name: "RSA", files: map[string]string{"a.pem": encodePEM(t, testKeys.rsa)}, active: "a"},
+		{name: "PKCS#1 RSA", files: map[string]string{"a.pem": pkcs1}, active: "a"},
+		{name: "Ed25519", files: map[string]string{"a.pem": encodePEM(t, testKeys.ed25519)}, active: "a"},
+		{name: "retired public keys", active: "a", files: map[string]string{
+			"a.pem":   encodePEM(t, testKeys.ed25519),
+			"old.pem": encodePEM(t, &testKeys.rsa.PublicKey),
+			"notes":   "not a key, and not read",
+		}},
+		{name: "no keys", files: map[string]string{"a.txt": "x"}, active: "a", err: "no *.pem keys"},
+		{name: "not PEM", files: map[string]string{"a.pem": "garbage"}, active: "a", err: "no PEM block"},
+		{name: "certificate", active: "a", err: "unsupported PEM block",
+			files: map[string]string{"a.pem": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{1}}))}},
+		{name: "corrupt key", active: "a", err: "a.pem",
+			files: map[string]string{"a.pem": string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte{1, 2, 3}}))}},
+		{name: "weak RSA", files: map[string]string{"a.pem": encodePEM(t, testKeys.weakRSA)}, active: "a", err: "2048 bits"},
+		{name: "unknown active key", files: map[string]string{"a.pem": encodePEM(t, testKeys.rsa)}, active: "b", err: "does not match"},
+		{name: "public active key", files: map[string]string{"a.pem": encodePEM(t, &testKeys.rsa.PublicKey)}, active: "a", err: "no private key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set, err := readKeyDir(keyDir(t, tt.files), tt.active)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want it to mention %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if set.active == nil || set.active.ID != tt.active || set.active.Private == nil {
+				t.Errorf("active key = %+v", set.active)
+			}
+			if old, ok := set.keys["old"]; ok && (old.Private != nil || old.Method != jwt.SigningMethodRS256) {
+				t.Errorf("retired key = %+v", old)
+			}
+		})
+	}
+}
+
+func TestConfigureReportsBadKeysEveryTime(t *testing.T) {
+	dir := keyDir(t, map[string]string{"a.pem": "garbage"})
+	for i := 0; i < 2; i++ {
+		if err := configureKeys(t, dir, "a"); err == nil {
+			t.Fatal("a broken keys directory was accepted")
+		}
+	}
+
+	// Once the key is fixed the next Configure loads it; the error isn't kept
+	if err := os.WriteFile(filepath.Join(dir, "a.pem"), []byte(encodePEM(t, testKeys.ed25519)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := configureKeys(t, dir, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if keys == nil || keys.active.ID != "a" {
+		t.Errorf("keys = %+v", keys)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	dir := keyDir(t, map[string]string{
+		"old.pem": encodePEM(t, testKeys.ed25519),
+		"new.pem": encodePEM(t, testKeys.rsa),
+	})
+	sign := func() string {
+		t.Helper()
+		token, err := signToken(jwt.RegisteredClaims{Subject: "u1", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	verify := func(token string) (string, error) {
+		parsed, err := jwt.Parse(token, KeyFunc)
+		if err != nil {
+			return "", err
+		}
+		kid, _ := parsed.Header["kid"].(string)
+		return kid, nil
+	}
+
+	if err := configureKeys(t, dir, "old"); err != nil {
+		t.Fatal(err)
+	}
+	oldToken := sign()
+
+	// After the rotation new tokens use the new key and old ones still verify
+	if err := configureKeys(t, dir, "new"); err != nil {
+		t.Fatal(err)
+	}
+	newToken := sign()
+	for token, want := range map[string]string{oldToken: "old", newToken: "new"} {
+		if kid, err := verify(token); err != nil || kid != want {
+			t.Errorf("token verified with %q, %v, want %q", kid, err, want)
+		}
+	}
+
+	// A kid must name a key, and the token's algorithm must be that key's
+	forged := jwt.NewWithClaims(jwt.SigningMethodEdDSA, jwt.RegisteredClaims{Subject: "u1"})
+	forged.Header["kid"] = "new"
+	forgedToken, err := forged.SignedString(testKeys.ed25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hmacToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{Subject: "u1"}).SignedString([]byte("test-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, token := range map[string]string{"algorithm of another key": forgedToken, "HMAC without a kid": hmacToken} {
+		if _, err := verify(token); err == nil {
+			t.Errorf("%s: the token verified", name)
+		}
+	}
+
+	// Once the old key is removed its tokens stop verifying
+	if err := os.Remove(filepath.Join(dir, "old.pem")); err != nil {
+		t.Fatal(err)
+	}
+	if err := configureKeys(t, dir, "new"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verify(oldToken); err == nil {
+		t.Error("a token of a removed key verified")
+	}
+}
+
+func TestJWKSHandler(t *testing.T) {
+	dir := keyDir(t, map[string]string{
+		"b-rsa.pem":     encodePEM(t, testKeys.rsa),
+		"a-ed25519.pem": encodePEM(t, testKeys.ed25519),
+		"c-retired.pem": encodePEM(t, &testKeys.rsa.PublicKey),
+	})
+	if err := configureKeys(t, dir, "b-rsa"); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	JWKSHandler(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	if w.Header().Get("Cache-Control") == "" {
+		t.Error("no Cache-Control")
+	}
+	body := w.Body.String()
+	for _, private := range []string{`"d"`, `"p"`, `"q"`, `"dp"`, `"dq"`, `"qi"`} {
+		if strings.Contains(body, private) {
+			t.Errorf("the key set shows the private member %s: %s", private, body)
+		}
+	}
+
+	var set struct{ Keys []jwk }
+	if err := json.Unmarshal(w.Body.Bytes(), &set); err != nil {
+		t.Fatal(err)
+	}
+	if len(set.Keys) != 3 || set.Keys[0].Kid != "a-ed25519" || set.Keys[1].Kid != "b-rsa" || set.Keys[2].Kid != "c-retired" {
+		t.Fatalf("keys = %+v", set.Keys)
+	}
+
+	okp := set.Keys[0]
+	x, err := base64.RawURLEncoding.DecodeString(okp.X)
+	if okp.Kty != "OKP" || okp.Crv != "Ed25519" || okp.Alg != "EdDSA" || err != nil || !ed25519.PublicKey(x).Equal(testKeys.ed25519.Public()) {
+		t.Errorf("Ed25519 key = %+v", okp)
+	}
+	for _, key := range set.Keys[1:] {
+		n, errN := base64.RawURLEncoding.DecodeString(key.N)
+		if key.Kty != "RSA" || key.Alg != "RS256" || key.Use != "sig" || errN != nil || new(big.Int).SetBytes(n).Cmp(testKeys.rsa.N) != 0 || key.E != "AQAB" {
+			t.Errorf("RSA key = %+v", key)
+		}
+	}
+}
+
+func TestJWKSHandlerWithoutKeys(t *testing.T) {
+	if err := configureKeys(t, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	JWKSHandler(w, httptest.NewRequest("GET", "/.well-known/jwks.json", nil))
+	if strings.TrimSpace(w.Body.String()) != `{"keys":[]}` {
+		t.Errorf("body = %s", w.Body)
+	}
+}
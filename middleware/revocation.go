@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"context"
+	"time"
+
+	"profolio-vercel/models"
+)
+
+func userRevocationID(userID string) string {
+	return "user:" + userID
+}
+
+// RevokeToken stops the access token described by claims from being accepted
+// until it would have expired anyway
+func RevokeToken(ctx context.Context, claims *Claims) error {
+	if stores.Revocations == nil {
+		return errNoDatabase
+	}
+
+	expiresAt := time.Now().Add(AccessTokenTTL)
+	if claims.ExpiresAt != nil {
+		expiresAt = claims.ExpiresAt.Time
+	}
+	return stores.Revocations.SaveRevocation(ctx, models.RevokedToken{ID: claims.ID, UserID: claims.UserID, ExpiresAt: expiresAt})
+}
+
+// RevokeAllForUser rejects every access token issued to the user up to now
+func RevokeAllForUser(ctx context.Context, userID string) error {
+	if stores.Revocations == nil {
+		return errNoDatabase
+	}
+
+	now := time.Now()
+	return stores.Revocations.SaveRevocation(ctx, models.RevokedToken{
+		ID:            userRevocationID(userID),
+		UserID:        userID,
+		RevokedBefore: now,
+		ExpiresAt:     now.Add(AccessTokenTTL),
+	})
+}
+
+// revokes reports whether a revoked_tokens entry rejects the token: either
+// its jti was revoked or it was issued before its user signed out everywhere.
+// A token issued at the cutoff itself, up to the millisecond kept in iat, is
+// rejected too, since it may well predate the revocation.
+func revokes(entry models.RevokedToken, claims *Claims) bool {
+	if entry.ID == claims.ID {
+		return true
+	}
+	return claims.IssuedAt == nil || !claims.IssuedAt.Time.After(entry.RevokedBefore)
+}
+
+// isRevoked reports whether the token's jti was revoked, or whether it was
+// issued before its user signed out everywhere
+func isRevoked(ctx context.Context, claims *Claims) (bool, error) {
+	if stores.Revocations == nil {
+		return false, errNoDatabase
+	}
+
+	revoked, err := stores.Revocations.FindRevocations(ctx, []string{claims.ID, userRevocationID(claims.UserID)})
+	if err != nil {
+		return false, err
+	}
+
+	for _, entry := range revoked {
+		if revokes(entry, claims) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"profolio-vercel/models"
+	"profolio-vercel/store"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestRevokesByIssueTime(t *testing.T) {
+	// Revoked half way through a second
+	revokedAt := time.Date(2024, 6, 1, 12, 0, 0, 500_000_000, time.UTC)
+	entry := models.RevokedToken{
+		ID:            userRevocationID("u1"),
+		UserID:        "u1",
+		RevokedBefore: revokedAt,
+	}
+
+	tests := []struct {
+		name     string
+		issuedAt time.Time
+		revoked  bool
+	}{
+		{"issued a second before", revokedAt.Add(-time.Second), true},
+		{"issued earlier in the same second", revokedAt.Add(-100 * time.Millisecond), true},
+		{"issued in the same millisecond", revokedAt.Add(500 * time.Microsecond), true},
+		{"reissued in the same second", revokedAt.Add(100 * time.Millisecond), false},
+		{"issued a second after", revokedAt.Add(time.Second), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := &Claims{UserID: "u1", RegisteredClaims: jwt.RegisteredClaims{
+				ID:       "jti",
+				IssuedAt: jwt.NewNumericDate(tt.issuedAt),
+			}}
+			if got := revokes(entry, claims); got != tt.revoked {
+				t.Errorf("revokes() = %v, want %v", got, tt.revoked)
+			}
+		})
+	}
+}
+
+func TestRevokesByJTI(t *testing.T) {
+	claims := &Claims{UserID: "u1", RegisteredClaims: jwt.RegisteredClaims{ID: "jti", IssuedAt: jwt.NewNumericDate(time.Now())}}
+	if !revokes(models.RevokedToken{ID: "jti"}, claims) {
+		t.Error("a revoked jti is accepted")
+	}
+}
+
+func TestRevokeAllForUser(t *testing.T) {
+	m := store.NewMemory()
+	SetStores(Stores{Users: m, Auth: m, APIKeys: m, Revocations: m})
+	t.Cleanup(func() { SetStores(Stores{}) })
+	ctx := context.Background()
+
+	// The token's iat goes through the signed token, as Authenticate sees it
+	issue := func() *Claims {
+		t.Helper()
+		tokenID, err := newTokenID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := signToken(Claims{UserID: "u1", RegisteredClaims: jwt.RegisteredClaims{ID: tokenID, IssuedAt: jwt.NewNumericDate(time.Now())}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims := &Claims{}
+		if _, err := jwt.ParseWithClaims(token, claims, KeyFunc); err != nil {
+			t.Fatal(err)
+		}
+		return claims
+	}
+
+	before := issue()
+	if err := RevokeAllForUser(ctx, "u1"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	after := issue()
+
+	if revoked, err := isRevoked(ctx, before); err != nil || !revoked {
+		t.Errorf("token issued just before: revoked = %v, %v", revoked, err)
+	}
+	if revoked, err := isRevoked(ctx, after); err != nil || revoked {
+		t.Errorf("token issued after: revoked = %v, %v", revoked, err)
+	}
+}
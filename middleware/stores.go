@@ -0,0 +1,27 @@
+package middleware
+
+import (
+	"errors"
+
+	"profolio-vercel/store"
+)
+
+// Stores are what the middleware checks tokens and accounts against
+type Stores struct {
+	Users       store.UserStore
+	Auth        store.AuthStore
+	APIKeys     store.APIKeyStore
+	Revocations store.RevocationStore
+}
+
+var (
+	stores Stores
+
+	errNoDatabase = errors.New("database client not initialized")
+)
+
+// SetStores replaces the stores, for tests or other databases. NewRouter sets
+// the Mongo stores.
+func SetStores(s Stores) {
+	stores = s
+}
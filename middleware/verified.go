@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"profolio-vercel/problem"
+)
+
+// emailVerified checks auth_users, since a token issued before the user
+// followed the verification link still says the address is unverified
+func emailVerified(ctx context.Context, email string) (bool, error) {
+	if stores.Auth == nil {
+		return false, errNoDatabase
+	}
+
+	authUser, err := stores.Auth.FindAuthUser(ctx, email)
+	if err != nil {
+		return false, err
+	}
+	return authUser.EmailVerified, nil
+}
+
+// RequireVerifiedEmail blocks sensitive routes until the caller has verified
+// their email address. It must run after JwtVerify.
+func RequireVerifiedEmail(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := ClaimsFromContext(r.Context())
+		if !ok {
+			problem.Write(w, r, ErrMissingClaims)
+			return
+		}
+
+		if !claims.EmailVerified {
+			ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+			defer cancel()
+
+			verified, err := emailVerified(ctx, claims.Email)
+			if err != nil {
+				problem.Write(w, r, problem.Internal("Error checking email verification", err))
+				return
+			}
+			if !verified {
+				problem.Write(w, r, problem.Forbidden("email_unverified", "Email address is not verified"))
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,48 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Actions recorded in the audit_events collection
+const (
+	AuditSignIn           = "auth.signin"
+	AuditSignInFailed     = "auth.signin_failed"
+	AuditSignUp           = "auth.signup"
+	AuditPasswordChanged  = "auth.password_changed"
+	AuditTokenRevoked     = "auth.token_revoked"
+	AuditSessionsRevoked  = "auth.sessions_revoked"
+	AuditAPIKeyRevoked    = "auth.api_key_revoked"
+	AuditAccountChanged   = "auth.account_changed"
+	AuditUserUpdated      = "user.updated"
+	AuditUserDisabled     = "user.disabled"
+	AuditUserEnabled      = "user.enabled"
+	AuditUserRoleChanged  = "user.role_changed"
+	AuditUserImpersonated = "user.impersonated"
+	AuditResumeCreated    = "resume.created"
+	AuditResumeUpdated    = "resume.updated"
+	AuditResumeDeleted    = "resume.deleted"
+)
+
+// FieldChange is one field of a document an audited action changed
+type FieldChange struct {
+	Field string      `bson:"field" json:"field"`
+	From  interface{} `bson:"from,omitempty" json:"from,omitempty"`
+	To    interface{} `bson:"to,omitempty" json:"to,omitempty"`
+}
+
+// AuditEvent records a security relevant action. Events are only ever inserted,
+// never updated or deleted.
+type AuditEvent struct {
+	ID        primitive.ObjectID     `bson:"_id,omitempty" json:"id"`
+	Action    string                 `bson:"action" json:"action"`
+	ActorID   string                 `bson:"actorId,omitempty" json:"actorId,omitempty"`   // User who performed the action
+	TargetID  string                 `bson:"targetId,omitempty" json:"targetId,omitempty"` // User the action was performed on
+	IP        string                 `bson:"ip,omitempty" json:"ip,omitempty"`
+	UserAgent string                 `bson:"userAgent,omitempty" json:"userAgent,omitempty"`
+	Changes   []FieldChange          `bson:"changes,omitempty" json:"changes,omitempty"`
+	Details   map[string]interface{} `bson:"details,omitempty" json:"details,omitempty"`
+	CreatedAt time.Time              `bson:"createdAt" json:"createdAt"`
+}
@@ -0,0 +1,92 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RefreshToken is a long-lived token stored in the refresh_tokens collection.
+// Only the SHA-256 hash of the token is kept. Every rotation creates a new
+// token in the same family, so reusing a spent token can revoke the family.
+type RefreshToken struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID    primitive.ObjectID `bson:"userId" json:"userId"`
+	Family    string             `bson:"family" json:"family"`
+	TokenHash string             `bson:"tokenHash" json:"-"`
+	Email     string             `bson:"email,omitempty" json:"-"` // The address the token was mailed to
+	CreatedAt time.Time          `bson:"createdAt" json:"createdAt"`
+	ExpiresAt time.Time          `bson:"expiresAt" json:"expiresAt"`
+	UsedAt    *time.Time         `bson:"usedAt,omitempty" json:"usedAt,omitempty"`
+	RevokedAt *time.Time         `bson:"revokedAt,omitempty" json:"revokedAt,omitempty"`
+}
+
+// RevokedToken marks access tokens that must no longer be accepted.
+// ID is either a token's jti or "user:<id>" to reject every token
+// issued to that user before RevokedBefore.
+type RevokedToken struct {
+	ID            string    `bson:"_id" json:"id"`
+	UserID        string    `bson:"userId" json:"userId"`
+	RevokedBefore time.Time `bson:"revokedBefore,omitempty" json:"revokedBefore,omitempty"`
+	ExpiresAt     time.Time `bson:"expiresAt" json:"expiresAt"`
+}
+
+// Purposes of the single-use tokens in the action_tokens collection
+const (
+	PurposePasswordReset     = "password_reset"
+	PurposeEmailVerification = "email_verification"
+)
+
+// ActionToken is a single-use token mailed to a user, such as a password reset
+// link. Only its SHA-256 hash is stored and a TTL index removes it once expired.
+type ActionToken struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID    primitive.ObjectID `bson:"userId" json:"userId"`
+	Purpose   string             `bson:"purpose" json:"purpose"`
+	TokenHash string             `bson:"tokenHash" json:"-"`
+	Email     string             `bson:"email,omitempty" json:"-"` // The address the token was mailed to
+	CreatedAt time.Time          `bson:"createdAt" json:"createdAt"`
+	ExpiresAt time.Time          `bson:"expiresAt" json:"expiresAt"`
+	UsedAt    *time.Time         `bson:"usedAt,omitempty" json:"usedAt,omitempty"`
+}
+
+// OAuthState is a pending social login, keyed by the hash of the state
+// parameter sent to the provider. It carries the PKCE verifier and the
+// nonce so the callback can finish the flow on any serverless instance.
+// BrowserHash is the hash of the cookie set on the browser that started it.
+type OAuthState struct {
+	ID          string              `bson:"_id" json:"-"`
+	Provider    string              `bson:"provider" json:"provider"`
+	BrowserHash string              `bson:"browserHash" json:"-"`
+	Nonce       string              `bson:"nonce" json:"-"`
+	Verifier    string              `bson:"verifier" json:"-"`
+	LinkUserID  *primitive.ObjectID `bson:"linkUserId,omitempty" json:"linkUserId,omitempty"` // Set when a signed-in user links a provider
+	ExpiresAt   time.Time           `bson:"expiresAt" json:"expiresAt"`
+}
+
+// Scopes an API key can be granted
+const (
+	ScopeUserRead     = "user:read"
+	ScopeUserWrite    = "user:write"
+	ScopeResumesWrite = "resumes:write"
+	ScopeAI           = "ai"
+	ScopeMetrics      = "metrics:read" // Scrape /metrics, when the key belongs to an admin
+)
+
+// APIKeyScopes lists every scope an API key can be granted
+var APIKeyScopes = []string{ScopeUserRead, ScopeUserWrite, ScopeResumesWrite, ScopeAI, ScopeMetrics}
+
+// APIKey lets scripts call the API on behalf of a user through the X-API-Key
+// header. Only the SHA-256 hash of the key is stored; Prefix identifies it in listings.
+type APIKey struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID     primitive.ObjectID `bson:"userId" json:"-"`
+	Name       string             `bson:"name" json:"name"`
+	Prefix     string             `bson:"prefix" json:"prefix"`
+	KeyHash    string             `bson:"keyHash" json:"-"`
+	Scopes     []string           `bson:"scopes" json:"scopes"`
+	CreatedAt  time.Time          `bson:"createdAt" json:"createdAt"`
+	LastUsedAt *time.Time         `bson:"lastUsedAt,omitempty" json:"lastUsedAt,omitempty"`
+	ExpiresAt  *time.Time         `bson:"expiresAt,omitempty" json:"expiresAt,omitempty"`
+	RevokedAt  *time.Time         `bson:"revokedAt,omitempty" json:"revokedAt,omitempty"`
+}
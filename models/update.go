@@ -0,0 +1,70 @@
+package models
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// UserUpdate is the part of a profile a PATCH may change. Fields left out of
+// the request stay nil and are not touched. The email and username are not
+// here: they also live in auth_users and change through their own endpoints.
+type UserUpdate struct {
+	Basics       *BasicsUpdate      `json:"basics"`
+	Work         *[]WorkExperience  `json:"work" validate:"omitempty,max=50,dive"`
+	Education    *[]EducationDetail `json:"education" validate:"omitempty,max=50,dive"`
+	Certificates *[]Certificate     `json:"certificates" validate:"omitempty,max=50,dive"`
+	Skills       *[]Skill           `json:"skills" validate:"omitempty,max=100,dive"`
+	Languages    *[]Language        `json:"languages" validate:"omitempty,max=50,dive"`
+	Interests    *[]Interest        `json:"interests" validate:"omitempty,max=50,dive"`
+	Projects     *[]Project         `json:"projects" validate:"omitempty,max=50,dive"`
+}
+
+// BasicsUpdate is the part of Basics a PATCH may change
+type BasicsUpdate struct {
+	Name     *string    `json:"name" validate:"omitempty,max=100"`
+	Label    *string    `json:"label" validate:"omitempty,max=100"`
+	Image    *string    `json:"image" validate:"omitempty,http_url,max=2048"`
+	Phone    *string    `json:"phone" validate:"omitempty,phone"`
+	URL      *string    `json:"url" validate:"omitempty,http_url,max=2048"`
+	Summary  *string    `json:"summary" validate:"omitempty,max=2000"`
+	Location *Location  `json:"location"`
+	Profiles *[]Profile `json:"profiles" validate:"omitempty,max=20,dive"`
+}
+
+// Set returns the $set document for the fields present in the update, keyed
+// by their paths in the users collection. Values are converted to what Mongo
+// stores, so they compare equal to the stored ones.
+func (u UserUpdate) Set() (bson.M, error) {
+	set := bson.M{}
+	add := func(path string, present bool, value interface{}) {
+		if present {
+			set[path] = value
+		}
+	}
+	if b := u.Basics; b != nil {
+		add("basics.name", b.Name != nil, b.Name)
+		add("basics.label", b.Label != nil, b.Label)
+		add("basics.image", b.Image != nil, b.Image)
+		add("basics.phone", b.Phone != nil, b.Phone)
+		add("basics.url", b.URL != nil, b.URL)
+		add("basics.summary", b.Summary != nil, b.Summary)
+		add("basics.location", b.Location != nil, b.Location)
+		add("basics.profiles", b.Profiles != nil, b.Profiles)
+	}
+	add("work", u.Work != nil, u.Work)
+	add("education", u.Education != nil, u.Education)
+	add("certificates", u.Certificates != nil, u.Certificates)
+	add("skills", u.Skills != nil, u.Skills)
+	add("languages", u.Languages != nil, u.Languages)
+	add("interests", u.Interests != nil, u.Interests)
+	add("projects", u.Projects != nil, u.Projects)
+
+	// A round trip through BSON dereferences the pointers and applies the
+	// field names the users collection uses
+	data, err := bson.Marshal(set)
+	if err != nil {
+		return nil, err
+	}
+	var stored bson.M
+	err = bson.Unmarshal(data, &stored)
+	return stored, err
+}
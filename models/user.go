@@ -6,113 +6,182 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// The validate tags below are checked by the validation package before a
+// payload is stored. Lists are capped so one document stays well under Mongo's limit.
+
 type Location struct {
-	Address     string `json:"address"`
-	PostalCode  string `json:"postalCode"`
-	City        string `json:"city"`
-	CountryCode string `json:"countryCode"`
-	Region      string `json:"region"`
+	Address     string `json:"address" validate:"max=200"`
+	PostalCode  string `json:"postalCode" validate:"max=20"`
+	City        string `json:"city" validate:"max=100"`
+	CountryCode string `json:"countryCode" validate:"omitempty,iso3166_1_alpha2"`
+	Region      string `json:"region" validate:"max=100"`
 }
 
 type Profile struct {
-	Network  string `json:"network"`
-	Username string `json:"username"`
-	URL      string `json:"url"`
+	Network  string `json:"network" validate:"required,max=50"`
+	Username string `json:"username" validate:"max=100"`
+	URL      string `json:"url" validate:"omitempty,http_url,max=2048"`
 }
 
 type WorkExperience struct {
-	Name       string     `json:"name"`
-	Position   string     `json:"position"`
-	URL        string     `json:"url,omitempty"`
-	StartDate  time.Time  `json:"startDate"`
-	EndDate    *time.Time `json:"endDate,omitempty"`
-	Summary    string     `json:"summary"`
-	Highlights []string   `json:"highlights,omitempty"`
+	Name       string     `json:"name" validate:"required,max=200"`
+	Position   string     `json:"position" validate:"required,max=200"`
+	URL        string     `json:"url,omitempty" validate:"omitempty,http_url,max=2048"`
+	StartDate  time.Time  `json:"startDate" validate:"required"`
+	EndDate    *time.Time `json:"endDate,omitempty" validate:"omitempty,gtefield=StartDate"`
+	Summary    string     `json:"summary" validate:"max=2000"`
+	Highlights []string   `json:"highlights,omitempty" validate:"max=20,dive,max=500"`
 }
 
 type EducationDetail struct {
-	Institution string     `json:"institution"`
-	URL         string     `json:"url,omitempty"`
-	Area        string     `json:"area"`
-	StudyType   string     `json:"studyType"`
-	StartDate   time.Time  `json:"startDate"`
-	EndDate     *time.Time `json:"endDate,omitempty"`
-	Score       *string    `json:"score,omitempty"`
-	ScoreType   *string    `json:"scoreType,omitempty"`
-	Courses     []string   `json:"courses,omitempty"`
+	Institution string     `json:"institution" validate:"required,max=200"`
+	URL         string     `json:"url,omitempty" validate:"omitempty,http_url,max=2048"`
+	Area        string     `json:"area" validate:"max=200"`
+	StudyType   string     `json:"studyType" validate:"max=100"`
+	StartDate   time.Time  `json:"startDate" validate:"required"`
+	EndDate     *time.Time `json:"endDate,omitempty" validate:"omitempty,gtefield=StartDate"`
+	Score       *string    `json:"score,omitempty" validate:"omitempty,max=20"`
+	ScoreType   *string    `json:"scoreType,omitempty" validate:"omitempty,max=50"`
+	Courses     []string   `json:"courses,omitempty" validate:"max=50,dive,max=200"`
 }
 
 type Certificate struct {
-	Name   string    `json:"name"`
-	Date   time.Time `json:"date"`
-	Issuer string    `json:"issuer"`
-	URL    string    `json:"url,omitempty"`
+	Name   string    `json:"name" validate:"required,max=200"`
+	Date   time.Time `json:"date" validate:"required"`
+	Issuer string    `json:"issuer" validate:"required,max=200"`
+	URL    string    `json:"url,omitempty" validate:"omitempty,http_url,max=2048"`
 }
 
+// Skill levels a user can claim
+const (
+	SkillBeginner     = "beginner"
+	SkillIntermediate = "intermediate"
+	SkillAdvanced     = "advanced"
+	SkillExpert       = "expert"
+)
+
 type Skill struct {
-	Name     string               `json:"name"`
-	Level    string               `json:"level"`
-	Keywords []primitive.ObjectID `json:"keywords,omitempty"`
+	Name     string               `json:"name" validate:"required,max=100"`
+	Level    string               `json:"level" validate:"omitempty,oneof=beginner intermediate advanced expert"`
+	Keywords []primitive.ObjectID `json:"keywords,omitempty" validate:"max=50"`
 }
 
+// Fluency levels of a spoken language
+const (
+	FluencyElementary   = "elementary"
+	FluencyLimited      = "limited"
+	FluencyProfessional = "professional"
+	FluencyFluent       = "fluent"
+	FluencyNative       = "native"
+)
+
 type Language struct {
-	Language string `json:"language"`
-	Fluency  string `json:"fluency"`
+	Language string `json:"language" validate:"required,max=100"`
+	Fluency  string `json:"fluency" validate:"omitempty,oneof=elementary limited professional fluent native"`
 }
 
 type Interest struct {
-	Name     string   `json:"name"`
-	Keywords []string `json:"keywords,omitempty"`
+	Name     string   `json:"name" validate:"required,max=100"`
+	Keywords []string `json:"keywords,omitempty" validate:"max=20,dive,max=100"`
 }
 
+// Roles a user in auth_users can hold
+const (
+	RoleUser    = "user"
+	RoleSupport = "support"
+	RoleAdmin   = "admin"
+)
+
+// Roles lists every role in increasing order of privilege
+var Roles = []string{RoleUser, RoleSupport, RoleAdmin}
+
 type AuthUser struct {
-	Username string `bson:"username" json:"username"`
-	Email    string `bson:"email" json:"email"`
-	Password string `bson:"password" json:"password"`
+	Username      string `bson:"username" json:"username" validate:"required,username"`
+	Email         string `bson:"email" json:"email" validate:"required,email,max=254"`
+	Password      string `bson:"password" json:"password" validate:"required,min=8,max=72"` // bcrypt ignores bytes past 72
+	Role          string `bson:"role,omitempty" json:"role,omitempty"`
+	EmailVerified bool   `bson:"emailVerified" json:"emailVerified"`
+	Disabled      bool   `bson:"disabled,omitempty" json:"-"` // Set by an admin; disabled users cannot sign in
+
+	// Two-factor authentication; none of it is ever read from or written to JSON
+	TOTPEnabled       bool     `bson:"totpEnabled,omitempty" json:"-"`
+	TOTPSecret        string   `bson:"totpSecret,omitempty" json:"-"`
+	TOTPPendingSecret string   `bson:"totpPendingSecret,omitempty" json:"-"`
+	TOTPLastStep      int64    `bson:"totpLastStep,omitempty" json:"-"`
+	RecoveryCodes     []string `bson:"recoveryCodes,omitempty" json:"-"` // SHA-256 hashes of unused recovery codes
+
+	// Social login accounts linked to this user
+	Identities []ExternalIdentity `bson:"identities,omitempty" json:"-"`
+}
+
+// ExternalIdentity links an account at a social login provider to a user.
+// Key is "<provider>:<subject>", which a unique index keeps to one user.
+type ExternalIdentity struct {
+	Key      string    `bson:"key" json:"-"`
+	Provider string    `bson:"provider" json:"provider"`
+	Subject  string    `bson:"subject" json:"subject"`
+	Email    string    `bson:"email,omitempty" json:"email,omitempty"`
+	LinkedAt time.Time `bson:"linkedAt" json:"linkedAt"`
 }
 type Project struct {
-	Name         string               `json:"name"`
-	StartDate    time.Time            `json:"startDate"`
-	EndDate      *time.Time           `json:"endDate,omitempty"`
-	Description  string               `json:"description"`
-	Highlights   []string             `json:"highlights,omitempty"`
-	GithubURL    string               `json:"githubUrl,omitempty"`
-	DeployedURL  string               `json:"deployedUrl,omitempty"`
-	Technologies string               `json:"technologies,omitempty"`
-	TechStack    []primitive.ObjectID `json:"techStack,omitempty"`
+	Name         string               `json:"name" validate:"required,max=200"`
+	StartDate    time.Time            `json:"startDate" validate:"required"`
+	EndDate      *time.Time           `json:"endDate,omitempty" validate:"omitempty,gtefield=StartDate"`
+	Description  string               `json:"description" validate:"max=2000"`
+	Highlights   []string             `json:"highlights,omitempty" validate:"max=20,dive,max=500"`
+	GithubURL    string               `json:"githubUrl,omitempty" validate:"omitempty,http_url,max=2048"`
+	DeployedURL  string               `json:"deployedUrl,omitempty" validate:"omitempty,http_url,max=2048"`
+	Technologies string               `json:"technologies,omitempty" validate:"max=500"`
+	TechStack    []primitive.ObjectID `json:"techStack,omitempty" validate:"max=50"`
 }
 
 type Basics struct {
-	Name     string    `json:"name,omitempty"`
-	Username string    `json:"username,omitempty"`
-	Label    string    `json:"label,omitempty"`
-	Image    string    `json:"image,omitempty"`
-	Email    string    `json:"email"`
-	Phone    string    `json:"phone,omitempty"`
-	URL      string    `json:"url,omitempty"`
-	Summary  string    `json:"summary,omitempty"`
+	Name     string    `json:"name,omitempty" validate:"max=100"`
+	Username string    `json:"username,omitempty" validate:"omitempty,username"`
+	Label    string    `json:"label,omitempty" validate:"max=100"`
+	Image    string    `json:"image,omitempty" validate:"omitempty,http_url,max=2048"`
+	Email    string    `json:"email" validate:"required,email,max=254"`
+	Phone    string    `json:"phone,omitempty" validate:"omitempty,phone"`
+	URL      string    `json:"url,omitempty" validate:"omitempty,http_url,max=2048"`
+	Summary  string    `json:"summary,omitempty" validate:"max=2000"`
+	Location Location  `json:"location,omitempty"`
+	Profiles []Profile `json:"profiles,omitempty" validate:"max=20,dive"`
+}
+
+// ResumeBasics is the header of a resume. Unlike the profile's Basics the
+// email is optional, as a resume may leave contact details out.
+type ResumeBasics struct {
+	Name     string    `json:"name,omitempty" validate:"max=100"`
+	Username string    `json:"username,omitempty" validate:"omitempty,username"`
+	Label    string    `json:"label,omitempty" validate:"max=100"`
+	Image    string    `json:"image,omitempty" validate:"omitempty,http_url,max=2048"`
+	Email    string    `json:"email,omitempty" validate:"omitempty,email,max=254"`
+	Phone    string    `json:"phone,omitempty" validate:"omitempty,phone"`
+	URL      string    `json:"url,omitempty" validate:"omitempty,http_url,max=2048"`
+	Summary  string    `json:"summary,omitempty" validate:"max=2000"`
 	Location Location  `json:"location,omitempty"`
-	Profiles []Profile `json:"profiles,omitempty"`
+	Profiles []Profile `json:"profiles,omitempty" validate:"max=20,dive"`
 }
 
 type ResumeSkill struct {
-	Name      string `json:"name"`
-	TechStack string `json:"techStack"`
+	Name      string `json:"name" validate:"required,max=100"`
+	TechStack string `json:"techStack" validate:"max=500"`
 }
 
 type Resume struct {
 	ID           primitive.ObjectID `bson:"_id,omitempty" json:"_id,omitempty"`
-	Name         string             `json:"name,omitempty"`
+	Version      int64              `json:"version"` // Incremented by every write to the resume
+	Name         string             `json:"name,omitempty" validate:"max=100"`
 	IsDefault    bool               `json:"isDefault,omitempty"`
-	TemplateID   string             `json:"templateId,omitempty"`
-	Basics       Basics             `json:"basics,omitempty"`
-	Work         []WorkExperience   `json:"work,omitempty"`
-	Education    []EducationDetail  `json:"education,omitempty"`
-	Certificates []Certificate      `json:"certificates,omitempty"`
-	Skills       []ResumeSkill      `json:"skills,omitempty"`
-	Languages    []Language         `json:"languages,omitempty"`
-	Interests    []Interest         `json:"interests,omitempty"`
-	Projects     []Project          `json:"projects,omitempty"`
+	TemplateID   string             `json:"templateId,omitempty" validate:"max=100"`
+	Basics       ResumeBasics       `json:"basics,omitempty"`
+	Work         []WorkExperience   `json:"work,omitempty" validate:"max=50,dive"`
+	Education    []EducationDetail  `json:"education,omitempty" validate:"max=50,dive"`
+	Certificates []Certificate      `json:"certificates,omitempty" validate:"max=50,dive"`
+	Skills       []ResumeSkill      `json:"skills,omitempty" validate:"max=100,dive"`
+	Languages    []Language         `json:"languages,omitempty" validate:"max=50,dive"`
+	Interests    []Interest         `json:"interests,omitempty" validate:"max=50,dive"`
+	Projects     []Project          `json:"projects,omitempty" validate:"max=50,dive"`
 } // Resume Schema
 
 type SkillCollection struct {
@@ -122,13 +191,14 @@ type SkillCollection struct {
 
 type User struct {
 	ID           primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+	Version      int64              `json:"version"` // Incremented by every write to the document
 	Basics       Basics             `json:"basics"`
-	Resumes      []Resume           `json:"resumes"`
-	Work         []WorkExperience   `json:"work,omitempty"`
-	Education    []EducationDetail  `json:"education,omitempty"`
-	Certificates []Certificate      `json:"certificates,omitempty"`
-	Skills       []Skill            `json:"skills,omitempty"`
-	Languages    []Language         `json:"languages,omitempty"`
-	Interests    []Interest         `json:"interests,omitempty"`
-	Projects     []Project          `json:"projects,omitempty"`
+	Resumes      []Resume           `json:"resumes" validate:"max=3,dive"` // store.MaxResumes
+	Work         []WorkExperience   `json:"work,omitempty" validate:"max=50,dive"`
+	Education    []EducationDetail  `json:"education,omitempty" validate:"max=50,dive"`
+	Certificates []Certificate      `json:"certificates,omitempty" validate:"max=50,dive"`
+	Skills       []Skill            `json:"skills,omitempty" validate:"max=100,dive"`
+	Languages    []Language         `json:"languages,omitempty" validate:"max=50,dive"`
+	Interests    []Interest         `json:"interests,omitempty" validate:"max=50,dive"`
+	Projects     []Project          `json:"projects,omitempty" validate:"max=50,dive"`
 }
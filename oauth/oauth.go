@@ -0,0 +1,95 @@
+// Package oauth implements the authorization code + PKCE flow against social
+// login providers: GitHub, Google and any OpenID Connect issuer.
+package oauth
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"profolio-vercel/config"
+)
+
+// Identity is what a provider asserts about the user who signed in
+type Identity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Login         string // The user's handle at the provider, if it has one
+}
+
+// Provider is a social login provider
+type Provider interface {
+	Name() string
+	// AuthCodeURL returns the URL the browser is sent to. The verifier's S256
+	// challenge is included for PKCE; nonce binds the returned ID token.
+	AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error)
+	// Exchange trades the authorization code for the user's identity
+	Exchange(ctx context.Context, code, nonce, verifier string) (Identity, error)
+}
+
+// Registry holds the providers enabled by configuration
+type Registry struct {
+	providers map[string]Provider
+}
+
+func NewRegistry(providers ...Provider) *Registry {
+	registry := &Registry{providers: make(map[string]Provider)}
+	for _, provider := range providers {
+		registry.providers[provider.Name()] = provider
+	}
+	return registry
+}
+
+// Get returns the provider registered under name
+func (r *Registry) Get(name string) (Provider, bool) {
+	provider, ok := r.providers[name]
+	return provider, ok
+}
+
+// Names lists the registered providers
+func (r *Registry) Names() []string {
+	names := make([]string, 0, len(r.providers))
+	for name := range r.providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RedirectURL is the callback URL registered with a provider
+func RedirectURL(baseURL, provider string) string {
+	return strings.TrimSuffix(baseURL, "/") + "/api/oauth/" + provider + "/callback"
+}
+
+// FromConfig enables every provider whose client ID is set. Callbacks are
+// served under the redirect base URL.
+func FromConfig(cfg config.OAuthConfig) (*Registry, error) {
+	baseURL := cfg.RedirectBaseURL
+	if baseURL == "" {
+		baseURL = "http://localhost:8080"
+	}
+
+	var providers []Provider
+	if cfg.GitHubClientID != "" {
+		providers = append(providers, NewGitHubProvider(cfg.GitHubClientID, cfg.GitHubClientSecret, RedirectURL(baseURL, "github")))
+	}
+	if cfg.GoogleClientID != "" {
+		providers = append(providers, NewOIDCProvider("google", "https://accounts.google.com", cfg.GoogleClientID, cfg.GoogleClientSecret, RedirectURL(baseURL, "google")))
+	}
+	if cfg.OIDCClientID != "" {
+		if cfg.OIDCIssuer == "" {
+			return nil, fmt.Errorf("OIDC_CLIENT_ID is set but OIDC_ISSUER is not")
+		}
+		name := cfg.OIDCProviderName
+		if name == "" {
+			name = "oidc"
+		}
+		providers = append(providers, NewOIDCProvider(name, cfg.OIDCIssuer, cfg.OIDCClientID, cfg.OIDCClientSecret, RedirectURL(baseURL, name)))
+	}
+
+	return NewRegistry(providers...), nil
+}
@@ -0,0 +1,184 @@
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"golang.org/x/oauth2"
+)
+
+// mockIssuer is a local OpenID Connect provider. Its authorize endpoint signs
+// the user in straight away and its token endpoint checks the PKCE verifier.
+type mockIssuer struct {
+	*httptest.Server
+	signer jose.Signer
+	keys   jose.JSONWebKeySet
+
+	mu      sync.Mutex
+	pending map[string]url.Values // Authorize parameters by the code issued for them
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: key, KeyID: "test"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{
+		signer:  signer,
+		keys:    jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"}}},
+		pending: map[string]url.Values{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                m.URL,
+			"authorization_endpoint":                m.URL + "/authorize",
+			"token_endpoint":                        m.URL + "/token",
+			"jwks_uri":                              m.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(m.keys)
+	})
+	mux.HandleFunc("/authorize", m.authorize)
+	mux.HandleFunc("/token", m.token)
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *mockIssuer) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	m.mu.Lock()
+	code := "code-" + query.Get("state")
+	m.pending[code] = query
+	m.mu.Unlock()
+
+	redirect := query.Get("redirect_uri") + "?" + url.Values{"code": {code}, "state": {query.Get("state")}}.Encode()
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+func (m *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	authorize, ok := m.pending[r.PostFormValue("code")]
+	delete(m.pending, r.PostFormValue("code"))
+	m.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != authorize.Get("code_challenge") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":                m.URL,
+		"sub":                "subject-1",
+		"aud":                authorize.Get("client_id"),
+		"iat":                time.Now().Unix(),
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"nonce":              authorize.Get("nonce"),
+		"email":              "alice@example.com",
+		"email_verified":     true,
+		"name":               "Alice",
+		"preferred_username": "alice",
+	})
+	signed, err := m.signer.Sign(claims)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	idToken, _ := signed.CompactSerialize()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+// signIn sends the browser to the authorize URL and returns the code the
+// provider redirects back with
+func signIn(t *testing.T, authURL string) string {
+	t.Helper()
+	browser := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := browser.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location, err := resp.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := location.Query().Get("state"); got != "state" {
+		t.Fatalf("state = %q", got)
+	}
+	return location.Query().Get("code")
+}
+
+func TestOIDCProvider(t *testing.T) {
+	tests := []struct {
+		name          string
+		exchangeNonce string
+		wrongVerifier bool
+		wantErr       bool
+	}{
+		{"sign in", "nonce", false, false},
+		{"wrong verifier", "nonce", true, true},
+		{"nonce of another login", "other-nonce", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer := newMockIssuer(t)
+			provider := NewOIDCProvider("mock", issuer.URL, "client", "secret", RedirectURL("http://localhost:8080", "mock"))
+			ctx := context.Background()
+
+			verifier := oauth2.GenerateVerifier()
+			authURL, err := provider.AuthCodeURL(ctx, "state", "nonce", verifier)
+			if err != nil {
+				t.Fatal(err)
+			}
+			code := signIn(t, authURL)
+
+			if tt.wrongVerifier {
+				verifier = oauth2.GenerateVerifier()
+			}
+			identity, err := provider.Exchange(ctx, code, tt.exchangeNonce, verifier)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Exchange() = %+v, want an error", identity)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := Identity{Provider: "mock", Subject: "subject-1", Email: "alice@example.com", EmailVerified: true, Name: "Alice", Login: "alice"}
+			if identity != want {
+				t.Errorf("Exchange() = %+v, want %+v", identity, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,516 @@
+// Package patch applies RFC 7396 JSON merge patches and RFC 6902 JSON patches
+// to decoded JSON documents. Besides the patched document it reports which
+// members and arrays each patch wrote, so the caller can store the result as
+// a targeted update instead of replacing the whole document.
+package patch
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"profolio-vercel/problem"
+)
+
+// Media types of the two patch formats
+const (
+	MergePatchType = "application/merge-patch+json"
+	JSONPatchType  = "application/json-patch+json"
+)
+
+// Kind is how a Change wrote its path
+type Kind int
+
+const (
+	// Set replaced the value at the path
+	Set Kind = iota
+	// Unset removed the member at the path
+	Unset
+	// Push inserted one element into the array at the path
+	Push
+)
+
+// Change is one write a patch made. Path is made of JSON pointer segments.
+// For a Push, Index is where the element landed and Append reports that it
+// went to the end.
+type Change struct {
+	Kind   Kind
+	Path   []string
+	Index  int
+	Append bool
+}
+
+// Pointer formats the path of the change as a JSON pointer
+func (c Change) Pointer() string {
+	return pointer(c.Path)
+}
+
+// Operation is one entry of a JSON patch
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// invalid rejects a patch document whose operation at index i is malformed
+func invalid(i int, path, message string) error {
+	return problem.Invalid("invalid_patch", "The patch is not a valid JSON patch",
+		problem.Field(path, "invalid_patch", "operation "+strconv.Itoa(i)+": "+message))
+}
+
+// unprocessable rejects a patch whose operation at index i doesn't fit the
+// document, as RFC 5789 section 2.2 suggests
+func unprocessable(i int, path, message string) error {
+	return problem.Unprocessable("unprocessable_patch", "The patch cannot be applied",
+		problem.Field(path, "unprocessable_patch", "operation "+strconv.Itoa(i)+": "+message))
+}
+
+// Parse reads a JSON patch document
+func Parse(data []byte) ([]Operation, error) {
+	var ops []Operation
+	if err := json.Unmarshal(data, &ops); err != nil {
+		return nil, problem.Invalid("invalid_body", "A JSON patch must be an array of operations")
+	}
+	for i, op := range ops {
+		switch op.Op {
+		case "add", "replace", "test":
+			if len(op.Value) == 0 {
+				return nil, invalid(i, "", op.Op+" needs a value")
+			}
+		case "move", "copy":
+			if _, err := parsePointer(op.From); err != nil {
+				return nil, invalid(i, "", "from is not a JSON pointer")
+			}
+		case "remove":
+		default:
+			return nil, invalid(i, "", "unknown op "+strconv.Quote(op.Op))
+		}
+		if _, err := parsePointer(op.Path); err != nil {
+			return nil, invalid(i, "", "path is not a JSON pointer")
+		}
+	}
+	return ops, nil
+}
+
+// Apply applies the operations in order to doc, which it may modify, and
+// returns the patched document with the changes made. An operation that
+// doesn't fit the document makes the patch unprocessable, and a failed test
+// op is a conflict with the current state of the document.
+func Apply(doc interface{}, ops []Operation) (interface{}, []Change, error) {
+	var changes []Change
+	for i, op := range ops {
+		path, _ := parsePointer(op.Path)
+
+		var err error
+		switch op.Op {
+		case "add":
+			var value interface{}
+			if value, err = decodeValue(op.Value); err == nil {
+				doc, changes, err = add(doc, path, value, changes)
+			}
+		case "remove":
+			doc, _, changes, err = remove(doc, path, changes)
+		case "replace":
+			var value interface{}
+			if value, err = decodeValue(op.Value); err == nil {
+				if _, err = get(doc, path); err == nil {
+					doc, err = set(doc, path, value)
+					changes = append(changes, Change{Kind: Set, Path: path})
+				}
+			}
+		case "move":
+			from, _ := parsePointer(op.From)
+			if isPrefix(from, path) && len(from) < len(path) {
+				return nil, nil, unprocessable(i, op.Path, "a value cannot be moved into itself")
+			}
+			if pointer(from) == pointer(path) {
+				continue
+			}
+			var value interface{}
+			if doc, value, changes, err = remove(doc, from, changes); err == nil {
+				doc, changes, err = add(doc, path, value, changes)
+			}
+		case "copy":
+			from, _ := parsePointer(op.From)
+			var value interface{}
+			if value, err = get(doc, from); err == nil {
+				doc, changes, err = add(doc, path, deepCopy(value), changes)
+			}
+		case "test":
+			var value, current interface{}
+			if value, err = decodeValue(op.Value); err == nil {
+				if current, err = get(doc, path); err == nil && !reflect.DeepEqual(current, value) {
+					return nil, nil, problem.Conflict("patch_test_failed", "Test of "+op.Path+" failed")
+				}
+			}
+		}
+		if err != nil {
+			return nil, nil, unprocessable(i, op.Path, err.Error())
+		}
+	}
+	return doc, compact(changes), nil
+}
+
+// Merge applies a merge patch to doc, which it may modify, and returns the
+// patched document with the changes made
+func Merge(doc, patch interface{}) (interface{}, []Change) {
+	var changes []Change
+	doc = merge(doc, patch, nil, &changes)
+	return doc, changes
+}
+
+// merge is the algorithm of RFC 7396 section 2. Changes below a value that is
+// replaced as a whole are not recorded, as the replacement covers them.
+func merge(target, patch interface{}, path []string, changes *[]Change) interface{} {
+	record := func(c Change) {
+		if changes != nil {
+			*changes = append(*changes, c)
+		}
+	}
+
+	fields, ok := patch.(map[string]interface{})
+	if !ok {
+		record(Change{Kind: Set, Path: path})
+		return patch
+	}
+	doc, ok := target.(map[string]interface{})
+	if !ok {
+		record(Change{Kind: Set, Path: path})
+		doc, changes = map[string]interface{}{}, nil
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		child := append(path[:len(path):len(path)], key)
+		if fields[key] == nil {
+			if _, ok := doc[key]; ok {
+				delete(doc, key)
+				record(Change{Kind: Unset, Path: child})
+			}
+			continue
+		}
+		doc[key] = merge(doc[key], fields[key], child, changes)
+	}
+	return doc
+}
+
+var (
+	errMissing = errors.New("no value at the path")
+	errIndex   = errors.New("array index out of range")
+	errParent  = errors.New("the parent of the path is not an object or array")
+	errRoot    = errors.New("the whole document cannot be removed")
+)
+
+// add implements the add op and records its change
+func add(doc interface{}, path []string, value interface{}, changes []Change) (interface{}, []Change, error) {
+	if len(path) == 0 {
+		return value, append(changes, Change{Kind: Set}), nil
+	}
+	parent, key := path[:len(path)-1], path[len(path)-1]
+	container, err := get(doc, parent)
+	if err != nil {
+		return nil, changes, err
+	}
+
+	switch c := container.(type) {
+	case map[string]interface{}:
+		c[key] = value
+		return doc, append(changes, Change{Kind: Set, Path: path}), nil
+	case []interface{}:
+		index := len(c)
+		if key != "-" {
+			if index, err = arrayIndex(key, len(c)+1); err != nil {
+				return nil, changes, err
+			}
+		}
+		c = append(c, nil)
+		copy(c[index+1:], c[index:])
+		c[index] = value
+		doc, err = set(doc, parent, c)
+		return doc, append(changes, Change{Kind: Push, Path: parent, Index: index, Append: key == "-"}), err
+	default:
+		return nil, changes, errParent
+	}
+}
+
+// remove implements the remove op, returning the removed value, and records
+// its change. An element removed from an array rewrites the array, as Mongo
+// has no update that removes by index.
+func remove(doc interface{}, path []string, changes []Change) (interface{}, interface{}, []Change, error) {
+	if len(path) == 0 {
+		return nil, nil, changes, errRoot
+	}
+	parent, key := path[:len(path)-1], path[len(path)-1]
+	container, err := get(doc, parent)
+	if err != nil {
+		return nil, nil, changes, err
+	}
+
+	switch c := container.(type) {
+	case map[string]interface{}:
+		value, ok := c[key]
+		if !ok {
+			return nil, nil, changes, errMissing
+		}
+		delete(c, key)
+		return doc, value, append(changes, Change{Kind: Unset, Path: path}), nil
+	case []interface{}:
+		index, err := arrayIndex(key, len(c))
+		if err != nil {
+			return nil, nil, changes, err
+		}
+		value := c[index]
+		c = append(c[:index:index], c[index+1:]...)
+		doc, err = set(doc, parent, c)
+		return doc, value, append(changes, Change{Kind: Set, Path: parent}), err
+	default:
+		return nil, nil, changes, errParent
+	}
+}
+
+// get returns the value at path
+func get(doc interface{}, path []string) (interface{}, error) {
+	current := doc
+	for _, key := range path {
+		switch c := current.(type) {
+		case map[string]interface{}:
+			value, ok := c[key]
+			if !ok {
+				return nil, errMissing
+			}
+			current = value
+		case []interface{}:
+			index, err := arrayIndex(key, len(c))
+			if err != nil {
+				return nil, err
+			}
+			current = c[index]
+		default:
+			return nil, errMissing
+		}
+	}
+	return current, nil
+}
+
+// set replaces the value at path, which must exist unless it is a new member
+// of an object, and returns the document
+func set(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, key := path[:len(path)-1], path[len(path)-1]
+	container, err := get(doc, parent)
+	if err != nil {
+		return nil, err
+	}
+	switch c := container.(type) {
+	case map[string]interface{}:
+		c[key] = value
+	case []interface{}:
+		index, err := arrayIndex(key, len(c))
+		if err != nil {
+			return nil, err
+		}
+		c[index] = value
+	default:
+		return nil, errParent
+	}
+	return doc, nil
+}
+
+// arrayIndex parses an array index of RFC 6901, which has no sign or leading
+// zeros, and checks it is below length
+func arrayIndex(key string, length int) (int, error) {
+	if key == "" || (len(key) > 1 && key[0] == '0') || strings.TrimLeft(key, "0123456789") != "" {
+		return 0, errIndex
+	}
+	index, err := strconv.Atoi(key)
+	if err != nil || index >= length {
+		return 0, errIndex
+	}
+	return index, nil
+}
+
+// compact merges changes whose paths overlap into one Set of the outer path,
+// since a single Mongo update cannot write a path and a path inside it
+func compact(changes []Change) []Change {
+	for merged := true; merged; {
+		merged = false
+		for i := 0; i < len(changes) && !merged; i++ {
+			for j := i + 1; j < len(changes); j++ {
+				a, b := changes[i].Path, changes[j].Path
+				if !isPrefix(a, b) && !isPrefix(b, a) {
+					continue
+				}
+				if len(b) < len(a) {
+					a = b
+				}
+				changes[i] = Change{Kind: Set, Path: a}
+				changes = append(changes[:j], changes[j+1:]...)
+				merged = true
+				break
+			}
+		}
+	}
+	return changes
+}
+
+// isPrefix reports whether path starts with prefix
+func isPrefix(prefix, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != path[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Within reports whether the change writes at or below one of the paths,
+// given as JSON pointers
+func (c Change) Within(pointers ...string) bool {
+	for _, p := range pointers {
+		path, err := parsePointer(p)
+		if err == nil && len(path) > 0 && isPrefix(path, c.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePointer splits a JSON pointer into its unescaped segments
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if p[0] != '/' {
+		return nil, errors.New("a JSON pointer starts with /")
+	}
+	segments := strings.Split(p[1:], "/")
+	for i, s := range segments {
+		if strings.Count(s, "~") != strings.Count(s, "~0")+strings.Count(s, "~1") {
+			return nil, errors.New("~ must be escaped as ~0")
+		}
+		segments[i] = strings.ReplaceAll(strings.ReplaceAll(s, "~1", "/"), "~0", "~")
+	}
+	return segments, nil
+}
+
+// pointer joins segments into a JSON pointer
+func pointer(path []string) string {
+	var b strings.Builder
+	for _, s := range path {
+		b.WriteString("/")
+		b.WriteString(strings.ReplaceAll(strings.ReplaceAll(s, "~", "~0"), "/", "~1"))
+	}
+	return b.String()
+}
+
+// decodeValue decodes the value of an operation the same way the document was
+func decodeValue(raw json.RawMessage) (interface{}, error) {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, errors.New("value is not valid JSON")
+	}
+	return value, nil
+}
+
+// deepCopy copies a decoded JSON value, so a copied value and its source
+// don't share containers
+func deepCopy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			copied[key] = deepCopy(item)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, item := range v {
+			copied[i] = deepCopy(item)
+		}
+		return copied
+	default:
+		return v
+	}
+}
+
+// Document converts v into the decoded JSON a patch applies to. Unlike a plain
+// round trip through encoding/json, fields tagged omitempty are kept, so a
+// patch can replace an empty string or append to an empty list.
+func Document(v interface{}) (interface{}, error) {
+	return document(reflect.ValueOf(v))
+}
+
+var marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+func document(v reflect.Value) (interface{}, error) {
+	if v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, nil
+		}
+		return document(v.Elem())
+	}
+	if v.Type().Implements(marshalerType) {
+		return roundTrip(v.Interface())
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		doc := map[string]interface{}{}
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if !field.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			value, err := document(v.Field(i))
+			if err != nil {
+				return nil, err
+			}
+			doc[name] = value
+		}
+		return doc, nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			return roundTrip(v.Interface())
+		}
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			value, err := document(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			list[i] = value
+		}
+		return list, nil
+	default:
+		return roundTrip(v.Interface())
+	}
+}
+
+// roundTrip decodes the JSON encoding of v
+func roundTrip(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	err = json.Unmarshal(data, &value)
+	return value, err
+}
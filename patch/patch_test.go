@@ -0,0 +1,210 @@
+package patch
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"profolio-vercel/problem"
+)
+
+// decode parses a JSON document the way the handlers decode one
+func decode(t *testing.T, data string) interface{} {
+	t.Helper()
+	var doc interface{}
+	if err := json.Unmarshal([]byte(data), &doc); err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+// status is the HTTP status err would be answered with
+func status(err error) int {
+	var e *problem.Error
+	if errors.As(err, &e) {
+		return e.Kind.Status()
+	}
+	return 0
+}
+
+func TestApply(t *testing.T) {
+	const doc = `{"a":{"b":1},"list":[1,2,3],"x/y":1,"m~n":2}`
+	tests := []struct {
+		name  string
+		patch string
+		want  string // The patched document, when the patch applies
+		err   int    // The status of the error, when it doesn't
+	}{
+		{name: "add a member", patch: `[{"op":"add","path":"/a/c","value":2}]`,
+			want: `{"a":{"b":1,"c":2},"list":[1,2,3],"x/y":1,"m~n":2}`},
+		{name: "add replaces a member", patch: `[{"op":"add","path":"/a/b","value":[]}]`,
+			want: `{"a":{"b":[]},"list":[1,2,3],"x/y":1,"m~n":2}`},
+		{name: "append with -", patch: `[{"op":"add","path":"/list/-","value":4}]`,
+			want: `{"a":{"b":1},"list":[1,2,3,4],"x/y":1,"m~n":2}`},
+		{name: "insert at the start", patch: `[{"op":"add","path":"/list/0","value":0}]`,
+			want: `{"a":{"b":1},"list":[0,1,2,3],"x/y":1,"m~n":2}`},
+		{name: "insert at the length", patch: `[{"op":"add","path":"/list/3","value":4}]`,
+			want: `{"a":{"b":1},"list":[1,2,3,4],"x/y":1,"m~n":2}`},
+		{name: "insert past the length", patch: `[{"op":"add","path":"/list/4","value":5}]`, err: http.StatusUnprocessableEntity},
+		{name: "index with a leading zero", patch: `[{"op":"add","path":"/list/01","value":5}]`, err: http.StatusUnprocessableEntity},
+		{name: "add below a missing member", patch: `[{"op":"add","path":"/z/c","value":1}]`, err: http.StatusUnprocessableEntity},
+		{name: "add to a number", patch: `[{"op":"add","path":"/a/b/c","value":1}]`, err: http.StatusUnprocessableEntity},
+		{name: "remove a member", patch: `[{"op":"remove","path":"/a/b"}]`,
+			want: `{"a":{},"list":[1,2,3],"x/y":1,"m~n":2}`},
+		{name: "remove an element", patch: `[{"op":"remove","path":"/list/1"}]`,
+			want: `{"a":{"b":1},"list":[1,3],"x/y":1,"m~n":2}`},
+		{name: "remove a missing member", patch: `[{"op":"remove","path":"/a/z"}]`, err: http.StatusUnprocessableEntity},
+		{name: "remove past the end", patch: `[{"op":"remove","path":"/list/3"}]`, err: http.StatusUnprocessableEntity},
+		{name: "remove with -", patch: `[{"op":"remove","path":"/list/-"}]`, err: http.StatusUnprocessableEntity},
+		{name: "remove the document", patch: `[{"op":"remove","path":""}]`, err: http.StatusUnprocessableEntity},
+		{name: "replace", patch: `[{"op":"replace","path":"/list/2","value":"three"}]`,
+			want: `{"a":{"b":1},"list":[1,2,"three"],"x/y":1,"m~n":2}`},
+		{name: "replace the document", patch: `[{"op":"replace","path":"","value":{"c":1}}]`, want: `{"c":1}`},
+		{name: "replace a missing member", patch: `[{"op":"replace","path":"/a/z","value":1}]`, err: http.StatusUnprocessableEntity},
+		{name: "move", patch: `[{"op":"move","from":"/a/b","path":"/list/0"}]`,
+			want: `{"a":{},"list":[1,1,2,3],"x/y":1,"m~n":2}`},
+		{name: "move to itself", patch: `[{"op":"move","from":"/a","path":"/a"}]`,
+			want: `{"a":{"b":1},"list":[1,2,3],"x/y":1,"m~n":2}`},
+		{name: "move into itself", patch: `[{"op":"move","from":"/a","path":"/a/c"}]`, err: http.StatusUnprocessableEntity},
+		{name: "move a missing member", patch: `[{"op":"move","from":"/z","path":"/y"}]`, err: http.StatusUnprocessableEntity},
+		{name: "copy does not share the value", patch: `[{"op":"copy","from":"/list","path":"/copy"},{"op":"add","path":"/copy/-","value":4}]`,
+			want: `{"a":{"b":1},"list":[1,2,3],"copy":[1,2,3,4],"x/y":1,"m~n":2}`},
+		{name: "test", patch: `[{"op":"test","path":"/a","value":{"b":1}},{"op":"replace","path":"/a/b","value":2}]`,
+			want: `{"a":{"b":2},"list":[1,2,3],"x/y":1,"m~n":2}`},
+		{name: "failed test aborts the patch", patch: `[{"op":"replace","path":"/a/b","value":2},{"op":"test","path":"/list","value":[1,2]}]`,
+			err: http.StatusConflict},
+		{name: "test of a missing member", patch: `[{"op":"test","path":"/z","value":null}]`, err: http.StatusUnprocessableEntity},
+		{name: "escaped slash", patch: `[{"op":"replace","path":"/x~1y","value":2}]`,
+			want: `{"a":{"b":1},"list":[1,2,3],"x/y":2,"m~n":2}`},
+		{name: "escaped tilde", patch: `[{"op":"remove","path":"/m~0n"}]`,
+			want: `{"a":{"b":1},"list":[1,2,3],"x/y":1}`},
+		{name: "escapes apply once", patch: `[{"op":"add","path":"/~01","value":3}]`,
+			want: `{"a":{"b":1},"list":[1,2,3],"x/y":1,"m~n":2,"~1":3}`},
+		{name: "bare tilde", patch: `[{"op":"remove","path":"/m~n"}]`, err: http.StatusBadRequest},
+		{name: "path without a slash", patch: `[{"op":"remove","path":"a"}]`, err: http.StatusBadRequest},
+		{name: "unknown op", patch: `[{"op":"increment","path":"/a/b"}]`, err: http.StatusBadRequest},
+		{name: "add without a value", patch: `[{"op":"add","path":"/a/c"}]`, err: http.StatusBadRequest},
+		{name: "not an array", patch: `{"op":"remove","path":"/a"}`, err: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops, err := Parse([]byte(tt.patch))
+			var got interface{}
+			var changes []Change
+			if err == nil {
+				got, changes, err = Apply(decode(t, doc), ops)
+			}
+			if tt.err != 0 {
+				if status(err) != tt.err {
+					t.Errorf("error = %v, want status %d", err, tt.err)
+				}
+				if got != nil || changes != nil {
+					t.Errorf("a failed patch returned %v with %v", got, changes)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := decode(t, tt.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("document = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestApplyChanges(t *testing.T) {
+	const doc = `{"a":{"b":1},"list":[{"n":1},{"n":2}]}`
+	tests := []struct {
+		name  string
+		patch string
+		want  []Change
+	}{
+		{"set", `[{"op":"replace","path":"/a/b","value":2}]`, []Change{{Kind: Set, Path: []string{"a", "b"}}}},
+		{"unset", `[{"op":"remove","path":"/a/b"}]`, []Change{{Kind: Unset, Path: []string{"a", "b"}}}},
+		{"append", `[{"op":"add","path":"/list/-","value":{}}]`, []Change{{Kind: Push, Path: []string{"list"}, Index: 2, Append: true}}},
+		{"insert", `[{"op":"add","path":"/list/1","value":{}}]`, []Change{{Kind: Push, Path: []string{"list"}, Index: 1}}},
+		{"remove an element rewrites the array", `[{"op":"remove","path":"/list/0"}]`, []Change{{Kind: Set, Path: []string{"list"}}}},
+		{"move", `[{"op":"move","from":"/a/b","path":"/c"}]`, []Change{
+			{Kind: Unset, Path: []string{"a", "b"}},
+			{Kind: Set, Path: []string{"c"}},
+		}},
+		{"overlapping writes are compacted", `[{"op":"add","path":"/list/-","value":{}},{"op":"replace","path":"/list/0/n","value":3}]`,
+			[]Change{{Kind: Set, Path: []string{"list"}}}},
+		{"test writes nothing", `[{"op":"test","path":"/a/b","value":1}]`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops, err := Parse([]byte(tt.patch))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, changes, err := Apply(decode(t, doc), ops)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(changes, tt.want) {
+				t.Errorf("changes = %+v, want %+v", changes, tt.want)
+			}
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	const doc = `{"a":{"b":1,"c":2},"list":[1,2],"s":"x"}`
+	tests := []struct {
+		name    string
+		patch   string
+		want    string
+		changes []Change
+	}{
+		{"null deletes a member", `{"a":{"b":null}}`, `{"a":{"c":2},"list":[1,2],"s":"x"}`,
+			[]Change{{Kind: Unset, Path: []string{"a", "b"}}}},
+		{"null for a missing member", `{"z":null}`, doc, nil},
+		{"nested object", `{"n":{"o":{"p":1,"q":null}}}`, `{"a":{"b":1,"c":2},"list":[1,2],"s":"x","n":{"o":{"p":1}}}`,
+			[]Change{{Kind: Set, Path: []string{"n"}}}},
+		{"merges into an object", `{"a":{"d":{"e":1}}}`, `{"a":{"b":1,"c":2,"d":{"e":1}},"list":[1,2],"s":"x"}`,
+			[]Change{{Kind: Set, Path: []string{"a", "d"}}}},
+		{"arrays are replaced", `{"list":[3]}`, `{"a":{"b":1,"c":2},"list":[3],"s":"x"}`,
+			[]Change{{Kind: Set, Path: []string{"list"}}}},
+		{"object over a scalar", `{"s":{"t":1}}`, `{"a":{"b":1,"c":2},"list":[1,2],"s":{"t":1}}`,
+			[]Change{{Kind: Set, Path: []string{"s"}}}},
+		{"not an object", `[1]`, `[1]`, []Change{{Kind: Set}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, changes := Merge(decode(t, doc), decode(t, tt.patch))
+			if want := decode(t, tt.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("document = %v, want %v", got, want)
+			}
+			if !reflect.DeepEqual(changes, tt.changes) {
+				t.Errorf("changes = %+v, want %+v", changes, tt.changes)
+			}
+		})
+	}
+}
+
+func TestCompact(t *testing.T) {
+	set := func(path ...string) Change { return Change{Kind: Set, Path: path} }
+	tests := []struct {
+		name    string
+		changes []Change
+		want    []Change
+	}{
+		{"disjoint", []Change{set("a"), set("b")}, []Change{set("a"), set("b")}},
+		{"segments, not prefixes of strings", []Change{set("a"), set("ab")}, []Change{set("a"), set("ab")}},
+		{"inner after outer", []Change{set("a"), {Kind: Unset, Path: []string{"a", "b"}}}, []Change{set("a")}},
+		{"outer after inner", []Change{set("a", "b"), set("a")}, []Change{set("a")}},
+		{"push and a write inside", []Change{{Kind: Push, Path: []string{"l"}, Index: 1}, set("l", "0", "n")}, []Change{set("l")}},
+		{"chains", []Change{set("a", "b", "c"), set("x"), set("a", "b"), set("a")}, []Change{set("a"), set("x")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := compact(tt.changes); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("compact = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,245 @@
+// Package problem answers failed requests with RFC 7807 problem+json bodies.
+// Handlers return an *Error, or a domain error such as store.ErrNotFound,
+// and HandlerFunc maps it to a status code and writes the body.
+package problem
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"profolio-vercel/logging"
+	"profolio-vercel/store"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ContentType is the media type of every error response
+const ContentType = "application/problem+json"
+
+// typePrefix turns a code into the problem type URI
+const typePrefix = "urn:profolio:problem:"
+
+// requestIDHeader is set on the response by middleware.RequestID
+const requestIDHeader = "X-Request-ID"
+
+// Kind is the class of failure and picks the status code
+type Kind int
+
+const (
+	KindInternal Kind = iota
+	KindInvalid
+	KindUnauthorized
+	KindForbidden
+	KindNotFound
+	KindMethodNotAllowed
+	KindConflict
+	KindPreconditionFailed
+	KindUnsupportedMediaType
+	KindUnprocessable
+	KindTooManyRequests
+	KindBadGateway
+	KindUnavailable
+)
+
+var kindStatus = map[Kind]int{
+	KindInternal:             http.StatusInternalServerError,
+	KindInvalid:              http.StatusBadRequest,
+	KindUnauthorized:         http.StatusUnauthorized,
+	KindForbidden:            http.StatusForbidden,
+	KindNotFound:             http.StatusNotFound,
+	KindMethodNotAllowed:     http.StatusMethodNotAllowed,
+	KindConflict:             http.StatusConflict,
+	KindPreconditionFailed:   http.StatusPreconditionFailed,
+	KindUnsupportedMediaType: http.StatusUnsupportedMediaType,
+	KindUnprocessable:        http.StatusUnprocessableEntity,
+	KindTooManyRequests:      http.StatusTooManyRequests,
+	KindBadGateway:           http.StatusBadGateway,
+	KindUnavailable:          http.StatusServiceUnavailable,
+}
+
+// Status is the HTTP status code of the kind
+func (k Kind) Status() int {
+	if status, ok := kindStatus[k]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// FieldError explains why one field of the request was rejected
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Field builds a FieldError
+func Field(field, code, message string) FieldError {
+	return FieldError{Field: field, Code: code, Message: message}
+}
+
+// Error is a failure a handler can return. Code is stable and meant for
+// programs, Detail is meant for people, and Err is logged but never sent.
+type Error struct {
+	Kind   Kind
+	Code   string
+	Detail string
+	Fields []FieldError
+	Err    error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Code, e.Detail, e.Err)
+	}
+	return e.Code + ": " + e.Detail
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Invalid rejects a malformed request, optionally naming the fields at fault
+func Invalid(code, detail string, fields ...FieldError) *Error {
+	return &Error{Kind: KindInvalid, Code: code, Detail: detail, Fields: fields}
+}
+
+// Unauthorized rejects a request without valid credentials
+func Unauthorized(code, detail string) *Error {
+	return &Error{Kind: KindUnauthorized, Code: code, Detail: detail}
+}
+
+// Forbidden rejects a request the caller is not allowed to make
+func Forbidden(code, detail string) *Error {
+	return &Error{Kind: KindForbidden, Code: code, Detail: detail}
+}
+
+// NotFound reports that the resource does not exist
+func NotFound(code, detail string) *Error {
+	return &Error{Kind: KindNotFound, Code: code, Detail: detail}
+}
+
+// MethodNotAllowed rejects a method the route does not serve
+func MethodNotAllowed(detail string) *Error {
+	return &Error{Kind: KindMethodNotAllowed, Code: "method_not_allowed", Detail: detail}
+}
+
+// Conflict reports that the request clashes with the current state
+func Conflict(code, detail string) *Error {
+	return &Error{Kind: KindConflict, Code: code, Detail: detail}
+}
+
+// PreconditionFailed rejects a request whose If-Match no longer holds
+func PreconditionFailed(code, detail string) *Error {
+	return &Error{Kind: KindPreconditionFailed, Code: code, Detail: detail}
+}
+
+// UnsupportedMediaType rejects a body in a format the route does not read
+func UnsupportedMediaType(detail string) *Error {
+	return &Error{Kind: KindUnsupportedMediaType, Code: "unsupported_media_type", Detail: detail}
+}
+
+// Unprocessable rejects a well-formed request that cannot be carried out,
+// such as a patch whose operations don't fit the document
+func Unprocessable(code, detail string, fields ...FieldError) *Error {
+	return &Error{Kind: KindUnprocessable, Code: code, Detail: detail, Fields: fields}
+}
+
+// TooManyRequests asks the caller to slow down
+func TooManyRequests(code, detail string) *Error {
+	return &Error{Kind: KindTooManyRequests, Code: code, Detail: detail}
+}
+
+// BadGateway reports that a service we depend on failed
+func BadGateway(code, detail string, err error) *Error {
+	return &Error{Kind: KindBadGateway, Code: code, Detail: detail, Err: err}
+}
+
+// Unavailable reports that the server cannot serve the request right now
+func Unavailable(code, detail string) *Error {
+	return &Error{Kind: KindUnavailable, Code: code, Detail: detail}
+}
+
+// Internal reports our own failure. Only detail reaches the caller.
+func Internal(detail string, err error) *Error {
+	return &Error{Kind: KindInternal, Code: "internal", Detail: detail, Err: err}
+}
+
+// From maps any error to an *Error. Domain errors get their status and code
+// here; anything unknown becomes a 500 that does not leak its message.
+func From(err error) *Error {
+	var e *Error
+	switch {
+	case errors.As(err, &e):
+		return e
+	case errors.Is(err, store.ErrNotFound), errors.Is(err, mongo.ErrNoDocuments):
+		return &Error{Kind: KindNotFound, Code: "not_found", Detail: "Resource not found", Err: err}
+	case errors.Is(err, store.ErrEmailTaken):
+		return &Error{Kind: KindConflict, Code: "email_taken", Detail: "Email already exists", Err: err}
+	case errors.Is(err, store.ErrUsernameTaken):
+		return &Error{Kind: KindConflict, Code: "username_taken", Detail: "Username already exists", Err: err}
+	case errors.Is(err, store.ErrVersionMismatch):
+		return &Error{Kind: KindConflict, Code: "version_conflict", Detail: "The resource changed while it was being written", Err: err}
+	case errors.Is(err, store.ErrResumeLimit):
+		return &Error{Kind: KindInvalid, Code: "resume_limit", Detail: "Maximum number of resumes reached", Err: err}
+	case mongo.IsDuplicateKeyError(err):
+		return &Error{Kind: KindConflict, Code: "duplicate", Detail: "Resource already exists", Err: err}
+	default:
+		return Internal("Internal server error", err)
+	}
+}
+
+// Problem is the RFC 7807 body, extended with a code, field errors and the request ID
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"requestId,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+}
+
+// Write answers the request with err as problem+json
+func Write(w http.ResponseWriter, r *http.Request, err error) {
+	e := From(err)
+	status := e.Kind.Status()
+	if status >= http.StatusInternalServerError {
+		logging.FromContext(r.Context()).Error(e.Detail, "code", e.Code, "status", status, "error", e.Err)
+	}
+
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Problem{
+		Type:      typePrefix + e.Code,
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    e.Detail,
+		Instance:  r.URL.Path,
+		Code:      e.Code,
+		RequestID: w.Header().Get(requestIDHeader),
+		Errors:    e.Fields,
+	})
+}
+
+// HandlerFunc is a handler that returns its failure instead of writing it
+type HandlerFunc func(w http.ResponseWriter, r *http.Request) error
+
+func (f HandlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := f(w, r); err != nil {
+		Write(w, r, err)
+	}
+}
+
+// NotFoundHandler answers requests that match no route
+var NotFoundHandler = HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+	return NotFound("route_not_found", "No route matches "+r.URL.Path)
+})
+
+// MethodNotAllowedHandler answers requests whose path matches but method does not
+var MethodNotAllowedHandler = HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+	return MethodNotAllowed(r.Method + " is not allowed on " + r.URL.Path)
+})
@@ -2,66 +2,116 @@ package shared
 
 import (
 	"context"
-	"log"
-	"os"
+	"errors"
+	"log/slog"
 	"sync"
 	"time"
 
-	"github.com/joho/godotenv"
+	"profolio-vercel/config"
+	"profolio-vercel/metrics"
+	"profolio-vercel/tracing"
+
+	"go.mongodb.org/mongo-driver/event"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var (
-	client *mongo.Client
-	once   sync.Once
+	client   *mongo.Client
+	mu       sync.Mutex
+	mongoURI string
 )
 
-func init() {
-	initDB()
+// Configure sets the database to connect to. It must be called before the
+// first Connect.
+func Configure(cfg *config.Config) {
+	mongoURI = cfg.MongoURI
 }
 
-func initDB() {
-	once.Do(func() {
-		// Load local .env file
-		err := godotenv.Load()
-		if err != nil {
-			log.Printf("Error loading .env file: %v", err)
-		}
+// Connect returns the database client, connecting on the first call. A failed
+// connection is not kept, so a later call tries again.
+func Connect() (*mongo.Client, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if client != nil {
+		return client, nil
+	}
+	if mongoURI == "" {
+		return nil, errors.New("MONGODB_URI is not configured")
+	}
 
-		mongoURI := os.Getenv("MONGODB_URI")
-		if mongoURI == "" {
-			log.Println("MONGODB_URI environment variable is not set")
-			return
-		}
+	clientOptions := options.Client().ApplyURI(mongoURI).SetMonitor(combineMonitors(metrics.MongoMonitor(), tracing.MongoMonitor()))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-		clientOptions := options.Client().ApplyURI(mongoURI)
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
+	connected, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		return nil, err
+	}
+	if err := connected.Ping(ctx, nil); err != nil {
+		connected.Disconnect(ctx)
+		return nil, err
+	}
+	slog.Info("connected to MongoDB")
+	client = connected
+	return client, nil
+}
 
-		// var err error
-		client, err = mongo.Connect(ctx, clientOptions)
-		if err != nil {
-			log.Printf("Error connecting to MongoDB: %v", err)
-			return
-		}
+// GetClient returns the database client, or nil when it cannot connect
+func GetClient() *mongo.Client {
+	connected, err := Connect()
+	if err != nil {
+		slog.Warn("no MongoDB client", "error", err)
+		return nil
+	}
+	return connected
+}
 
-		err = client.Ping(ctx, nil)
-		if err != nil {
-			log.Printf("Error pinging MongoDB: %v", err)
-			return
-		}
-		log.Println("Connected to MongoDB successfully")
-	})
+// combineMonitors lets several command monitors watch the one client
+func combineMonitors(monitors ...*event.CommandMonitor) *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+			for _, m := range monitors {
+				if m.Started != nil {
+					m.Started(ctx, e)
+				}
+			}
+		},
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			for _, m := range monitors {
+				if m.Succeeded != nil {
+					m.Succeeded(ctx, e)
+				}
+			}
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			for _, m := range monitors {
+				if m.Failed != nil {
+					m.Failed(ctx, e)
+				}
+			}
+		},
+	}
 }
 
-func GetClient() *mongo.Client {
+// Ping checks the database answers. It fails when no client is connected.
+func Ping(ctx context.Context) error {
+	mu.Lock()
+	client := client
+	mu.Unlock()
+	if client == nil {
+		return errors.New("database is not connected")
+	}
+	return client.Ping(ctx, nil)
+}
+
+// Disconnect closes the database connections, on shutdown
+func Disconnect(ctx context.Context) error {
+	mu.Lock()
+	client := client
+	mu.Unlock()
 	if client == nil {
-		initDB()
-		if client == nil {
-			log.Println("Error: Failed to initialize client.")
-			return nil
-		}
+		return nil
 	}
-	return client
+	return client.Disconnect(ctx)
 }
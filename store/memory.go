@@ -0,0 +1,996 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"profolio-vercel/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Memory implements every store in process memory. Documents go through BSON
+// on the way in and out, so callers never share state with the store and
+// updates see the same field names as they would in Mongo.
+type Memory struct {
+	mu            sync.Mutex
+	users         []bson.M
+	authUsers     []bson.M
+	skills        []models.SkillCollection
+	refreshTokens []models.RefreshToken
+	actionTokens  []models.ActionToken
+	oauthStates   []models.OAuthState
+	revocations   map[string]models.RevokedToken
+	apiKeys       []models.APIKey
+	auditEvents   []models.AuditEvent
+}
+
+// NewMemory returns empty stores. The skills are what ListSkills serves.
+func NewMemory(skills ...models.SkillCollection) *Memory {
+	return &Memory{skills: skills}
+}
+
+// toDoc converts a model into the document Mongo would store
+func toDoc(v interface{}) (bson.M, error) {
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var doc bson.M
+	err = bson.Unmarshal(data, &doc)
+	return doc, err
+}
+
+// fromDoc decodes a stored document into out
+func fromDoc(doc bson.M, out interface{}) error {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(data, out)
+}
+
+// copyDoc returns a deep copy of a stored document
+func copyDoc(doc bson.M) bson.M {
+	copied, _ := toDoc(doc)
+	return copied
+}
+
+// setField sets a dotted path such as "basics.name" or "resumes.0.name",
+// creating embedded documents on the way like $set does
+func setField(doc bson.M, path string, value interface{}) {
+	parts := strings.Split(path, ".")
+	var current interface{} = doc
+	for i, part := range parts {
+		last := i == len(parts)-1
+		switch v := current.(type) {
+		case bson.M:
+			if last {
+				v[part] = value
+				return
+			}
+			if _, ok := v[part].(bson.M); !ok {
+				if _, ok := v[part].(bson.A); !ok {
+					v[part] = bson.M{}
+				}
+			}
+			current = v[part]
+		case bson.A:
+			index, err := strconv.Atoi(part)
+			if err != nil || index < 0 || index >= len(v) {
+				return
+			}
+			if last {
+				v[index] = value
+				return
+			}
+			current = v[index]
+		default:
+			return
+		}
+	}
+}
+
+// fieldValue returns the value at a dotted path, or nil when there is none
+func fieldValue(doc bson.M, path string) interface{} {
+	var current interface{} = doc
+	for _, part := range strings.Split(path, ".") {
+		switch v := current.(type) {
+		case bson.M:
+			current = v[part]
+		case bson.A:
+			index, err := strconv.Atoi(part)
+			if err != nil || index < 0 || index >= len(v) {
+				return nil
+			}
+			current = v[index]
+		default:
+			return nil
+		}
+	}
+	return current
+}
+
+// unsetField removes a dotted path like $unset does, which leaves null behind
+// in an array
+func unsetField(doc bson.M, path string) {
+	parent, key := "", path
+	if i := strings.LastIndex(path, "."); i >= 0 {
+		parent, key = path[:i], path[i+1:]
+	}
+	var container interface{} = doc
+	if parent != "" {
+		container = fieldValue(doc, parent)
+	}
+	switch v := container.(type) {
+	case bson.M:
+		delete(v, key)
+	case bson.A:
+		if index, err := strconv.Atoi(key); err == nil && index >= 0 && index < len(v) {
+			v[index] = nil
+		}
+	}
+}
+
+// pushField inserts values into the array at a dotted path like $push with
+// $each and $position does; a negative position appends
+func pushField(doc bson.M, path string, values bson.A, position int) error {
+	current := fieldValue(doc, path)
+	list, ok := current.(bson.A)
+	if current != nil && !ok {
+		return errors.New("the field " + path + " must be an array")
+	}
+	if position < 0 || position > len(list) {
+		position = len(list)
+	}
+	updated := append(bson.A{}, list[:position]...)
+	updated = append(updated, values...)
+	updated = append(updated, list[position:]...)
+	setField(doc, path, updated)
+	return nil
+}
+
+// applyUpdate applies the $set, $unset and $push operators of an update to doc
+func applyUpdate(doc bson.M, update bson.M) error {
+	for operator, fields := range update {
+		for path, value := range fields.(bson.M) {
+			switch operator {
+			case "$set":
+				setField(doc, path, value)
+			case "$unset":
+				unsetField(doc, path)
+			case "$push":
+				values, position := bson.A{value}, -1
+				if modifiers, ok := value.(bson.M); ok {
+					values, _ = modifiers["$each"].(bson.A)
+					if p, ok := modifiers["$position"].(int); ok {
+						position = p
+					}
+				}
+				if err := pushField(doc, path, values, position); err != nil {
+					return err
+				}
+			default:
+				return errors.New("unsupported update operator " + operator)
+			}
+		}
+	}
+	return nil
+}
+
+// checkVersion fails with ErrVersionMismatch unless doc is at version
+func checkVersion(doc bson.M, version int64) error {
+	if version != AnyVersion && Version(doc) != version {
+		return ErrVersionMismatch
+	}
+	return nil
+}
+
+// bump increments the version of a stored document
+func bump(doc bson.M) {
+	doc["version"] = Version(doc) + 1
+}
+
+// field returns the string at a dotted path, or "" when there is none
+func field(doc bson.M, path string) string {
+	var current interface{} = doc
+	for _, part := range strings.Split(path, ".") {
+		m, ok := current.(bson.M)
+		if !ok {
+			return ""
+		}
+		current = m[part]
+	}
+	s, _ := current.(string)
+	return s
+}
+
+// unique checks that no document in docs other than the one at index except
+// uses the email or username of doc
+func unique(docs []bson.M, except int, doc bson.M, emailField, usernameField string) error {
+	email, username := field(doc, emailField), field(doc, usernameField)
+	for i, other := range docs {
+		if i == except {
+			continue
+		}
+		if email != "" && field(other, emailField) == email {
+			return ErrEmailTaken
+		}
+		if username != "" && field(other, usernameField) == username {
+			return ErrUsernameTaken
+		}
+	}
+	return nil
+}
+
+func (m *Memory) findUser(lookup Lookup) (int, error) {
+	for i, doc := range m.users {
+		var user models.User
+		if err := fromDoc(doc, &user); err != nil {
+			return -1, err
+		}
+		if lookup.matches(user) {
+			return i, nil
+		}
+	}
+	return -1, ErrNotFound
+}
+
+func (m *Memory) FindUser(ctx context.Context, lookup Lookup) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var user models.User
+	i, err := m.findUser(lookup)
+	if err != nil {
+		return user, err
+	}
+	err = fromDoc(m.users[i], &user)
+	return user, err
+}
+
+func (m *Memory) ListUsers(ctx context.Context, skip, limit int64) ([]models.User, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	users := []models.User{}
+	total := int64(len(m.users))
+	for i := skip; i < total && i < skip+limit; i++ {
+		var user models.User
+		if err := fromDoc(m.users[i], &user); err != nil {
+			return nil, 0, err
+		}
+		users = append(users, user)
+	}
+	return users, total, nil
+}
+
+func (m *Memory) insertUser(user models.User) (models.User, error) {
+	if user.ID.IsZero() {
+		user.ID = primitive.NewObjectID()
+	}
+	doc, err := toDoc(user)
+	if err != nil {
+		return user, err
+	}
+	if err := unique(m.users, -1, doc, "basics.email", "basics.username"); err != nil {
+		return user, err
+	}
+	m.users = append(m.users, doc)
+	return user, nil
+}
+
+func (m *Memory) InsertUser(ctx context.Context, user models.User) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.insertUser(user)
+}
+
+func (m *Memory) UpdateUser(ctx context.Context, lookup Lookup, version int64, set map[string]interface{}) (bson.M, error) {
+	return m.PatchUser(ctx, lookup, version, bson.M{"$set": bson.M(set)})
+}
+
+func (m *Memory) PatchUser(ctx context.Context, lookup Lookup, version int64, update bson.M) (bson.M, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i, err := m.findUser(lookup)
+	if err != nil {
+		return nil, err
+	}
+	before := m.users[i]
+	if err := checkVersion(before, version); err != nil {
+		return nil, err
+	}
+	updated := copyDoc(before)
+	if err := applyUpdate(updated, update); err != nil {
+		return nil, err
+	}
+	bump(updated)
+	// Normalize the values through the model, as Mongo would reject what it cannot store
+	var user models.User
+	if err := fromDoc(updated, &user); err != nil {
+		return nil, err
+	}
+	if err := unique(m.users, i, updated, "basics.email", "basics.username"); err != nil {
+		return nil, err
+	}
+	m.users[i] = updated
+	return copyDoc(before), nil
+}
+
+func (m *Memory) findAuthUser(email string) int {
+	for i, doc := range m.authUsers {
+		if field(doc, "email") == email {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *Memory) FindAuthUser(ctx context.Context, email string) (models.AuthUser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var authUser models.AuthUser
+	i := m.findAuthUser(email)
+	if i < 0 {
+		return authUser, ErrNotFound
+	}
+	err := fromDoc(m.authUsers[i], &authUser)
+	return authUser, err
+}
+
+func (m *Memory) UpdateAuthUser(ctx context.Context, email string, set map[string]interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findAuthUser(email)
+	if i < 0 {
+		return ErrNotFound
+	}
+	updated := copyDoc(m.authUsers[i])
+	for path, value := range set {
+		setField(updated, path, value)
+	}
+	if err := unique(m.authUsers, i, updated, "email", "username"); err != nil {
+		return err
+	}
+	m.authUsers[i] = updated
+	return nil
+}
+
+func (m *Memory) CreateAccount(ctx context.Context, authUser models.AuthUser, user models.User) (models.User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	doc, err := toDoc(authUser)
+	if err != nil {
+		return user, err
+	}
+	if err := unique(m.authUsers, -1, doc, "email", "username"); err != nil {
+		return user, err
+	}
+
+	// Holding the lock over both inserts makes them atomic
+	user, err = m.insertUser(user)
+	if err != nil {
+		return user, err
+	}
+	m.authUsers = append(m.authUsers, doc)
+	return user, nil
+}
+
+func (m *Memory) ChangeAccount(ctx context.Context, email string, change AccountChange) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a := m.findAuthUser(email)
+	u, err := m.findUser(ByEmail(email))
+	if a < 0 || err != nil {
+		return ErrNotFound
+	}
+
+	authUser := copyDoc(m.authUsers[a])
+	for path, value := range change.authSet() {
+		setField(authUser, path, value)
+	}
+	user := copyDoc(m.users[u])
+	for path, value := range change.userSet() {
+		setField(user, path, value)
+	}
+	bump(user)
+	if err := unique(m.authUsers, a, authUser, "email", "username"); err != nil {
+		return err
+	}
+	if err := unique(m.users, u, user, "basics.email", "basics.username"); err != nil {
+		return err
+	}
+
+	// Both documents are checked before either is written, under one lock
+	m.authUsers[a] = authUser
+	m.users[u] = user
+	if change.Email != "" {
+		id, _ := user["_id"].(primitive.ObjectID)
+		kept := m.actionTokens[:0]
+		for _, token := range m.actionTokens {
+			if token.UserID != id || token.UsedAt != nil {
+				kept = append(kept, token)
+			}
+		}
+		m.actionTokens = kept
+	}
+	return nil
+}
+
+// changeAuthUser applies change to the account with the email and stores the
+// result when change reports that it changed something
+func (m *Memory) changeAuthUser(email string, change func(authUser *models.AuthUser) bool) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.changeAuthUserLocked(email, change)
+}
+
+func (m *Memory) changeAuthUserLocked(email string, change func(authUser *models.AuthUser) bool) (bool, error) {
+	i := m.findAuthUser(email)
+	if i < 0 {
+		return false, ErrNotFound
+	}
+	var authUser models.AuthUser
+	if err := fromDoc(m.authUsers[i], &authUser); err != nil {
+		return false, err
+	}
+	if !change(&authUser) {
+		return false, nil
+	}
+	doc, err := toDoc(authUser)
+	if err != nil {
+		return false, err
+	}
+	m.authUsers[i] = doc
+	return true, nil
+}
+
+func (m *Memory) SetPendingTOTP(ctx context.Context, email, secret string) error {
+	_, err := m.changeAuthUser(email, func(authUser *models.AuthUser) bool {
+		authUser.TOTPPendingSecret = secret
+		return true
+	})
+	return err
+}
+
+func (m *Memory) EnableTOTP(ctx context.Context, email, secret string, step int64, recoveryHashes []string) error {
+	_, err := m.changeAuthUser(email, func(authUser *models.AuthUser) bool {
+		authUser.TOTPEnabled = true
+		authUser.TOTPSecret = secret
+		authUser.TOTPLastStep = step
+		authUser.RecoveryCodes = append([]string(nil), recoveryHashes...)
+		authUser.TOTPPendingSecret = ""
+		return true
+	})
+	return err
+}
+
+func (m *Memory) DisableTOTP(ctx context.Context, email string) error {
+	_, err := m.changeAuthUser(email, func(authUser *models.AuthUser) bool {
+		authUser.TOTPEnabled = false
+		authUser.TOTPSecret = ""
+		authUser.TOTPLastStep = 0
+		authUser.RecoveryCodes = nil
+		return true
+	})
+	return err
+}
+
+func (m *Memory) UseTOTPStep(ctx context.Context, email string, step int64) (bool, error) {
+	ok, err := m.changeAuthUser(email, func(authUser *models.AuthUser) bool {
+		if authUser.TOTPLastStep >= step {
+			return false
+		}
+		authUser.TOTPLastStep = step
+		return true
+	})
+	if err == ErrNotFound {
+		return false, nil
+	}
+	return ok, err
+}
+
+func (m *Memory) UseRecoveryCode(ctx context.Context, email, codeHash string) (bool, error) {
+	ok, err := m.changeAuthUser(email, func(authUser *models.AuthUser) bool {
+		for i, code := range authUser.RecoveryCodes {
+			if code == codeHash {
+				authUser.RecoveryCodes = append(authUser.RecoveryCodes[:i:i], authUser.RecoveryCodes[i+1:]...)
+				return true
+			}
+		}
+		return false
+	})
+	if err == ErrNotFound {
+		return false, nil
+	}
+	return ok, err
+}
+
+func (m *Memory) ChangeRole(ctx context.Context, email, role string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i := m.findAuthUser(email)
+	if i < 0 {
+		return ErrNotFound
+	}
+	if m.authUsers[i]["role"] == models.RoleAdmin && role != models.RoleAdmin {
+		others := 0
+		for j, doc := range m.authUsers {
+			if j != i && doc["role"] == models.RoleAdmin && doc["disabled"] != true {
+				others++
+			}
+		}
+		if others == 0 {
+			return ErrLastAdmin
+		}
+	}
+
+	updated := copyDoc(m.authUsers[i])
+	updated["role"] = role
+	m.authUsers[i] = updated
+	return nil
+}
+
+func (m *Memory) FindAuthUserByIdentity(ctx context.Context, key string) (models.AuthUser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.findAuthUserByIdentity(key)
+}
+
+func (m *Memory) findAuthUserByIdentity(key string) (models.AuthUser, error) {
+	for _, doc := range m.authUsers {
+		var authUser models.AuthUser
+		if err := fromDoc(doc, &authUser); err != nil {
+			return authUser, err
+		}
+		for _, identity := range authUser.Identities {
+			if identity.Key == key {
+				return authUser, nil
+			}
+		}
+	}
+	return models.AuthUser{}, ErrNotFound
+}
+
+func (m *Memory) LinkIdentity(ctx context.Context, email string, identity models.ExternalIdentity) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Like the unique index, the key may only appear once across every account
+	if _, err := m.findAuthUserByIdentity(identity.Key); err == nil {
+		return ErrIdentityTaken
+	} else if err != ErrNotFound {
+		return err
+	}
+	_, err := m.changeAuthUserLocked(email, func(authUser *models.AuthUser) bool {
+		authUser.Identities = append(authUser.Identities, identity)
+		return true
+	})
+	return err
+}
+
+func (m *Memory) UsernameTaken(ctx context.Context, username string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, doc := range m.authUsers {
+		if field(doc, "username") == username {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// resumes decodes the resumes of the user at index i
+func (m *Memory) resumes(i int) ([]models.Resume, error) {
+	var user models.User
+	err := fromDoc(m.users[i], &user)
+	return user.Resumes, err
+}
+
+// setResumes stores the resumes of the user at index i
+func (m *Memory) setResumes(i int, resumes []models.Resume) error {
+	doc, err := toDoc(bson.M{"resumes": resumes})
+	if err != nil {
+		return err
+	}
+	m.users[i]["resumes"] = doc["resumes"]
+	bump(m.users[i])
+	return nil
+}
+
+func (m *Memory) AddResume(ctx context.Context, userID primitive.ObjectID, resume models.Resume) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i, err := m.findUser(ByID(userID))
+	if err != nil {
+		return err
+	}
+	resumes, err := m.resumes(i)
+	if err != nil {
+		return err
+	}
+	if len(resumes) >= MaxResumes {
+		return ErrResumeLimit
+	}
+	return m.setResumes(i, append(resumes, resume))
+}
+
+// resumeIndex finds a resume of the user at index i
+func (m *Memory) resumeIndex(i int, resumeID primitive.ObjectID) (int, bson.A) {
+	list, _ := m.users[i]["resumes"].(bson.A)
+	for j, item := range list {
+		if doc, ok := item.(bson.M); ok && doc["_id"] == resumeID {
+			return j, list
+		}
+	}
+	return -1, list
+}
+
+func (m *Memory) UpdateResume(ctx context.Context, userID, resumeID primitive.ObjectID, version int64, resume models.Resume) (bson.M, error) {
+	doc, err := toDoc(resume)
+	if err != nil {
+		return nil, err
+	}
+	set := bson.M{}
+	for field, value := range doc {
+		if field != "_id" && field != "version" && field != "isdefault" {
+			set[field] = value
+		}
+	}
+	return m.PatchResume(ctx, userID, resumeID, version, bson.M{"$set": set})
+}
+
+func (m *Memory) PatchResume(ctx context.Context, userID, resumeID primitive.ObjectID, version int64, update bson.M) (bson.M, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i, err := m.findUser(ByID(userID))
+	if err != nil {
+		return nil, err
+	}
+	j, list := m.resumeIndex(i, resumeID)
+	if j < 0 {
+		return nil, ErrNotFound
+	}
+	if err := checkVersion(list[j].(bson.M), version); err != nil {
+		return nil, err
+	}
+
+	updated := copyDoc(m.users[i])
+	if err := applyUpdate(updated, prefixUpdate(update, "resumes."+strconv.Itoa(j)+".")); err != nil {
+		return nil, err
+	}
+	bump(updated)
+	bump(updated["resumes"].(bson.A)[j].(bson.M))
+	var user models.User
+	if err := fromDoc(updated, &user); err != nil {
+		return nil, err
+	}
+
+	before := copyDoc(list[j].(bson.M))
+	m.users[i] = updated
+	return before, nil
+}
+
+func (m *Memory) DeleteResume(ctx context.Context, userID, resumeID primitive.ObjectID, version int64) (bson.M, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i, err := m.findUser(ByID(userID))
+	if err != nil {
+		return nil, err
+	}
+	j, list := m.resumeIndex(i, resumeID)
+	if j < 0 {
+		return nil, ErrNotFound
+	}
+	if err := checkVersion(list[j].(bson.M), version); err != nil {
+		return nil, err
+	}
+
+	removed := copyDoc(list[j].(bson.M))
+	m.users[i]["resumes"] = append(list[:j:j], list[j+1:]...)
+	bump(m.users[i])
+	return removed, nil
+}
+
+func (m *Memory) SetDefaultResume(ctx context.Context, userID, resumeID primitive.ObjectID) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	i, err := m.findUser(ByID(userID))
+	if err != nil {
+		return false, err
+	}
+	current, err := m.resumes(i)
+	if err != nil {
+		return false, err
+	}
+
+	resumes, changed, found := withDefaultResume(current, resumeID)
+	if !found {
+		return false, ErrNotFound
+	}
+	if !changed {
+		return false, nil
+	}
+	return true, m.setResumes(i, resumes)
+}
+
+func (m *Memory) ListSkills(ctx context.Context) ([]models.SkillCollection, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]models.SkillCollection{}, m.skills...), nil
+}
+
+func (m *Memory) FindSkills(ctx context.Context, ids []primitive.ObjectID) ([]models.SkillCollection, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	wanted := make(map[primitive.ObjectID]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	skills := []models.SkillCollection{}
+	for _, skill := range m.skills {
+		if wanted[skill.ID] {
+			skills = append(skills, skill)
+		}
+	}
+	return skills, nil
+}
+
+func (m *Memory) InsertRefreshToken(ctx context.Context, token models.RefreshToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if token.ID.IsZero() {
+		token.ID = primitive.NewObjectID()
+	}
+	m.refreshTokens = append(m.refreshTokens, token)
+	return nil
+}
+
+func (m *Memory) FindRefreshToken(ctx context.Context, tokenHash string) (models.RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, token := range m.refreshTokens {
+		if token.TokenHash == tokenHash {
+			return token, nil
+		}
+	}
+	return models.RefreshToken{}, ErrNotFound
+}
+
+func (m *Memory) SpendRefreshToken(ctx context.Context, tokenHash string, now time.Time) (models.RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, token := range m.refreshTokens {
+		if token.TokenHash == tokenHash && token.UsedAt == nil && token.RevokedAt == nil && token.ExpiresAt.After(now) {
+			m.refreshTokens[i].UsedAt = &now
+			return token, nil
+		}
+	}
+	return models.RefreshToken{}, ErrNotFound
+}
+
+func (m *Memory) RevokeRefreshTokens(ctx context.Context, userID primitive.ObjectID, family string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for i, token := range m.refreshTokens {
+		if token.UserID == userID && (family == "" || token.Family == family) && token.RevokedAt == nil {
+			m.refreshTokens[i].RevokedAt = &now
+		}
+	}
+	return nil
+}
+
+func (m *Memory) ReplaceActionToken(ctx context.Context, token models.ActionToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	kept := m.actionTokens[:0]
+	for _, existing := range m.actionTokens {
+		if existing.UserID != token.UserID || existing.Purpose != token.Purpose || existing.UsedAt != nil {
+			kept = append(kept, existing)
+		}
+	}
+	if token.ID.IsZero() {
+		token.ID = primitive.NewObjectID()
+	}
+	m.actionTokens = append(kept, token)
+	return nil
+}
+
+func (m *Memory) ConsumeActionToken(ctx context.Context, tokenHash, purpose string, now time.Time) (models.ActionToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, token := range m.actionTokens {
+		if token.TokenHash == tokenHash && token.Purpose == purpose && token.UsedAt == nil && token.ExpiresAt.After(now) {
+			m.actionTokens[i].UsedAt = &now
+			return token, nil
+		}
+	}
+	return models.ActionToken{}, ErrNotFound
+}
+
+func (m *Memory) InsertOAuthState(ctx context.Context, state models.OAuthState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.oauthStates = append(m.oauthStates, state)
+	return nil
+}
+
+func (m *Memory) ConsumeOAuthState(ctx context.Context, stateHash, provider, browserHash string, now time.Time) (models.OAuthState, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, state := range m.oauthStates {
+		if state.ID == stateHash && state.Provider == provider && state.BrowserHash == browserHash && state.ExpiresAt.After(now) {
+			m.oauthStates = append(m.oauthStates[:i], m.oauthStates[i+1:]...)
+			return state, nil
+		}
+	}
+	return models.OAuthState{}, ErrNotFound
+}
+
+func (m *Memory) SaveRevocation(ctx context.Context, entry models.RevokedToken) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.revocations == nil {
+		m.revocations = map[string]models.RevokedToken{}
+	}
+	m.revocations[entry.ID] = entry
+	return nil
+}
+
+func (m *Memory) InsertRevocation(ctx context.Context, entry models.RevokedToken) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.revocations[entry.ID]; ok {
+		return false, nil
+	}
+	if m.revocations == nil {
+		m.revocations = map[string]models.RevokedToken{}
+	}
+	m.revocations[entry.ID] = entry
+	return true, nil
+}
+
+func (m *Memory) FindRevocations(ctx context.Context, ids []string) ([]models.RevokedToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var entries []models.RevokedToken
+	for _, id := range ids {
+		if entry, ok := m.revocations[id]; ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (m *Memory) InsertAPIKey(ctx context.Context, key models.APIKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if key.ID.IsZero() {
+		key.ID = primitive.NewObjectID()
+	}
+	m.apiKeys = append(m.apiKeys, key)
+	return nil
+}
+
+func (m *Memory) CountAPIKeys(ctx context.Context, userID primitive.ObjectID, now time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var count int64
+	for _, key := range m.apiKeys {
+		if key.UserID == userID && key.RevokedAt == nil && (key.ExpiresAt == nil || key.ExpiresAt.After(now)) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (m *Memory) ListAPIKeys(ctx context.Context, userID primitive.ObjectID) ([]models.APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := []models.APIKey{}
+	for i := len(m.apiKeys) - 1; i >= 0; i-- {
+		if m.apiKeys[i].UserID == userID {
+			keys = append(keys, m.apiKeys[i])
+		}
+	}
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (m *Memory) RevokeAPIKey(ctx context.Context, userID, keyID primitive.ObjectID, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, key := range m.apiKeys {
+		if key.ID == keyID && key.UserID == userID && key.RevokedAt == nil {
+			m.apiKeys[i].RevokedAt = &now
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (m *Memory) FindActiveAPIKey(ctx context.Context, keyHash string, now time.Time) (models.APIKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, key := range m.apiKeys {
+		if key.KeyHash == keyHash && key.RevokedAt == nil && (key.ExpiresAt == nil || key.ExpiresAt.After(now)) {
+			return key, nil
+		}
+	}
+	return models.APIKey{}, ErrNotFound
+}
+
+func (m *Memory) TouchAPIKey(ctx context.Context, keyID primitive.ObjectID, now time.Time, resolution time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, key := range m.apiKeys {
+		if key.ID == keyID && (key.LastUsedAt == nil || key.LastUsedAt.Before(now.Add(-resolution))) {
+			m.apiKeys[i].LastUsedAt = &now
+		}
+	}
+	return nil
+}
+
+func (m *Memory) RecordAudit(ctx context.Context, event models.AuditEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if event.ID.IsZero() {
+		event.ID = primitive.NewObjectID()
+	}
+	m.auditEvents = append(m.auditEvents, event)
+	return nil
+}
+
+func (m *Memory) ListAudit(ctx context.Context, filter AuditFilter, skip, limit int64) ([]models.AuditEvent, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Newest first; events recorded in the same instant come out latest first
+	var matched []models.AuditEvent
+	for i := len(m.auditEvents) - 1; i >= 0; i-- {
+		if filter.matches(m.auditEvents[i]) {
+			matched = append(matched, m.auditEvents[i])
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool { return matched[i].CreatedAt.After(matched[j].CreatedAt) })
+
+	events := []models.AuditEvent{}
+	total := int64(len(matched))
+	for i := skip; i < total && i < skip+limit; i++ {
+		events = append(events, matched[i])
+	}
+	return events, total, nil
+}
+
+// ActionTokens returns the action tokens stored so far, used or not
+func (m *Memory) ActionTokens() []models.ActionToken {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]models.ActionToken(nil), m.actionTokens...)
+}
+
+// AuditEvents returns the events recorded so far, oldest first
+func (m *Memory) AuditEvents() []models.AuditEvent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]models.AuditEvent(nil), m.auditEvents...)
+}
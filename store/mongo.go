@@ -0,0 +1,651 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"profolio-vercel/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Names of the unique indexes on auth_users and users, which duplicate key
+// errors are matched against
+const (
+	EmailIndex    = "email_unique"
+	UsernameIndex = "username_unique"
+)
+
+// Mongo implements every store on the profileFolio database. Accounts are
+// created and renamed in transactions, which need a replica set or a sharded
+// cluster: a standalone mongod rejects them. Atlas always qualifies; a local
+// mongod has to be started with --replSet and initiated with rs.initiate().
+type Mongo struct {
+	client *mongo.Client
+	db     *mongo.Database
+}
+
+// NewMongo returns stores backed by the client's profileFolio database
+func NewMongo(client *mongo.Client) *Mongo {
+	return &Mongo{client: client, db: client.Database("profileFolio")}
+}
+
+// notFound turns mongo.ErrNoDocuments into ErrNotFound
+func notFound(err error) error {
+	if err == mongo.ErrNoDocuments {
+		return ErrNotFound
+	}
+	return err
+}
+
+// duplicateKey maps a unique index violation to ErrEmailTaken or ErrUsernameTaken
+func duplicateKey(err error) error {
+	var writeErr mongo.WriteException
+	if errors.As(err, &writeErr) {
+		for _, e := range writeErr.WriteErrors {
+			if e.Code != 11000 {
+				continue
+			}
+			if strings.Contains(e.Message, "index: "+UsernameIndex) {
+				return ErrUsernameTaken
+			}
+			return ErrEmailTaken
+		}
+	}
+	return err
+}
+
+func (m *Mongo) FindUser(ctx context.Context, lookup Lookup) (models.User, error) {
+	var user models.User
+	err := m.db.Collection("users").FindOne(ctx, lookup.filter()).Decode(&user)
+	return user, notFound(err)
+}
+
+func (m *Mongo) ListUsers(ctx context.Context, skip, limit int64) ([]models.User, int64, error) {
+	collection := m.db.Collection("users")
+	total, err := collection.CountDocuments(ctx, bson.M{})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetSkip(skip).SetLimit(limit)
+	cursor, err := collection.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	users := []models.User{}
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, 0, err
+	}
+	return users, total, nil
+}
+
+func (m *Mongo) InsertUser(ctx context.Context, user models.User) (models.User, error) {
+	result, err := m.db.Collection("users").InsertOne(ctx, user)
+	if err != nil {
+		return user, duplicateKey(err)
+	}
+	user.ID = result.InsertedID.(primitive.ObjectID)
+	return user, nil
+}
+
+func (m *Mongo) UpdateUser(ctx context.Context, lookup Lookup, version int64, set map[string]interface{}) (bson.M, error) {
+	return m.PatchUser(ctx, lookup, version, bson.M{"$set": set})
+}
+
+func (m *Mongo) PatchUser(ctx context.Context, lookup Lookup, version int64, update bson.M) (bson.M, error) {
+	filter := lookup.filter()
+	if version != AnyVersion {
+		filter["version"] = versionFilter(version)
+	}
+
+	var before bson.M
+	err := m.db.Collection("users").FindOneAndUpdate(ctx, filter, bumpVersion(update, "version")).Decode(&before)
+	if err != nil {
+		return nil, m.mismatch(ctx, lookup.filter(), duplicateKey(notFound(err)))
+	}
+	return before, nil
+}
+
+// mismatch tells apart why a versioned write to users matched nothing: when
+// the document still matches filter, it is at another version
+func (m *Mongo) mismatch(ctx context.Context, filter bson.M, err error) error {
+	if err != ErrNotFound {
+		return err
+	}
+	count, countErr := m.db.Collection("users").CountDocuments(ctx, filter)
+	if countErr != nil {
+		return countErr
+	}
+	if count > 0 {
+		return ErrVersionMismatch
+	}
+	return ErrNotFound
+}
+
+func (m *Mongo) FindAuthUser(ctx context.Context, email string) (models.AuthUser, error) {
+	var authUser models.AuthUser
+	err := m.db.Collection("auth_users").FindOne(ctx, bson.M{"email": email}).Decode(&authUser)
+	return authUser, notFound(err)
+}
+
+func (m *Mongo) UpdateAuthUser(ctx context.Context, email string, set map[string]interface{}) error {
+	result, err := m.db.Collection("auth_users").UpdateOne(ctx, bson.M{"email": email}, bson.M{"$set": set})
+	if err != nil {
+		return duplicateKey(err)
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// CreateAccount runs both inserts in a transaction, so it fails on a standalone mongod
+func (m *Mongo) CreateAccount(ctx context.Context, authUser models.AuthUser, user models.User) (models.User, error) {
+	session, err := m.client.StartSession()
+	if err != nil {
+		return user, err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		if _, err := m.db.Collection("auth_users").InsertOne(sc, authUser); err != nil {
+			return nil, err
+		}
+		result, err := m.db.Collection("users").InsertOne(sc, user)
+		if err != nil {
+			return nil, err
+		}
+		user.ID = result.InsertedID.(primitive.ObjectID)
+		return nil, nil
+	})
+	if err != nil {
+		return user, duplicateKey(err)
+	}
+	return user, nil
+}
+
+// ChangeAccount runs both updates in a transaction, so it fails on a standalone mongod
+func (m *Mongo) ChangeAccount(ctx context.Context, email string, change AccountChange) error {
+	session, err := m.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		result, err := m.db.Collection("auth_users").UpdateOne(sc, bson.M{"email": email}, bson.M{"$set": change.authSet()})
+		if err != nil {
+			return nil, err
+		}
+		if result.MatchedCount == 0 {
+			return nil, ErrNotFound
+		}
+		var user models.User
+		err = m.db.Collection("users").FindOneAndUpdate(sc, bson.M{"basics.email": email}, bumpVersion(bson.M{"$set": change.userSet()}, "version")).Decode(&user)
+		if err != nil {
+			return nil, notFound(err)
+		}
+		if change.Email != "" {
+			_, err = m.db.Collection("action_tokens").DeleteMany(sc, bson.M{"userId": user.ID, "usedAt": bson.M{"$exists": false}})
+		}
+		return nil, err
+	})
+	return duplicateKey(err)
+}
+
+// ChangeRole demotes an admin in a transaction that also writes every other
+// enabled admin, bumping their adminEpoch. Two admins demoting each other at
+// once then conflict, and the retried transaction finds no admin left.
+func (m *Mongo) ChangeRole(ctx context.Context, email, role string) error {
+	session, err := m.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		authUsers := m.db.Collection("auth_users")
+		var before models.AuthUser
+		err := authUsers.FindOneAndUpdate(sc, bson.M{"email": email}, bson.M{"$set": bson.M{"role": role}}).Decode(&before)
+		if err != nil {
+			return nil, notFound(err)
+		}
+		if before.Role != models.RoleAdmin || role == models.RoleAdmin {
+			return nil, nil
+		}
+
+		others, err := authUsers.UpdateMany(sc,
+			bson.M{"email": bson.M{"$ne": email}, "role": models.RoleAdmin, "disabled": bson.M{"$ne": true}},
+			bson.M{"$inc": bson.M{"adminEpoch": 1}},
+		)
+		if err != nil {
+			return nil, err
+		}
+		if others.MatchedCount == 0 {
+			return nil, ErrLastAdmin
+		}
+		return nil, nil
+	})
+	return err
+}
+
+func (m *Mongo) SetPendingTOTP(ctx context.Context, email, secret string) error {
+	return m.updateAuthUser(ctx, email, bson.M{"$set": bson.M{"totpPendingSecret": secret}})
+}
+
+func (m *Mongo) EnableTOTP(ctx context.Context, email, secret string, step int64, recoveryHashes []string) error {
+	return m.updateAuthUser(ctx, email, bson.M{
+		"$set": bson.M{
+			"totpEnabled":   true,
+			"totpSecret":    secret,
+			"totpLastStep":  step,
+			"recoveryCodes": recoveryHashes,
+		},
+		"$unset": bson.M{"totpPendingSecret": ""},
+	})
+}
+
+func (m *Mongo) DisableTOTP(ctx context.Context, email string) error {
+	return m.updateAuthUser(ctx, email, bson.M{
+		"$unset": bson.M{"totpEnabled": "", "totpSecret": "", "totpLastStep": "", "recoveryCodes": ""},
+	})
+}
+
+// updateAuthUser applies an update to the auth_users document with the email
+func (m *Mongo) updateAuthUser(ctx context.Context, email string, update bson.M) error {
+	result, err := m.db.Collection("auth_users").UpdateOne(ctx, bson.M{"email": email}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m *Mongo) UseTOTPStep(ctx context.Context, email string, step int64) (bool, error) {
+	// Only move forward, so the same code can't be replayed within its window
+	result, err := m.db.Collection("auth_users").UpdateOne(ctx,
+		bson.M{"email": email, "totpLastStep": bson.M{"$not": bson.M{"$gte": step}}},
+		bson.M{"$set": bson.M{"totpLastStep": step}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+func (m *Mongo) UseRecoveryCode(ctx context.Context, email, codeHash string) (bool, error) {
+	result, err := m.db.Collection("auth_users").UpdateOne(ctx,
+		bson.M{"email": email, "recoveryCodes": codeHash},
+		bson.M{"$pull": bson.M{"recoveryCodes": codeHash}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+func (m *Mongo) FindAuthUserByIdentity(ctx context.Context, key string) (models.AuthUser, error) {
+	var authUser models.AuthUser
+	err := m.db.Collection("auth_users").FindOne(ctx, bson.M{"identities.key": key}).Decode(&authUser)
+	return authUser, notFound(err)
+}
+
+func (m *Mongo) LinkIdentity(ctx context.Context, email string, identity models.ExternalIdentity) error {
+	err := m.updateAuthUser(ctx, email, bson.M{"$push": bson.M{"identities": identity}})
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrIdentityTaken
+	}
+	return err
+}
+
+func (m *Mongo) UsernameTaken(ctx context.Context, username string) (bool, error) {
+	count, err := m.db.Collection("auth_users").CountDocuments(ctx, bson.M{"username": username})
+	return count > 0, err
+}
+
+func (m *Mongo) AddResume(ctx context.Context, userID primitive.ObjectID, resume models.Resume) error {
+	// The size check and the push happen in one update, so concurrent adds cannot pass the limit
+	filter := bson.M{"_id": userID, "resumes." + strconv.Itoa(MaxResumes-1): bson.M{"$exists": false}}
+	result, err := m.db.Collection("users").UpdateOne(ctx, filter, bumpVersion(bson.M{"$push": bson.M{"resumes": resume}}, "version"))
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		count, err := m.db.Collection("users").CountDocuments(ctx, bson.M{"_id": userID})
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return ErrNotFound
+		}
+		return ErrResumeLimit
+	}
+	return nil
+}
+
+// resumeProjection only returns the resume being changed
+func resumeProjection(resumeID primitive.ObjectID) bson.M {
+	return bson.M{"resumes": bson.M{"$elemMatch": bson.M{"_id": resumeID}}}
+}
+
+// resumeDoc is a users document read with resumeProjection
+type resumeDoc struct {
+	Resumes []bson.M `bson:"resumes"`
+}
+
+// resume returns the one resume the projection kept
+func (d resumeDoc) resume() bson.M {
+	if len(d.Resumes) == 0 {
+		return nil
+	}
+	return d.Resumes[0]
+}
+
+func (m *Mongo) UpdateResume(ctx context.Context, userID, resumeID primitive.ObjectID, version int64, resume models.Resume) (bson.M, error) {
+	// Every field is replaced but the ID, the version, which is incremented,
+	// and the default flag, which only SetDefaultResume changes
+	doc, err := toDoc(resume)
+	if err != nil {
+		return nil, err
+	}
+	set := bson.M{}
+	for field, value := range doc {
+		if field != "_id" && field != "version" && field != "isdefault" {
+			set[field] = value
+		}
+	}
+	return m.PatchResume(ctx, userID, resumeID, version, bson.M{"$set": set})
+}
+
+func (m *Mongo) PatchResume(ctx context.Context, userID, resumeID primitive.ObjectID, version int64, update bson.M) (bson.M, error) {
+	opts := options.FindOneAndUpdate().
+		SetArrayFilters(options.ArrayFilters{Filters: []interface{}{bson.M{"elem._id": resumeID}}}).
+		SetProjection(resumeProjection(resumeID))
+
+	var before resumeDoc
+	err := m.db.Collection("users").FindOneAndUpdate(ctx,
+		resumeFilter(userID, resumeID, version),
+		bumpVersion(prefixUpdate(update, "resumes.$[elem]."), "version", "resumes.$[elem].version"),
+		opts,
+	).Decode(&before)
+	if err != nil {
+		return nil, m.mismatch(ctx, resumeFilter(userID, resumeID, AnyVersion), notFound(err))
+	}
+	return before.resume(), nil
+}
+
+func (m *Mongo) DeleteResume(ctx context.Context, userID, resumeID primitive.ObjectID, version int64) (bson.M, error) {
+	opts := options.FindOneAndUpdate().SetProjection(resumeProjection(resumeID))
+
+	var before resumeDoc
+	err := m.db.Collection("users").FindOneAndUpdate(ctx,
+		resumeFilter(userID, resumeID, version),
+		bumpVersion(bson.M{"$pull": bson.M{"resumes": bson.M{"_id": resumeID}}}, "version"),
+		opts,
+	).Decode(&before)
+	if err != nil {
+		return nil, m.mismatch(ctx, resumeFilter(userID, resumeID, AnyVersion), notFound(err))
+	}
+	return before.resume(), nil
+}
+
+func (m *Mongo) SetDefaultResume(ctx context.Context, userID, resumeID primitive.ObjectID) (bool, error) {
+	user, err := m.FindUser(ctx, ByID(userID))
+	if err != nil {
+		return false, err
+	}
+
+	resumes, changed, found := withDefaultResume(user.Resumes, resumeID)
+	if !found {
+		return false, ErrNotFound
+	}
+	if !changed {
+		return false, nil
+	}
+
+	// The resumes were read above, so the write only goes through if nothing changed since
+	result, err := m.db.Collection("users").UpdateOne(ctx,
+		bson.M{"_id": userID, "version": versionFilter(user.Version)},
+		bumpVersion(bson.M{"$set": bson.M{"resumes": resumes}}, "version"),
+	)
+	if err != nil {
+		return false, err
+	}
+	if result.MatchedCount == 0 {
+		return false, ErrVersionMismatch
+	}
+	return true, nil
+}
+
+func (m *Mongo) ListSkills(ctx context.Context) ([]models.SkillCollection, error) {
+	return m.findSkills(ctx, bson.M{})
+}
+
+func (m *Mongo) FindSkills(ctx context.Context, ids []primitive.ObjectID) ([]models.SkillCollection, error) {
+	return m.findSkills(ctx, bson.M{"_id": bson.M{"$in": ids}})
+}
+
+func (m *Mongo) findSkills(ctx context.Context, filter bson.M) ([]models.SkillCollection, error) {
+	cursor, err := m.db.Collection("skills").Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	skills := []models.SkillCollection{}
+	if err := cursor.All(ctx, &skills); err != nil {
+		return nil, err
+	}
+	return skills, nil
+}
+
+func (m *Mongo) InsertRefreshToken(ctx context.Context, token models.RefreshToken) error {
+	_, err := m.db.Collection("refresh_tokens").InsertOne(ctx, token)
+	return err
+}
+
+func (m *Mongo) FindRefreshToken(ctx context.Context, tokenHash string) (models.RefreshToken, error) {
+	var token models.RefreshToken
+	err := m.db.Collection("refresh_tokens").FindOne(ctx, bson.M{"tokenHash": tokenHash}).Decode(&token)
+	return token, notFound(err)
+}
+
+func (m *Mongo) SpendRefreshToken(ctx context.Context, tokenHash string, now time.Time) (models.RefreshToken, error) {
+	var token models.RefreshToken
+	err := m.db.Collection("refresh_tokens").FindOneAndUpdate(ctx,
+		bson.M{
+			"tokenHash": tokenHash,
+			"usedAt":    bson.M{"$exists": false},
+			"revokedAt": bson.M{"$exists": false},
+			"expiresAt": bson.M{"$gt": now},
+		},
+		bson.M{"$set": bson.M{"usedAt": now}},
+	).Decode(&token)
+	return token, notFound(err)
+}
+
+func (m *Mongo) RevokeRefreshTokens(ctx context.Context, userID primitive.ObjectID, family string) error {
+	filter := bson.M{"userId": userID, "revokedAt": bson.M{"$exists": false}}
+	if family != "" {
+		filter["family"] = family
+	}
+	_, err := m.db.Collection("refresh_tokens").UpdateMany(ctx, filter, bson.M{"$set": bson.M{"revokedAt": time.Now()}})
+	return err
+}
+
+func (m *Mongo) ReplaceActionToken(ctx context.Context, token models.ActionToken) error {
+	collection := m.db.Collection("action_tokens")
+	_, err := collection.DeleteMany(ctx, bson.M{"userId": token.UserID, "purpose": token.Purpose, "usedAt": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+	_, err = collection.InsertOne(ctx, token)
+	return err
+}
+
+func (m *Mongo) ConsumeActionToken(ctx context.Context, tokenHash, purpose string, now time.Time) (models.ActionToken, error) {
+	var token models.ActionToken
+	err := m.db.Collection("action_tokens").FindOneAndUpdate(ctx,
+		bson.M{
+			"tokenHash": tokenHash,
+			"purpose":   purpose,
+			"usedAt":    bson.M{"$exists": false},
+			"expiresAt": bson.M{"$gt": now},
+		},
+		bson.M{"$set": bson.M{"usedAt": now}},
+	).Decode(&token)
+	return token, notFound(err)
+}
+
+func (m *Mongo) InsertOAuthState(ctx context.Context, state models.OAuthState) error {
+	_, err := m.db.Collection("oauth_states").InsertOne(ctx, state)
+	return err
+}
+
+func (m *Mongo) ConsumeOAuthState(ctx context.Context, stateHash, provider, browserHash string, now time.Time) (models.OAuthState, error) {
+	var state models.OAuthState
+	err := m.db.Collection("oauth_states").FindOneAndDelete(ctx, bson.M{
+		"_id":         stateHash,
+		"provider":    provider,
+		"browserHash": browserHash,
+		"expiresAt":   bson.M{"$gt": now},
+	}).Decode(&state)
+	return state, notFound(err)
+}
+
+func (m *Mongo) SaveRevocation(ctx context.Context, entry models.RevokedToken) error {
+	_, err := m.db.Collection("revoked_tokens").UpdateOne(ctx,
+		bson.M{"_id": entry.ID},
+		bson.M{"$set": entry},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+func (m *Mongo) InsertRevocation(ctx context.Context, entry models.RevokedToken) (bool, error) {
+	_, err := m.db.Collection("revoked_tokens").InsertOne(ctx, entry)
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (m *Mongo) FindRevocations(ctx context.Context, ids []string) ([]models.RevokedToken, error) {
+	cursor, err := m.db.Collection("revoked_tokens").Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var entries []models.RevokedToken
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (m *Mongo) InsertAPIKey(ctx context.Context, key models.APIKey) error {
+	_, err := m.db.Collection("api_keys").InsertOne(ctx, key)
+	return err
+}
+
+func (m *Mongo) CountAPIKeys(ctx context.Context, userID primitive.ObjectID, now time.Time) (int64, error) {
+	return m.db.Collection("api_keys").CountDocuments(ctx, bson.M{
+		"userId":    userID,
+		"revokedAt": bson.M{"$exists": false},
+		"$or": bson.A{
+			bson.M{"expiresAt": bson.M{"$exists": false}},
+			bson.M{"expiresAt": bson.M{"$gt": now}},
+		},
+	})
+}
+
+func (m *Mongo) ListAPIKeys(ctx context.Context, userID primitive.ObjectID) ([]models.APIKey, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}})
+	cursor, err := m.db.Collection("api_keys").Find(ctx, bson.M{"userId": userID}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	keys := []models.APIKey{}
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (m *Mongo) RevokeAPIKey(ctx context.Context, userID, keyID primitive.ObjectID, now time.Time) error {
+	result, err := m.db.Collection("api_keys").UpdateOne(ctx,
+		bson.M{"_id": keyID, "userId": userID, "revokedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revokedAt": now}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (m *Mongo) FindActiveAPIKey(ctx context.Context, keyHash string, now time.Time) (models.APIKey, error) {
+	var key models.APIKey
+	err := m.db.Collection("api_keys").FindOne(ctx, bson.M{
+		"keyHash":   keyHash,
+		"revokedAt": bson.M{"$exists": false},
+		"$or": bson.A{
+			bson.M{"expiresAt": bson.M{"$exists": false}},
+			bson.M{"expiresAt": bson.M{"$gt": now}},
+		},
+	}).Decode(&key)
+	return key, notFound(err)
+}
+
+func (m *Mongo) TouchAPIKey(ctx context.Context, keyID primitive.ObjectID, now time.Time, resolution time.Duration) error {
+	_, err := m.db.Collection("api_keys").UpdateOne(ctx,
+		bson.M{"_id": keyID, "$or": bson.A{
+			bson.M{"lastUsedAt": bson.M{"$exists": false}},
+			bson.M{"lastUsedAt": bson.M{"$lt": now.Add(-resolution)}},
+		}},
+		bson.M{"$set": bson.M{"lastUsedAt": now}},
+	)
+	return err
+}
+
+func (m *Mongo) RecordAudit(ctx context.Context, event models.AuditEvent) error {
+	_, err := m.db.Collection("audit_events").InsertOne(ctx, event)
+	return err
+}
+
+func (m *Mongo) ListAudit(ctx context.Context, filter AuditFilter, skip, limit int64) ([]models.AuditEvent, int64, error) {
+	collection := m.db.Collection("audit_events")
+	query := filter.query()
+	total, err := collection.CountDocuments(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}}).
+		SetSkip(skip).
+		SetLimit(limit)
+	cursor, err := collection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	events := []models.AuditEvent{}
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, 0, err
+	}
+	return events, total, nil
+}
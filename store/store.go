@@ -0,0 +1,348 @@
+// Package store holds the repositories the handlers read and write users,
+// credentials, resumes, skills, tokens and the audit log through, with a Mongo
+// implementation for the server and an in-memory one for tests.
+package store
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"profolio-vercel/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	// ErrNotFound is returned when no document matches
+	ErrNotFound = errors.New("not found")
+	// ErrEmailTaken and ErrUsernameTaken are returned when a unique email or username is already in use
+	ErrEmailTaken    = errors.New("email already exists")
+	ErrUsernameTaken = errors.New("username already exists")
+	// ErrResumeLimit is returned when a user already has MaxResumes resumes
+	ErrResumeLimit = errors.New("maximum number of resumes reached")
+	// ErrVersionMismatch is returned when a write expected another version of the document
+	ErrVersionMismatch = errors.New("version mismatch")
+	// ErrIdentityTaken is returned when a social login identity is linked to another account
+	ErrIdentityTaken = errors.New("identity already linked")
+	// ErrLastAdmin is returned when a role change would leave no enabled admin
+	ErrLastAdmin = errors.New("last admin")
+)
+
+// MaxResumes is how many resumes a user can keep
+const MaxResumes = 3
+
+// AnyVersion makes a write skip its version check. Every write to a users
+// document increments its version, and a write to a resume increments the
+// resume's version as well.
+const AnyVersion int64 = -1
+
+// Version reads the version of a stored users document or resume. Documents
+// written before versions existed count as version 0.
+func Version(doc bson.M) int64 {
+	switch v := doc["version"].(type) {
+	case int64:
+		return v
+	case int32:
+		return int64(v)
+	}
+	return 0
+}
+
+// versionFilter matches a version, including a missing one for version 0
+func versionFilter(version int64) interface{} {
+	if version == 0 {
+		return bson.M{"$in": bson.A{0, nil}}
+	}
+	return version
+}
+
+// resumeFilter matches the user with the resume, at the version unless it is AnyVersion
+func resumeFilter(userID, resumeID primitive.ObjectID, version int64) bson.M {
+	if version == AnyVersion {
+		return bson.M{"_id": userID, "resumes._id": resumeID}
+	}
+	return bson.M{"_id": userID, "resumes": bson.M{"$elemMatch": bson.M{"_id": resumeID, "version": versionFilter(version)}}}
+}
+
+// bumpVersion returns the update with the version fields incremented
+func bumpVersion(update bson.M, fields ...string) bson.M {
+	bumped := bson.M{}
+	for operator, value := range update {
+		bumped[operator] = value
+	}
+	inc := bson.M{}
+	for _, field := range fields {
+		inc[field] = 1
+	}
+	bumped["$inc"] = inc
+	return bumped
+}
+
+// Lookup names the users document a call applies to. Exactly one field is set.
+type Lookup struct {
+	ID       primitive.ObjectID
+	Email    string
+	Username string
+}
+
+func ByID(id primitive.ObjectID) Lookup { return Lookup{ID: id} }
+func ByEmail(email string) Lookup       { return Lookup{Email: email} }
+func ByUsername(username string) Lookup { return Lookup{Username: username} }
+
+// filter returns the Mongo query for the lookup
+func (l Lookup) filter() bson.M {
+	switch {
+	case !l.ID.IsZero():
+		return bson.M{"_id": l.ID}
+	case l.Email != "":
+		return bson.M{"basics.email": l.Email}
+	default:
+		return bson.M{"basics.username": l.Username}
+	}
+}
+
+// matches reports whether the user is the one the lookup names
+func (l Lookup) matches(user models.User) bool {
+	switch {
+	case !l.ID.IsZero():
+		return user.ID == l.ID
+	case l.Email != "":
+		return user.Basics.Email == l.Email
+	default:
+		return l.Username != "" && user.Basics.Username == l.Username
+	}
+}
+
+// UserStore keeps the public profiles in the users collection
+type UserStore interface {
+	FindUser(ctx context.Context, lookup Lookup) (models.User, error)
+	// ListUsers returns one page of users, oldest first, and the total number of users
+	ListUsers(ctx context.Context, skip, limit int64) ([]models.User, int64, error)
+	InsertUser(ctx context.Context, user models.User) (models.User, error)
+	// UpdateUser applies a $set of dotted field paths to the user at version
+	// and returns the document as it was before
+	UpdateUser(ctx context.Context, lookup Lookup, version int64, set map[string]interface{}) (bson.M, error)
+	// PatchUser applies an update of $set, $unset and $push operators to the
+	// user at version and returns the document as it was before
+	PatchUser(ctx context.Context, lookup Lookup, version int64, update bson.M) (bson.M, error)
+}
+
+// AuthStore keeps the credentials in the auth_users collection, keyed by email
+type AuthStore interface {
+	FindAuthUser(ctx context.Context, email string) (models.AuthUser, error)
+	UpdateAuthUser(ctx context.Context, email string, set map[string]interface{}) error
+	// CreateAccount inserts the credentials and the profile of a new account
+	// together; neither is left behind when the other fails
+	CreateAccount(ctx context.Context, authUser models.AuthUser, user models.User) (models.User, error)
+	// ChangeAccount renames the account with the email in auth_users and users
+	// together. A new email also deletes the account's unused action tokens,
+	// which were mailed to the old address.
+	ChangeAccount(ctx context.Context, email string, change AccountChange) error
+	// ChangeRole sets the role of the account with the email. Taking the admin
+	// role from the last enabled admin fails with ErrLastAdmin.
+	ChangeRole(ctx context.Context, email, role string) error
+}
+
+// TwoFactorStore keeps the two-factor fields of auth_users, keyed by email
+type TwoFactorStore interface {
+	// SetPendingTOTP keeps the secret a user is enrolling with until they confirm a code from it
+	SetPendingTOTP(ctx context.Context, email, secret string) error
+	// EnableTOTP turns the pending secret on with step already used and
+	// replaces the recovery codes with the hashes
+	EnableTOTP(ctx context.Context, email, secret string, step int64, recoveryHashes []string) error
+	DisableTOTP(ctx context.Context, email string) error
+	// UseTOTPStep records step as used; ok is false when it or a later step
+	// already was, so a code cannot be replayed within its window
+	UseTOTPStep(ctx context.Context, email string, step int64) (ok bool, err error)
+	// UseRecoveryCode removes the recovery code; ok is false when the account does not have it
+	UseRecoveryCode(ctx context.Context, email, codeHash string) (ok bool, err error)
+}
+
+// IdentityStore links the accounts in auth_users to social login identities
+type IdentityStore interface {
+	// FindAuthUserByIdentity returns the account the identity key is linked to
+	FindAuthUserByIdentity(ctx context.Context, key string) (models.AuthUser, error)
+	// LinkIdentity adds the identity to the account with the email, or fails
+	// with ErrIdentityTaken when another account already has it
+	LinkIdentity(ctx context.Context, email string, identity models.ExternalIdentity) error
+	// UsernameTaken reports whether an account has the username
+	UsernameTaken(ctx context.Context, username string) (bool, error)
+}
+
+// AccountChange is a new email or username for an account. Empty fields are
+// left alone, and a new email starts out unverified.
+type AccountChange struct {
+	Email    string
+	Username string
+}
+
+// authSet is the $set of the change on auth_users
+func (c AccountChange) authSet() bson.M {
+	set := bson.M{}
+	if c.Email != "" {
+		set["email"] = c.Email
+		set["emailVerified"] = false
+	}
+	if c.Username != "" {
+		set["username"] = c.Username
+	}
+	return set
+}
+
+// userSet is the $set of the change on users
+func (c AccountChange) userSet() bson.M {
+	set := bson.M{}
+	if c.Email != "" {
+		set["basics.email"] = c.Email
+	}
+	if c.Username != "" {
+		set["basics.username"] = c.Username
+	}
+	return set
+}
+
+// ResumeStore keeps the resumes embedded in each users document
+type ResumeStore interface {
+	AddResume(ctx context.Context, userID primitive.ObjectID, resume models.Resume) error
+	// UpdateResume replaces the fields of the resume at version, keeping its
+	// ID and default flag, and returns the resume as it was before
+	UpdateResume(ctx context.Context, userID, resumeID primitive.ObjectID, version int64, resume models.Resume) (bson.M, error)
+	// PatchResume applies an update like PatchUser does, with paths relative
+	// to the resume at version, and returns the resume as it was before
+	PatchResume(ctx context.Context, userID, resumeID primitive.ObjectID, version int64, update bson.M) (bson.M, error)
+	// DeleteResume removes the resume at version and returns it
+	DeleteResume(ctx context.Context, userID, resumeID primitive.ObjectID, version int64) (bson.M, error)
+	// SetDefaultResume makes the resume the user's only default; changed is false when it already was
+	SetDefaultResume(ctx context.Context, userID, resumeID primitive.ObjectID) (changed bool, err error)
+}
+
+// prefixUpdate prepends prefix to every path of an update
+func prefixUpdate(update bson.M, prefix string) bson.M {
+	prefixed := bson.M{}
+	for operator, fields := range update {
+		paths := bson.M{}
+		for path, value := range fields.(bson.M) {
+			paths[prefix+path] = value
+		}
+		prefixed[operator] = paths
+	}
+	return prefixed
+}
+
+// SkillStore reads the shared skills collection
+type SkillStore interface {
+	ListSkills(ctx context.Context) ([]models.SkillCollection, error)
+	FindSkills(ctx context.Context, ids []primitive.ObjectID) ([]models.SkillCollection, error)
+}
+
+// TokenStore keeps the refresh_tokens, action_tokens and oauth_states
+// collections. Tokens are only stored and looked up by their hash.
+type TokenStore interface {
+	InsertRefreshToken(ctx context.Context, token models.RefreshToken) error
+	FindRefreshToken(ctx context.Context, tokenHash string) (models.RefreshToken, error)
+	// SpendRefreshToken marks the token as used at now and returns it, or
+	// fails with ErrNotFound when it is used, revoked or expired
+	SpendRefreshToken(ctx context.Context, tokenHash string, now time.Time) (models.RefreshToken, error)
+	// RevokeRefreshTokens revokes the user's live refresh tokens, only those
+	// of family when it is set
+	RevokeRefreshTokens(ctx context.Context, userID primitive.ObjectID, family string) error
+	// ReplaceActionToken stores the token in place of the user's unused
+	// tokens with the same purpose
+	ReplaceActionToken(ctx context.Context, token models.ActionToken) error
+	// ConsumeActionToken marks the token as used at now and returns it, or
+	// fails with ErrNotFound when it is used or expired
+	ConsumeActionToken(ctx context.Context, tokenHash, purpose string, now time.Time) (models.ActionToken, error)
+	InsertOAuthState(ctx context.Context, state models.OAuthState) error
+	// ConsumeOAuthState deletes the pending login and returns it, or fails
+	// with ErrNotFound when it is expired or another browser started it
+	ConsumeOAuthState(ctx context.Context, stateHash, provider, browserHash string, now time.Time) (models.OAuthState, error)
+}
+
+// RevocationStore keeps the revoked_tokens collection access tokens are
+// checked against
+type RevocationStore interface {
+	// SaveRevocation stores the entry in place of any with the same ID
+	SaveRevocation(ctx context.Context, entry models.RevokedToken) error
+	// InsertRevocation stores the entry unless one with the same ID exists,
+	// and reports whether it did, so only one caller can use up a token
+	InsertRevocation(ctx context.Context, entry models.RevokedToken) (bool, error)
+	FindRevocations(ctx context.Context, ids []string) ([]models.RevokedToken, error)
+}
+
+// APIKeyStore keeps the api_keys collection. Keys are only stored and looked up by their hash.
+type APIKeyStore interface {
+	InsertAPIKey(ctx context.Context, key models.APIKey) error
+	// CountAPIKeys counts the user's keys that are neither revoked nor expired at now
+	CountAPIKeys(ctx context.Context, userID primitive.ObjectID, now time.Time) (int64, error)
+	// ListAPIKeys returns every key of the user, newest first
+	ListAPIKeys(ctx context.Context, userID primitive.ObjectID) ([]models.APIKey, error)
+	// RevokeAPIKey revokes the user's key at now, or fails with ErrNotFound
+	// when the user has no unrevoked key with the ID
+	RevokeAPIKey(ctx context.Context, userID, keyID primitive.ObjectID, now time.Time) error
+	// FindActiveAPIKey returns the key with the hash unless it is revoked or expired at now
+	FindActiveAPIKey(ctx context.Context, keyHash string, now time.Time) (models.APIKey, error)
+	// TouchAPIKey records that the key was used at now, at most once per resolution
+	TouchAPIKey(ctx context.Context, keyID primitive.ObjectID, now time.Time, resolution time.Duration) error
+}
+
+// AuditStore keeps the audit_events collection
+type AuditStore interface {
+	RecordAudit(ctx context.Context, event models.AuditEvent) error
+	// ListAudit returns one page of the events matching filter, newest first,
+	// and how many match in total
+	ListAudit(ctx context.Context, filter AuditFilter, skip, limit int64) ([]models.AuditEvent, int64, error)
+}
+
+// AuditFilter selects audit events. Empty fields match every event.
+type AuditFilter struct {
+	Action   string
+	ActorID  string
+	TargetID string
+	// UserID matches the events the user performed or was the target of
+	UserID string
+}
+
+// query returns the Mongo query for the filter
+func (f AuditFilter) query() bson.M {
+	query := bson.M{}
+	if f.Action != "" {
+		query["action"] = f.Action
+	}
+	if f.ActorID != "" {
+		query["actorId"] = f.ActorID
+	}
+	if f.TargetID != "" {
+		query["targetId"] = f.TargetID
+	}
+	if f.UserID != "" {
+		query["$or"] = bson.A{bson.M{"actorId": f.UserID}, bson.M{"targetId": f.UserID}}
+	}
+	return query
+}
+
+// matches reports whether the event is one the filter selects
+func (f AuditFilter) matches(event models.AuditEvent) bool {
+	return (f.Action == "" || event.Action == f.Action) &&
+		(f.ActorID == "" || event.ActorID == f.ActorID) &&
+		(f.TargetID == "" || event.TargetID == f.TargetID) &&
+		(f.UserID == "" || event.ActorID == f.UserID || event.TargetID == f.UserID)
+}
+
+// withDefaultResume returns the resumes with only resumeID marked as default,
+// with the version of each resume that changed incremented. changed reports
+// whether any resume changed and found whether resumeID exists.
+func withDefaultResume(resumes []models.Resume, resumeID primitive.ObjectID) (updated []models.Resume, changed, found bool) {
+	updated = append([]models.Resume(nil), resumes...)
+	for i := range updated {
+		isTarget := updated[i].ID == resumeID
+		found = found || isTarget
+		if updated[i].IsDefault != isTarget {
+			updated[i].IsDefault = isTarget
+			updated[i].Version++
+			changed = true
+		}
+	}
+	return updated, changed, found
+}
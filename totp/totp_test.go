@@ -0,0 +1,103 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 seed of RFC 6238 Appendix B, "12345678901234567890"
+var rfcSecret = encoding.EncodeToString([]byte("12345678901234567890"))
+
+func TestCodeAt(t *testing.T) {
+	// The Appendix B codes have 8 digits; ours are their last 6
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		got, err := CodeAt(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestCodeAtIgnoresSecretCase(t *testing.T) {
+	got, err := CodeAt(strings.ToLower(rfcSecret), Step(time.Unix(59, 0)))
+	if err != nil || got != "287082" {
+		t.Errorf("code = %q, %v, want 287082", got, err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+	code := func(step int64) string {
+		c, err := CodeAt(rfcSecret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name string
+		code string
+		step int64
+		ok   bool
+	}{
+		{"current step", code(current), current, true},
+		{"one step behind", code(current - 1), current - 1, true},
+		{"one step ahead", code(current + 1), current + 1, true},
+		{"two steps behind", code(current - 2), 0, false},
+		{"two steps ahead", code(current + 2), 0, false},
+		{"spaces", " " + code(current)[:3] + " " + code(current)[3:] + " ", current, true},
+		{"too short", code(current)[:5], 0, false},
+		{"too long", code(current) + "0", 0, false},
+		{"empty", "", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, ok := Validate(rfcSecret, tt.code, now)
+			if ok != tt.ok || step != tt.step {
+				t.Errorf("Validate(%q) = %d, %v, want %d, %v", tt.code, step, ok, tt.step, tt.ok)
+			}
+		})
+	}
+}
+
+func TestBadSecret(t *testing.T) {
+	for _, secret := range []string{"not base32!", "ABC1", "MZXW6===="} {
+		if _, err := CodeAt(secret, 1); err == nil {
+			t.Errorf("CodeAt(%q) accepted the secret", secret)
+		}
+		if _, ok := Validate(secret, "123456", time.Now()); ok {
+			t.Errorf("Validate(%q) accepted a code", secret)
+		}
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := encoding.DecodeString(secret)
+	if err != nil || len(key) != 20 {
+		t.Errorf("secret %q decodes to %d bytes, %v", secret, len(key), err)
+	}
+	if other, _ := GenerateSecret(); other == secret {
+		t.Error("two secrets are the same")
+	}
+}
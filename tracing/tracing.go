@@ -0,0 +1,73 @@
+// Package tracing sets up OpenTelemetry tracing. Spans are only exported when
+// an exporter is configured; otherwise the global no-op tracer is kept.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"profolio-vercel/config"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name is the instrumentation name of the spans this module creates
+const Name = "profolio-vercel"
+
+var provider *sdktrace.TracerProvider
+
+func init() {
+	// Trace context is propagated even when nothing is exported, so traces
+	// started upstream continue through outbound calls
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+// Tracer returns the tracer for spans created by hand
+func Tracer() trace.Tracer {
+	return otel.Tracer(Name)
+}
+
+// Setup installs a tracer provider exporting to the configured OTLP endpoint.
+// It does nothing when the exporter is "none".
+func Setup(ctx context.Context, cfg config.TracingConfig) error {
+	switch cfg.Exporter {
+	case config.TracingNone:
+		return nil
+	case config.TracingOTLP:
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+		}
+		exporter, err := otlptracehttp.New(ctx, opts...)
+		if err != nil {
+			return fmt.Errorf("creating OTLP exporter: %w", err)
+		}
+		install(sdktrace.NewBatchSpanProcessor(exporter), cfg)
+		return nil
+	default:
+		return fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+	}
+}
+
+func install(processor sdktrace.SpanProcessor, cfg config.TracingConfig) {
+	res := resource.NewSchemaless(semconv.ServiceName(cfg.ServiceName))
+	provider = sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(processor),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+}
+
+// Shutdown flushes the spans still buffered, on shutdown
+func Shutdown(ctx context.Context) error {
+	if provider == nil {
+		return nil
+	}
+	return provider.Shutdown(ctx)
+}
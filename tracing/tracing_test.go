@@ -0,0 +1,76 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"profolio-vercel/config"
+
+	"go.mongodb.org/mongo-driver/event"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newInMemory installs a tracer provider that keeps finished spans in memory
+// until the test ends
+func newInMemory(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	previous := otel.GetTracerProvider()
+	exporter := tracetest.NewInMemoryExporter()
+	install(sdktrace.NewSimpleSpanProcessor(exporter), config.TracingConfig{ServiceName: Name})
+	t.Cleanup(func() {
+		provider.Shutdown(context.Background())
+		provider = nil
+		otel.SetTracerProvider(previous)
+	})
+	return exporter
+}
+
+func TestMongoMonitor(t *testing.T) {
+	exporter := newInMemory(t)
+	monitor := MongoMonitor()
+
+	ctx, parent := Tracer().Start(context.Background(), "request")
+	monitor.Started(ctx, &event.CommandStartedEvent{CommandName: "find", DatabaseName: "profileFolio", RequestID: 1})
+	monitor.Started(ctx, &event.CommandStartedEvent{CommandName: "insert", DatabaseName: "profileFolio", RequestID: 2})
+	monitor.Succeeded(ctx, &event.CommandSucceededEvent{CommandFinishedEvent: event.CommandFinishedEvent{RequestID: 1}})
+	monitor.Failed(ctx, &event.CommandFailedEvent{CommandFinishedEvent: event.CommandFinishedEvent{RequestID: 2}, Failure: "duplicate key"})
+	parent.End()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 3 {
+		t.Fatalf("spans = %d, want 3", len(spans))
+	}
+	tests := []struct {
+		name   string
+		status codes.Code
+	}{
+		{"mongo.find", codes.Unset},
+		{"mongo.insert", codes.Error},
+	}
+	for i, tt := range tests {
+		span := spans[i]
+		if span.Name != tt.name || span.SpanKind != trace.SpanKindClient || span.Status.Code != tt.status {
+			t.Errorf("span %d = %s %s %s, want %s client %s", i, span.Name, span.SpanKind, span.Status.Code, tt.name, tt.status)
+		}
+		if span.Parent.SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("%s is not a child of the request span", span.Name)
+		}
+		if !hasAttribute(span.Attributes, attribute.String("db.system", "mongodb")) {
+			t.Errorf("%s attributes = %v", span.Name, span.Attributes)
+		}
+	}
+}
+
+func hasAttribute(attributes []attribute.KeyValue, want attribute.KeyValue) bool {
+	for _, kv := range attributes {
+		if kv == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+// Package validation checks request payloads against the validate tags on
+// their models and reports every violation at once.
+package validation
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"profolio-vercel/problem"
+
+	"github.com/go-playground/validator/v10"
+)
+
+var (
+	// usernamePattern matches the usernames signup and social login hand out
+	usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{3,30}$`)
+	// phonePattern allows an optional leading + and the usual separators
+	phonePattern = regexp.MustCompile(`^\+?[0-9][0-9 ().-]{5,22}[0-9]$`)
+)
+
+var validate = newValidator()
+
+func newValidator() *validator.Validate {
+	v := validator.New(validator.WithRequiredStructEnabled())
+
+	// Report fields by their JSON names, as the caller sent them
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		if name == "" {
+			return field.Name
+		}
+		return name
+	})
+	v.RegisterValidation("username", func(fl validator.FieldLevel) bool {
+		return usernamePattern.MatchString(fl.Field().String())
+	})
+	v.RegisterValidation("phone", func(fl validator.FieldLevel) bool {
+		return phonePattern.MatchString(fl.Field().String())
+	})
+	return v
+}
+
+// Struct validates v and returns a problem listing every field at fault, or nil
+func Struct(v interface{}) error {
+	err := validate.Struct(v)
+	var invalid validator.ValidationErrors
+	if !errors.As(err, &invalid) {
+		return err
+	}
+
+	fields := make([]problem.FieldError, 0, len(invalid))
+	for _, fe := range invalid {
+		fields = append(fields, fieldError(fe))
+	}
+	return problem.Invalid("validation_failed", "The request has invalid fields", fields...)
+}
+
+// fieldError turns one violation into a stable code and a readable message
+func fieldError(fe validator.FieldError) problem.FieldError {
+	// Drop the root type from the path, so basics.email rather than User.basics.email
+	_, field, _ := strings.Cut(fe.Namespace(), ".")
+
+	code, message := fe.Tag(), "is invalid"
+	switch fe.Tag() {
+	case "required":
+		message = "is required"
+	case "email":
+		code, message = "invalid_email", "must be an email address"
+	case "http_url":
+		code, message = "invalid_url", "must be an http or https URL"
+	case "phone":
+		code, message = "invalid_phone", "must be a phone number"
+	case "username":
+		code, message = "invalid_username", "must be 3 to 30 letters, digits, _ or -"
+	case "iso3166_1_alpha2":
+		code, message = "invalid_country", "must be a two-letter country code"
+	case "oneof":
+		code, message = "invalid_choice", "must be one of: "+strings.ReplaceAll(fe.Param(), " ", ", ")
+	case "gtefield":
+		code, message = "out_of_order", "must not be before "+lowerFirst(fe.Param())
+	case "max":
+		code, message = "too_long", fmt.Sprintf("must have at most %s %s", fe.Param(), unit(fe.Kind()))
+	case "min":
+		code, message = "too_short", fmt.Sprintf("must have at least %s %s", fe.Param(), unit(fe.Kind()))
+	}
+	return problem.Field(field, code, field+" "+message)
+}
+
+// unit names what max and min count for a kind of field
+func unit(kind reflect.Kind) string {
+	if kind == reflect.Slice || kind == reflect.Array || kind == reflect.Map {
+		return "items"
+	}
+	return "characters"
+}
+
+// lowerFirst turns a Go field name such as StartDate into its JSON name
+func lowerFirst(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToLower(s[:1]) + s[1:]
+}